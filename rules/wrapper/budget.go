@@ -0,0 +1,76 @@
+package wrapper
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+
+	C "github.com/metacubex/mihomo/constant"
+)
+
+const evalBudgetMiddleware = "eval-budget"
+
+// WithEvalBudget caps how many times the underlying rule is evaluated per second, 0 means unlimited.
+// Evaluations over the budget are counted as misses without running the rule.
+func WithEvalBudget(perSecond int) Option {
+	return func(r *RuleWrapper) {
+		if perSecond <= 0 {
+			r.Remove(evalBudgetMiddleware)
+			return
+		}
+		budget := newEvalBudget(perSecond)
+		r.Use(evalBudgetMiddleware, priorityEvalBudget, func(next MatchFunc) MatchFunc {
+			return func(metadata *C.Metadata, helper C.RuleMatchHelper) (bool, string) {
+				if !budget.take(timeNow()) {
+					r.skippedCount.Add(1)
+					return false, ""
+				}
+				return next(metadata, helper)
+			}
+		})
+	}
+}
+
+// SetEvalBudget is a shortcut of With(WithEvalBudget(perSecond))
+func (r *RuleWrapper) SetEvalBudget(perSecond int) {
+	r.With(WithEvalBudget(perSecond))
+}
+
+// SkippedCount return how many evaluations were skipped by the eval budget
+func (r *RuleWrapper) SkippedCount() uint64 {
+	return r.skippedCount.Load()
+}
+
+// evalBudget is a fixed one second window counter limiting rule evaluations.
+// Like a hitWindow bucket, state packs the second it counts, in the high 32 bits, with the
+// evaluations taken in the low 32 bits, so that a single compare-and-swap advances both.
+type evalBudget struct {
+	limit uint32
+	state atomic.Uint64
+}
+
+func newEvalBudget(perSecond int) *evalBudget {
+	limit := uint32(math.MaxUint32)
+	if uint64(perSecond) < math.MaxUint32 {
+		limit = uint32(perSecond)
+	}
+	return &evalBudget{limit: limit}
+}
+
+// take reports whether one more evaluation fits into the window containing now.
+func (b *evalBudget) take(now time.Time) bool {
+	sec := uint64(uint32(now.Unix()))
+	for {
+		old := b.state.Load()
+		next := sec<<32 | 1
+		if old>>32 == sec {
+			if uint32(old) >= b.limit {
+				return false
+			}
+			next = old + 1
+		}
+		if b.state.CompareAndSwap(old, next) {
+			return true
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package wrapper
+
+import (
+	"net/netip"
+	"sync/atomic"
+	"time"
+
+	"github.com/metacubex/mihomo/common/lru"
+	C "github.com/metacubex/mihomo/constant"
+)
+
+const (
+	// DefaultMatchCacheTTL is how long a CachingRuleWrapper remembers a result when no TTL is given
+	DefaultMatchCacheTTL  = time.Second
+	defaultMatchCacheSize = 4096
+)
+
+// CachingRuleWrapper is a RuleWrapper remembering the result of its rule for a short TTL, for rules
+// such as GEOIP or IPASN queried over and over by the connections to the same destination.
+// Results are keyed by the metadata fields the rule depends on, as told by its type:
+//
+//   - the rule host for the domain rules and GEOSITE
+//   - the destination IP for GEOIP, IPASN, IPCIDR and IPSuffix, or the host and whether the helper
+//     can resolve it while the destination isn't resolved yet
+//   - the source IP for their Src counterparts
+//
+// Rules of other types, such as process or logical rules, are always evaluated.
+//
+// The cache sits right around the rule, inside the middlewares: only the results of the rule itself
+// are remembered, never an evaluation skipped by WithEvalBudget or a MatchContext given up on ctx.
+// A cached result still goes through the middlewares, taking from the eval budget like an evaluation.
+//
+// A result served from the cache skips the rule entirely, along with its side effects on metadata
+// such as resolving the destination, later rules resolving it on their own. It still goes through
+// the hit and miss accounting, callbacks and events like an evaluated one, since it's what Match
+// answers, CacheHits tells how many matches were served from the cache.
+type CachingRuleWrapper struct {
+	*RuleWrapper
+}
+
+// matchCache remembers the results of the rule of a CachingRuleWrapper, see RuleWrapper.matchRule
+type matchCache struct {
+	ttl    time.Duration
+	cache  *lru.LruCache[matchKey, cachedMatch]
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+// matchKey holds the metadata fields the result of a rule depends on
+type matchKey struct {
+	ip      netip.Addr
+	host    string
+	resolve bool
+}
+
+type cachedMatch struct {
+	ok      bool
+	adapter string
+	expires int64
+}
+
+// NewCachingRuleWrapper wraps rule like NewRuleWrapper, caching its results for ttl,
+// DefaultMatchCacheTTL when ttl <= 0.
+func NewCachingRuleWrapper(rule C.Rule, ttl time.Duration, opts ...Option) *CachingRuleWrapper {
+	if ttl <= 0 {
+		ttl = DefaultMatchCacheTTL
+	}
+	r := &RuleWrapper{Rule: rule, cache: &matchCache{
+		ttl:   ttl,
+		cache: lru.New[matchKey, cachedMatch](lru.WithSize[matchKey, cachedMatch](defaultMatchCacheSize)),
+	}}
+	r.With(opts...)
+	return &CachingRuleWrapper{RuleWrapper: r}
+}
+
+// lookup returns the fresh result cached for metadata if found, otherwise the key to store
+// the result of the evaluation under when cacheable.
+func (m *matchCache) lookup(ruleType C.RuleType, metadata *C.Metadata, helper C.RuleMatchHelper) (cached cachedMatch, key matchKey, found, cacheable bool) {
+	key, cacheable = matchKeyOf(ruleType, metadata, helper)
+	if !cacheable {
+		return cachedMatch{}, key, false, false
+	}
+	if cached, found = m.cache.Get(key); found && timeNow().UnixNano() < cached.expires {
+		m.hits.Add(1)
+		return cached, key, true, true
+	}
+	m.misses.Add(1)
+	return cachedMatch{}, key, false, true
+}
+
+// store caches the result of a successful evaluation of the rule under key
+func (m *matchCache) store(key matchKey, ok bool, adapter string) {
+	m.cache.Set(key, cachedMatch{ok: ok, adapter: adapter, expires: timeNow().UnixNano() + int64(m.ttl)})
+}
+
+// matchKeyOf returns the key caching the result of a rule of ruleType for metadata,
+// false when the rule depends on more than the key can tell.
+func matchKeyOf(ruleType C.RuleType, metadata *C.Metadata, helper C.RuleMatchHelper) (matchKey, bool) {
+	switch ruleType {
+	case C.Domain, C.DomainSuffix, C.DomainKeyword, C.DomainRegex, C.DomainWildcard, C.GEOSITE:
+		return matchKey{host: metadata.RuleHost()}, true
+	case C.GEOIP, C.IPASN, C.IPCIDR, C.IPSuffix:
+		if metadata.DstIP.IsValid() {
+			return matchKey{ip: metadata.DstIP}, true
+		}
+		// the rule resolves the host when it may, and fails without an IP otherwise
+		return matchKey{host: metadata.Host, resolve: helper.ResolveIP != nil}, true
+	case C.SrcGEOIP, C.SrcIPASN, C.SrcIPCIDR, C.SrcIPSuffix:
+		return matchKey{ip: metadata.SrcIP}, true
+	}
+	return matchKey{}, false
+}
+
+// CacheHits returns how many matches were answered from the cache
+func (c *CachingRuleWrapper) CacheHits() uint64 {
+	return c.cache.hits.Load()
+}
+
+// CacheMisses returns how many cacheable matches evaluated the rule, for want of a fresh result
+func (c *CachingRuleWrapper) CacheMisses() uint64 {
+	return c.cache.misses.Load()
+}
+
+// ClearCache forgets every cached result, so that the next matches evaluate the rule
+func (c *CachingRuleWrapper) ClearCache() {
+	c.cache.cache.Clear()
+}
@@ -0,0 +1,60 @@
+package wrapper
+
+import (
+	"sync/atomic"
+
+	C "github.com/metacubex/mihomo/constant"
+)
+
+// MatchCallback is called by Match with the metadata of the evaluated connection.
+// It runs synchronously on the matching goroutine once the counters are updated, without any
+// lock of the RuleWrapper held, so it should be fast or hand the work over to a channel.
+type MatchCallback func(metadata *C.Metadata)
+
+// SetOnHit sets the callback of every hit, nil removes it
+func (r *RuleWrapper) SetOnHit(fn MatchCallback) {
+	storeCallback(&r.onHit, fn)
+}
+
+// SetOnMiss sets the callback of every miss, nil removes it.
+// Evaluations of a disabled rule are neither hits nor misses and call nothing.
+func (r *RuleWrapper) SetOnMiss(fn MatchCallback) {
+	storeCallback(&r.onMiss, fn)
+}
+
+// hitThreshold fires its callback once the hit count reaches n, fired is cleared again by ResetStats
+type hitThreshold struct {
+	n     uint64
+	fn    func(*RuleWrapper)
+	fired atomic.Bool
+}
+
+// SetHitThreshold calls fn once, from the Match whose hit brings the hit count to n or above.
+// Later hits don't call it again until ResetStats re-arms the threshold, a hit count already
+// at n when setting it counts as crossed. n == 0 or a nil fn removes the threshold.
+// fn runs synchronously like a MatchCallback.
+func (r *RuleWrapper) SetHitThreshold(n uint64, fn func(*RuleWrapper)) {
+	if n == 0 || fn == nil {
+		r.threshold.Store(nil)
+		return
+	}
+	t := &hitThreshold{n: n, fn: fn}
+	r.lockStats()
+	t.fired.Store(r.hitCount.Load() >= n)
+	r.threshold.Store(t)
+	r.unlockStats()
+}
+
+func (r *RuleWrapper) checkHitThreshold(hits uint64) {
+	if t := r.threshold.Load(); t != nil && hits >= t.n && t.fired.CompareAndSwap(false, true) {
+		t.fn(r)
+	}
+}
+
+func storeCallback(p *atomic.Pointer[MatchCallback], fn MatchCallback) {
+	if fn == nil {
+		p.Store(nil)
+		return
+	}
+	p.Store(&fn)
+}
@@ -0,0 +1,40 @@
+package wrapper
+
+// Clone returns a detached wrapper of the same underlying rule, carrying a point-in-time copy
+// of the disabled state, schedule, tags, counters, simulated hits, adapter breakdown, latency and last match of r.
+// The clone shares no atomic state with r, so it may be handed to another goroutine,
+// and its counters aren't live: later matches of r don't show up in it, nor the other way round.
+// Middlewares, callbacks and the hit threshold are behaviors rather than state and aren't copied.
+func (r *RuleWrapper) Clone() *RuleWrapper {
+	clone := &RuleWrapper{Rule: r.Rule}
+
+	clone.disabled.Store(r.disabled.Load())
+	clone.disableUntil.Store(r.disableUntil.Load())
+	// the pointed values are never modified once stored, sharing them is safe
+	clone.reason.Store(r.reason.Load())
+	clone.schedule.Store(r.schedule.Load())
+	clone.tags.Store(r.tags.Load())
+	clone.lastMatched.Store(r.lastMatched.Load())
+
+	stats := r.Snapshot()
+	clone.hitCount.Store(stats.HitCount)
+	clone.missCount.Store(stats.MissCount)
+	if !stats.HitAt.IsZero() {
+		clone.hitAt.Store(stats.HitAt)
+		clone.firstHitAt.Store(stats.FirstHitAt)
+	}
+	if !stats.MissAt.IsZero() {
+		clone.missAt.Store(stats.MissAt)
+	}
+	clone.missStreak.Store(r.missStreak.Load())
+	clone.adapterMu.Lock()
+	for adapter, n := range r.AdapterHits() {
+		clone.storeAdapterHits(adapter, n)
+	}
+	clone.adapterMu.Unlock()
+	clone.skippedCount.Store(r.skippedCount.Load())
+	clone.simulatedHits.Store(r.simulatedHits.Load())
+	clone.latency.avg.Store(r.latency.avg.Load())
+	clone.latency.max.Store(r.latency.max.Load())
+	return clone
+}
@@ -0,0 +1,192 @@
+package wrapper
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// WrapperConfig declares the optional behaviors of a RuleWrapper, for config driven construction.
+// Unset optional fields remove the corresponding behavior.
+type WrapperConfig struct {
+	Disabled bool `yaml:"disabled" json:"disabled"`
+	// EvalBudget caps evaluations of the underlying rule per second
+	EvalBudget *int `yaml:"eval-budget,omitempty" json:"eval-budget,omitempty"`
+	// Schedule limits the rule to time windows, see SetSchedule
+	Schedule []TimeWindowConfig `yaml:"schedule,omitempty" json:"schedule,omitempty"`
+	// AutoDisable disables the rule once it reached a number of hits, see SetHitThreshold
+	AutoDisable *AutoDisableConfig `yaml:"auto-disable,omitempty" json:"auto-disable,omitempty"`
+	// Tags are the labels of the rule, see SetTags
+	Tags []string `yaml:"tags,omitempty" json:"tags,omitempty"`
+}
+
+// TimeWindowConfig is a TimeWindow in config form, such as
+//
+//	{days: [fri, sat], start: "22:00", end: "06:00", timezone: Asia/Shanghai}
+type TimeWindowConfig struct {
+	// Days are weekday names, full or three letters, empty means every day
+	Days []string `yaml:"days,omitempty" json:"days,omitempty"`
+	// Start and End are HH:MM wall clock times
+	Start string `yaml:"start" json:"start"`
+	End   string `yaml:"end" json:"end"`
+	// Timezone is an IANA location name, empty means the host local time
+	Timezone string `yaml:"timezone,omitempty" json:"timezone,omitempty"`
+}
+
+// AutoDisableConfig disables the rule with DisabledReasonThreshold once its hit count reaches Hits,
+// for For when set, otherwise until enabled again. ResetStats re-arms it.
+type AutoDisableConfig struct {
+	Hits uint64 `yaml:"hits" json:"hits"`
+	// For is a duration such as "10m", see DisableFor
+	For string `yaml:"for,omitempty" json:"for,omitempty"`
+}
+
+// Validate checks cfg without applying it
+func (cfg WrapperConfig) Validate() error {
+	if cfg.EvalBudget != nil && *cfg.EvalBudget <= 0 {
+		return fmt.Errorf("eval-budget must be positive, got %d (omit it to disable the budget)", *cfg.EvalBudget)
+	}
+	if _, err := cfg.windows(); err != nil {
+		return err
+	}
+	if _, err := cfg.AutoDisable.duration(); err != nil {
+		return err
+	}
+	for i, tag := range cfg.Tags {
+		if tag == "" {
+			return fmt.Errorf("tag %d is empty", i)
+		}
+	}
+	return nil
+}
+
+// windows parses the schedule, validated like SetSchedule does
+func (cfg WrapperConfig) windows() ([]TimeWindow, error) {
+	windows := make([]TimeWindow, len(cfg.Schedule))
+	for i, w := range cfg.Schedule {
+		window, err := w.parse()
+		if err != nil {
+			return nil, fmt.Errorf("schedule window %d: %w", i, err)
+		}
+		if err := window.validate(); err != nil {
+			return nil, fmt.Errorf("schedule window %d: %w", i, err)
+		}
+		windows[i] = window
+	}
+	return windows, nil
+}
+
+func (w TimeWindowConfig) parse() (TimeWindow, error) {
+	var window TimeWindow
+	for _, name := range w.Days {
+		weekday, ok := parseWeekday(name)
+		if !ok {
+			return TimeWindow{}, fmt.Errorf("unknown weekday %q", name)
+		}
+		window.Days = append(window.Days, weekday)
+	}
+	var err error
+	if window.Start, err = parseClock(w.Start); err != nil {
+		return TimeWindow{}, fmt.Errorf("start: %w", err)
+	}
+	if window.End, err = parseClock(w.End); err != nil {
+		return TimeWindow{}, fmt.Errorf("end: %w", err)
+	}
+	if w.Timezone != "" {
+		if window.Location, err = time.LoadLocation(w.Timezone); err != nil {
+			return TimeWindow{}, fmt.Errorf("timezone: %w", err)
+		}
+	}
+	return window, nil
+}
+
+func parseWeekday(name string) (time.Weekday, bool) {
+	name = strings.ToLower(name)
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		if full := strings.ToLower(day.String()); name == full || name == full[:3] {
+			return day, true
+		}
+	}
+	return 0, false
+}
+
+// parseClock parses a HH:MM wall clock time into its offset from midnight
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, want HH:MM", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// duration returns how long the rule stays disabled, 0 for good
+func (a *AutoDisableConfig) duration() (time.Duration, error) {
+	if a == nil {
+		return 0, nil
+	}
+	if a.Hits == 0 {
+		return 0, fmt.Errorf("auto-disable hits must be positive (omit auto-disable to keep the rule enabled)")
+	}
+	if a.For == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(a.For)
+	if err != nil {
+		return 0, fmt.Errorf("auto-disable for: %w", err)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("auto-disable for must be positive, got %v (omit it to disable for good)", d)
+	}
+	return d, nil
+}
+
+// Options return the Options described by cfg, cfg should be validated first
+func (cfg WrapperConfig) Options() []Option {
+	evalBudget := 0
+	if cfg.EvalBudget != nil {
+		evalBudget = *cfg.EvalBudget
+	}
+	windows, _ := cfg.windows()
+	disableFor, _ := cfg.AutoDisable.duration()
+	autoDisable := cfg.AutoDisable
+	tags := cfg.Tags
+	return []Option{
+		WithEvalBudget(evalBudget),
+		func(r *RuleWrapper) {
+			_ = r.SetSchedule(windows)
+		},
+		func(r *RuleWrapper) {
+			if autoDisable == nil {
+				r.SetHitThreshold(0, nil)
+				return
+			}
+			r.SetHitThreshold(autoDisable.Hits, func(r *RuleWrapper) {
+				if disableFor > 0 {
+					r.DisableFor(disableFor)
+				} else {
+					r.SetDisabledReason(DisabledReasonThreshold)
+				}
+			})
+		},
+		func(r *RuleWrapper) {
+			r.SetTags(tags...)
+		},
+	}
+}
+
+// ApplyConfig validates cfg and applies it, nothing is changed when validation fails.
+// Disabled only undoes what a previous config did: a rule disabled by the API, DisableFor
+// or AutoDisable stays so when a reloaded config doesn't disable it.
+func (r *RuleWrapper) ApplyConfig(cfg WrapperConfig) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	r.With(cfg.Options()...)
+	if cfg.Disabled {
+		r.SetDisabledReason(DisabledReasonConfig)
+	} else if reason := r.reason.Load(); r.disabled.Load() && reason != nil && *reason == DisabledReasonConfig {
+		r.disabled.Store(false)
+		r.reason.CompareAndSwap(reason, nil)
+	}
+	return nil
+}
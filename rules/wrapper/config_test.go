@@ -0,0 +1,150 @@
+package wrapper
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	C "github.com/metacubex/mihomo/constant"
+)
+
+func TestRuleWrapperApplyConfig(t *testing.T) {
+	useFakeClock(t)
+	w := NewRuleWrapper(&fakeRule{adapter: "DIRECT", match: matchHost("a.com")}).(*RuleWrapper)
+
+	var cfg WrapperConfig
+	if err := json.Unmarshal([]byte(`{"eval-budget": 1}`), &cfg); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if err := w.ApplyConfig(cfg); err != nil {
+		t.Fatalf("apply config: %v", err)
+	}
+	metadata := &C.Metadata{Host: "a.com"}
+	w.Match(metadata, C.RuleMatchHelper{})
+	if ok, _ := w.Match(metadata, C.RuleMatchHelper{}); ok || w.SkippedCount() != 1 {
+		t.Fatalf("eval budget from config not applied")
+	}
+
+	if err := w.ApplyConfig(WrapperConfig{Disabled: true}); err != nil {
+		t.Fatalf("apply config: %v", err)
+	}
+	if !w.IsDisabled() || w.DisabledReason() != DisabledReasonConfig || len(w.Middlewares()) != 0 {
+		t.Fatalf("expected disabled wrapper without middlewares, got %v", w.Middlewares())
+	}
+}
+
+func TestRuleWrapperApplyConfigInvalid(t *testing.T) {
+	w := NewRuleWrapper(&fakeRule{}).(*RuleWrapper)
+	zero := 0
+	if err := w.ApplyConfig(WrapperConfig{Disabled: true, EvalBudget: &zero}); err == nil {
+		t.Fatalf("expected zero eval-budget to be rejected")
+	}
+	if w.IsDisabled() {
+		t.Fatalf("invalid config was partially applied")
+	}
+}
+
+func TestRuleWrapperApplyConfigBehaviors(t *testing.T) {
+	clock := useFakeClock(t) // a Monday
+	w := NewRuleWrapper(&fakeRule{adapter: "DIRECT", match: matchHost("a.com")}).(*RuleWrapper)
+
+	var cfg WrapperConfig
+	if err := json.Unmarshal([]byte(`{
+		"schedule": [{"days": ["mon", "Tuesday"], "start": "09:00", "end": "18:00", "timezone": "UTC"}],
+		"auto-disable": {"hits": 2, "for": "10m"},
+		"tags": ["ads", "experiment"]
+	}`), &cfg); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if err := w.ApplyConfig(cfg); err != nil {
+		t.Fatalf("apply config: %v", err)
+	}
+	want := []TimeWindow{{Days: []time.Weekday{time.Monday, time.Tuesday}, Start: 9 * time.Hour, End: 18 * time.Hour, Location: time.UTC}}
+	if got := w.Schedule(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("schedule = %+v, want %+v", got, want)
+	}
+	if tags := w.Tags(); !reflect.DeepEqual(tags, []string{"ads", "experiment"}) {
+		t.Fatalf("tags = %v", tags)
+	}
+
+	metadata := &C.Metadata{Host: "a.com"}
+	w.Match(metadata, C.RuleMatchHelper{})
+	w.Match(metadata, C.RuleMatchHelper{})
+	if !w.IsDisabled() || w.DisabledReason() != DisabledReasonTemporary {
+		t.Fatalf("expected auto-disable after 2 hits, reason %q", w.DisabledReason())
+	}
+	clock.Advance(10 * time.Minute)
+	if w.IsDisabled() {
+		t.Fatalf("expected auto-disable to last 10m")
+	}
+	clock.Advance(10 * time.Hour)
+	if w.DisabledReason() != DisabledReasonSchedule {
+		t.Fatalf("expected the schedule from config to apply, reason %q", w.DisabledReason())
+	}
+
+	if err := w.ApplyConfig(WrapperConfig{}); err != nil {
+		t.Fatalf("apply config: %v", err)
+	}
+	if w.Schedule() != nil || w.Tags() != nil || w.IsDisabled() {
+		t.Fatalf("expected an empty config to remove the behaviors")
+	}
+}
+
+func TestRuleWrapperApplyConfigKeepsRuntimeDisable(t *testing.T) {
+	useFakeClock(t)
+	w := NewRuleWrapper(&fakeRule{}).(*RuleWrapper)
+	w.DisableFor(time.Hour)
+	if err := w.ApplyConfig(WrapperConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if w.DisabledReason() != DisabledReasonTemporary {
+		t.Fatalf("config reload cancelled DisableFor, reason %q", w.DisabledReason())
+	}
+	w.DisableFor(0)
+
+	w.SetDisabledReason("incident")
+	if err := w.ApplyConfig(WrapperConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if w.DisabledReason() != "incident" {
+		t.Fatalf("config reload cleared a manual disable, reason %q", w.DisabledReason())
+	}
+
+	w.SetDisabled(false)
+	if err := w.ApplyConfig(WrapperConfig{Disabled: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.ApplyConfig(WrapperConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if w.IsDisabled() {
+		t.Fatalf("expected a reload to undo the disable of the previous config")
+	}
+}
+
+func TestWrapperConfigValidate(t *testing.T) {
+	cases := map[string]string{
+		"unknown weekday":   `{"schedule": [{"days": ["someday"], "start": "09:00", "end": "18:00"}]}`,
+		"bad start":         `{"schedule": [{"start": "9am", "end": "18:00"}]}`,
+		"bad end":           `{"schedule": [{"start": "09:00", "end": "24:00"}]}`,
+		"unknown timezone":  `{"schedule": [{"start": "09:00", "end": "18:00", "timezone": "Nowhere/City"}]}`,
+		"zero hits":         `{"auto-disable": {"hits": 0}}`,
+		"bad duration":      `{"auto-disable": {"hits": 1, "for": "soon"}}`,
+		"negative duration": `{"auto-disable": {"hits": 1, "for": "-1m"}}`,
+		"empty tag":         `{"tags": ["ads", ""]}`,
+	}
+	for name, raw := range cases {
+		var cfg WrapperConfig
+		if err := json.Unmarshal([]byte(raw), &cfg); err != nil {
+			t.Fatalf("%s: unmarshal: %v", name, err)
+		}
+		w := NewRuleWrapper(&fakeRule{}).(*RuleWrapper)
+		if err := w.ApplyConfig(cfg); err == nil {
+			t.Fatalf("%s: expected the config to be rejected", name)
+		}
+		if w.Schedule() != nil || w.Tags() != nil {
+			t.Fatalf("%s: invalid config was partially applied", name)
+		}
+	}
+}
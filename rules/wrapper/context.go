@@ -0,0 +1,71 @@
+package wrapper
+
+import (
+	"context"
+	"time"
+
+	C "github.com/metacubex/mihomo/constant"
+)
+
+// ContextRule is implemented by rules whose evaluation may block, such as remote lookups,
+// MatchContext should give up and return ctx.Err() once ctx is done.
+type ContextRule interface {
+	MatchContext(ctx context.Context, metadata *C.Metadata, helper C.RuleMatchHelper) (bool, string, error)
+}
+
+// MatchContext is Match passing ctx down to a wrapped ContextRule, other rules are evaluated
+// by the blocking Match once ctx is checked. An evaluation failing with an error, a cancelled one
+// included, is neither a hit nor a miss.
+// For a ContextRule the middlewares are composed again over the cancellable evaluation on every call,
+// so they should keep their state outside of the Middleware itself, as the built-in ones do.
+func (r *RuleWrapper) MatchContext(ctx context.Context, metadata *C.Metadata, helper C.RuleMatchHelper) (bool, string, error) {
+	if err := ctx.Err(); err != nil {
+		return false, "", err
+	}
+	rule, ok := r.Rule.(ContextRule)
+	if !ok {
+		ok, adapter := r.Match(metadata, helper)
+		return ok, adapter, nil
+	}
+	if r.IsDisabled() {
+		return false, "", nil
+	}
+
+	var matchErr error
+	match := MatchFunc(func(metadata *C.Metadata, helper C.RuleMatchHelper) (bool, string) {
+		var key matchKey
+		var cacheable bool
+		if r.cache != nil {
+			var cached cachedMatch
+			var found bool
+			if cached, key, found, cacheable = r.cache.lookup(r.RuleType(), metadata, helper); found {
+				return cached.ok, cached.adapter
+			}
+		}
+		var start time.Time
+		tracking := latencyTracking.Load()
+		if tracking {
+			start = time.Now()
+		}
+		var ok bool
+		var adapter string
+		ok, adapter, matchErr = rule.MatchContext(ctx, metadata, helper)
+		if tracking {
+			r.latency.observe(time.Since(start))
+		}
+		if cacheable && matchErr == nil {
+			r.cache.store(key, ok, adapter)
+		}
+		return ok, adapter
+	})
+	if mws := r.chain.mws.Load(); mws != nil {
+		match = compose(match, *mws)
+	}
+
+	ok, adapter := match(metadata, helper)
+	if matchErr != nil {
+		return false, "", matchErr
+	}
+	r.account(ok, metadata, adapter)
+	return ok, adapter, nil
+}
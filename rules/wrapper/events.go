@@ -0,0 +1,72 @@
+package wrapper
+
+import (
+	"net/netip"
+	"time"
+
+	C "github.com/metacubex/mihomo/constant"
+)
+
+const eventsMiddleware = "events"
+
+// MatchEvent describes one hit of a wrapped rule
+type MatchEvent struct {
+	Time    time.Time  `json:"time"`
+	Type    string     `json:"type"`
+	Payload string     `json:"payload"`
+	Adapter string     `json:"adapter"`
+	Network string     `json:"network"`
+	Host    string     `json:"host,omitempty"`
+	DstIP   netip.Addr `json:"destinationIP"`
+	DstPort uint16     `json:"destinationPort"`
+	Process string     `json:"process,omitempty"`
+}
+
+// EventSink receives MatchEvents.
+// Publish is called on the matching goroutine and must never block.
+type EventSink interface {
+	Publish(event MatchEvent)
+}
+
+// ChanSink publishes events into a channel, dropping them when it is full
+type ChanSink chan MatchEvent
+
+func (s ChanSink) Publish(event MatchEvent) {
+	select {
+	case s <- event:
+	default:
+	}
+}
+
+// WithEventSink publishes a MatchEvent to sink on every hit, a nil sink stops publishing.
+func WithEventSink(sink EventSink) Option {
+	return func(r *RuleWrapper) {
+		if sink == nil {
+			r.Remove(eventsMiddleware)
+			return
+		}
+		r.Use(eventsMiddleware, priorityEvents, func(next MatchFunc) MatchFunc {
+			return func(metadata *C.Metadata, helper C.RuleMatchHelper) (bool, string) {
+				ok, adapter := next(metadata, helper)
+				if ok {
+					sink.Publish(newMatchEvent(r, metadata, adapter))
+				}
+				return ok, adapter
+			}
+		})
+	}
+}
+
+func newMatchEvent(r *RuleWrapper, metadata *C.Metadata, adapter string) MatchEvent {
+	return MatchEvent{
+		Time:    timeNow(),
+		Type:    r.RuleType().String(),
+		Payload: r.Payload(),
+		Adapter: adapter,
+		Network: metadata.NetWork.String(),
+		Host:    metadata.Host,
+		DstIP:   metadata.DstIP,
+		DstPort: metadata.DstPort,
+		Process: metadata.Process,
+	}
+}
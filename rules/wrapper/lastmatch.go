@@ -0,0 +1,62 @@
+package wrapper
+
+import (
+	"net/netip"
+	"sync/atomic"
+	"time"
+
+	C "github.com/metacubex/mihomo/constant"
+)
+
+// lastMatchCapture enables LastMatched for all RuleWrappers, it is disabled by default because
+// a capture copies the connection fields on every hit, and some deployments must not keep them.
+var lastMatchCapture atomic.Bool
+
+// SetLastMatchCapture enable/disable the capture of LastMatched of all RuleWrappers
+func SetLastMatchCapture(v bool) {
+	lastMatchCapture.Store(v)
+}
+
+func IsLastMatchCapture() bool {
+	return lastMatchCapture.Load()
+}
+
+// MatchInfo is a copy of the connection fields of a hit, the metadata itself is not retained
+type MatchInfo struct {
+	Time    time.Time  `json:"time"`
+	Adapter string     `json:"adapter"`
+	Network string     `json:"network"`
+	Host    string     `json:"host,omitempty"`
+	DstIP   netip.Addr `json:"destinationIP"`
+	DstPort uint16     `json:"destinationPort"`
+	Process string     `json:"process,omitempty"`
+}
+
+// LastMatched returns the connection of the latest hit, ok is false before any hit
+// or unless the capture is enabled by SetLastMatchCapture.
+func (r *RuleWrapper) LastMatched() (MatchInfo, bool) {
+	if !lastMatchCapture.Load() {
+		return MatchInfo{}, false
+	}
+	info := r.lastMatched.Load()
+	if info == nil {
+		return MatchInfo{}, false
+	}
+	return *info, true
+}
+
+// captureLastMatched stores a fresh copy on every hit, so concurrent hits replace each other whole
+func (r *RuleWrapper) captureLastMatched(metadata *C.Metadata, adapter string) {
+	if !lastMatchCapture.Load() {
+		return
+	}
+	r.lastMatched.Store(&MatchInfo{
+		Time:    timeNow(),
+		Adapter: adapter,
+		Network: metadata.NetWork.String(),
+		Host:    metadata.Host,
+		DstIP:   metadata.DstIP,
+		DstPort: metadata.DstPort,
+		Process: metadata.Process,
+	})
+}
@@ -0,0 +1,89 @@
+package wrapper
+
+import (
+	"sync/atomic"
+	"time"
+
+	C "github.com/metacubex/mihomo/constant"
+)
+
+// latencyTracking enables the timing of every evaluation of wrapped rules, it is disabled by default
+// because reading the clock twice is noticeable next to a fast rule such as DOMAIN.
+var latencyTracking atomic.Bool
+
+// ewmaWeight is the inverse weight of a new sample in the average, 1/8 as with TCP's SRTT
+const ewmaWeight = 8
+
+// SetLatencyTracking enable/disable the match latency measurement of all RuleWrappers
+func SetLatencyTracking(v bool) {
+	latencyTracking.Store(v)
+}
+
+func IsLatencyTracking() bool {
+	return latencyTracking.Load()
+}
+
+// matchLatency keeps an exponentially weighted moving average and the maximum of evaluation times
+type matchLatency struct {
+	avg atomic.Int64
+	max atomic.Int64
+}
+
+func (l *matchLatency) observe(d time.Duration) {
+	sample := int64(d)
+	for {
+		old := l.avg.Load()
+		avg := sample
+		if old != 0 {
+			avg = old + (sample-old)/ewmaWeight
+		}
+		if l.avg.CompareAndSwap(old, avg) {
+			break
+		}
+	}
+	for {
+		old := l.max.Load()
+		if sample <= old || l.max.CompareAndSwap(old, sample) {
+			return
+		}
+	}
+}
+
+// AvgMatchLatency returns the moving average of the time spent in the wrapped rule,
+// only sampled while SetLatencyTracking is enabled.
+func (r *RuleWrapper) AvgMatchLatency() time.Duration {
+	return time.Duration(r.latency.avg.Load())
+}
+
+// MaxMatchLatency return the slowest evaluation of the wrapped rule, see AvgMatchLatency
+func (r *RuleWrapper) MaxMatchLatency() time.Duration {
+	return time.Duration(r.latency.max.Load())
+}
+
+// matchRule answers from the cache of a CachingRuleWrapper when it holds a fresh result,
+// and evaluates the wrapped rule otherwise.
+func (r *RuleWrapper) matchRule(metadata *C.Metadata, helper C.RuleMatchHelper) (bool, string) {
+	if r.cache == nil {
+		return r.evalRule(metadata, helper)
+	}
+	cached, key, found, cacheable := r.cache.lookup(r.RuleType(), metadata, helper)
+	if found {
+		return cached.ok, cached.adapter
+	}
+	ok, adapter := r.evalRule(metadata, helper)
+	if cacheable {
+		r.cache.store(key, ok, adapter)
+	}
+	return ok, adapter
+}
+
+// evalRule evaluates the wrapped rule, timing it with the monotonic clock when enabled.
+func (r *RuleWrapper) evalRule(metadata *C.Metadata, helper C.RuleMatchHelper) (bool, string) {
+	if !latencyTracking.Load() {
+		return r.Rule.Match(metadata, helper)
+	}
+	start := time.Now()
+	ok, adapter := r.Rule.Match(metadata, helper)
+	r.latency.observe(time.Since(start))
+	return ok, adapter
+}
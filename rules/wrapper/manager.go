@@ -0,0 +1,150 @@
+package wrapper
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	C "github.com/metacubex/mihomo/constant"
+)
+
+// Manager keeps the RuleWrappers it created in wrapping order, for enumeration and aggregated stats.
+// Registration happens while building the rules, matching only touches the wrappers themselves,
+// so reads never contend with Match.
+type Manager struct {
+	opts []Option
+
+	mu    sync.RWMutex
+	rules []*RuleWrapper
+
+	resetAt atomicTime
+}
+
+// NewManager returns a Manager applying opts to every wrapper it creates
+func NewManager(opts ...Option) *Manager {
+	m := &Manager{opts: opts}
+	m.resetAt.Store(timeNow())
+	return m
+}
+
+// Wrap returns rule wrapped in a RuleWrapper and registers it after the previous ones.
+// A rule which is already a *RuleWrapper is registered as is.
+func (m *Manager) Wrap(rule C.Rule) C.RuleWrapper {
+	w, ok := rule.(*RuleWrapper)
+	if !ok {
+		w = NewRuleWrapper(rule, m.opts...).(*RuleWrapper)
+	}
+	m.mu.Lock()
+	m.rules = append(m.rules, w)
+	m.mu.Unlock()
+	return w
+}
+
+// All returns the registered wrappers in registration order,
+// the slice is a copy that later registrations don't change.
+func (m *Manager) All() []*RuleWrapper {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]*RuleWrapper(nil), m.rules...)
+}
+
+func (m *Manager) Len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.rules)
+}
+
+// FindByPayload returns the wrappers whose rule has payload s, in registration order
+func (m *Manager) FindByPayload(s string) []*RuleWrapper {
+	var found []*RuleWrapper
+	for _, r := range m.All() {
+		if r.Payload() == s {
+			found = append(found, r)
+		}
+	}
+	return found
+}
+
+// TotalHits sums the hit counts of all registered wrappers
+func (m *Manager) TotalHits() uint64 {
+	var total uint64
+	for _, r := range m.All() {
+		total += r.HitCount()
+	}
+	return total
+}
+
+// TotalMisses sums the miss counts of all registered wrappers
+func (m *Manager) TotalMisses() uint64 {
+	var total uint64
+	for _, r := range m.All() {
+		total += r.MissCount()
+	}
+	return total
+}
+
+// ResetAllStats calls ResetStats on every registered wrapper, opening a new measurement window
+// such as after a ruleset reload. A concurrent match is accounted entirely before or after the reset
+// of its wrapper, and wrappers registered meanwhile start fresh anyway. Only the counters are reset,
+// the disabled state, schedules and tags of the wrappers are left alone.
+func (m *Manager) ResetAllStats() {
+	m.resetAt.Store(timeNow())
+	for _, r := range m.All() {
+		r.ResetStats()
+	}
+}
+
+// ResetSince returns when the last ResetAllStats started, or when the Manager was created before any,
+// the start of the window TotalHits and TotalMisses cover.
+func (m *Manager) ResetSince() time.Time {
+	return m.resetAt.loadOrZero()
+}
+
+// TopRules returns the n most hit registered wrappers, see TopRules
+func (m *Manager) TopRules(n int) []*RuleWrapper {
+	return TopRules(m.All(), n)
+}
+
+// TopRules returns the n most hit of rules in descending order, rules with as many hits
+// are ordered by their latest hit first. Counters are read once at call time and rules isn't reordered.
+// Fewer than n are returned when rules is shorter.
+func TopRules(rules []*RuleWrapper, n int) []*RuleWrapper {
+	if n <= 0 || len(rules) == 0 {
+		return nil
+	}
+	type ranked struct {
+		rule  *RuleWrapper
+		stats RuleStats
+	}
+	ranking := make([]ranked, len(rules))
+	for i, r := range rules {
+		ranking[i] = ranked{rule: r, stats: r.Snapshot()}
+	}
+	sort.SliceStable(ranking, func(i, j int) bool {
+		a, b := ranking[i].stats, ranking[j].stats
+		if a.HitCount != b.HitCount {
+			return a.HitCount > b.HitCount
+		}
+		return a.HitAt.After(b.HitAt)
+	})
+	if n > len(ranking) {
+		n = len(ranking)
+	}
+	top := make([]*RuleWrapper, n)
+	for i := range top {
+		top[i] = ranking[i].rule
+	}
+	return top
+}
+
+// LikelyDead returns the registered wrappers that missed at least minStreak times in a row
+// and haven't hit since before, never hit ones included, in registration order.
+func (m *Manager) LikelyDead(minStreak uint64, before time.Time) []*RuleWrapper {
+	var dead []*RuleWrapper
+	for _, r := range m.All() {
+		if r.MissStreak() >= minStreak && r.hitAt.loadOrZero().Before(before) {
+			dead = append(dead, r)
+		}
+	}
+	return dead
+}
@@ -0,0 +1,335 @@
+package wrapper
+
+import (
+	"encoding/json"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	C "github.com/metacubex/mihomo/constant"
+)
+
+func TestManager(t *testing.T) {
+	m := NewManager(WithEvalBudget(100))
+	hosts := []string{"a.com", "b.com", "c.com", "a.com"}
+	for _, host := range hosts {
+		m.Wrap(&fakeRule{payload: host, adapter: "DIRECT", match: matchHost(host)})
+	}
+	existing := NewRuleWrapper(&fakeRule{payload: "d.com", match: matchHost("d.com")})
+	if m.Wrap(existing) != existing {
+		t.Fatalf("expected a RuleWrapper to be registered without wrapping it again")
+	}
+
+	all := m.All()
+	if len(all) != 5 || m.Len() != 5 {
+		t.Fatalf("unexpected registered wrappers: %d", len(all))
+	}
+	for i, host := range append(hosts, "d.com") {
+		if all[i].Payload() != host {
+			t.Fatalf("wrapper %d has payload %s, want %s", i, all[i].Payload(), host)
+		}
+	}
+	all[0] = nil
+	if m.All()[0] == nil {
+		t.Fatalf("All returned the internal slice")
+	}
+
+	if found := m.FindByPayload("a.com"); len(found) != 2 || found[0] != m.All()[0] || found[1] != m.All()[3] {
+		t.Fatalf("unexpected wrappers of a.com: %v", found)
+	}
+	if found := m.FindByPayload("e.com"); len(found) != 0 {
+		t.Fatalf("unexpected wrappers of e.com: %v", found)
+	}
+
+	// match like the tunnel does, concurrently with enumeration
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, host := range []string{"b.com", "e.com"} {
+				metadata := &C.Metadata{Host: host}
+				for _, r := range m.All() {
+					if ok, _ := r.Match(metadata, C.RuleMatchHelper{}); ok {
+						break
+					}
+				}
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			_ = m.TotalHits() + m.TotalMisses()
+		}
+	}()
+	wg.Wait()
+
+	// b.com misses a.com, e.com misses all five rules
+	if hits, misses := m.TotalHits(), m.TotalMisses(); hits != 4 || misses != 4*6 {
+		t.Fatalf("unexpected totals: hits=%d misses=%d", hits, misses)
+	}
+}
+
+func TestManagerTopRules(t *testing.T) {
+	m := NewManager()
+	hits := map[string]int{"a.com": 3, "b.com": 7, "c.com": 0, "d.com": 3, "e.com": 5}
+	for _, host := range []string{"a.com", "b.com", "c.com", "d.com", "e.com"} {
+		m.Wrap(&fakeRule{payload: host, match: matchHost(host)})
+	}
+	for _, r := range m.All() {
+		for i := 0; i < hits[r.Payload()]; i++ {
+			r.Match(&C.Metadata{Host: r.Payload()}, C.RuleMatchHelper{})
+		}
+	}
+	// break the tie of a.com and d.com by the latest hit
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	m.FindByPayload("a.com")[0].hitAt.Store(base.Add(time.Minute))
+	m.FindByPayload("d.com")[0].hitAt.Store(base)
+
+	top := m.TopRules(4)
+	want := []string{"b.com", "e.com", "a.com", "d.com"}
+	if len(top) != len(want) {
+		t.Fatalf("got %d rules, want %d", len(top), len(want))
+	}
+	for i, r := range top {
+		if r.Payload() != want[i] {
+			t.Fatalf("rule %d is %s, want %s", i, r.Payload(), want[i])
+		}
+	}
+	if all := m.All(); all[0].Payload() != "a.com" || all[4].Payload() != "e.com" {
+		t.Fatalf("TopRules reordered the registered rules")
+	}
+	if top := m.TopRules(10); len(top) != 5 || top[4].Payload() != "c.com" {
+		t.Fatalf("expected all rules with the unhit one last")
+	}
+	if top := m.TopRules(0); top != nil {
+		t.Fatalf("unexpected rules for n=0: %v", top)
+	}
+}
+
+func TestManagerLikelyDead(t *testing.T) {
+	m := NewManager()
+	for _, host := range []string{"a.com", "stale.com", "b.com", "retired.com"} {
+		m.Wrap(&fakeRule{payload: host, match: matchHost(host)})
+	}
+	match := func(host string) {
+		metadata := &C.Metadata{Host: host}
+		for _, r := range m.All() {
+			if ok, _ := r.Match(metadata, C.RuleMatchHelper{}); ok {
+				return
+			}
+		}
+	}
+	match("stale.com")
+	for i := 0; i < 5; i++ {
+		match("b.com")
+		match("unknown.com")
+	}
+	match("a.com")
+	// retired.com never hit, stale.com hit long ago, a.com and b.com are alive
+	m.FindByPayload("stale.com")[0].hitAt.Store(time.Now().Add(-48 * time.Hour))
+
+	dead := m.LikelyDead(5, time.Now().Add(-24*time.Hour))
+	if len(dead) != 2 || dead[0].Payload() != "stale.com" || dead[1].Payload() != "retired.com" {
+		t.Fatalf("unexpected dead rules: %v", dead)
+	}
+}
+
+func TestManagerState(t *testing.T) {
+	clock := useFakeClock(t)
+	load := func(hosts ...string) *Manager {
+		m := NewManager()
+		for _, host := range hosts {
+			m.Wrap(&fakeRule{ruleType: C.DomainSuffix, payload: host, adapter: "DIRECT", match: matchHost(host)})
+		}
+		return m
+	}
+
+	before := load("a.com", "b.com", "c.com", "a.com", "gone.com")
+	all := before.All()
+	all[0].SetDisabled(true)
+	all[2].DisableFor(time.Hour)
+	all[3].SetDisabledReason("maintenance")
+	all[4].SetDisabled(true)
+
+	states := before.ExportState()
+	keys := []string{"DomainSuffix,a.com", "DomainSuffix,b.com", "DomainSuffix,c.com", "DomainSuffix,a.com#2", "DomainSuffix,gone.com"}
+	if len(states) != len(keys) {
+		t.Fatalf("unexpected states: %+v", states)
+	}
+	for i, key := range keys {
+		if states[i].Key != key {
+			t.Fatalf("state %d has key %s, want %s", i, states[i].Key, key)
+		}
+	}
+	if !states[0].Disabled || states[0].DisabledReason != DisabledReasonManual || states[1].Disabled ||
+		states[2].Disabled || states[2].DisabledUntil == nil || !states[2].DisabledUntil.Equal(clock.now.Add(time.Hour)) ||
+		states[3].DisabledReason != "maintenance" {
+		t.Fatalf("unexpected states: %+v", states)
+	}
+
+	// the reloaded ruleset dropped gone.com and gained d.com, which was disabled by config
+	clock.Advance(10 * time.Minute)
+	after := load("a.com", "b.com", "c.com", "a.com", "d.com")
+	reloaded := after.All()
+	reloaded[1].SetDisabled(true)
+	reloaded[4].SetDisabledReason(DisabledReasonConfig)
+	unmatched := after.ApplyState(states)
+	if len(unmatched) != 1 || unmatched[0].Key != "DomainSuffix,gone.com" {
+		t.Fatalf("unexpected unmatched states: %+v", unmatched)
+	}
+
+	if reason := reloaded[0].DisabledReason(); reason != DisabledReasonManual {
+		t.Fatalf("a.com: disabled reason %q", reason)
+	}
+	if reloaded[1].IsDisabled() {
+		t.Fatal("b.com: the enabled state wasn't restored")
+	}
+	if reason := reloaded[2].DisabledReason(); reason != DisabledReasonTemporary || !reloaded[2].DisabledUntil().Equal(clock.now.Add(50*time.Minute)) {
+		t.Fatalf("c.com: disabled %q until %v", reason, reloaded[2].DisabledUntil())
+	}
+	if reason := reloaded[3].DisabledReason(); reason != "maintenance" {
+		t.Fatalf("a.com#2: disabled reason %q", reason)
+	}
+	if reason := reloaded[4].DisabledReason(); reason != DisabledReasonConfig {
+		t.Fatalf("d.com: a rule without state was changed, reason %q", reason)
+	}
+
+	// a temporary disable that ran out while the process was down isn't restored
+	clock.Advance(time.Hour)
+	late := load("c.com")
+	if unmatched := late.ApplyState(states[2:3]); len(unmatched) != 0 || late.All()[0].IsDisabled() {
+		t.Fatalf("expired temporary disable restored")
+	}
+
+	encoded, err := json.Marshal(states)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded []RuleState
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(before.ExportState()[:2], decoded[:2]) || decoded[2].DisabledUntil == nil || !decoded[2].DisabledUntil.Equal(*states[2].DisabledUntil) {
+		t.Fatalf("states don't survive JSON: %s", encoded)
+	}
+}
+
+func TestManagerMatchAll(t *testing.T) {
+	SetLastMatchCapture(true)
+	t.Cleanup(func() { SetLastMatchCapture(false) })
+	sink := make(ChanSink, 16)
+	m := NewManager(WithEventSink(sink))
+	suffix := m.Wrap(&fakeRule{ruleType: C.DomainSuffix, payload: "example.com", adapter: "PROXY", match: matchHost("www.example.com")}).(*RuleWrapper)
+	other := m.Wrap(&fakeRule{payload: "other.com", adapter: "DIRECT", match: matchHost("other.com")}).(*RuleWrapper)
+	disabled := m.Wrap(&fakeRule{payload: "www.example.com", adapter: "REJECT", match: matchHost("www.example.com")}).(*RuleWrapper)
+	disabled.SetDisabled(true)
+	logical := m.Wrap(&routingRule{routes: map[string]string{"www.example.com": "GAME", "other.com": "DIRECT"}}).(*RuleWrapper)
+	all := m.Wrap(&fakeRule{ruleType: C.MATCH, adapter: "FINAL", match: func(*C.Metadata) bool { return true }}).(*RuleWrapper)
+
+	results := m.MatchAll(&C.Metadata{Host: "www.example.com"}, C.RuleMatchHelper{})
+	want := []MatchResult{{suffix, "PROXY"}, {logical, "GAME"}, {all, "FINAL"}}
+	if !reflect.DeepEqual(results, want) {
+		t.Fatalf("unexpected matches: %v, want %v", results, want)
+	}
+	if results := m.MatchAll(&C.Metadata{Host: "none.com"}, C.RuleMatchHelper{}); len(results) != 1 || results[0].Rule != all {
+		t.Fatalf("unexpected matches of none.com: %v", results)
+	}
+
+	for _, r := range m.All() {
+		if stats := r.Snapshot(); stats.HitCount != 0 || stats.MissCount != 0 || !stats.HitAt.IsZero() || !stats.MissAt.IsZero() {
+			t.Fatalf("simulation recorded stats on %s: %+v", r.Payload(), stats)
+		}
+		if _, ok := r.LastMatched(); ok {
+			t.Fatalf("simulation captured the last match of %s", r.Payload())
+		}
+	}
+	if len(sink) != 0 {
+		t.Fatalf("simulation went through the middlewares: %d events", len(sink))
+	}
+	for r, n := range map[*RuleWrapper]uint64{suffix: 1, other: 0, disabled: 0, logical: 1, all: 2} {
+		if got := r.SimulatedHitCount(); got != n {
+			t.Fatalf("%s has %d simulated hits, want %d", r.Payload(), got, n)
+		}
+	}
+
+	// real routing is accounted as usual alongside
+	if ok, _ := suffix.Match(&C.Metadata{Host: "www.example.com"}, C.RuleMatchHelper{}); !ok || suffix.HitCount() != 1 || suffix.SimulatedHitCount() != 1 {
+		t.Fatalf("unexpected stats after a real match: hits=%d simulated=%d", suffix.HitCount(), suffix.SimulatedHitCount())
+	}
+	suffix.ResetStats()
+	if suffix.SimulatedHitCount() != 0 {
+		t.Fatalf("simulated hits survived ResetStats")
+	}
+}
+
+func TestManagerResetAllStats(t *testing.T) {
+	clock := useFakeClock(t)
+	m := NewManager()
+	if since := m.ResetSince(); !since.Equal(timeNow()) {
+		t.Fatalf("window starts at %v, want the creation at %v", since, timeNow())
+	}
+	hosts := []string{"a.com", "b.com", "c.com"}
+	for _, host := range hosts {
+		m.Wrap(&fakeRule{payload: host, adapter: "DIRECT", match: matchHost(host)})
+	}
+	m.All()[1].SetDisabled(true)
+
+	// match and register concurrently with the resets
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			metadata := &C.Metadata{Host: hosts[i%len(hosts)]}
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				for _, r := range m.All() {
+					if ok, _ := r.Match(metadata, C.RuleMatchHelper{}); ok {
+						break
+					}
+				}
+			}
+		}(i)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			m.Wrap(&fakeRule{payload: "d.com", match: matchHost("d.com")})
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		m.ResetAllStats()
+	}
+	close(stop)
+	wg.Wait()
+
+	clock.Advance(time.Hour)
+	m.ResetAllStats()
+	if hits, misses := m.TotalHits(), m.TotalMisses(); hits != 0 || misses != 0 {
+		t.Fatalf("totals after reset: hits=%d misses=%d", hits, misses)
+	}
+	for _, r := range m.All() {
+		if stats := r.Snapshot(); stats.HitCount != 0 || stats.MissCount != 0 || !stats.HitAt.IsZero() || !stats.MissAt.IsZero() {
+			t.Fatalf("stats of %s after reset: %+v", r.Payload(), stats)
+		}
+	}
+	if m.Len() != len(hosts)+50 {
+		t.Fatalf("registrations lost during the resets: %d", m.Len())
+	}
+	if !m.All()[1].IsDisabled() || m.All()[0].IsDisabled() {
+		t.Fatalf("reset changed the disabled state")
+	}
+	if since := m.ResetSince(); !since.Equal(timeNow()) {
+		t.Fatalf("window starts at %v, want the last reset at %v", since, timeNow())
+	}
+}
@@ -0,0 +1,93 @@
+// Package metrics exports the statistics of RuleWrappers to Prometheus,
+// it is kept apart so the wrapper package doesn't depend on the Prometheus client.
+package metrics
+
+import (
+	"github.com/metacubex/mihomo/rules/wrapper"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	hitsDesc = prometheus.NewDesc(
+		"rule_hits_total",
+		"Number of connections matched by the rule.",
+		[]string{"type", "payload"}, nil,
+	)
+	missesDesc = prometheus.NewDesc(
+		"rule_misses_total",
+		"Number of connections evaluated by the rule without a match.",
+		[]string{"type", "payload"}, nil,
+	)
+	disabledDesc = prometheus.NewDesc(
+		"rule_disabled",
+		"Whether the rule is currently disabled.",
+		[]string{"type", "payload"}, nil,
+	)
+)
+
+// Collector is a prometheus.Collector reading the counters of RuleWrappers at scrape time.
+//
+// Every rule is a series per metric labeled by its type and payload, so the cardinality grows
+// with the ruleset. Rulesets with many thousands of rules should only export a selection of them,
+// or use rule sets whose single RULE-SET rule stands for all of its entries.
+// Rules sharing type and payload are reported as one series, adding their counters up,
+// which is disabled only when all of them are. ResetStats shows up as a counter reset.
+type Collector struct {
+	rules func() []*wrapper.RuleWrapper
+}
+
+var _ prometheus.Collector = (*Collector)(nil)
+
+// NewCollector returns a Collector of the wrappers returned by rules, which is called on every scrape
+// so the collector follows rule reloads.
+func NewCollector(rules func() []*wrapper.RuleWrapper) *Collector {
+	return &Collector{rules: rules}
+}
+
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- hitsDesc
+	ch <- missesDesc
+	ch <- disabledDesc
+}
+
+type ruleKey struct {
+	ruleType string
+	payload  string
+}
+
+type ruleSample struct {
+	hits     uint64
+	misses   uint64
+	disabled bool
+}
+
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	rules := c.rules()
+	keys := make([]ruleKey, 0, len(rules))
+	samples := make(map[ruleKey]*ruleSample, len(rules))
+	for _, rule := range rules {
+		key := ruleKey{ruleType: rule.RuleType().String(), payload: rule.Payload()}
+		stats := rule.Snapshot()
+		sample, ok := samples[key]
+		if !ok {
+			sample = &ruleSample{disabled: true}
+			samples[key] = sample
+			keys = append(keys, key)
+		}
+		sample.hits += stats.HitCount
+		sample.misses += stats.MissCount
+		sample.disabled = sample.disabled && stats.Disabled
+	}
+
+	for _, key := range keys {
+		sample := samples[key]
+		disabled := 0.0
+		if sample.disabled {
+			disabled = 1
+		}
+		ch <- prometheus.MustNewConstMetric(hitsDesc, prometheus.CounterValue, float64(sample.hits), key.ruleType, key.payload)
+		ch <- prometheus.MustNewConstMetric(missesDesc, prometheus.CounterValue, float64(sample.misses), key.ruleType, key.payload)
+		ch <- prometheus.MustNewConstMetric(disabledDesc, prometheus.GaugeValue, disabled, key.ruleType, key.payload)
+	}
+}
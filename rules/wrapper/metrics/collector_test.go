@@ -0,0 +1,81 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+
+	C "github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/rules/wrapper"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+type fakeRule struct {
+	ruleType C.RuleType
+	payload  string
+}
+
+func (r *fakeRule) RuleType() C.RuleType { return r.ruleType }
+
+func (r *fakeRule) Match(metadata *C.Metadata, helper C.RuleMatchHelper) (bool, string) {
+	if metadata.Host == r.payload {
+		return true, "DIRECT"
+	}
+	return false, ""
+}
+
+func (r *fakeRule) Adapter() string         { return "DIRECT" }
+func (r *fakeRule) Payload() string         { return r.payload }
+func (r *fakeRule) ProviderNames() []string { return nil }
+
+func TestCollector(t *testing.T) {
+	a := wrapper.NewRuleWrapper(&fakeRule{ruleType: C.Domain, payload: "a.com"}).(*wrapper.RuleWrapper)
+	b := wrapper.NewRuleWrapper(&fakeRule{ruleType: C.DomainSuffix, payload: "b.com"}).(*wrapper.RuleWrapper)
+	rules := []*wrapper.RuleWrapper{a, b}
+	collector := NewCollector(func() []*wrapper.RuleWrapper { return rules })
+
+	for _, host := range []string{"a.com", "a.com", "b.com", "c.com"} {
+		metadata := &C.Metadata{Host: host}
+		for _, rule := range rules {
+			if ok, _ := rule.Match(metadata, C.RuleMatchHelper{}); ok {
+				break
+			}
+		}
+	}
+	b.SetDisabled(true)
+
+	expected := `
+# HELP rule_disabled Whether the rule is currently disabled.
+# TYPE rule_disabled gauge
+rule_disabled{payload="a.com",type="Domain"} 0
+rule_disabled{payload="b.com",type="DomainSuffix"} 1
+# HELP rule_hits_total Number of connections matched by the rule.
+# TYPE rule_hits_total counter
+rule_hits_total{payload="a.com",type="Domain"} 2
+rule_hits_total{payload="b.com",type="DomainSuffix"} 1
+# HELP rule_misses_total Number of connections evaluated by the rule without a match.
+# TYPE rule_misses_total counter
+rule_misses_total{payload="a.com",type="Domain"} 2
+rule_misses_total{payload="b.com",type="DomainSuffix"} 1
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected)); err != nil {
+		t.Fatalf("unexpected samples: %v", err)
+	}
+
+	// the counters are read at scrape time, duplicates are merged into one series
+	rules = append(rules, wrapper.NewRuleWrapper(&fakeRule{ruleType: C.Domain, payload: "a.com"}).(*wrapper.RuleWrapper))
+	a.Match(&C.Metadata{Host: "a.com"}, C.RuleMatchHelper{})
+	rules[2].Match(&C.Metadata{Host: "a.com"}, C.RuleMatchHelper{})
+	if n := testutil.CollectAndCount(collector, "rule_hits_total"); n != 2 {
+		t.Fatalf("expected 2 hit series, got %d", n)
+	}
+	expected = `
+# HELP rule_hits_total Number of connections matched by the rule.
+# TYPE rule_hits_total counter
+rule_hits_total{payload="a.com",type="Domain"} 4
+rule_hits_total{payload="b.com",type="DomainSuffix"} 1
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected), "rule_hits_total"); err != nil {
+		t.Fatalf("unexpected samples: %v", err)
+	}
+}
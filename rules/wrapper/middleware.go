@@ -0,0 +1,135 @@
+package wrapper
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	C "github.com/metacubex/mihomo/constant"
+)
+
+// MatchFunc has the signature of C.Rule.Match
+type MatchFunc func(metadata *C.Metadata, helper C.RuleMatchHelper) (bool, string)
+
+// Middleware decorates the evaluation of the wrapped rule.
+// It may answer on its own or fall through by calling next.
+type Middleware func(next MatchFunc) MatchFunc
+
+// Option installs an optional behavior on a RuleWrapper
+type Option func(r *RuleWrapper)
+
+// WithMiddleware installs mw under name, see RuleWrapper.Use
+func WithMiddleware(name string, priority int, mw Middleware) Option {
+	return func(r *RuleWrapper) {
+		r.Use(name, priority, mw)
+	}
+}
+
+// priorities of the built-in middlewares, higher runs first
+const (
+	priorityEvents     = 1000
+	priorityEvalBudget = 100
+	priorityTracing    = 0
+)
+
+type middlewareEntry struct {
+	name     string
+	priority int
+	mw       Middleware
+}
+
+type middlewareChain struct {
+	mu      sync.Mutex
+	entries []middlewareEntry
+	match   atomic.Pointer[MatchFunc]
+	// mws are the middlewares of match in execution order, to compose them over another base
+	mws atomic.Pointer[[]Middleware]
+}
+
+// With applies opts and returns r for chaining.
+func (r *RuleWrapper) With(opts ...Option) *RuleWrapper {
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// Use installs mw under name, replacing a middleware already installed under the same name.
+// Middlewares with higher priority run first and fall through to lower ones,
+// the wrapped rule itself runs last. Hit and miss accounting sees the result of the whole chain.
+func (r *RuleWrapper) Use(name string, priority int, mw Middleware) {
+	r.chain.mu.Lock()
+	defer r.chain.mu.Unlock()
+	entry := middlewareEntry{name: name, priority: priority, mw: mw}
+	replaced := false
+	for i := range r.chain.entries {
+		if r.chain.entries[i].name == name {
+			r.chain.entries[i] = entry
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		r.chain.entries = append(r.chain.entries, entry)
+	}
+	r.rebuildChain()
+}
+
+// Remove uninstalls the middleware installed under name
+func (r *RuleWrapper) Remove(name string) {
+	r.chain.mu.Lock()
+	defer r.chain.mu.Unlock()
+	for i := range r.chain.entries {
+		if r.chain.entries[i].name == name {
+			r.chain.entries = append(r.chain.entries[:i], r.chain.entries[i+1:]...)
+			r.rebuildChain()
+			return
+		}
+	}
+}
+
+// Middlewares return the names of installed middlewares in execution order
+func (r *RuleWrapper) Middlewares() []string {
+	r.chain.mu.Lock()
+	defer r.chain.mu.Unlock()
+	names := make([]string, len(r.chain.entries))
+	for i, entry := range r.chain.entries {
+		names[i] = entry.name
+	}
+	return names
+}
+
+// rebuildChain must be called with chain.mu held
+func (r *RuleWrapper) rebuildChain() {
+	if len(r.chain.entries) == 0 {
+		r.chain.match.Store(nil)
+		r.chain.mws.Store(nil)
+		return
+	}
+	sort.SliceStable(r.chain.entries, func(i, j int) bool {
+		return r.chain.entries[i].priority > r.chain.entries[j].priority
+	})
+	mws := make([]Middleware, len(r.chain.entries))
+	for i, entry := range r.chain.entries {
+		mws[i] = entry.mw
+	}
+	match := compose(r.matchRule, mws)
+	r.chain.match.Store(&match)
+	r.chain.mws.Store(&mws)
+}
+
+// compose wraps base in mws, the first one running first
+func compose(base MatchFunc, mws []Middleware) MatchFunc {
+	match := base
+	for i := len(mws) - 1; i >= 0; i-- {
+		match = mws[i](match)
+	}
+	return match
+}
+
+func (r *RuleWrapper) evaluate(metadata *C.Metadata, helper C.RuleMatchHelper) (bool, string) {
+	if match := r.chain.match.Load(); match != nil {
+		return (*match)(metadata, helper)
+	}
+	return r.matchRule(metadata, helper)
+}
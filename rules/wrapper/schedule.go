@@ -0,0 +1,118 @@
+package wrapper
+
+import (
+	"fmt"
+	"time"
+)
+
+const day = 24 * time.Hour
+
+// TimeWindow is a period of the week a scheduled rule is active in.
+// Start and End are wall clock offsets from midnight, an End not after Start wraps past midnight,
+// so 22:00-06:00 on Friday lasts until Saturday 06:00 and Start == End spans a whole day.
+type TimeWindow struct {
+	// Days the window starts on, empty means every day
+	Days  []time.Weekday
+	Start time.Duration
+	End   time.Duration
+	// Location the window is evaluated in, nil means the host local time
+	Location *time.Location
+}
+
+func (w TimeWindow) validate() error {
+	if w.Start < 0 || w.Start >= day {
+		return fmt.Errorf("window start %v out of range, want [0, 24h)", w.Start)
+	}
+	if w.End < 0 || w.End >= day {
+		return fmt.Errorf("window end %v out of range, want [0, 24h)", w.End)
+	}
+	for _, weekday := range w.Days {
+		if weekday < time.Sunday || weekday > time.Saturday {
+			return fmt.Errorf("invalid weekday %d", weekday)
+		}
+	}
+	return nil
+}
+
+func (w TimeWindow) startsOn(weekday time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, d := range w.Days {
+		if d == weekday {
+			return true
+		}
+	}
+	return false
+}
+
+// contains reports whether t falls into the window
+func (w TimeWindow) contains(t time.Time) bool {
+	loc := w.Location
+	if loc == nil {
+		loc = time.Local
+	}
+	t = t.In(loc)
+	hour, minute, sec := t.Clock()
+	offset := time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute +
+		time.Duration(sec)*time.Second + time.Duration(t.Nanosecond())
+	weekday := t.Weekday()
+
+	if w.Start < w.End {
+		return w.startsOn(weekday) && offset >= w.Start && offset < w.End
+	}
+	// the tail of a wrapping window belongs to the day it started on
+	yesterday := (weekday + 6) % 7
+	return (w.startsOn(weekday) && offset >= w.Start) || (w.startsOn(yesterday) && offset < w.End)
+}
+
+type schedule []TimeWindow
+
+func (s schedule) active(t time.Time) bool {
+	for _, w := range s {
+		if w.contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetSchedule limits the rule to windows, outside all of them IsDisabled reports true
+// and the DisabledReason is DisabledReasonSchedule. An empty windows removes the schedule.
+// Nothing is changed when a window is invalid.
+func (r *RuleWrapper) SetSchedule(windows []TimeWindow) error {
+	if len(windows) == 0 {
+		r.schedule.Store(nil)
+		return nil
+	}
+	s := make(schedule, len(windows))
+	for i, w := range windows {
+		if err := w.validate(); err != nil {
+			return fmt.Errorf("time window %d: %w", i, err)
+		}
+		w.Days = append([]time.Weekday(nil), w.Days...)
+		s[i] = w
+	}
+	r.schedule.Store(&s)
+	return nil
+}
+
+// Schedule returns a copy of the windows set by SetSchedule, nil when the rule isn't scheduled
+func (r *RuleWrapper) Schedule() []TimeWindow {
+	s := r.schedule.Load()
+	if s == nil {
+		return nil
+	}
+	windows := make([]TimeWindow, len(*s))
+	for i, w := range *s {
+		w.Days = append([]time.Weekday(nil), w.Days...)
+		windows[i] = w
+	}
+	return windows
+}
+
+// outOfSchedule reports whether a schedule is set and now is outside all of its windows
+func (r *RuleWrapper) outOfSchedule(now time.Time) bool {
+	s := r.schedule.Load()
+	return s != nil && !s.active(now)
+}
@@ -0,0 +1,127 @@
+package wrapper
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+
+	C "github.com/metacubex/mihomo/constant"
+)
+
+// RuleWrapperSet evaluates an ordered list of rules and returns the first match.
+// With tracing enabled it also attributes evaluation time to each rule,
+// which is disabled by default because timing every evaluation has overhead.
+type RuleWrapperSet struct {
+	rules   []C.Rule
+	timings []ruleTiming
+	tracing atomic.Bool
+}
+
+type ruleTiming struct {
+	evaluations atomic.Uint64
+	total       atomic.Int64
+	bottleneck  atomic.Uint64
+}
+
+// RuleTiming is the accumulated evaluation cost of a single rule in a RuleWrapperSet.
+type RuleTiming struct {
+	Rule        C.Rule
+	Index       int
+	Evaluations uint64
+	Total       time.Duration
+	// Bottleneck counts the match chains in which this rule was the slowest one evaluated.
+	Bottleneck uint64
+}
+
+func NewRuleWrapperSet(rules []C.Rule) *RuleWrapperSet {
+	return &RuleWrapperSet{
+		rules:   rules,
+		timings: make([]ruleTiming, len(rules)),
+	}
+}
+
+func (s *RuleWrapperSet) Rules() []C.Rule {
+	return s.rules
+}
+
+// SetTracing enable/disable per rule timing attribution in Match
+func (s *RuleWrapperSet) SetTracing(v bool) {
+	s.tracing.Store(v)
+}
+
+func (s *RuleWrapperSet) IsTracing() bool {
+	return s.tracing.Load()
+}
+
+// Match evaluates rules in order and returns the first matched rule with its adapter.
+func (s *RuleWrapperSet) Match(metadata *C.Metadata, helper C.RuleMatchHelper) (C.Rule, string, bool) {
+	if s.IsTracing() {
+		return s.tracedMatch(metadata, helper)
+	}
+	for _, rule := range s.rules {
+		if ok, adapter := rule.Match(metadata, helper); ok {
+			return rule, adapter, true
+		}
+	}
+	return nil, "", false
+}
+
+func (s *RuleWrapperSet) tracedMatch(metadata *C.Metadata, helper C.RuleMatchHelper) (C.Rule, string, bool) {
+	slowest := -1
+	var slowestCost time.Duration
+	defer func() {
+		if slowest >= 0 {
+			s.timings[slowest].bottleneck.Add(1)
+		}
+	}()
+
+	for i, rule := range s.rules {
+		start := time.Now()
+		ok, adapter := rule.Match(metadata, helper)
+		cost := time.Since(start)
+
+		timing := &s.timings[i]
+		timing.evaluations.Add(1)
+		timing.total.Add(int64(cost))
+		if slowest < 0 || cost > slowestCost {
+			slowest, slowestCost = i, cost
+		}
+		if ok {
+			return rule, adapter, true
+		}
+	}
+	return nil, "", false
+}
+
+// TimingReport returns the accumulated timings of every evaluated rule, sorted by total time descending.
+func (s *RuleWrapperSet) TimingReport() []RuleTiming {
+	report := make([]RuleTiming, 0, len(s.rules))
+	for i, rule := range s.rules {
+		timing := &s.timings[i]
+		evaluations := timing.evaluations.Load()
+		if evaluations == 0 {
+			continue
+		}
+		report = append(report, RuleTiming{
+			Rule:        rule,
+			Index:       i,
+			Evaluations: evaluations,
+			Total:       time.Duration(timing.total.Load()),
+			Bottleneck:  timing.bottleneck.Load(),
+		})
+	}
+	sort.SliceStable(report, func(i, j int) bool {
+		return report[i].Total > report[j].Total
+	})
+	return report
+}
+
+// ResetTimings clears all accumulated timings
+func (s *RuleWrapperSet) ResetTimings() {
+	for i := range s.timings {
+		timing := &s.timings[i]
+		timing.evaluations.Store(0)
+		timing.total.Store(0)
+		timing.bottleneck.Store(0)
+	}
+}
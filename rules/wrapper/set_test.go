@@ -0,0 +1,60 @@
+package wrapper
+
+import (
+	"testing"
+	"time"
+
+	C "github.com/metacubex/mihomo/constant"
+)
+
+func TestRuleWrapperSetMatch(t *testing.T) {
+	first := &fakeRule{payload: "a.com", adapter: "A", match: matchHost("a.com")}
+	second := &fakeRule{payload: "b.com", adapter: "B", match: matchHost("b.com")}
+	set := NewRuleWrapperSet([]C.Rule{first, second})
+
+	rule, adapter, ok := set.Match(&C.Metadata{Host: "b.com"}, C.RuleMatchHelper{})
+	if !ok || rule != second || adapter != "B" {
+		t.Fatalf("unexpected match result: %v %q %v", rule, adapter, ok)
+	}
+	if _, _, ok := set.Match(&C.Metadata{Host: "c.com"}, C.RuleMatchHelper{}); ok {
+		t.Fatalf("expected no match")
+	}
+	if report := set.TimingReport(); len(report) != 0 {
+		t.Fatalf("timings recorded without tracing: %+v", report)
+	}
+}
+
+func TestRuleWrapperSetTimingReport(t *testing.T) {
+	cheap := &fakeRule{payload: "cheap"}
+	slow := &fakeRule{payload: "slow", delay: 2 * time.Millisecond}
+	last := &fakeRule{payload: "last", adapter: "DIRECT", match: matchHost("x.com")}
+	set := NewRuleWrapperSet([]C.Rule{cheap, slow, last})
+	set.SetTracing(true)
+
+	for i := 0; i < 5; i++ {
+		if _, _, ok := set.Match(&C.Metadata{Host: "x.com"}, C.RuleMatchHelper{}); !ok {
+			t.Fatalf("expected match")
+		}
+	}
+
+	report := set.TimingReport()
+	if len(report) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(report))
+	}
+	if report[0].Rule != slow {
+		t.Fatalf("expected slow rule first, got %s", report[0].Rule.Payload())
+	}
+	if report[0].Bottleneck != 5 || report[0].Evaluations != 5 {
+		t.Fatalf("unexpected slow rule timing: %+v", report[0])
+	}
+	for i := 1; i < len(report); i++ {
+		if report[i].Total > report[i-1].Total {
+			t.Fatalf("report not sorted by total time")
+		}
+	}
+
+	set.ResetTimings()
+	if report := set.TimingReport(); len(report) != 0 {
+		t.Fatalf("expected empty report after reset, got %d entries", len(report))
+	}
+}
@@ -0,0 +1,35 @@
+package wrapper
+
+import (
+	C "github.com/metacubex/mihomo/constant"
+)
+
+// MatchResult is one wrapper matching the metadata given to MatchAll
+type MatchResult struct {
+	Rule    *RuleWrapper
+	Adapter string
+}
+
+// MatchAll evaluates every enabled registered wrapper against metadata, the way a rules tester
+// would, and returns all the matches in registration order instead of stopping at the first one.
+// The evaluation is a simulation: it runs the underlying rules without the middlewares, and leaves
+// the hit and miss stats, the callbacks, the last match and the latency untouched, so that production
+// metrics only reflect real routing. Matches are counted in SimulatedHitCount instead.
+func (m *Manager) MatchAll(metadata *C.Metadata, helper C.RuleMatchHelper) []MatchResult {
+	var results []MatchResult
+	for _, r := range m.All() {
+		if r.IsDisabled() {
+			continue
+		}
+		if ok, adapter := r.Rule.Match(metadata, helper); ok {
+			r.simulatedHits.Add(1)
+			results = append(results, MatchResult{Rule: r, Adapter: adapter})
+		}
+	}
+	return results
+}
+
+// SimulatedHitCount returns the matches of r in Manager.MatchAll, which are never part of HitCount
+func (r *RuleWrapper) SimulatedHitCount() uint64 {
+	return r.simulatedHits.Load()
+}
@@ -0,0 +1,96 @@
+package wrapper
+
+import (
+	"strconv"
+	"time"
+)
+
+// RuleState is the disabled state of a rule as exported by Manager.ExportState, serializable
+// so it can outlive the process and be applied to the rules loaded after a restart.
+// Schedules come from the configuration and aren't part of it.
+type RuleState struct {
+	// Key identifies the rule across reloads, see Manager.ExportState
+	Key            string `json:"key"`
+	Disabled       bool   `json:"disabled"`
+	DisabledReason string `json:"disabledReason,omitempty"`
+	// DisabledUntil is the end of a DisableFor window still in progress
+	DisabledUntil *time.Time `json:"disabledUntil,omitempty"`
+}
+
+// ruleKeys returns the key of each rule: its type and payload, suffixed with #n for the n-th
+// duplicate in order, so the keys stay the same as long as the ruleset keeps its order of duplicates.
+func ruleKeys(rules []*RuleWrapper) []string {
+	keys := make([]string, len(rules))
+	seen := make(map[string]int, len(rules))
+	for i, r := range rules {
+		key := r.RuleType().String() + "," + r.Payload()
+		seen[key]++
+		if n := seen[key]; n > 1 {
+			key += "#" + strconv.Itoa(n)
+		}
+		keys[i] = key
+	}
+	return keys
+}
+
+// state returns the disabled state of r, keyed by key. It reflects SetDisabled and DisableFor,
+// not the schedule.
+func (r *RuleWrapper) state(key string) RuleState {
+	state := RuleState{Key: key, Disabled: r.disabled.Load()}
+	if state.Disabled {
+		state.DisabledReason = r.DisabledReason()
+	}
+	if until := r.DisabledUntil(); !until.IsZero() {
+		state.DisabledUntil = &until
+	}
+	return state
+}
+
+// applyState makes r disabled as described by state, a DisableFor window already over is dropped
+func (r *RuleWrapper) applyState(state RuleState) {
+	r.SetDisabled(false)
+	if state.Disabled {
+		reason := state.DisabledReason
+		if reason == "" {
+			reason = DisabledReasonManual
+		}
+		r.SetDisabledReason(reason)
+	}
+	if state.DisabledUntil != nil {
+		r.DisableFor(state.DisabledUntil.Sub(timeNow()))
+	}
+}
+
+// ExportState returns the disabled state of every registered wrapper in registration order.
+// A rule is keyed by its type and payload, such as "DomainSuffix,example.com",
+// with "#2", "#3"... appended to the duplicates after the first one.
+func (m *Manager) ExportState() []RuleState {
+	rules := m.All()
+	states := make([]RuleState, len(rules))
+	for i, key := range ruleKeys(rules) {
+		states[i] = rules[i].state(key)
+	}
+	return states
+}
+
+// ApplyState restores states exported by ExportState, typically into the wrappers of a ruleset
+// loaded after a restart. Each state replaces the disabled state of the wrapper of the same key,
+// wrappers without a state are left alone. The states matching no registered wrapper, such as those
+// of rules removed from the ruleset, are returned in their order.
+func (m *Manager) ApplyState(states []RuleState) []RuleState {
+	rules := m.All()
+	byKey := make(map[string]*RuleWrapper, len(rules))
+	for i, key := range ruleKeys(rules) {
+		byKey[key] = rules[i]
+	}
+	var unmatched []RuleState
+	for _, state := range states {
+		r, ok := byKey[state.Key]
+		if !ok {
+			unmatched = append(unmatched, state)
+			continue
+		}
+		r.applyState(state)
+	}
+	return unmatched
+}
@@ -0,0 +1,204 @@
+package wrapper
+
+import (
+	"encoding/json"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// The hit and miss stats are written seqlock style: writers take turns on statsMu, holding it for
+// a handful of atomic operations, and statsSeq is odd while a write is in progress so that Snapshot
+// reads them without taking the mutex, reporting never blocks matches. A parked mutex rather than
+// a spinning one, as a hot rule such as the final MATCH is written by every connection at once.
+// The single field accessors read one value each and may be mutually inconsistent, use Snapshot
+// to report them together.
+
+// RuleStats is a coherent copy of the hit and miss stats of a RuleWrapper,
+// zero times mean no hit or miss was recorded since creation or the last reset.
+// The disabled state is read alongside, outside of the stats coherence.
+type RuleStats struct {
+	HitCount       uint64    `json:"hitCount"`
+	HitAt          time.Time `json:"hitAt"`
+	FirstHitAt     time.Time `json:"firstHitAt"`
+	MissCount      uint64    `json:"missCount"`
+	MissAt         time.Time `json:"missAt"`
+	Disabled       bool      `json:"disabled"`
+	DisabledReason string    `json:"disabledReason,omitempty"`
+}
+
+// MarshalJSON encodes times in RFC 3339, omitting zero ones rather than emitting the Unix epoch
+func (s RuleStats) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		HitCount       uint64     `json:"hitCount"`
+		HitAt          *time.Time `json:"hitAt,omitempty"`
+		FirstHitAt     *time.Time `json:"firstHitAt,omitempty"`
+		MissCount      uint64     `json:"missCount"`
+		MissAt         *time.Time `json:"missAt,omitempty"`
+		Disabled       bool       `json:"disabled"`
+		DisabledReason string     `json:"disabledReason,omitempty"`
+	}{
+		HitCount:       s.HitCount,
+		HitAt:          nonZeroTime(s.HitAt),
+		FirstHitAt:     nonZeroTime(s.FirstHitAt),
+		MissCount:      s.MissCount,
+		MissAt:         nonZeroTime(s.MissAt),
+		Disabled:       s.Disabled,
+		DisabledReason: s.DisabledReason,
+	})
+}
+
+func nonZeroTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// Snapshot returns the stats as left by a single point between Hit, Miss and ResetStats calls,
+// so a hit count always matches its time. It retries while a write is in progress and never blocks one.
+func (r *RuleWrapper) Snapshot() RuleStats {
+	for {
+		seq := r.statsSeq.Load()
+		if seq%2 == 1 {
+			runtime.Gosched()
+			continue
+		}
+		stats := RuleStats{
+			HitCount:   r.hitCount.Load(),
+			HitAt:      r.hitAt.loadOrZero(),
+			FirstHitAt: r.firstHitAt.loadOrZero(),
+			MissCount:  r.missCount.Load(),
+			MissAt:     r.missAt.loadOrZero(),
+		}
+		if r.statsSeq.Load() == seq {
+			stats.DisabledReason = r.DisabledReason()
+			stats.Disabled = stats.DisabledReason != ""
+			return stats
+		}
+	}
+}
+
+// ResetStats clears the hit and miss counters along with their times,
+// a concurrent Match is accounted either entirely before or entirely after it.
+// It also clears SimulatedHitCount, re-arms the threshold of SetHitThreshold and empties the window of SetHitWindow.
+func (r *RuleWrapper) ResetStats() {
+	r.lockStats()
+	r.hitCount.Store(0)
+	r.hitAt.i.Store(0)
+	r.firstHitAt.i.Store(0)
+	r.missCount.Store(0)
+	r.missAt.i.Store(0)
+	r.missStreak.Store(0)
+	r.adapterMu.Lock()
+	r.adapterHits.Store(nil)
+	r.adapterMu.Unlock()
+	r.simulatedHits.Store(0)
+	r.unlockStats()
+	if t := r.threshold.Load(); t != nil {
+		t.fired.Store(false)
+	}
+	if w := r.window.Load(); w != nil {
+		w.reset()
+	}
+}
+
+// AdapterHits returns the hits of Match broken down by the adapter they were routed to, which
+// tells apart where a logical rule sends its traffic. Hits recorded by Hit carry no adapter
+// and only show in HitCount. The map is a copy, nil until Match first hit. It is read apart from
+// Snapshot, so a hit in progress may show in one and not yet in the other.
+func (r *RuleWrapper) AdapterHits() map[string]uint64 {
+	counters := r.adapterHits.Load()
+	if counters == nil {
+		return nil
+	}
+	hits := make(map[string]uint64, len(*counters))
+	for adapter, n := range *counters {
+		hits[adapter] = n.Load()
+	}
+	return hits
+}
+
+// countAdapterHit adds a hit to adapter, a single atomic add once the adapter was seen.
+// A new adapter copies the map of counters, as a rule routes to a handful of adapters at most.
+func (r *RuleWrapper) countAdapterHit(adapter string) {
+	if counters := r.adapterHits.Load(); counters != nil {
+		if n, ok := (*counters)[adapter]; ok {
+			n.Add(1)
+			return
+		}
+	}
+	r.adapterMu.Lock()
+	defer r.adapterMu.Unlock()
+	r.storeAdapterHits(adapter, 1)
+}
+
+// storeAdapterHits adds n hits to adapter, it must be called with adapterMu held
+func (r *RuleWrapper) storeAdapterHits(adapter string, n uint64) {
+	old := r.adapterHits.Load()
+	if old != nil {
+		if counter, ok := (*old)[adapter]; ok {
+			counter.Add(n)
+			return
+		}
+	}
+	var counters map[string]*atomic.Uint64
+	if old != nil {
+		counters = make(map[string]*atomic.Uint64, len(*old)+1)
+		for name, counter := range *old {
+			counters[name] = counter
+		}
+	} else {
+		counters = make(map[string]*atomic.Uint64, 1)
+	}
+	counter := new(atomic.Uint64)
+	counter.Store(n)
+	counters[adapter] = counter
+	r.adapterHits.Store(&counters)
+}
+
+// lockStats starts a write of the stats, waiting for the write in progress, if any, to end
+func (r *RuleWrapper) lockStats() {
+	r.statsMu.Lock()
+	r.statsSeq.Add(1)
+}
+
+// unlockStats ends the write started by lockStats
+func (r *RuleWrapper) unlockStats() {
+	r.statsSeq.Add(1)
+	r.statsMu.Unlock()
+}
+
+// MarshalJSON encodes the Snapshot of the stats
+func (r *RuleWrapper) MarshalJSON() ([]byte, error) {
+	return r.Snapshot().MarshalJSON()
+}
+
+// loadOrZero returns the zero time while nothing was stored, instead of the Unix epoch
+func (t *atomicTime) loadOrZero() time.Time {
+	if i := t.i.Load(); i != 0 {
+		return time.Unix(0, i)
+	}
+	return time.Time{}
+}
+
+// TotalMatches returns the hits and misses together, read from one Snapshot
+func (r *RuleWrapper) TotalMatches() uint64 {
+	stats := r.Snapshot()
+	return stats.HitCount + stats.MissCount
+}
+
+// HitRate returns the fraction of evaluations that hit, from one Snapshot so it never exceeds 1.
+// It is 0 before any evaluation.
+func (r *RuleWrapper) HitRate() float64 {
+	return r.Snapshot().HitRate()
+}
+
+// HitRate returns HitCount over the hits and misses, 0 when there are none
+func (s RuleStats) HitRate() float64 {
+	total := s.HitCount + s.MissCount
+	if total == 0 {
+		return 0
+	}
+	return float64(s.HitCount) / float64(total)
+}
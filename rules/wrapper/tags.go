@@ -0,0 +1,79 @@
+package wrapper
+
+// SetTags replaces the labels of the rule, duplicate and empty tags are dropped.
+// tags is copied, the caller may reuse it afterwards.
+func (r *RuleWrapper) SetTags(tags ...string) {
+	if len(tags) == 0 {
+		r.tags.Store(nil)
+		return
+	}
+	stored := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		if tag != "" && !containsTag(stored, tag) {
+			stored = append(stored, tag)
+		}
+	}
+	r.tags.Store(&stored)
+}
+
+// Tags returns a copy of the labels set by SetTags, in their original order
+func (r *RuleWrapper) Tags() []string {
+	tags := r.tags.Load()
+	if tags == nil || len(*tags) == 0 {
+		return nil
+	}
+	return append([]string(nil), *tags...)
+}
+
+func (r *RuleWrapper) HasTag(tag string) bool {
+	tags := r.tags.Load()
+	return tags != nil && containsTag(*tags, tag)
+}
+
+func containsTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// TagStats is the sum of the stats of all rules sharing a tag
+type TagStats struct {
+	Rules     int    `json:"rules"`
+	HitCount  uint64 `json:"hitCount"`
+	MissCount uint64 `json:"missCount"`
+}
+
+// WithTag returns the rules labeled with tag, keeping their order
+func WithTag(rules []*RuleWrapper, tag string) []*RuleWrapper {
+	var tagged []*RuleWrapper
+	for _, r := range rules {
+		if r.HasTag(tag) {
+			tagged = append(tagged, r)
+		}
+	}
+	return tagged
+}
+
+// StatsByTag sums the hit and miss counts of rules per tag, a rule with several tags counts towards each of them.
+// Every rule is read from its own Snapshot, the sums aren't coherent across rules.
+func StatsByTag(rules []*RuleWrapper) map[string]TagStats {
+	stats := make(map[string]TagStats)
+	for _, r := range rules {
+		tags := r.tags.Load()
+		if tags == nil || len(*tags) == 0 {
+			continue
+		}
+		snapshot := r.Snapshot()
+		for _, tag := range *tags {
+			s := stats[tag]
+			s.Rules++
+			s.HitCount += snapshot.HitCount
+			s.MissCount += snapshot.MissCount
+			stats[tag] = s
+		}
+	}
+	return stats
+}
@@ -0,0 +1,44 @@
+package wrapper
+
+import (
+	C "github.com/metacubex/mihomo/constant"
+)
+
+const tracingMiddleware = "tracing"
+
+// Span is the subset of a tracing span used by rule matching,
+// an OpenTelemetry span can be adapted with a few lines.
+type Span interface {
+	SetAttribute(key string, value any)
+	End()
+}
+
+// Tracer starts a span for one rule evaluation.
+// metadata is passed so an adapter can look up the parent span of the connection.
+type Tracer interface {
+	StartSpan(metadata *C.Metadata, name string) Span
+}
+
+// WithTracer wraps every evaluation of the underlying rule in a span,
+// tagged with rule.type, rule.payload, rule.matched and rule.adapter.
+// A nil tracer removes the tracing, so no span is created by default.
+func WithTracer(tracer Tracer) Option {
+	return func(r *RuleWrapper) {
+		if tracer == nil {
+			r.Remove(tracingMiddleware)
+			return
+		}
+		r.Use(tracingMiddleware, priorityTracing, func(next MatchFunc) MatchFunc {
+			return func(metadata *C.Metadata, helper C.RuleMatchHelper) (bool, string) {
+				span := tracer.StartSpan(metadata, "rule.match")
+				span.SetAttribute("rule.type", r.RuleType().String())
+				span.SetAttribute("rule.payload", r.Payload())
+				ok, adapter := next(metadata, helper)
+				span.SetAttribute("rule.matched", ok)
+				span.SetAttribute("rule.adapter", adapter)
+				span.End()
+				return ok, adapter
+			}
+		})
+	}
+}
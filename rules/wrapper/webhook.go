@@ -0,0 +1,212 @@
+package wrapper
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/metacubex/mihomo/log"
+
+	"github.com/metacubex/http"
+)
+
+// WebhookSink is an EventSink that POSTs events to a URL as JSON arrays.
+// Events are queued without blocking and flushed in batches once BatchSize events
+// are pending or FlushInterval elapsed, events are dropped when the queue is full.
+type WebhookSink struct {
+	url           string
+	client        *http.Client
+	batchSize     int
+	flushInterval time.Duration
+	queueSize     int
+	maxRetries    int
+	retryBackoff  time.Duration
+
+	queue     chan MatchEvent
+	dropped   atomic.Uint64
+	failed    atomic.Uint64
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+type WebhookOption func(s *WebhookSink)
+
+// WithWebhookBatch sets how many events are sent per request and how long events may wait for a batch
+func WithWebhookBatch(size int, interval time.Duration) WebhookOption {
+	return func(s *WebhookSink) {
+		if size > 0 {
+			s.batchSize = size
+		}
+		if interval > 0 {
+			s.flushInterval = interval
+		}
+	}
+}
+
+// WithWebhookQueueSize bounds the events waiting to be sent
+func WithWebhookQueueSize(size int) WebhookOption {
+	return func(s *WebhookSink) {
+		if size > 0 {
+			s.queueSize = size
+		}
+	}
+}
+
+// WithWebhookRetry sets how many times a failed batch is retried, backoff grows linearly per attempt
+func WithWebhookRetry(retries int, backoff time.Duration) WebhookOption {
+	return func(s *WebhookSink) {
+		if retries >= 0 {
+			s.maxRetries = retries
+		}
+		if backoff > 0 {
+			s.retryBackoff = backoff
+		}
+	}
+}
+
+func WithWebhookClient(client *http.Client) WebhookOption {
+	return func(s *WebhookSink) {
+		if client != nil {
+			s.client = client
+		}
+	}
+}
+
+func NewWebhookSink(url string, opts ...WebhookOption) *WebhookSink {
+	s := &WebhookSink{
+		url:           url,
+		client:        &http.Client{Timeout: 10 * time.Second},
+		batchSize:     100,
+		flushInterval: 5 * time.Second,
+		queueSize:     4096,
+		maxRetries:    3,
+		retryBackoff:  time.Second,
+		done:          make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.queue = make(chan MatchEvent, s.queueSize)
+	s.wg.Add(1)
+	go s.loop()
+	return s
+}
+
+// Publish implements EventSink
+func (s *WebhookSink) Publish(event MatchEvent) {
+	select {
+	case s.queue <- event:
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+// Dropped return how many events were dropped because the queue was full
+func (s *WebhookSink) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// Failed return how many events were lost because their batch failed after all retries
+func (s *WebhookSink) Failed() uint64 {
+	return s.failed.Load()
+}
+
+// Close stops the sink after flushing the queued events
+func (s *WebhookSink) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+	s.wg.Wait()
+	return nil
+}
+
+func (s *WebhookSink) loop() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]MatchEvent, 0, s.batchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		s.send(batch)
+		batch = make([]MatchEvent, 0, s.batchSize)
+	}
+
+	for {
+		select {
+		case event := <-s.queue:
+			batch = append(batch, event)
+			if len(batch) >= s.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-s.done:
+			for {
+				select {
+				case event := <-s.queue:
+					batch = append(batch, event)
+					if len(batch) >= s.batchSize {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+func (s *WebhookSink) send(batch []MatchEvent) {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		log.Warnln("[Rule] encode webhook batch failed: %s", err)
+		s.failed.Add(uint64(len(batch)))
+		return
+	}
+	for attempt := 0; ; attempt++ {
+		err = s.post(body)
+		if err == nil {
+			return
+		}
+		if attempt >= s.maxRetries {
+			break
+		}
+		timer := time.NewTimer(s.retryBackoff * time.Duration(attempt+1))
+		select {
+		case <-timer.C:
+		case <-s.done:
+			// closing, give the remaining attempts no backoff
+			timer.Stop()
+		}
+	}
+	log.Warnln("[Rule] webhook %s dropped %d events: %s", s.url, len(batch), err)
+	s.failed.Add(uint64(len(batch)))
+}
+
+func (s *WebhookSink) post(body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package wrapper
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	C "github.com/metacubex/mihomo/constant"
+
+	"github.com/metacubex/http"
+	"github.com/metacubex/http/httptest"
+)
+
+type webhookRecorder struct {
+	mu       sync.Mutex
+	batches  [][]MatchEvent
+	failures int
+}
+
+func (rec *webhookRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rec.failures > 0 {
+		rec.failures--
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	var batch []MatchEvent
+	if err := json.Unmarshal(body, &batch); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	rec.batches = append(rec.batches, batch)
+}
+
+func (rec *webhookRecorder) sizes() []int {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	sizes := make([]int, len(rec.batches))
+	for i, batch := range rec.batches {
+		sizes[i] = len(batch)
+	}
+	return sizes
+}
+
+func TestWebhookSinkBatching(t *testing.T) {
+	rec := &webhookRecorder{failures: 1}
+	server := httptest.NewServer(rec)
+	defer server.Close()
+
+	sink := NewWebhookSink(server.URL,
+		WithWebhookBatch(3, time.Hour),
+		WithWebhookRetry(2, time.Millisecond),
+	)
+	rule := &fakeRule{ruleType: C.Domain, payload: "a.com", adapter: "PROXY", match: matchHost("a.com")}
+	w := NewRuleWrapper(rule, WithEventSink(sink)).(*RuleWrapper)
+	for i := 0; i < 7; i++ {
+		w.Match(&C.Metadata{Host: "a.com", DstPort: 443}, C.RuleMatchHelper{})
+	}
+	w.Match(&C.Metadata{Host: "b.com"}, C.RuleMatchHelper{})
+	if err := sink.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	sizes := rec.sizes()
+	if len(sizes) != 3 || sizes[0] != 3 || sizes[1] != 3 || sizes[2] != 1 {
+		t.Fatalf("unexpected batch sizes: %v", sizes)
+	}
+	event := rec.batches[0][0]
+	if event.Type != "Domain" || event.Payload != "a.com" || event.Adapter != "PROXY" || event.Host != "a.com" || event.DstPort != 443 {
+		t.Fatalf("unexpected event: %+v", event)
+	}
+	if sink.Dropped() != 0 || sink.Failed() != 0 {
+		t.Fatalf("unexpected losses: dropped=%d failed=%d", sink.Dropped(), sink.Failed())
+	}
+}
+
+func TestWebhookSinkDropsOnOverflow(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+
+	sink := NewWebhookSink(server.URL, WithWebhookBatch(1, time.Hour), WithWebhookQueueSize(2))
+	start := time.Now()
+	for i := 0; i < 100; i++ {
+		sink.Publish(MatchEvent{Payload: "x"})
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("publish blocked for %v", elapsed)
+	}
+	if sink.Dropped() == 0 {
+		t.Fatalf("expected events to be dropped on overflow")
+	}
+	close(release)
+	_ = sink.Close()
+}
+
+func TestChanSink(t *testing.T) {
+	events := make(ChanSink, 1)
+	w := NewRuleWrapper(&fakeRule{adapter: "DIRECT", match: matchHost("a.com")}, WithEventSink(events)).(*RuleWrapper)
+	w.Match(&C.Metadata{Host: "a.com"}, C.RuleMatchHelper{})
+	w.Match(&C.Metadata{Host: "a.com"}, C.RuleMatchHelper{})
+	if event := <-events; event.Adapter != "DIRECT" {
+		t.Fatalf("unexpected event: %+v", event)
+	}
+	select {
+	case event := <-events:
+		t.Fatalf("full channel should drop, got %+v", event)
+	default:
+	}
+}
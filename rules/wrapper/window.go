@@ -0,0 +1,88 @@
+package wrapper
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// hitWindowBuckets one second buckets make up the sliding window of recent hits
+const hitWindowBuckets = 60
+
+// hitWindow counts hits per second in a ring, buckets are recycled lazily when a hit lands
+// in a bucket last used a full window ago, so no goroutine is needed to advance it.
+// A bucket packs the second it counts, in the high 32 bits, with its count in the low 32 bits,
+// letting a single compare-and-swap both recycle and increment it.
+type hitWindow struct {
+	buckets [hitWindowBuckets]atomic.Uint64
+}
+
+func (w *hitWindow) add(now time.Time) {
+	sec := uint64(uint32(now.Unix()))
+	b := &w.buckets[sec%hitWindowBuckets]
+	for {
+		old := b.Load()
+		next := sec<<32 | 1
+		if old>>32 == sec {
+			next = old + 1
+			if uint32(old) == ^uint32(0) {
+				return // saturated
+			}
+		}
+		if b.CompareAndSwap(old, next) {
+			return
+		}
+	}
+}
+
+// sum counts the hits of the window ending at now, including the current second
+func (w *hitWindow) sum(now time.Time) uint64 {
+	sec := uint32(now.Unix())
+	var total uint64
+	for i := range w.buckets {
+		v := w.buckets[i].Load()
+		if age := sec - uint32(v>>32); age < hitWindowBuckets {
+			total += uint64(uint32(v))
+		}
+	}
+	return total
+}
+
+func (w *hitWindow) reset() {
+	for i := range w.buckets {
+		w.buckets[i].Store(0)
+	}
+}
+
+// SetHitWindow enable/disable counting the hits of the last minute, alongside the cumulative counters.
+// It is disabled by default since it costs 480 bytes per rule, disabling drops the counted hits.
+func (r *RuleWrapper) SetHitWindow(v bool) {
+	if !v {
+		r.window.Store(nil)
+		return
+	}
+	r.window.CompareAndSwap(nil, new(hitWindow))
+}
+
+func (r *RuleWrapper) IsHitWindow() bool {
+	return r.window.Load() != nil
+}
+
+// HitsInLastMinute returns the hits of the last 60 seconds, always 0 unless SetHitWindow is enabled
+func (r *RuleWrapper) HitsInLastMinute() uint64 {
+	w := r.window.Load()
+	if w == nil {
+		return 0
+	}
+	return w.sum(timeNow())
+}
+
+// RecentHitsPerSecond returns the average hits per second over the last minute, see HitsInLastMinute
+func (r *RuleWrapper) RecentHitsPerSecond() float64 {
+	return float64(r.HitsInLastMinute()) / hitWindowBuckets
+}
+
+func (r *RuleWrapper) recordWindowHit() {
+	if w := r.window.Load(); w != nil {
+		w.add(timeNow())
+	}
+}
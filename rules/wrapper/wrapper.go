@@ -1,6 +1,9 @@
 package wrapper
 
 import (
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -9,19 +12,126 @@ import (
 
 type RuleWrapper struct {
 	C.Rule
-	disabled  atomic.Bool
-	hitCount  atomic.Uint64
-	hitAt     atomicTime
-	missCount atomic.Uint64
-	missAt    atomicTime
+	disabled      atomic.Bool
+	disableUntil  atomic.Int64
+	reason        atomic.Pointer[string]
+	schedule      atomic.Pointer[schedule]
+	statsMu       sync.Mutex // serializes the writers of the stats, see lockStats
+	statsSeq      atomic.Uint64
+	adapterHits   atomic.Pointer[map[string]*atomic.Uint64]
+	adapterMu     sync.Mutex // serializes the copies of adapterHits adding an adapter
+	hitCount      atomic.Uint64
+	hitAt         atomicTime
+	firstHitAt    atomicTime
+	missCount     atomic.Uint64
+	missAt        atomicTime
+	missStreak    atomic.Uint64
+	skippedCount  atomic.Uint64
+	simulatedHits atomic.Uint64
+	latency       matchLatency
+	onHit         atomic.Pointer[MatchCallback]
+	onMiss        atomic.Pointer[MatchCallback]
+	threshold     atomic.Pointer[hitThreshold]
+	lastMatched   atomic.Pointer[MatchInfo]
+	tags          atomic.Pointer[[]string]
+	window        atomic.Pointer[hitWindow]
+	chain         middlewareChain
+	cache         *matchCache // set by NewCachingRuleWrapper, never changed afterwards
 }
 
+// Reasons recorded by the built-in ways of disabling a rule, see DisabledReason
+const (
+	DisabledReasonManual    = "manual"
+	DisabledReasonTemporary = "temporary"
+	DisabledReasonConfig    = "config"
+	DisabledReasonSchedule  = "schedule"
+	DisabledReasonThreshold = "threshold"
+)
+
+// timeNow is replaced in tests to drive time based behaviors
+var timeNow = time.Now
+
+// IsDisabled reports a rule disabled by SetDisabled, by DisableFor until its window passes,
+// or outside the windows of SetSchedule
 func (r *RuleWrapper) IsDisabled() bool {
-	return r.disabled.Load()
+	if r.disabled.Load() {
+		return true
+	}
+	if !r.timeBound() {
+		return false
+	}
+	now := timeNow()
+	return r.disabledTemporarily(now) || r.outOfSchedule(now)
 }
 
+// timeBound reports whether a DisableFor window or a schedule may disable the rule, so that
+// rules without either don't read the clock on every Match
+func (r *RuleWrapper) timeBound() bool {
+	return r.disableUntil.Load() != 0 || r.schedule.Load() != nil
+}
+
+func (r *RuleWrapper) disabledTemporarily(now time.Time) bool {
+	until := r.disableUntil.Load()
+	return until != 0 && now.UnixNano() < until
+}
+
+// SetDisabled disables the rule until enabled again, enabling also cancels DisableFor.
+// The DisabledReason of SetDisabled(true) is DisabledReasonManual.
 func (r *RuleWrapper) SetDisabled(v bool) {
-	r.disabled.Store(v)
+	if v {
+		r.SetDisabledReason(DisabledReasonManual)
+		return
+	}
+	r.disableUntil.Store(0)
+	r.disabled.Store(false)
+	r.reason.Store(nil)
+}
+
+// SetDisabledReason disables the rule like SetDisabled(true), recording why for DisabledReason.
+func (r *RuleWrapper) SetDisabledReason(reason string) {
+	r.reason.Store(&reason)
+	r.disabled.Store(true)
+}
+
+// DisabledReason returns why the rule is disabled, empty while it is enabled.
+func (r *RuleWrapper) DisabledReason() string {
+	if r.disabled.Load() {
+		if reason := r.reason.Load(); reason != nil {
+			return *reason
+		}
+		return DisabledReasonManual
+	}
+	if !r.timeBound() {
+		return ""
+	}
+	now := timeNow()
+	if r.disabledTemporarily(now) {
+		return DisabledReasonTemporary
+	}
+	if r.outOfSchedule(now) {
+		return DisabledReasonSchedule
+	}
+	return ""
+}
+
+// DisableFor disables the rule for d, calling it again restarts the window from now.
+// The rule re-enables itself once IsDisabled sees the window passed, so no timer is left behind.
+// d <= 0 cancels a temporary disable.
+func (r *RuleWrapper) DisableFor(d time.Duration) {
+	if d <= 0 {
+		r.disableUntil.Store(0)
+		return
+	}
+	r.disableUntil.Store(timeNow().Add(d).UnixNano())
+}
+
+// DisabledUntil returns the end of the window set by DisableFor, zero when there is none in progress
+func (r *RuleWrapper) DisabledUntil() time.Time {
+	until := r.disableUntil.Load()
+	if until == 0 || timeNow().UnixNano() >= until {
+		return time.Time{}
+	}
+	return time.Unix(0, until)
 }
 
 func (r *RuleWrapper) HitCount() uint64 {
@@ -32,6 +142,12 @@ func (r *RuleWrapper) HitAt() time.Time {
 	return r.hitAt.Load()
 }
 
+// FirstHitAt returns the time of the first hit since creation or ResetStats, zero without a hit.
+// Unlike HitAt it stays put as the rule keeps hitting.
+func (r *RuleWrapper) FirstHitAt() time.Time {
+	return r.firstHitAt.loadOrZero()
+}
+
 func (r *RuleWrapper) MissCount() uint64 {
 	return r.missCount.Load()
 }
@@ -40,35 +156,97 @@ func (r *RuleWrapper) MissAt() time.Time {
 	return r.missAt.Load()
 }
 
+// MissStreak returns the misses since the latest hit, or since creation or ResetStats without a hit
+func (r *RuleWrapper) MissStreak() uint64 {
+	return r.missStreak.Load()
+}
+
 func (r *RuleWrapper) Unwrap() C.Rule {
 	return r.Rule
 }
 
 func (r *RuleWrapper) Hit() {
-	r.hitCount.Add(1)
-	r.hitAt.Store(time.Now())
+	r.hit("")
+}
+
+// hit records a hit routed to adapter, if known, and returns the new hit count
+func (r *RuleWrapper) hit(adapter string) uint64 {
+	now := time.Now()
+	r.lockStats()
+	hits := r.hitCount.Add(1)
+	r.hitAt.Store(now)
+	r.firstHitAt.i.CompareAndSwap(0, now.UnixNano())
+	r.missStreak.Store(0)
+	r.unlockStats()
+	if adapter != "" {
+		r.countAdapterHit(adapter)
+	}
+	return hits
 }
 
 func (r *RuleWrapper) Miss() {
+	now := time.Now()
+	r.lockStats()
 	r.missCount.Add(1)
-	r.missAt.Store(time.Now())
+	r.missAt.Store(now)
+	r.missStreak.Add(1)
+	r.unlockStats()
 }
 
 func (r *RuleWrapper) Match(metadata *C.Metadata, helper C.RuleMatchHelper) (bool, string) {
 	if r.IsDisabled() {
 		return false, ""
 	}
-	ok, adapter := r.Rule.Match(metadata, helper)
+	ok, adapter := r.evaluate(metadata, helper)
+	r.account(ok, metadata, adapter)
+	return ok, adapter
+}
+
+// account records the result of an evaluation and calls the callbacks of Match
+func (r *RuleWrapper) account(ok bool, metadata *C.Metadata, adapter string) {
+	var callback *MatchCallback
 	if ok {
-		r.Hit()
+		hits := r.hit(adapter)
+		r.recordWindowHit()
+		r.captureLastMatched(metadata, adapter)
+		r.checkHitThreshold(hits)
+		callback = r.onHit.Load()
 	} else {
 		r.Miss()
+		callback = r.onMiss.Load()
 	}
-	return ok, adapter
+	if callback != nil {
+		(*callback)(metadata)
+	}
+}
+
+// String renders the rule with its live counters on one line, for logs:
+//
+//	DomainSuffix,example.com -> PROXY [hits=42 miss=3 disabled]
+//
+// The payload is left out when empty, as for MATCH, and "disabled" only shows while IsDisabled.
+func (r *RuleWrapper) String() string {
+	var b strings.Builder
+	b.WriteString(r.RuleType().String())
+	if payload := r.Payload(); payload != "" {
+		b.WriteByte(',')
+		b.WriteString(payload)
+	}
+	b.WriteString(" -> ")
+	b.WriteString(r.Adapter())
+	b.WriteString(" [hits=")
+	b.WriteString(strconv.FormatUint(r.hitCount.Load(), 10))
+	b.WriteString(" miss=")
+	b.WriteString(strconv.FormatUint(r.missCount.Load(), 10))
+	if r.IsDisabled() {
+		b.WriteString(" disabled")
+	}
+	b.WriteByte(']')
+	return b.String()
 }
 
-func NewRuleWrapper(rule C.Rule) C.RuleWrapper {
-	return &RuleWrapper{Rule: rule}
+func NewRuleWrapper(rule C.Rule, opts ...Option) C.RuleWrapper {
+	return (&RuleWrapper{Rule: rule}).With(opts...)
 }
 
 // atomicTime is a wrapper of [atomic.Int64] to provide atomic time storage.
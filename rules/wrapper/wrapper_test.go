@@ -0,0 +1,1201 @@
+package wrapper
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/netip"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	C "github.com/metacubex/mihomo/constant"
+)
+
+// fakeRule is a test rule whose result and cost are controlled by the test.
+type fakeRule struct {
+	ruleType C.RuleType
+	payload  string
+	adapter  string
+	match    func(metadata *C.Metadata) bool
+	delay    time.Duration
+	calls    atomic.Int64
+}
+
+func (r *fakeRule) RuleType() C.RuleType { return r.ruleType }
+
+func (r *fakeRule) Match(metadata *C.Metadata, helper C.RuleMatchHelper) (bool, string) {
+	r.calls.Add(1)
+	if r.delay > 0 {
+		time.Sleep(r.delay)
+	}
+	if r.match != nil && r.match(metadata) {
+		return true, r.adapter
+	}
+	return false, ""
+}
+
+func (r *fakeRule) Adapter() string         { return r.adapter }
+func (r *fakeRule) Payload() string         { return r.payload }
+func (r *fakeRule) ProviderNames() []string { return nil }
+
+func matchHost(host string) func(metadata *C.Metadata) bool {
+	return func(metadata *C.Metadata) bool {
+		return metadata.Host == host
+	}
+}
+
+// fakeClock replaces timeNow for the duration of a test.
+type fakeClock struct {
+	now time.Time
+}
+
+func useFakeClock(t *testing.T) *fakeClock {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+	origin := timeNow
+	timeNow = func() time.Time { return clock.now }
+	t.Cleanup(func() { timeNow = origin })
+	return clock
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func TestRuleWrapperEvalBudget(t *testing.T) {
+	clock := useFakeClock(t)
+	rule := &fakeRule{adapter: "DIRECT", match: matchHost("a.com")}
+	w := NewRuleWrapper(rule).(*RuleWrapper)
+	w.SetEvalBudget(3)
+
+	metadata := &C.Metadata{Host: "a.com"}
+	for i := 0; i < 5; i++ {
+		ok, _ := w.Match(metadata, C.RuleMatchHelper{})
+		if want := i < 3; ok != want {
+			t.Fatalf("match %d = %v, want %v", i, ok, want)
+		}
+	}
+	if calls := rule.calls.Load(); calls != 3 {
+		t.Fatalf("underlying rule evaluated %d times, want 3", calls)
+	}
+	if w.SkippedCount() != 2 || w.HitCount() != 3 || w.MissCount() != 2 {
+		t.Fatalf("unexpected counters: skipped=%d hit=%d miss=%d", w.SkippedCount(), w.HitCount(), w.MissCount())
+	}
+
+	clock.Advance(time.Second)
+	if ok, _ := w.Match(metadata, C.RuleMatchHelper{}); !ok {
+		t.Fatalf("expected budget to refill in the next window")
+	}
+
+	w.SetEvalBudget(0)
+	for i := 0; i < 10; i++ {
+		if ok, _ := w.Match(metadata, C.RuleMatchHelper{}); !ok {
+			t.Fatalf("expected unlimited budget")
+		}
+	}
+}
+
+func TestEvalBudgetConcurrent(t *testing.T) {
+	budget := newEvalBudget(100)
+	start := time.Unix(1000, 0)
+	budget.take(start)
+
+	// the goroutines race to advance the window, the budget still holds for it
+	var granted atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if budget.take(start.Add(time.Second)) {
+					granted.Add(1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if n := granted.Load(); n != 100 {
+		t.Fatalf("granted %d evaluations in a window of 100", n)
+	}
+}
+
+func TestCachingRuleWrapper(t *testing.T) {
+	clock := useFakeClock(t)
+	rule := &fakeRule{ruleType: C.DomainSuffix, adapter: "DIRECT", match: matchHost("a.com")}
+	w := NewCachingRuleWrapper(rule, 100*time.Millisecond)
+
+	a := &C.Metadata{Host: "a.com"}
+	for i := 0; i < 3; i++ {
+		if ok, adapter := w.Match(a, C.RuleMatchHelper{}); !ok || adapter != "DIRECT" {
+			t.Fatalf("match %d = %v %q", i, ok, adapter)
+		}
+	}
+	if calls := rule.calls.Load(); calls != 1 {
+		t.Fatalf("underlying rule evaluated %d times, want 1", calls)
+	}
+	if w.CacheHits() != 2 || w.CacheMisses() != 1 || w.HitCount() != 3 {
+		t.Fatalf("unexpected counters: cache hits=%d misses=%d hit=%d", w.CacheHits(), w.CacheMisses(), w.HitCount())
+	}
+
+	if ok, _ := w.Match(&C.Metadata{Host: "b.com"}, C.RuleMatchHelper{}); ok {
+		t.Fatalf("a cached result was served for another host")
+	}
+	if ok, _ := w.Match(&C.Metadata{Host: "b.com"}, C.RuleMatchHelper{}); ok || w.MissCount() != 2 {
+		t.Fatalf("expected cached misses to count as misses, got %d", w.MissCount())
+	}
+	if calls := rule.calls.Load(); calls != 2 {
+		t.Fatalf("underlying rule evaluated %d times, want 2", calls)
+	}
+
+	clock.Advance(100 * time.Millisecond)
+	w.Match(a, C.RuleMatchHelper{})
+	if calls := rule.calls.Load(); calls != 3 {
+		t.Fatalf("expected an expired result to be evaluated again, got %d calls", calls)
+	}
+	w.ClearCache()
+	w.Match(a, C.RuleMatchHelper{})
+	if calls := rule.calls.Load(); calls != 4 {
+		t.Fatalf("expected a cleared cache to evaluate again, got %d calls", calls)
+	}
+
+	ipRule := &fakeRule{ruleType: C.IPCIDR, adapter: "DIRECT", match: func(metadata *C.Metadata) bool {
+		return metadata.DstIP == netip.MustParseAddr("1.1.1.1")
+	}}
+	ip := NewCachingRuleWrapper(ipRule, time.Second)
+	resolve := C.RuleMatchHelper{ResolveIP: func() {}}
+	for _, metadata := range []*C.Metadata{
+		{Host: "a.com", DstIP: netip.MustParseAddr("1.1.1.1")},
+		{Host: "a.com", DstIP: netip.MustParseAddr("1.1.1.1")},
+		{Host: "a.com", DstIP: netip.MustParseAddr("8.8.8.8")},
+		{Host: "b.com", DstIP: netip.MustParseAddr("1.1.1.1")},
+		{Host: "a.com"},
+	} {
+		ip.Match(metadata, resolve)
+	}
+	ip.Match(&C.Metadata{Host: "a.com"}, C.RuleMatchHelper{})
+	if calls := ipRule.calls.Load(); calls != 4 {
+		t.Fatalf("IP rule evaluated %d times, want 4", calls)
+	}
+	if ip.CacheHits() != 2 {
+		t.Fatalf("expected the same destination IP to be served from cache whatever the host, got %d hits", ip.CacheHits())
+	}
+
+	processRule := &fakeRule{ruleType: C.ProcessName, adapter: "DIRECT", match: matchHost("a.com")}
+	process := NewCachingRuleWrapper(processRule, time.Second)
+	process.Match(a, C.RuleMatchHelper{})
+	process.Match(a, C.RuleMatchHelper{})
+	if calls := processRule.calls.Load(); calls != 2 || process.CacheMisses() != 0 {
+		t.Fatalf("expected a process rule to be evaluated every time, got %d calls", calls)
+	}
+}
+
+func TestCachingRuleWrapperOnlyCachesEvaluations(t *testing.T) {
+	clock := useFakeClock(t)
+	rule := &fakeRule{ruleType: C.DomainSuffix, adapter: "DIRECT", match: func(*C.Metadata) bool { return true }}
+	w := NewCachingRuleWrapper(rule, 10*time.Second, WithEvalBudget(1))
+	w.Match(&C.Metadata{Host: "a.com"}, C.RuleMatchHelper{})
+	if ok, _ := w.Match(&C.Metadata{Host: "b.com"}, C.RuleMatchHelper{}); ok || w.SkippedCount() != 1 {
+		t.Fatalf("expected the eval budget to skip the second match")
+	}
+	clock.Advance(time.Second)
+	if ok, _ := w.Match(&C.Metadata{Host: "b.com"}, C.RuleMatchHelper{}); !ok || rule.calls.Load() != 2 {
+		t.Fatalf("a skipped evaluation was cached, %d calls", rule.calls.Load())
+	}
+
+	ctxRule := &contextRule{fakeRule{ruleType: C.DomainSuffix, adapter: "PROXY", match: matchHost("a.com"), delay: time.Hour}}
+	cw := NewCachingRuleWrapper(ctxRule, 10*time.Second)
+	metadata := &C.Metadata{Host: "a.com"}
+	cancelled, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, _, err := cw.MatchContext(cancelled, metadata, C.RuleMatchHelper{}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the deadline to interrupt the match, got %v", err)
+	}
+	ctxRule.delay = 0
+	if ok, adapter, err := cw.MatchContext(context.Background(), metadata, C.RuleMatchHelper{}); err != nil || !ok || adapter != "PROXY" {
+		t.Fatalf("a cancelled evaluation was cached: %v %q %v", ok, adapter, err)
+	}
+	if ok, _ := cw.Match(metadata, C.RuleMatchHelper{}); !ok || ctxRule.calls.Load() != 2 || cw.CacheHits() != 1 {
+		t.Fatalf("expected the successful evaluation to be cached, %d calls, %d cache hits", ctxRule.calls.Load(), cw.CacheHits())
+	}
+}
+
+func TestRuleWrapperMiddlewareOrder(t *testing.T) {
+	rule := &fakeRule{adapter: "DIRECT", match: matchHost("a.com")}
+	var trace []string
+	record := func(name string) Middleware {
+		return func(next MatchFunc) MatchFunc {
+			return func(metadata *C.Metadata, helper C.RuleMatchHelper) (bool, string) {
+				trace = append(trace, name)
+				return next(metadata, helper)
+			}
+		}
+	}
+	w := NewRuleWrapper(rule,
+		WithMiddleware("low", 1, record("low")),
+		WithMiddleware("high", 10, record("high")),
+	).(*RuleWrapper)
+
+	if ok, adapter := w.Match(&C.Metadata{Host: "a.com"}, C.RuleMatchHelper{}); !ok || adapter != "DIRECT" {
+		t.Fatalf("unexpected result %v %q", ok, adapter)
+	}
+	if len(trace) != 2 || trace[0] != "high" || trace[1] != "low" {
+		t.Fatalf("unexpected middleware order: %v", trace)
+	}
+
+	// a middleware answering on its own does not fall through
+	w.Use("high", 10, func(next MatchFunc) MatchFunc {
+		return func(metadata *C.Metadata, helper C.RuleMatchHelper) (bool, string) {
+			return true, "REJECT"
+		}
+	})
+	trace = trace[:0]
+	if ok, adapter := w.Match(&C.Metadata{Host: "b.com"}, C.RuleMatchHelper{}); !ok || adapter != "REJECT" {
+		t.Fatalf("unexpected result %v %q", ok, adapter)
+	}
+	if len(trace) != 0 || rule.calls.Load() != 1 {
+		t.Fatalf("replaced middleware fell through: trace=%v calls=%d", trace, rule.calls.Load())
+	}
+	if names := w.Middlewares(); len(names) != 2 || names[0] != "high" {
+		t.Fatalf("unexpected middlewares: %v", names)
+	}
+	if w.HitCount() != 2 {
+		t.Fatalf("hit count = %d, want 2", w.HitCount())
+	}
+
+	w.Remove("high")
+	w.Remove("low")
+	if ok, _ := w.Match(&C.Metadata{Host: "b.com"}, C.RuleMatchHelper{}); ok {
+		t.Fatalf("expected plain rule behavior after removing middlewares")
+	}
+}
+
+type recordedSpan struct {
+	name  string
+	attrs map[string]any
+	ended bool
+}
+
+func (s *recordedSpan) SetAttribute(key string, value any) { s.attrs[key] = value }
+func (s *recordedSpan) End()                               { s.ended = true }
+
+type recordingTracer struct {
+	spans []*recordedSpan
+}
+
+func (t *recordingTracer) StartSpan(metadata *C.Metadata, name string) Span {
+	span := &recordedSpan{name: name, attrs: map[string]any{}}
+	t.spans = append(t.spans, span)
+	return span
+}
+
+func TestRuleWrapperTracer(t *testing.T) {
+	rule := &fakeRule{ruleType: C.DomainSuffix, payload: "a.com", adapter: "PROXY", match: matchHost("a.com")}
+	tracer := &recordingTracer{}
+	w := NewRuleWrapper(rule, WithTracer(tracer)).(*RuleWrapper)
+
+	w.Match(&C.Metadata{Host: "a.com"}, C.RuleMatchHelper{})
+	w.Match(&C.Metadata{Host: "b.com"}, C.RuleMatchHelper{})
+	if len(tracer.spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(tracer.spans))
+	}
+	hit := tracer.spans[0]
+	if !hit.ended || hit.attrs["rule.type"] != "DomainSuffix" || hit.attrs["rule.payload"] != "a.com" ||
+		hit.attrs["rule.matched"] != true || hit.attrs["rule.adapter"] != "PROXY" {
+		t.Fatalf("unexpected hit span: %+v", hit)
+	}
+	if miss := tracer.spans[1]; miss.attrs["rule.matched"] != false || miss.attrs["rule.adapter"] != "" {
+		t.Fatalf("unexpected miss span: %+v", miss)
+	}
+
+	w.With(WithTracer(nil))
+	w.Match(&C.Metadata{Host: "a.com"}, C.RuleMatchHelper{})
+	if len(tracer.spans) != 2 {
+		t.Fatalf("span created after removing tracer")
+	}
+}
+
+func TestRuleWrapperResetStats(t *testing.T) {
+	rule := &fakeRule{adapter: "DIRECT", match: matchHost("a.com")}
+	w := NewRuleWrapper(rule).(*RuleWrapper)
+
+	data, err := json.Marshal(w)
+	if err != nil || string(data) != `{"hitCount":0,"missCount":0,"disabled":false}` {
+		t.Fatalf("unexpected JSON of fresh stats: %s %v", data, err)
+	}
+
+	const workers, matches = 8, 1000
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			metadata := &C.Metadata{Host: "a.com"}
+			if i%2 == 1 {
+				metadata.Host = "b.com"
+			}
+			for j := 0; j < matches; j++ {
+				w.Match(metadata, C.RuleMatchHelper{})
+			}
+		}(i)
+	}
+	for i := 0; i < 100; i++ {
+		w.ResetStats()
+		if w.HitCount() > workers*matches || w.MissCount() > workers*matches {
+			t.Fatalf("counters out of range: hit=%d miss=%d", w.HitCount(), w.MissCount())
+		}
+	}
+	wg.Wait()
+
+	w.ResetStats()
+	w.Match(&C.Metadata{Host: "a.com"}, C.RuleMatchHelper{})
+	var stats struct {
+		HitCount  uint64  `json:"hitCount"`
+		HitAt     *string `json:"hitAt"`
+		MissCount uint64  `json:"missCount"`
+		MissAt    *string `json:"missAt"`
+	}
+	data, err = json.Marshal(w)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	if err := json.Unmarshal(data, &stats); err != nil {
+		t.Fatalf("unmarshal %s: %v", data, err)
+	}
+	if stats.HitCount != 1 || stats.HitAt == nil || stats.MissCount != 0 || stats.MissAt != nil {
+		t.Fatalf("unexpected stats after reset: %s", data)
+	}
+	if _, err := time.Parse(time.RFC3339, *stats.HitAt); err != nil {
+		t.Fatalf("hitAt is not RFC3339: %v", err)
+	}
+}
+
+func TestRuleWrapperFirstHitAt(t *testing.T) {
+	w := NewRuleWrapper(&fakeRule{adapter: "DIRECT", match: matchHost("a.com")}).(*RuleWrapper)
+	w.Match(&C.Metadata{Host: "b.com"}, C.RuleMatchHelper{})
+	if first := w.FirstHitAt(); !first.IsZero() {
+		t.Fatalf("first hit reported before any hit: %v", first)
+	}
+
+	w.Match(&C.Metadata{Host: "a.com"}, C.RuleMatchHelper{})
+	first := w.FirstHitAt()
+	if first.IsZero() || !first.Equal(w.HitAt()) {
+		t.Fatalf("first hit %v, want the hit at %v", first, w.HitAt())
+	}
+	for i := 0; i < 3; i++ {
+		previous := w.HitAt()
+		time.Sleep(2 * time.Millisecond)
+		w.Hit()
+		if !w.HitAt().After(previous) {
+			t.Fatalf("hitAt %v didn't advance past %v", w.HitAt(), previous)
+		}
+		if !w.FirstHitAt().Equal(first) {
+			t.Fatalf("first hit moved from %v to %v", first, w.FirstHitAt())
+		}
+	}
+	if stats := w.Snapshot(); !stats.FirstHitAt.Equal(first) || !stats.FirstHitAt.Before(stats.HitAt) {
+		t.Fatalf("unexpected snapshot: %+v", stats)
+	}
+
+	var stats struct {
+		FirstHitAt *time.Time `json:"firstHitAt"`
+	}
+	data, _ := json.Marshal(w)
+	if err := json.Unmarshal(data, &stats); err != nil || stats.FirstHitAt == nil || !stats.FirstHitAt.Equal(first) {
+		t.Fatalf("unexpected JSON: %s %v", data, err)
+	}
+	if clone := w.Clone(); !clone.FirstHitAt().Equal(first) {
+		t.Fatalf("clone first hit %v, want %v", clone.FirstHitAt(), first)
+	}
+
+	w.ResetStats()
+	if !w.FirstHitAt().IsZero() {
+		t.Fatalf("first hit survived ResetStats")
+	}
+	stats.FirstHitAt = nil
+	data, _ = json.Marshal(w)
+	if err := json.Unmarshal(data, &stats); err != nil || stats.FirstHitAt != nil {
+		t.Fatalf("firstHitAt of a rule without hits in JSON: %s %v", data, err)
+	}
+}
+
+func TestRuleWrapperSnapshotCoherent(t *testing.T) {
+	rule := &fakeRule{adapter: "DIRECT", match: matchHost("a.com")}
+	w := NewRuleWrapper(rule).(*RuleWrapper)
+	if stats := w.Snapshot(); stats != (RuleStats{}) {
+		t.Fatalf("unexpected fresh snapshot: %+v", stats)
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			metadata := &C.Metadata{Host: "a.com"}
+			if i%2 == 1 {
+				metadata.Host = "b.com"
+			}
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					w.Match(metadata, C.RuleMatchHelper{})
+				}
+			}
+		}(i)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				w.ResetStats()
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}()
+
+	for i := 0; i < 20000; i++ {
+		stats := w.Snapshot()
+		if (stats.HitCount == 0) != stats.HitAt.IsZero() || (stats.MissCount == 0) != stats.MissAt.IsZero() {
+			close(done)
+			wg.Wait()
+			t.Fatalf("contradictory snapshot: %+v", stats)
+		}
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestRuleWrapperMatchLatency(t *testing.T) {
+	rule := &fakeRule{adapter: "DIRECT", match: matchHost("a.com"), delay: 2 * time.Millisecond}
+	w := NewRuleWrapper(rule).(*RuleWrapper)
+	metadata := &C.Metadata{Host: "a.com"}
+
+	w.Match(metadata, C.RuleMatchHelper{})
+	if w.AvgMatchLatency() != 0 || w.MaxMatchLatency() != 0 {
+		t.Fatalf("latency measured while tracking is disabled")
+	}
+
+	SetLatencyTracking(true)
+	t.Cleanup(func() { SetLatencyTracking(false) })
+	for i := 0; i < 30; i++ {
+		w.Match(metadata, C.RuleMatchHelper{})
+	}
+	if avg := w.AvgMatchLatency(); avg < rule.delay || avg > 10*rule.delay {
+		t.Fatalf("average latency %v doesn't converge to %v", avg, rule.delay)
+	}
+
+	// a single spike raises the maximum but barely moves the average
+	rule.delay = 40 * time.Millisecond
+	w.Match(metadata, C.RuleMatchHelper{})
+	if max := w.MaxMatchLatency(); max < rule.delay {
+		t.Fatalf("max latency %v below the spike", max)
+	}
+	if avg := w.AvgMatchLatency(); avg >= rule.delay/2 {
+		t.Fatalf("average latency %v follows the spike", avg)
+	}
+}
+
+func TestRuleWrapperIsDisabledSkipsClock(t *testing.T) {
+	clock := useFakeClock(t)
+	reads := 0
+	timeNow = func() time.Time {
+		reads++
+		return clock.now
+	}
+	w := NewRuleWrapper(&fakeRule{adapter: "DIRECT", match: matchHost("a.com")}).(*RuleWrapper)
+	w.Match(&C.Metadata{Host: "b.com"}, C.RuleMatchHelper{})
+	if w.IsDisabled() || w.DisabledReason() != "" || reads != 0 {
+		t.Fatalf("expected a rule without window nor schedule not to read the clock, read it %d times", reads)
+	}
+	w.DisableFor(time.Minute)
+	if !w.IsDisabled() || w.DisabledReason() != DisabledReasonTemporary || reads == 0 {
+		t.Fatalf("expected DisableFor to be checked against the clock, read it %d times", reads)
+	}
+}
+
+func TestRuleWrapperDisableFor(t *testing.T) {
+	clock := useFakeClock(t)
+	rule := &fakeRule{adapter: "DIRECT", match: matchHost("a.com")}
+	w := NewRuleWrapper(rule).(*RuleWrapper)
+	metadata := &C.Metadata{Host: "a.com"}
+
+	w.DisableFor(10 * time.Minute)
+	if ok, _ := w.Match(metadata, C.RuleMatchHelper{}); ok || !w.IsDisabled() {
+		t.Fatalf("expected the rule to be disabled")
+	}
+	if until := w.DisabledUntil(); !until.Equal(clock.now.Add(10 * time.Minute)) {
+		t.Fatalf("disabled until %v", until)
+	}
+
+	// calling it again restarts the window
+	clock.Advance(9 * time.Minute)
+	w.DisableFor(10 * time.Minute)
+	clock.Advance(9 * time.Minute)
+	if !w.IsDisabled() {
+		t.Fatalf("expected the extended window to be in progress")
+	}
+	clock.Advance(time.Minute)
+	if w.IsDisabled() || !w.DisabledUntil().IsZero() {
+		t.Fatalf("expected the rule to re-enable after the window")
+	}
+	if ok, _ := w.Match(metadata, C.RuleMatchHelper{}); !ok {
+		t.Fatalf("expected a re-enabled rule to match")
+	}
+
+	// enabling cancels the window, a permanent disable outlasts it
+	w.DisableFor(time.Hour)
+	w.SetDisabled(false)
+	if w.IsDisabled() {
+		t.Fatalf("expected SetDisabled(false) to cancel DisableFor")
+	}
+	w.DisableFor(time.Minute)
+	w.SetDisabled(true)
+	clock.Advance(time.Hour)
+	if !w.IsDisabled() {
+		t.Fatalf("expected the permanent disable to remain")
+	}
+}
+
+func TestRuleWrapperDisabledReason(t *testing.T) {
+	clock := useFakeClock(t)
+	w := NewRuleWrapper(&fakeRule{adapter: "DIRECT", match: matchHost("a.com")}).(*RuleWrapper)
+	if reason := w.DisabledReason(); reason != "" {
+		t.Fatalf("unexpected reason of an enabled rule: %q", reason)
+	}
+
+	w.SetDisabled(true)
+	if reason := w.DisabledReason(); reason != DisabledReasonManual {
+		t.Fatalf("expected %q, got %q", DisabledReasonManual, reason)
+	}
+	w.SetDisabledReason("flapping upstream")
+	if !w.IsDisabled() || w.DisabledReason() != "flapping upstream" {
+		t.Fatalf("expected the custom reason, got %q", w.DisabledReason())
+	}
+	stats := w.Snapshot()
+	if !stats.Disabled || stats.DisabledReason != "flapping upstream" {
+		t.Fatalf("unexpected snapshot: %+v", stats)
+	}
+	data, err := json.Marshal(w)
+	if err != nil || string(data) != `{"hitCount":0,"missCount":0,"disabled":true,"disabledReason":"flapping upstream"}` {
+		t.Fatalf("unexpected JSON of disabled stats: %s %v", data, err)
+	}
+
+	w.SetDisabled(false)
+	if reason := w.DisabledReason(); reason != "" {
+		t.Fatalf("expected enabling to clear the reason, got %q", reason)
+	}
+	w.DisableFor(time.Minute)
+	if reason := w.DisabledReason(); reason != DisabledReasonTemporary {
+		t.Fatalf("expected %q, got %q", DisabledReasonTemporary, reason)
+	}
+	clock.Advance(time.Minute)
+	if stats := w.Snapshot(); stats.Disabled || stats.DisabledReason != "" {
+		t.Fatalf("expected the reason to expire with the window: %+v", stats)
+	}
+}
+
+func TestRuleWrapperSchedule(t *testing.T) {
+	clock := useFakeClock(t) // Monday 12:00 UTC
+	w := NewRuleWrapper(&fakeRule{adapter: "REJECT", match: matchHost("a.com")}).(*RuleWrapper)
+	metadata := &C.Metadata{Host: "a.com"}
+
+	workdays := []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday}
+	if err := w.SetSchedule([]TimeWindow{{Days: workdays, Start: 9 * time.Hour, End: 18 * time.Hour, Location: time.UTC}}); err != nil {
+		t.Fatalf("set schedule: %v", err)
+	}
+	if ok, _ := w.Match(metadata, C.RuleMatchHelper{}); !ok || w.IsDisabled() {
+		t.Fatalf("expected the rule to be active within the window")
+	}
+	clock.Advance(6 * time.Hour)
+	if ok, _ := w.Match(metadata, C.RuleMatchHelper{}); ok || w.DisabledReason() != DisabledReasonSchedule {
+		t.Fatalf("expected the rule to be inactive after the window, reason %q", w.DisabledReason())
+	}
+	clock.now = time.Date(2024, 1, 6, 12, 0, 0, 0, time.UTC) // Saturday
+	if !w.IsDisabled() {
+		t.Fatalf("expected the rule to be inactive on a day without window")
+	}
+
+	// the window is evaluated in its location, 09:00-18:00 in UTC+8 is 01:00-10:00 UTC
+	east := time.FixedZone("UTC+8", 8*60*60)
+	if err := w.SetSchedule([]TimeWindow{{Start: 9 * time.Hour, End: 18 * time.Hour, Location: east}}); err != nil {
+		t.Fatalf("set schedule: %v", err)
+	}
+	clock.now = time.Date(2024, 1, 1, 1, 30, 0, 0, time.UTC)
+	if w.IsDisabled() {
+		t.Fatalf("expected the rule to be active in the window of its location")
+	}
+	clock.now = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	if !w.IsDisabled() {
+		t.Fatalf("expected the rule to be inactive outside the window of its location")
+	}
+
+	if err := w.SetSchedule(nil); err != nil || w.IsDisabled() || w.Schedule() != nil {
+		t.Fatalf("expected removing the schedule to restore the rule: %v", err)
+	}
+	if err := w.SetSchedule([]TimeWindow{{Start: 25 * time.Hour}}); err == nil || w.Schedule() != nil {
+		t.Fatalf("expected an out of range window to be rejected")
+	}
+}
+
+func TestRuleWrapperScheduleMidnightWrap(t *testing.T) {
+	clock := useFakeClock(t)
+	w := NewRuleWrapper(&fakeRule{adapter: "REJECT", match: matchHost("a.com")}).(*RuleWrapper)
+	// Friday 22:00 until Saturday 06:00
+	if err := w.SetSchedule([]TimeWindow{{Days: []time.Weekday{time.Friday}, Start: 22 * time.Hour, End: 6 * time.Hour, Location: time.UTC}}); err != nil {
+		t.Fatalf("set schedule: %v", err)
+	}
+
+	for _, tc := range []struct {
+		now    time.Time
+		active bool
+	}{
+		{time.Date(2024, 1, 5, 21, 59, 0, 0, time.UTC), false},
+		{time.Date(2024, 1, 5, 22, 0, 0, 0, time.UTC), true},
+		{time.Date(2024, 1, 5, 23, 59, 0, 0, time.UTC), true},
+		{time.Date(2024, 1, 6, 0, 0, 0, 0, time.UTC), true},
+		{time.Date(2024, 1, 6, 5, 59, 0, 0, time.UTC), true},
+		{time.Date(2024, 1, 6, 6, 0, 0, 0, time.UTC), false},
+		{time.Date(2024, 1, 6, 22, 30, 0, 0, time.UTC), false},
+		// the tail after midnight belongs to the start day only
+		{time.Date(2024, 1, 5, 3, 0, 0, 0, time.UTC), false},
+	} {
+		clock.now = tc.now
+		if active := !w.IsDisabled(); active != tc.active {
+			t.Fatalf("active at %v = %v, want %v", tc.now, active, tc.active)
+		}
+	}
+}
+
+func TestRuleWrapperHitRate(t *testing.T) {
+	rule := &fakeRule{adapter: "DIRECT", match: matchHost("a.com")}
+	w := NewRuleWrapper(rule).(*RuleWrapper)
+	if w.TotalMatches() != 0 || w.HitRate() != 0 {
+		t.Fatalf("unexpected fresh stats: total=%d rate=%v", w.TotalMatches(), w.HitRate())
+	}
+
+	for _, host := range []string{"a.com", "b.com", "b.com", "a.com", "c.com"} {
+		w.Match(&C.Metadata{Host: host}, C.RuleMatchHelper{})
+	}
+	if w.TotalMatches() != 5 || w.HitRate() != 0.4 {
+		t.Fatalf("unexpected stats: total=%d rate=%v", w.TotalMatches(), w.HitRate())
+	}
+}
+
+func TestRuleWrapperHitThreshold(t *testing.T) {
+	w := NewRuleWrapper(&fakeRule{adapter: "DIRECT", match: matchHost("a.com")}).(*RuleWrapper)
+	var fired atomic.Int64
+	w.SetHitThreshold(100, func(rw *RuleWrapper) {
+		if rw != w || rw.HitCount() < 100 {
+			t.Errorf("unexpected callback of %p at %d hits", rw, rw.HitCount())
+		}
+		fired.Add(1)
+	})
+
+	const workers, matches = 16, 50
+	metadata := &C.Metadata{Host: "a.com"}
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < matches; j++ {
+				w.Match(metadata, C.RuleMatchHelper{})
+			}
+		}()
+	}
+	wg.Wait()
+	if n := fired.Load(); n != 1 {
+		t.Fatalf("threshold fired %d times, want once", n)
+	}
+
+	// misses don't count, resetting re-arms it
+	w.Match(&C.Metadata{Host: "b.com"}, C.RuleMatchHelper{})
+	w.ResetStats()
+	for i := 0; i < 99; i++ {
+		w.Match(metadata, C.RuleMatchHelper{})
+	}
+	if n := fired.Load(); n != 1 {
+		t.Fatalf("threshold fired below it after reset: %d", n)
+	}
+	w.Match(metadata, C.RuleMatchHelper{})
+	if n := fired.Load(); n != 2 {
+		t.Fatalf("expected the reset threshold to fire again, fired %d times", n)
+	}
+
+	// a threshold already crossed when set doesn't fire, removing it stops the callback
+	w.SetHitThreshold(10, func(*RuleWrapper) { fired.Add(1) })
+	w.Match(metadata, C.RuleMatchHelper{})
+	w.SetHitThreshold(0, nil)
+	w.ResetStats()
+	w.Match(metadata, C.RuleMatchHelper{})
+	if n := fired.Load(); n != 2 {
+		t.Fatalf("unexpected callbacks: %d", n)
+	}
+}
+
+func TestRuleWrapperTags(t *testing.T) {
+	w := NewRuleWrapper(&fakeRule{adapter: "REJECT", match: matchHost("ads.com")}).(*RuleWrapper)
+	if tags := w.Tags(); tags != nil {
+		t.Fatalf("unexpected tags of a fresh wrapper: %v", tags)
+	}
+
+	tags := []string{"ads", "", "experiment-A", "ads"}
+	w.SetTags(tags...)
+	tags[0] = "mutated"
+	got := w.Tags()
+	if len(got) != 2 || got[0] != "ads" || got[1] != "experiment-A" {
+		t.Fatalf("unexpected tags: %v", got)
+	}
+	got[0] = "mutated"
+	if !w.HasTag("ads") || w.HasTag("mutated") {
+		t.Fatalf("tags were mutated through a copy: %v", w.Tags())
+	}
+
+	w.SetTags()
+	if w.Tags() != nil || w.HasTag("ads") {
+		t.Fatalf("expected SetTags() to clear the tags")
+	}
+}
+
+func TestStatsByTag(t *testing.T) {
+	ads := NewRuleWrapper(&fakeRule{adapter: "REJECT", match: matchHost("ads.com")}).(*RuleWrapper)
+	ads.SetTags("ads")
+	tracker := NewRuleWrapper(&fakeRule{adapter: "REJECT", match: matchHost("tracker.com")}).(*RuleWrapper)
+	tracker.SetTags("ads", "experiment-A")
+	video := NewRuleWrapper(&fakeRule{adapter: "PROXY", match: matchHost("video.com")}).(*RuleWrapper)
+	video.SetTags("streaming")
+	untagged := NewRuleWrapper(&fakeRule{adapter: "DIRECT", match: matchHost("a.com")}).(*RuleWrapper)
+	rules := []*RuleWrapper{ads, tracker, video, untagged}
+
+	for _, host := range []string{"ads.com", "ads.com", "tracker.com", "video.com", "a.com"} {
+		metadata := &C.Metadata{Host: host}
+		for _, r := range rules {
+			if ok, _ := r.Match(metadata, C.RuleMatchHelper{}); ok {
+				break
+			}
+		}
+	}
+
+	stats := StatsByTag(rules)
+	if len(stats) != 3 {
+		t.Fatalf("unexpected tags: %v", stats)
+	}
+	// rules after a match aren't evaluated, so tracker only misses video.com and a.com
+	if s := stats["ads"]; s != (TagStats{Rules: 2, HitCount: 3, MissCount: 5}) {
+		t.Fatalf("unexpected ads stats: %+v", s)
+	}
+	if s := stats["experiment-A"]; s != (TagStats{Rules: 1, HitCount: 1, MissCount: 2}) {
+		t.Fatalf("unexpected experiment-A stats: %+v", s)
+	}
+	if s := stats["streaming"]; s != (TagStats{Rules: 1, HitCount: 1, MissCount: 1}) {
+		t.Fatalf("unexpected streaming stats: %+v", s)
+	}
+	if tagged := WithTag(rules, "ads"); len(tagged) != 2 || tagged[0] != ads || tagged[1] != tracker {
+		t.Fatalf("unexpected rules tagged ads: %v", tagged)
+	}
+}
+
+func TestRuleWrapperClone(t *testing.T) {
+	SetLastMatchCapture(true)
+	t.Cleanup(func() { SetLastMatchCapture(false) })
+	rule := &fakeRule{adapter: "DIRECT", match: matchHost("a.com")}
+	w := NewRuleWrapper(rule).(*RuleWrapper)
+	w.SetTags("ads")
+	for _, host := range []string{"a.com", "a.com", "b.com"} {
+		w.Match(&C.Metadata{Host: host}, C.RuleMatchHelper{})
+	}
+	w.SetDisabledReason("maintenance")
+
+	clone := w.Clone()
+	if clone.Unwrap() != rule || clone == w {
+		t.Fatalf("expected a new wrapper of the same rule")
+	}
+	want := w.Snapshot()
+	if got := clone.Snapshot(); got != want {
+		t.Fatalf("clone stats %+v, want %+v", got, want)
+	}
+	if _, ok := clone.LastMatched(); !ok || !clone.HasTag("ads") {
+		t.Fatalf("expected the last match and tags to be copied")
+	}
+
+	w.SetDisabled(false)
+	w.SetTags("streaming")
+	w.Match(&C.Metadata{Host: "a.com"}, C.RuleMatchHelper{})
+	w.ResetStats()
+	w.Match(&C.Metadata{Host: "b.com"}, C.RuleMatchHelper{})
+	if got := clone.Snapshot(); got != want || !clone.HasTag("ads") || clone.HasTag("streaming") {
+		t.Fatalf("clone changed with the original: %+v %v", got, clone.Tags())
+	}
+
+	clone.SetDisabled(false)
+	clone.Match(&C.Metadata{Host: "a.com"}, C.RuleMatchHelper{})
+	if clone.HitCount() != 3 || w.HitCount() != 0 {
+		t.Fatalf("original changed with the clone: clone=%d original=%d", clone.HitCount(), w.HitCount())
+	}
+}
+
+func TestRuleWrapperHitWindow(t *testing.T) {
+	clock := useFakeClock(t)
+	w := NewRuleWrapper(&fakeRule{adapter: "DIRECT", match: matchHost("a.com")}).(*RuleWrapper)
+	metadata := &C.Metadata{Host: "a.com"}
+	w.Match(metadata, C.RuleMatchHelper{})
+	if w.HitsInLastMinute() != 0 {
+		t.Fatalf("expected no windowed hits without SetHitWindow")
+	}
+
+	w.SetHitWindow(true)
+	// 1 hit per second for 90 seconds, plus a miss that doesn't count
+	for i := 0; i < 90; i++ {
+		w.Match(metadata, C.RuleMatchHelper{})
+		if i < 59 {
+			if hits := w.HitsInLastMinute(); hits != uint64(i+1) {
+				t.Fatalf("%d hits in the window after %d seconds", hits, i)
+			}
+		}
+		clock.Advance(time.Second)
+	}
+	w.Match(&C.Metadata{Host: "b.com"}, C.RuleMatchHelper{})
+	clock.Advance(-time.Second)
+	if hits := w.HitsInLastMinute(); hits != 60 {
+		t.Fatalf("expected the window to hold the last 60 hits, got %d", hits)
+	}
+	if rate := w.RecentHitsPerSecond(); rate != 1 {
+		t.Fatalf("unexpected rate %v", rate)
+	}
+	if w.HitCount() != 91 {
+		t.Fatalf("expected the cumulative counter intact, got %d", w.HitCount())
+	}
+
+	// buckets expire one by one across their boundaries
+	clock.Advance(30 * time.Second)
+	if hits := w.HitsInLastMinute(); hits != 30 {
+		t.Fatalf("expected 30 hits after half a window, got %d", hits)
+	}
+	for i := 0; i < 5; i++ {
+		w.Match(metadata, C.RuleMatchHelper{})
+	}
+	if hits := w.HitsInLastMinute(); hits != 35 {
+		t.Fatalf("expected the hits of the current second to add up, got %d", hits)
+	}
+	clock.Advance(time.Minute)
+	if hits := w.HitsInLastMinute(); hits != 0 {
+		t.Fatalf("expected an idle minute to empty the window, got %d", hits)
+	}
+
+	w.Match(metadata, C.RuleMatchHelper{})
+	w.ResetStats()
+	if hits := w.HitsInLastMinute(); hits != 0 {
+		t.Fatalf("expected ResetStats to empty the window, got %d", hits)
+	}
+}
+
+func TestRuleWrapperHitWindowConcurrent(t *testing.T) {
+	w := NewRuleWrapper(&fakeRule{adapter: "DIRECT", match: matchHost("a.com")}).(*RuleWrapper)
+	w.SetHitWindow(true)
+	const workers, matches = 8, 1000
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < matches; j++ {
+				w.Match(&C.Metadata{Host: "a.com"}, C.RuleMatchHelper{})
+			}
+		}()
+	}
+	wg.Wait()
+	if hits := w.HitsInLastMinute(); hits != workers*matches {
+		t.Fatalf("lost windowed hits: %d", hits)
+	}
+}
+
+func TestRuleWrapperMissStreak(t *testing.T) {
+	w := NewRuleWrapper(&fakeRule{adapter: "DIRECT", match: matchHost("a.com")}).(*RuleWrapper)
+	for i, tc := range []struct {
+		host   string
+		streak uint64
+	}{
+		{"b.com", 1},
+		{"b.com", 2},
+		{"a.com", 0},
+		{"b.com", 1},
+		{"a.com", 0},
+		{"a.com", 0},
+		{"b.com", 1},
+		{"b.com", 2},
+		{"b.com", 3},
+	} {
+		w.Match(&C.Metadata{Host: tc.host}, C.RuleMatchHelper{})
+		if streak := w.MissStreak(); streak != tc.streak {
+			t.Fatalf("match %d of %s: streak %d, want %d", i, tc.host, streak, tc.streak)
+		}
+	}
+
+	// evaluations skipped while disabled don't count
+	w.SetDisabled(true)
+	w.Match(&C.Metadata{Host: "b.com"}, C.RuleMatchHelper{})
+	if streak := w.MissStreak(); streak != 3 {
+		t.Fatalf("disabled rule changed the streak: %d", streak)
+	}
+	w.ResetStats()
+	if streak := w.MissStreak(); streak != 0 {
+		t.Fatalf("expected ResetStats to clear the streak, got %d", streak)
+	}
+}
+
+// contextRule is a fakeRule whose delay can be interrupted by the context of MatchContext
+type contextRule struct {
+	fakeRule
+}
+
+func (r *contextRule) MatchContext(ctx context.Context, metadata *C.Metadata, helper C.RuleMatchHelper) (bool, string, error) {
+	r.calls.Add(1)
+	select {
+	case <-time.After(r.delay):
+	case <-ctx.Done():
+		return false, "", ctx.Err()
+	}
+	if r.match != nil && r.match(metadata) {
+		return true, r.adapter, nil
+	}
+	return false, "", nil
+}
+
+func TestRuleWrapperMatchContext(t *testing.T) {
+	rule := &contextRule{fakeRule{adapter: "PROXY", match: matchHost("a.com"), delay: time.Hour}}
+	w := NewRuleWrapper(rule).(*RuleWrapper)
+	metadata := &C.Metadata{Host: "a.com"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	ok, _, err := w.MatchContext(ctx, metadata, C.RuleMatchHelper{})
+	if !errors.Is(err, context.DeadlineExceeded) || ok {
+		t.Fatalf("expected the deadline to interrupt the match, got %v %v", ok, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("cancelled match returned after %v", elapsed)
+	}
+	if w.HitCount() != 0 || w.MissCount() != 0 {
+		t.Fatalf("cancelled match was counted: hit=%d miss=%d", w.HitCount(), w.MissCount())
+	}
+
+	// already cancelled contexts don't evaluate the rule
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := w.MatchContext(cancelled, metadata, C.RuleMatchHelper{}); !errors.Is(err, context.Canceled) || rule.calls.Load() != 1 {
+		t.Fatalf("unexpected result of a cancelled context: %v, %d calls", err, rule.calls.Load())
+	}
+
+	// completed evaluations are accounted through the middlewares
+	rule.delay = 0
+	w.SetEvalBudget(2)
+	for _, host := range []string{"a.com", "b.com", "a.com"} {
+		if _, _, err := w.MatchContext(context.Background(), &C.Metadata{Host: host}, C.RuleMatchHelper{}); err != nil {
+			t.Fatalf("match %s: %v", host, err)
+		}
+	}
+	if w.HitCount() != 1 || w.MissCount() != 2 || w.SkippedCount() != 1 || rule.calls.Load() != 3 {
+		t.Fatalf("unexpected counters: hit=%d miss=%d skipped=%d calls=%d", w.HitCount(), w.MissCount(), w.SkippedCount(), rule.calls.Load())
+	}
+}
+
+func TestRuleWrapperMatchContextFallback(t *testing.T) {
+	rule := &fakeRule{adapter: "DIRECT", match: matchHost("a.com"), delay: 10 * time.Millisecond}
+	w := NewRuleWrapper(rule).(*RuleWrapper)
+	ok, adapter, err := w.MatchContext(context.Background(), &C.Metadata{Host: "a.com"}, C.RuleMatchHelper{})
+	if err != nil || !ok || adapter != "DIRECT" || w.HitCount() != 1 {
+		t.Fatalf("unexpected fallback result: %v %s %v", ok, adapter, err)
+	}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := w.MatchContext(cancelled, &C.Metadata{Host: "a.com"}, C.RuleMatchHelper{}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected a cancelled context to be reported, got %v", err)
+	}
+	if rule.calls.Load() != 1 || w.HitCount() != 1 {
+		t.Fatalf("cancelled context evaluated the blocking rule")
+	}
+}
+
+func TestRuleWrapperCallbacks(t *testing.T) {
+	rule := &fakeRule{adapter: "DIRECT", match: matchHost("a.com")}
+	w := NewRuleWrapper(rule).(*RuleWrapper)
+
+	// no callback set is a no-op
+	w.Match(&C.Metadata{Host: "a.com"}, C.RuleMatchHelper{})
+
+	var hits, misses []string
+	w.SetOnHit(func(metadata *C.Metadata) {
+		if w.HitCount() != uint64(len(hits))+2 {
+			t.Errorf("callback ran before the hit was counted")
+		}
+		hits = append(hits, metadata.Host)
+	})
+	w.SetOnMiss(func(metadata *C.Metadata) {
+		// no internal lock is held, so the callback may use the wrapper freely
+		if w.Snapshot().MissCount != uint64(len(misses))+1 {
+			t.Errorf("callback ran before the miss was counted")
+		}
+		misses = append(misses, metadata.Host)
+	})
+	for _, host := range []string{"a.com", "b.com", "c.com"} {
+		w.Match(&C.Metadata{Host: host}, C.RuleMatchHelper{})
+	}
+	if len(hits) != 1 || hits[0] != "a.com" || len(misses) != 2 || misses[0] != "b.com" || misses[1] != "c.com" {
+		t.Fatalf("unexpected callbacks: hits=%v misses=%v", hits, misses)
+	}
+
+	w.SetOnHit(nil)
+	w.SetOnMiss(nil)
+	w.Match(&C.Metadata{Host: "a.com"}, C.RuleMatchHelper{})
+	w.Match(&C.Metadata{Host: "b.com"}, C.RuleMatchHelper{})
+	if len(hits) != 1 || len(misses) != 2 {
+		t.Fatalf("removed callbacks still called: hits=%v misses=%v", hits, misses)
+	}
+}
+
+func TestRuleWrapperLastMatched(t *testing.T) {
+	clock := useFakeClock(t)
+	rule := &fakeRule{adapter: "PROXY", match: matchHost("a.com")}
+	w := NewRuleWrapper(rule).(*RuleWrapper)
+	w.Match(&C.Metadata{Host: "a.com"}, C.RuleMatchHelper{})
+	if _, ok := w.LastMatched(); ok {
+		t.Fatalf("last match captured while capture is disabled by default")
+	}
+	SetLastMatchCapture(true)
+	t.Cleanup(func() { SetLastMatchCapture(false) })
+
+	w = NewRuleWrapper(rule).(*RuleWrapper)
+	w.Match(&C.Metadata{Host: "b.com"}, C.RuleMatchHelper{})
+	if _, ok := w.LastMatched(); ok {
+		t.Fatalf("miss captured as last match")
+	}
+
+	metadata := &C.Metadata{
+		NetWork: C.UDP,
+		Host:    "a.com",
+		DstIP:   netip.MustParseAddr("1.2.3.4"),
+		DstPort: 443,
+		Process: "curl",
+	}
+	w.Match(metadata, C.RuleMatchHelper{})
+	metadata.Host = "changed.com"
+	w.Match(&C.Metadata{Host: "b.com"}, C.RuleMatchHelper{})
+
+	info, ok := w.LastMatched()
+	want := MatchInfo{
+		Time:    clock.now,
+		Adapter: "PROXY",
+		Network: "udp",
+		Host:    "a.com",
+		DstIP:   netip.MustParseAddr("1.2.3.4"),
+		DstPort: 443,
+		Process: "curl",
+	}
+	if !ok || info != want {
+		t.Fatalf("unexpected last match: %+v %v", info, ok)
+	}
+
+	SetLastMatchCapture(false)
+	if _, ok := w.LastMatched(); ok {
+		t.Fatalf("last match reported while capture is disabled")
+	}
+}
+
+func TestRuleWrapperMatchAllocs(t *testing.T) {
+	w := NewRuleWrapper(&fakeRule{adapter: "PROXY", match: matchHost("a.com")}).(*RuleWrapper)
+	hit, miss := &C.Metadata{Host: "a.com"}, &C.Metadata{Host: "b.com"}
+	w.Match(hit, C.RuleMatchHelper{})
+	allocs := testing.AllocsPerRun(100, func() {
+		w.Match(hit, C.RuleMatchHelper{})
+		w.Match(miss, C.RuleMatchHelper{})
+	})
+	if allocs != 0 {
+		t.Fatalf("expected Match not to allocate by default, got %v allocs", allocs)
+	}
+}
+
+// routingRule is a logical rule routing each host to an adapter of its own
+type routingRule struct {
+	fakeRule
+	routes map[string]string
+}
+
+func (r *routingRule) Match(metadata *C.Metadata, helper C.RuleMatchHelper) (bool, string) {
+	adapter, ok := r.routes[metadata.Host]
+	return ok, adapter
+}
+
+func TestRuleWrapperAdapterHits(t *testing.T) {
+	rule := &routingRule{routes: map[string]string{"a.com": "PROXY", "b.com": "DIRECT", "c.com": "PROXY"}}
+	w := NewRuleWrapper(rule).(*RuleWrapper)
+	if hits := w.AdapterHits(); hits != nil {
+		t.Fatalf("unexpected hits before matching: %v", hits)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, host := range []string{"a.com", "b.com", "c.com", "unknown.com"} {
+				w.Match(&C.Metadata{Host: host}, C.RuleMatchHelper{})
+				_ = w.AdapterHits()
+			}
+		}()
+	}
+	wg.Wait()
+	w.Hit()
+
+	hits := w.AdapterHits()
+	if !reflect.DeepEqual(hits, map[string]uint64{"PROXY": 8, "DIRECT": 4}) {
+		t.Fatalf("unexpected adapter hits: %v", hits)
+	}
+	if w.HitCount() != 13 {
+		t.Fatalf("hit count = %d", w.HitCount())
+	}
+	hits["PROXY"] = 0
+	if w.AdapterHits()["PROXY"] != 8 {
+		t.Fatal("AdapterHits returned the internal map")
+	}
+	if clone := w.Clone(); !reflect.DeepEqual(clone.AdapterHits(), w.AdapterHits()) {
+		t.Fatalf("clone has adapter hits %v", clone.AdapterHits())
+	}
+
+	w.ResetStats()
+	if hits := w.AdapterHits(); hits != nil {
+		t.Fatalf("unexpected hits after reset: %v", hits)
+	}
+}
+
+func TestRuleWrapperString(t *testing.T) {
+	w := NewRuleWrapper(&fakeRule{ruleType: C.DomainSuffix, payload: "example.com", adapter: "PROXY", match: matchHost("example.com")}).(*RuleWrapper)
+	if got := w.String(); got != "DomainSuffix,example.com -> PROXY [hits=0 miss=0]" {
+		t.Fatalf("String() = %q", got)
+	}
+	for i := 0; i < 42; i++ {
+		w.Match(&C.Metadata{Host: "example.com"}, C.RuleMatchHelper{})
+	}
+	for i := 0; i < 3; i++ {
+		w.Match(&C.Metadata{Host: "other.com"}, C.RuleMatchHelper{})
+	}
+	w.SetDisabled(true)
+	if got := w.String(); got != "DomainSuffix,example.com -> PROXY [hits=42 miss=3 disabled]" {
+		t.Fatalf("String() = %q", got)
+	}
+
+	match := NewRuleWrapper(&fakeRule{ruleType: C.MATCH, adapter: "DIRECT"}).(*RuleWrapper)
+	if got := match.String(); got != "Match -> DIRECT [hits=0 miss=0]" {
+		t.Fatalf("String() = %q", got)
+	}
+}
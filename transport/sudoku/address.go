@@ -2,99 +2,212 @@ package sudoku
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"net/netip"
 	"strconv"
 	"strings"
 )
 
+// EncodeAddress encodes "host:port" in the SOCKS5 address format, IPv4-mapped IPv6 addresses
+// are encoded as IPv4 and decode back to the dotted-quad form.
+// The port may also name a UDP service, such as "domain".
 func EncodeAddress(rawAddr string) ([]byte, error) {
+	return appendAddress(nil, rawAddr)
+}
+
+// appendAddress is EncodeAddress appending to buf.
+func appendAddress(buf []byte, rawAddr string) ([]byte, error) {
 	host, portStr, err := net.SplitHostPort(rawAddr)
 	if err != nil {
 		return nil, err
 	}
 
-	portInt, err := strconv.ParseUint(portStr, 10, 16)
+	portInt, err := parsePort(portStr)
 	if err != nil {
 		return nil, err
 	}
 
-	var buf []byte
 	if i := strings.IndexByte(host, '%'); i >= 0 {
 		// Zone identifiers are not representable in SOCKS5 IPv6 address encoding.
 		host = host[:i]
 	}
-	if ip := net.ParseIP(host); ip != nil {
-		if ip4 := ip.To4(); ip4 != nil {
-			buf = append(buf, 0x01) // IPv4
-			buf = append(buf, ip4...)
-		} else {
-			buf = append(buf, 0x04) // IPv6
-			ip16 := ip.To16()
-			if ip16 == nil {
-				return nil, fmt.Errorf("invalid ipv6: %q", host)
-			}
-			buf = append(buf, ip16...)
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return appendIPAddress(buf, ip, portInt), nil
+	}
+	return appendDomainAddress(buf, host, portInt)
+}
+
+// parsePort parses a numeric port, only looking up names in the services database,
+// as nearly every port is numeric and encoded on the hot path of every datagram.
+func parsePort(port string) (uint16, error) {
+	if port == "" {
+		return 0, errors.New("missing port")
+	}
+	if isNumericPort(port) {
+		n, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			return 0, fmt.Errorf("invalid port %s, want 0-65535", port)
+		}
+		return uint16(n), nil
+	}
+	n, err := net.LookupPort("udp", port)
+	if err != nil {
+		return 0, err
+	}
+	return uint16(n), nil
+}
+
+// isNumericPort reports whether port looks like a number, signs included so "-1" is rejected
+// as out of range rather than looked up as a service name.
+func isNumericPort(port string) bool {
+	for i := 0; i < len(port); i++ {
+		if c := port[i]; (c < '0' || c > '9') && !(i == 0 && (c == '-' || c == '+')) {
+			return false
+		}
+	}
+	return true
+}
+
+// maxIPAddressLen is the encoded length of an IPv6 address, enough for every IP address
+const maxIPAddressLen = 1 + net.IPv6len + 2
+
+// minSOCKSAddressLen is the encoded length of an empty domain, the shortest address DecodeAddress accepts
+const minSOCKSAddressLen = 1 + 1 + 2
+
+// minAddressLen returns the shortest address section codec decodes, 1 for a codec of its own
+func minAddressLen(codec AddressCodec) int {
+	if _, ok := codec.(SOCKSAddressCodec); ok {
+		return minSOCKSAddressLen
+	}
+	return 1
+}
+
+// maxDomainAddressLen is the encoded length of a 255 byte domain, the longest address there is
+const maxDomainAddressLen = 1 + 1 + 255 + 2
+
+// appendNetAddr encodes *net.UDPAddr and *NamedAddr straight from their fields, to the same bytes
+// as EncodeAddress(addr.String()) without formatting and splitting the string.
+// ok is false for any other address, or one the fast path doesn't cover.
+func appendNetAddr(buf []byte, addr net.Addr) ([]byte, bool, error) {
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		ip, ok := netip.AddrFromSlice(addr.IP)
+		if !ok || addr.Port < 0 || addr.Port > 0xffff {
+			return buf, false, nil
+		}
+		return appendIPAddress(buf, ip, uint16(addr.Port)), true, nil
+	case *NamedAddr:
+		if strings.IndexByte(addr.Host, '%') >= 0 {
+			return buf, false, nil
 		}
+		if _, err := netip.ParseAddr(addr.Host); err == nil {
+			return buf, false, nil
+		}
+		buf, err := appendDomainAddress(buf, addr.Host, addr.Port)
+		return buf, true, err
+	default:
+		return buf, false, nil
+	}
+}
+
+func appendIPAddress(buf []byte, ip netip.Addr, port uint16) []byte {
+	// IPv4-mapped IPv6 always collapses to the IPv4 form, so the same address
+	// encodes to the same bytes however it was written.
+	if ip = ip.Unmap(); ip.Is4() {
+		ip4 := ip.As4()
+		buf = append(buf, 0x01) // IPv4
+		buf = append(buf, ip4[:]...)
 	} else {
-		if len(host) > 255 {
-			return nil, fmt.Errorf("domain too long")
+		ip16 := ip.As16()
+		buf = append(buf, 0x04) // IPv6
+		buf = append(buf, ip16[:]...)
+	}
+	return binary.BigEndian.AppendUint16(buf, port)
+}
+
+func appendDomainAddress(buf []byte, host string, port uint16) ([]byte, error) {
+	if len(host) > 255 {
+		return nil, fmt.Errorf("%w: domain of %d bytes", ErrAddressTooLong, len(host))
+	}
+	buf = append(buf, 0x03) // domain
+	buf = append(buf, byte(len(host)))
+	buf = append(buf, host...)
+	return binary.BigEndian.AppendUint16(buf, port), nil
+}
+
+// DecodeAddress decodes a SOCKS5 address from the start of b and returns it with the number of bytes consumed,
+// a b ending before the address does reports io.ErrUnexpectedEOF, or io.EOF when it is empty.
+// On error the int is the offset in b decoding failed at: 0 for the type byte, len(b) for a b too short.
+func DecodeAddress(b []byte) (string, int, error) {
+	if len(b) == 0 {
+		return "", 0, io.EOF
+	}
+	hostLen, err := addressHostLen(b[0], b[1:])
+	if err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return "", len(b), err
 		}
-		buf = append(buf, 0x03) // domain
-		buf = append(buf, byte(len(host)))
-		buf = append(buf, host...)
+		return "", 0, err
+	}
+	// type, host and port
+	consumed := 1 + hostLen + 2
+	if len(b) < consumed {
+		return "", len(b), io.ErrUnexpectedEOF
 	}
 
-	var portBytes [2]byte
-	binary.BigEndian.PutUint16(portBytes[:], uint16(portInt))
-	buf = append(buf, portBytes[:]...)
-	return buf, nil
+	var host string
+	port := binary.BigEndian.Uint16(b[1+hostLen : consumed])
+	switch b[0] {
+	case 0x01, 0x04: // IPv4, IPv6
+		// IPv4-mapped IPv6 prints in the dotted-quad form, like net.IP does,
+		// and netip formats the pair as net.JoinHostPort would in a single allocation
+		ip, _ := netip.AddrFromSlice(b[1 : 1+hostLen])
+		return netip.AddrPortFrom(ip.Unmap(), port).String(), consumed, nil
+	default: // domain
+		host = string(b[2 : 1+hostLen])
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), consumed, nil
 }
 
-func DecodeAddress(r io.Reader) (string, error) {
-	var atyp [1]byte
-	if _, err := io.ReadFull(r, atyp[:]); err != nil {
+// ReadAddress reads a single SOCKS5 address from r, see DecodeAddress.
+func ReadAddress(r io.Reader) (string, error) {
+	// type, domain length, 255 bytes of domain and port
+	var buf [maxDomainAddressLen]byte
+	if _, err := io.ReadFull(r, buf[:2]); err != nil {
 		return "", err
 	}
+	hostLen, err := addressHostLen(buf[0], buf[1:2])
+	if err != nil {
+		return "", err
+	}
+	consumed := 1 + hostLen + 2
+	if _, err := io.ReadFull(r, buf[2:consumed]); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	addr, _, err := DecodeAddress(buf[:consumed])
+	return addr, err
+}
 
-	switch atyp[0] {
+// addressHostLen returns the length of the host section following an address of type atyp,
+// rest holds what follows the type byte, of which only the domain length is needed.
+func addressHostLen(atyp byte, rest []byte) (int, error) {
+	switch atyp {
 	case 0x01: // IPv4
-		var ipBuf [net.IPv4len]byte
-		if _, err := io.ReadFull(r, ipBuf[:]); err != nil {
-			return "", err
-		}
-		var portBuf [2]byte
-		if _, err := io.ReadFull(r, portBuf[:]); err != nil {
-			return "", err
-		}
-		return net.JoinHostPort(net.IP(ipBuf[:]).String(), fmt.Sprint(binary.BigEndian.Uint16(portBuf[:]))), nil
+		return net.IPv4len, nil
 	case 0x04: // IPv6
-		var ipBuf [net.IPv6len]byte
-		if _, err := io.ReadFull(r, ipBuf[:]); err != nil {
-			return "", err
-		}
-		var portBuf [2]byte
-		if _, err := io.ReadFull(r, portBuf[:]); err != nil {
-			return "", err
-		}
-		return net.JoinHostPort(net.IP(ipBuf[:]).String(), fmt.Sprint(binary.BigEndian.Uint16(portBuf[:]))), nil
+		return net.IPv6len, nil
 	case 0x03: // domain
-		var lengthBuf [1]byte
-		if _, err := io.ReadFull(r, lengthBuf[:]); err != nil {
-			return "", err
-		}
-		l := int(lengthBuf[0])
-		hostBuf := make([]byte, l)
-		if _, err := io.ReadFull(r, hostBuf); err != nil {
-			return "", err
-		}
-		var portBuf [2]byte
-		if _, err := io.ReadFull(r, portBuf[:]); err != nil {
-			return "", err
+		if len(rest) == 0 {
+			return 0, io.ErrUnexpectedEOF
 		}
-		return net.JoinHostPort(string(hostBuf), fmt.Sprint(binary.BigEndian.Uint16(portBuf[:]))), nil
+		return 1 + int(rest[0]), nil
 	default:
-		return "", fmt.Errorf("unknown address type: %d", atyp[0])
+		return 0, fmt.Errorf("%w: %d", ErrUnknownAddressType, atyp)
 	}
 }
@@ -1,161 +1,845 @@
 package sudoku
 
 import (
-	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/netip"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/metacubex/mihomo/common/lru"
+	"github.com/metacubex/mihomo/common/pool"
 	"github.com/metacubex/mihomo/log"
 )
 
 const (
-	maxUoTPayload = 64 * 1024
+	// UoTMagicByte leads the preface unless another magic is configured, see WritePrefaceWithMagic
+	UoTMagicByte byte = 0xEE
+
+	// UoTVersion1 is the original framing, its peers never answer the preface
+	UoTVersion1 byte = 0x01
+	// UoTVersion2 adds fragment control frames for datagrams above the frame size, see EnableFragmentation
+	UoTVersion2 byte = 0x02
+	// UoTVersion3 adds a flags byte to datagram frames for per-frame options, see SetPadding
+	UoTVersion3 byte = 0x03
+	// UoTVersion4 prefixes frames with a session id and is only spoken by UoTMux
+	UoTVersion4 byte = 0x04
+	// uotVersion is the version written by WritePreface and accepted by ReadPreface
+	uotVersion = UoTVersion1
+
+	uotHeaderLen = 4
+	// maxUoTPayload is the largest length the 16-bit frame fields can carry
+	maxUoTPayload = 1<<16 - 1
 )
 
+var ErrPrefaceTimeout = errors.New("uot preface write timed out")
+
+// WritePreface writes the UDP-over-TCP marker and version.
+func WritePreface(w io.Writer) error {
+	return WritePrefaceWithMagic(w, UoTMagicByte)
+}
+
+// WritePrefaceWithMagic is WritePreface with magic leading the preface instead of UoTMagicByte,
+// so tunnel variants sharing a port can tell each other apart. The peer must expect the same magic.
+func WritePrefaceWithMagic(w io.Writer, magic byte) error {
+	return writePreface(w, magic, uotVersion, nil)
+}
+
+// ReadPreface consumes the preface written by WritePreface and returns the peer's version.
+// A wrong marker reports ErrBadMagic, a version other than uotVersion reports ErrUnsupportedVersion,
+// and a stream ending early reports io.ErrUnexpectedEOF (or io.EOF when nothing was read).
+func ReadPreface(r io.Reader) (byte, error) {
+	return ReadPrefaceWithMagic(r, UoTMagicByte)
+}
+
+// ReadPrefaceWithMagic is ReadPreface expecting magic instead of UoTMagicByte, any other leading byte
+// reports ErrBadMagic. The version is checked just as strictly.
+func ReadPrefaceWithMagic(r io.Reader, magic byte) (byte, error) {
+	return acceptVersion(r, nil, magic, []byte{uotVersion}, nil)
+}
+
+// WritePrefaceContext writes the preface like WritePreface, but gives up once ctx is done,
+// so a stalled or half-open conn can't hang the client forever.
+// A timed-out or canceled write returns an error wrapping both ErrPrefaceTimeout and ctx.Err().
+func WritePrefaceContext(ctx context.Context, conn net.Conn) error {
+	var deadline uotDeadline
+	err := deadline.run(ctx, conn.SetWriteDeadline, func() error {
+		return WritePreface(conn)
+	})
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return fmt.Errorf("%w: %w", ErrPrefaceTimeout, err)
+	}
+	return err
+}
+
 // WriteDatagram sends a single UDP datagram frame over a reliable stream.
+// payload may be empty, zero-length datagrams are valid and framed like any other.
 func WriteDatagram(w io.Writer, addr string, payload []byte) error {
-	addrBuf, err := EncodeAddress(addr)
+	return WriteDatagramWithLimit(w, addr, payload, maxUoTPayload)
+}
+
+// WriteDatagramWithLimit is WriteDatagram with payloads capped at maxPayload bytes instead of 65535.
+func WriteDatagramWithLimit(w io.Writer, addr string, payload []byte, maxPayload int) error {
+	if err := validatePayloadLimit(maxPayload); err != nil {
+		return err
+	}
+	_, err := writeDatagram(w, defaultAddressCodec, maxPayload, addr, payload)
+	return err
+}
+
+// WriteDatagramFrom is WriteDatagram for a payload of payloadLen bytes read from src, for callers holding it
+// in a reader rather than a slice. The header and address go out first and the payload is streamed with
+// io.CopyN, so nothing is written for an invalid payloadLen or address. A src yielding fewer than payloadLen
+// bytes fails with io.ErrUnexpectedEOF after the header is written, which leaves a truncated frame on w:
+// the stream is unusable from then on and should be closed. The bytes of src past the payload are left unread.
+func WriteDatagramFrom(w io.Writer, addr string, payloadLen int, src io.Reader) error {
+	if payloadLen < 0 {
+		return fmt.Errorf("%w: %d", ErrInvalidPayloadLength, payloadLen)
+	}
+	if payloadLen > maxUoTPayload {
+		return fmt.Errorf("%w: %d", ErrPayloadTooLarge, payloadLen)
+	}
+	addrBuf, err := encodeFrameAddress(defaultAddressCodec, maxUoTPayload, addr, nil)
 	if err != nil {
-		return fmt.Errorf("encode address: %w", err)
+		return err
 	}
 
-	if addrLen := len(addrBuf); addrLen == 0 || addrLen > maxUoTPayload {
-		return fmt.Errorf("address too long: %d", len(addrBuf))
+	head := pool.Get(uotHeaderLen + len(addrBuf))
+	defer pool.Put(head)
+	binary.BigEndian.PutUint16(head[:2], uint16(len(addrBuf)))
+	binary.BigEndian.PutUint16(head[2:4], uint16(payloadLen))
+	copy(head[uotHeaderLen:], addrBuf)
+	if _, err := w.Write(head); err != nil {
+		return err
+	}
+	if n, err := io.CopyN(w, src, int64(payloadLen)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return fmt.Errorf("stream payload: copied %d of %d bytes: %w", n, payloadLen, err)
 	}
-	if payloadLen := len(payload); payloadLen > maxUoTPayload {
-		return fmt.Errorf("payload too large: %d", payloadLen)
+	return nil
+}
+
+// writeDatagram writes a single frame and returns its size on the wire.
+func writeDatagram(w io.Writer, codec AddressCodec, maxPayload int, addr string, payload []byte) (int, error) {
+	addrBuf, err := encodeFrameAddress(codec, maxPayload, addr, payload)
+	if err != nil {
+		return 0, err
 	}
+	return writeDatagramFrame(w, addrBuf, payload)
+}
 
-	var header [4]byte
+// writeDatagramFrame writes a single frame of an address already encoded and validated.
+func writeDatagramFrame(w io.Writer, addrBuf, payload []byte) (int, error) {
+	var header [uotHeaderLen]byte
 	binary.BigEndian.PutUint16(header[:2], uint16(len(addrBuf)))
 	binary.BigEndian.PutUint16(header[2:], uint16(len(payload)))
 
-	return writeAllChunks(w, header[:], addrBuf, payload)
+	if err := writeChunksOnce(w, header[:], addrBuf, payload); err != nil {
+		return 0, err
+	}
+	return uotHeaderLen + len(addrBuf) + len(payload), nil
+}
+
+// encodeFrameAddress encodes addr and validates the lengths of a datagram frame carrying payload.
+func encodeFrameAddress(codec AddressCodec, maxPayload int, addr string, payload []byte) ([]byte, error) {
+	addrBuf, err := codec.EncodeAddress(addr)
+	if err != nil {
+		return nil, fmt.Errorf("encode address: %w", err)
+	}
+	if err := validateFrameAddress(addrBuf, maxPayload, payload); err != nil {
+		return nil, err
+	}
+	return addrBuf, nil
+}
+
+func validateFrameAddress(addrBuf []byte, maxPayload int, payload []byte) error {
+	if addrLen := len(addrBuf); addrLen == 0 {
+		return fmt.Errorf("%w: empty encoded address", ErrInvalidAddressLength)
+	} else if addrLen > maxUoTPayload {
+		return fmt.Errorf("%w: %d", ErrAddressTooLong, addrLen)
+	}
+	if payloadLen := len(payload); payloadLen > maxPayload {
+		return fmt.Errorf("%w: %d", ErrPayloadTooLarge, payloadLen)
+	}
+	return nil
 }
 
 // ReadDatagram parses a single UDP datagram frame from the reliable stream.
+// Decoding failures are reported as *FrameError, a clean EOF before the first header byte is returned as is.
 func ReadDatagram(r io.Reader) (string, []byte, error) {
-	addr, payloadLen, err := readDatagramHeaderAndAddress(r)
+	return ReadDatagramWithLimit(r, maxUoTPayload)
+}
+
+// ReadDatagramWithLimit is ReadDatagram rejecting payloads larger than maxPayload bytes.
+func ReadDatagramWithLimit(r io.Reader, maxPayload int) (string, []byte, error) {
+	if err := validatePayloadLimit(maxPayload); err != nil {
+		return "", nil, err
+	}
+	addr, payloadLen, offset, err := readDatagramHeaderAndAddress(r, defaultAddressCodec, maxPayload)
 	if err != nil {
 		return "", nil, err
 	}
 	payload := make([]byte, payloadLen)
-	if _, err := io.ReadFull(r, payload); err != nil {
+	if err := readFramePayload(r, payload, offset); err != nil {
 		return "", nil, err
 	}
 
 	return addr, payload, nil
 }
 
+// ReadDatagramInto reads a single frame into caller provided storage and returns the address and payload lengths.
+// addrBuf receives the encoded address, to be decoded with an AddressCodec.
+// A frame that doesn't fit is skipped, keeping the stream in sync, and reported as io.ErrShortBuffer.
+func ReadDatagramInto(r io.Reader, addrBuf, payloadBuf []byte) (int, int, error) {
+	addrLen, payloadLen, err := readFrameHeader(r)
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := validateFrameLengths(addrLen, 1, payloadLen, maxUoTPayload); err != nil {
+		return 0, 0, err
+	}
+	if addrLen > len(addrBuf) || payloadLen > len(payloadBuf) {
+		if err := discardBytes(r, addrLen+payloadLen); err != nil {
+			return 0, 0, newFrameError(FrameStageAddress, uotHeaderLen, err)
+		}
+		return 0, 0, io.ErrShortBuffer
+	}
+	if n, err := io.ReadFull(r, addrBuf[:addrLen]); err != nil {
+		return 0, 0, newFrameError(FrameStageAddress, uotHeaderLen+n, err)
+	}
+	if err := readFramePayload(r, payloadBuf[:payloadLen], uotHeaderLen+addrLen); err != nil {
+		return 0, 0, err
+	}
+	return addrLen, payloadLen, nil
+}
+
 // UoTPacketConn adapts a net.Conn with the Sudoku UoT framing to net.PacketConn.
 type UoTPacketConn struct {
-	conn    net.Conn
-	writeMu sync.Mutex
+	conn       net.Conn
+	magic      byte
+	version    byte
+	handshake  uotHandshakeInfo
+	codec      AddressCodec
+	maxPayload int
+	writeMu    sync.Mutex
+	counters   uotCounters
+	peer       uotPeerCounters
+
+	readDeadline  uotDeadline
+	writeDeadline uotDeadline
+	addrCache     atomic.Pointer[lru.LruCache[string, net.Addr]]
+	addrCacheSize atomic.Int64
+	ipAddrs       uotIPAddrCache
+	readHeader    [uotHeaderLen]byte
+	replay        uotReplayReader
+	idle          uotIdle
+	padding       uotPadding
+	checksum      atomic.Bool
+
+	peerClosed atomic.Bool
+	resync     atomic.Bool
+	rateLimit  atomic.Pointer[uotRateLimiter]
+	// datagramRate is set by any goroutine, its state is only touched by the reading one
+	datagramRate atomic.Pointer[uotDatagramRate]
+
+	consecutiveDiscards    atomic.Int64
+	maxConsecutiveDiscards atomic.Int64
+	discardLogger          atomic.Pointer[func(addr string, err error)]
+	localAddr              atomic.Pointer[net.Addr]
+	deniedAddrTypes        atomic.Uint32
+
+	// writeClosed, queue, compression, frameSaved, fragmentWrites, fragmentID and addrPortBuf are guarded by writeMu
+	writeClosed    bool
+	queue          *uotWriteQueue
+	compressMin    int
+	compress       bool
+	frameSaved     int // bytes compression kept off the wire in the last frame written
+	fragmentWrites bool
+	fragmentID     uint32
+	addrPortBuf    [maxIPAddressLen]byte
+	reassembly     uotReassembly
+
+	closeOnce sync.Once
+	done      chan struct{}
 }
 
 func NewUoTPacketConn(conn net.Conn) *UoTPacketConn {
-	return &UoTPacketConn{conn: conn}
+	return NewUoTPacketConnWithVersion(conn, uotVersion)
+}
+
+// NewUoTPacketConnWithVersion wraps conn using the framing of version, as agreed by NegotiateVersion/AcceptVersion.
+func NewUoTPacketConnWithVersion(conn net.Conn, version byte) *UoTPacketConn {
+	return newUoTPacketConnWithMagic(conn, UoTMagicByte, version)
+}
+
+// newUoTPacketConnWithMagic is NewUoTPacketConnWithVersion for a handshake led by magic,
+// which the sync markers of SetResync start with as well.
+func newUoTPacketConnWithMagic(conn net.Conn, magic, version byte) *UoTPacketConn {
+	c := &UoTPacketConn{
+		conn:       conn,
+		magic:      magic,
+		version:    version,
+		codec:      defaultAddressCodec,
+		maxPayload: maxUoTPayload,
+		done:       make(chan struct{}),
+	}
+	c.replay.r = conn
+	c.addrCache.Store(newUoTAddrCache(defaultUoTAddrCacheSize, defaultUoTAddrCacheTTL))
+	c.addrCacheSize.Store(defaultUoTAddrCacheSize)
+	return c
+}
+
+// NewUoTPacketConnWithLimit wraps conn with payloads capped at maxPayload bytes in both directions,
+// maxPayload must be within 1-65535 as the frame length field is 16-bit.
+func NewUoTPacketConnWithLimit(conn net.Conn, maxPayload int) (*UoTPacketConn, error) {
+	if err := validatePayloadLimit(maxPayload); err != nil {
+		return nil, err
+	}
+	c := NewUoTPacketConn(conn)
+	c.maxPayload = maxPayload
+	return c, nil
+}
+
+// MaxPayload returns the largest datagram payload accepted by this conn
+func (c *UoTPacketConn) MaxPayload() int {
+	return c.maxPayload
+}
+
+// MaxDatagramSize returns the largest payload WriteTo accepts under the current options, for callers
+// sizing their writes. Padding, checksums and compression don't lower it, as payloadLen only counts
+// the payload and a payload is only sent compressed when that shrinks it, so it is MaxPayload unless
+// EnableFragmentation lifts it to the largest datagram fragments can carry, for any address up to
+// a 255 byte domain.
+func (c *UoTPacketConn) MaxDatagramSize() int {
+	c.writeMu.Lock()
+	fragmentWrites := c.fragmentWrites
+	c.writeMu.Unlock()
+	if !fragmentWrites {
+		return c.maxPayload
+	}
+	return maxFragmentedDatagramSize(c.maxPayload, maxDomainAddressLen)
+}
+
+// Version returns the protocol version used for framing
+func (c *UoTPacketConn) Version() byte {
+	return c.version
 }
 
+// SetAddressCodec replaces the address codec used by this conn, nil restores the default.
+// Both peers must use the same codec, and it should be set before any datagram is exchanged.
+func (c *UoTPacketConn) SetAddressCodec(codec AddressCodec) {
+	if codec == nil {
+		codec = defaultAddressCodec
+	}
+	c.codec = codec
+}
+
+// ReadFrom reads the next datagram, its source is a *net.UDPAddr for IP literals and a *NamedAddr for domain names,
+// shared between datagrams from the same source while it stays in the address cache, see SetAddressCache.
+// A zero-length datagram is returned as 0 bytes from its source with a nil error, like a UDP socket does.
+// A stream closed by the peer at a frame boundary ends with io.EOF, one closed in the middle of a frame
+// with a FrameError wrapping ErrTruncatedFrame, which tells a clean shutdown apart from a broken peer.
+// A read interrupted by the read deadline may be retried, see SetReadDeadline.
 func (c *UoTPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, _, addr, err := c.readFrom(p, false)
+	if err != nil {
+		return n, addr, c.idleError(err)
+	}
+	c.touchIdle()
+	return n, addr, nil
+}
+
+// readFrom reads the next datagram along with its source, see datagramSource for addrPortOnly.
+// A frame interrupted by the read deadline is rewound for the next call, which sees it whole.
+func (c *UoTPacketConn) readFrom(p []byte, addrPortOnly bool) (int, netip.AddrPort, net.Addr, error) {
+	n, addrPort, addr, err := c.readDatagramFrame(p, addrPortOnly)
+	if timeout, ok := timeoutError(err); ok {
+		c.replay.rewind()
+		return 0, netip.AddrPort{}, nil, timeout
+	}
+	return n, addrPort, addr, err
+}
+
+func (c *UoTPacketConn) readDatagramFrame(p []byte, addrPortOnly bool) (int, netip.AddrPort, net.Addr, error) {
+	if c.peerClosed.Load() {
+		return 0, netip.AddrPort{}, nil, ErrPeerClosed
+	}
 	for {
-		addrStr, payloadLen, err := readDatagramHeaderAndAddress(c.conn)
+		c.replay.begin(c.readDeadline.armed())
+		addrLen, payloadLen, err := c.readFrameHeader()
 		if err != nil {
-			return 0, nil, err
+			return 0, netip.AddrPort{}, nil, err
 		}
-
-		udpAddr, err := parseDatagramUDPAddr(addrStr)
-		if payloadLen > len(p) {
-			if discardErr := discardBytes(c.conn, payloadLen); discardErr != nil {
-				return 0, nil, discardErr
+		if err := c.prefetchFrame(addrLen, payloadLen); err != nil {
+			if _, ok := timeoutError(err); ok {
+				return 0, netip.AddrPort{}, nil, err
+			}
+		}
+		if addrLen == 0 {
+			datagram, err := c.readControlFrame(payloadLen)
+			if err != nil {
+				return 0, netip.AddrPort{}, nil, err
 			}
-			return 0, nil, io.ErrShortBuffer
+			if datagram == nil {
+				continue
+			}
+			n, addrPort, addr, ok, err := c.deliverReassembled(datagram, p, addrPortOnly)
+			if ok || err != nil {
+				return n, addrPort, addr, err
+			}
+			continue
+		}
+		frame := uotFrameReader{r: &c.replay}
+		headerLen := uotHeaderLen
+		if c.extendedFraming() {
+			if frame, err = c.newExtendedFrameReader(addrLen, payloadLen); err != nil {
+				if err = c.resyncAfter(err); err == nil {
+					continue
+				}
+				return 0, netip.AddrPort{}, nil, err
+			}
+			headerLen++
+		}
+		var addrPort netip.AddrPort
+		var addrStr string
+		var offset int
+		if _, ok := c.codec.(SOCKSAddressCodec); ok && addrLen <= maxIPAddressLen {
+			addrPort, addrStr, offset, err = c.readShortFrameAddress(frame.r, headerLen, addrLen, payloadLen)
+		} else {
+			addrStr, offset, err = readFrameAddress(frame.r, c.codec, c.maxPayload, headerLen, addrLen, payloadLen)
 		}
 		if err != nil {
-			if discardErr := discardBytes(c.conn, payloadLen); discardErr != nil {
-				return 0, nil, discardErr
+			if err = c.resyncAfter(err); err == nil {
+				continue
+			}
+			return 0, netip.AddrPort{}, nil, err
+		}
+
+		c.counters.wireBytesRead.Add(uint64(offset + payloadLen))
+		c.counters.framesReceived.Add(1)
+
+		var compressed []byte
+		datagramLen := payloadLen
+		if frame.flags&uotFlagCompressed != 0 {
+			if compressed, datagramLen, err = c.readCompressedPayload(frame, payloadLen, offset); err != nil {
+				return 0, netip.AddrPort{}, nil, err
+			}
+		}
+		c.counters.frameBytesReceived.Add(uint64(datagramLen))
+
+		overRate := c.overDatagramRate()
+		var from net.Addr
+		var lookupErr error
+		if !overRate {
+			addrPort, from, lookupErr = c.datagramSource(addrPort, addrStr, addrPortOnly)
+		}
+		if overRate || datagramLen > len(p) || lookupErr != nil {
+			var skipErr error
+			if compressed != nil {
+				_ = pool.Put(compressed)
+			} else {
+				skipErr = c.discardFrameRest(frame, payloadLen, offset)
+			}
+			if skipErr != nil {
+				return 0, netip.AddrPort{}, nil, skipErr
+			}
+			if overRate {
+				return 0, netip.AddrPort{}, nil, ErrRateExceeded
+			}
+			if datagramLen > len(p) {
+				return 0, netip.AddrPort{}, nil, io.ErrShortBuffer
+			}
+			if addrStr == "" {
+				addrStr = addrPort.String()
+			}
+			if err := c.discardDatagram(addrStr, lookupErr); err != nil {
+				return 0, netip.AddrPort{}, nil, err
 			}
-			log.Debugln("[Sudoku][UoT] discard datagram with invalid address %s: %v", addrStr, err)
 			continue
 		}
-		if _, err := io.ReadFull(c.conn, p[:payloadLen]); err != nil {
-			return 0, nil, err
+		if compressed != nil {
+			// readCompressedPayload finished the frame, its checksum included
+			err = decompressPayload(p[:datagramLen], compressed, offset)
+			_ = pool.Put(compressed)
+		} else if err = readFramePayload(frame.r, p[:payloadLen], offset); err == nil {
+			err = c.finishFrame(frame, offset+payloadLen)
+		}
+		if err != nil {
+			return 0, netip.AddrPort{}, nil, err
+		}
+		c.countRead(datagramLen)
+		c.counters.compressionSaved.Add(uint64(datagramLen - payloadLen))
+		return datagramLen, addrPort, from, nil
+	}
+}
+
+// deliverReassembled hands a datagram reassembled from fragments to ReadFrom,
+// ok is false when it was dropped for an invalid address without reaching the discard limit.
+func (c *UoTPacketConn) deliverReassembled(datagram *uotDatagram, p []byte, addrPortOnly bool) (int, netip.AddrPort, net.Addr, bool, error) {
+	c.counters.framesReceived.Add(1)
+	c.counters.frameBytesReceived.Add(uint64(len(datagram.payload)))
+	if c.overDatagramRate() {
+		return 0, netip.AddrPort{}, nil, true, ErrRateExceeded
+	}
+	if len(datagram.payload) > len(p) {
+		return 0, netip.AddrPort{}, nil, true, io.ErrShortBuffer
+	}
+	addrPort, from, err := c.datagramSource(netip.AddrPort{}, datagram.addr, addrPortOnly)
+	if err != nil {
+		if err := c.discardDatagram(datagram.addr, err); err != nil {
+			return 0, netip.AddrPort{}, nil, true, err
 		}
-		return payloadLen, udpAddr, nil
+		return 0, netip.AddrPort{}, nil, false, nil
+	}
+	n := copy(p, datagram.payload)
+	c.countRead(n)
+	return n, addrPort, from, true, nil
+}
+
+func (c *UoTPacketConn) countRead(payloadLen int) {
+	c.counters.datagramsRead.Add(1)
+	c.counters.bytesRead.Add(uint64(payloadLen))
+	c.consecutiveDiscards.Store(0)
+}
+
+// discardDatagram accounts for a datagram dropped for its address,
+// failing once the consecutive discards reach the limit set by SetMaxConsecutiveDiscards.
+func (c *UoTPacketConn) discardDatagram(addr string, err error) error {
+	if logger := c.discardLogger.Load(); logger != nil {
+		(*logger)(addr, err)
+	} else {
+		log.Debugln("[Sudoku][UoT] discard datagram with invalid address %s: %v", addr, err)
+	}
+	c.counters.discarded.Add(1)
+	consecutive := c.consecutiveDiscards.Add(1)
+	if limit := c.maxConsecutiveDiscards.Load(); limit > 0 && consecutive >= limit {
+		return fmt.Errorf("%w: %d in a row, last %s: %w", ErrTooManyDiscards, consecutive, addr, err)
 	}
+	return nil
+}
+
+// DiscardedCount returns the number of datagrams ReadFrom dropped for an invalid address
+func (c *UoTPacketConn) DiscardedCount() uint64 {
+	return c.counters.discarded.Load()
+}
+
+// SetDiscardLogger routes the report of a datagram dropped for its address to fn instead of
+// the debug log, fn is called from ReadFrom without any lock of the conn held.
+// A no-op fn silences the reports, nil restores the debug log.
+func (c *UoTPacketConn) SetDiscardLogger(fn func(addr string, err error)) {
+	if fn == nil {
+		c.discardLogger.Store(nil)
+		return
+	}
+	c.discardLogger.Store(&fn)
+}
+
+// SetMaxConsecutiveDiscards makes ReadFrom fail with ErrTooManyDiscards after n datagrams in a row
+// were dropped, instead of spinning on a peer sending garbage. 0 or less keeps discarding forever.
+func (c *UoTPacketConn) SetMaxConsecutiveDiscards(n int) {
+	c.maxConsecutiveDiscards.Store(int64(n))
 }
 
 func (c *UoTPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
-	if addr == nil {
-		return 0, errors.New("address is nil")
+	if err := c.waitRateLimit(context.Background(), len(p)); err != nil {
+		return 0, err
 	}
 	c.writeMu.Lock()
 	defer c.writeMu.Unlock()
-	if err := WriteDatagram(c.conn, addr.String(), p); err != nil {
-		return 0, err
+	return c.writeToLocked(p, addr)
+}
+
+func (c *UoTPacketConn) writeToLocked(p []byte, addr net.Addr) (int, error) {
+	if addr == nil {
+		return 0, errors.New("address is nil")
+	}
+	if c.writeClosed {
+		return 0, ErrWriteClosed
+	}
+	wireLen, err := c.writeFrameLocked(c.writerLocked(), addr, p)
+	if err != nil {
+		return 0, c.idleError(err)
 	}
+	c.countWrite(len(p), wireLen, c.frameSaved)
 	return len(p), nil
 }
 
+// writeFrameLocked must be called with writeMu held, it frames p to w and returns its size on the wire.
+func (c *UoTPacketConn) writeFrameLocked(w io.Writer, addr net.Addr, p []byte) (int, error) {
+	if err := c.checkAddressType(netip.AddrPort{}, addr); err != nil {
+		return 0, err
+	}
+	addrBuf, err := c.encodeAddress(addr)
+	if err != nil {
+		return 0, err
+	}
+	return c.writeEncodedFrameLocked(w, addrBuf, p)
+}
+
+// writeEncodedFrameLocked is writeFrameLocked for an address already encoded with the codec of the conn.
+func (c *UoTPacketConn) writeEncodedFrameLocked(w io.Writer, addrBuf, p []byte) (int, error) {
+	c.frameSaved = 0
+	if c.fragmentWrites && len(p) > c.maxPayload {
+		return c.writeFragmentsLocked(w, addrBuf, p)
+	}
+	if err := validateFrameAddress(addrBuf, c.maxPayload, p); err != nil {
+		return 0, err
+	}
+	if c.extendedFraming() {
+		return c.writeExtendedFrameLocked(w, addrBuf, p)
+	}
+	return writeDatagramFrame(w, addrBuf, p)
+}
+
+// encodeAddress encodes addr with the codec of the conn, the default codec takes
+// the fast path of appendNetAddr for *net.UDPAddr and *NamedAddr.
+func (c *UoTPacketConn) encodeAddress(addr net.Addr) ([]byte, error) {
+	if _, ok := c.codec.(SOCKSAddressCodec); ok {
+		if addrBuf, ok, err := appendNetAddr(make([]byte, 0, maxIPAddressLen), addr); err != nil {
+			return nil, fmt.Errorf("encode address: %w", err)
+		} else if ok {
+			return addrBuf, nil
+		}
+	}
+	addrBuf, err := c.codec.EncodeAddress(addr.String())
+	if err != nil {
+		return nil, fmt.Errorf("encode address: %w", err)
+	}
+	return addrBuf, nil
+}
+
+// countWrite accounts for a datagram written, saved is what compression kept off the wire.
+func (c *UoTPacketConn) countWrite(payloadLen, wireLen, saved int) {
+	c.touchIdle()
+	c.counters.datagramsWritten.Add(1)
+	// in the reverse order of the loads of Stats, so that a snapshot never sees more payload than wire
+	c.counters.wireBytesWritten.Add(uint64(wireLen))
+	c.counters.bytesWritten.Add(uint64(payloadLen))
+	c.counters.compressionSaved.Add(uint64(saved))
+}
+
 func (c *UoTPacketConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+	c.stopQueue()
 	return c.conn.Close()
 }
 
+// LocalAddr returns the address set by SetLocalAddr, or else the local address of the stream
 func (c *UoTPacketConn) LocalAddr() net.Addr {
+	if addr := c.localAddr.Load(); addr != nil {
+		return *addr
+	}
 	return c.conn.LocalAddr()
 }
 
+// SetLocalAddr overrides the address LocalAddr reports, such as the UDP address a SOCKS UDP ASSOCIATE
+// echoes back to its client rather than the TCP one of the stream. It is only reported, the framing
+// and the stream are unaffected. nil restores the local address of the stream.
+func (c *UoTPacketConn) SetLocalAddr(addr net.Addr) {
+	if addr == nil {
+		c.localAddr.Store(nil)
+		return
+	}
+	c.localAddr.Store(&addr)
+}
+
+// RemoteAddr returns the address of the peer of the stream, nil when there is none to tell
+func (c *UoTPacketConn) RemoteAddr() net.Addr {
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.RemoteAddr()
+}
+
+// NetConn returns the stream conn carrying the frames
+func (c *UoTPacketConn) NetConn() net.Conn {
+	return c.conn
+}
+
+// SyscallConn returns the raw socket of the stream conn for options such as SO_MARK or TCP_NODELAY,
+// following Upstream() through wrapping conns. It fails with ErrNoSyscallConn when there is no socket beneath.
+func (c *UoTPacketConn) SyscallConn() (syscall.RawConn, error) {
+	if sc, ok := findUpstream[syscall.Conn](c.conn); ok {
+		return sc.SyscallConn()
+	}
+	return nil, fmt.Errorf("%w: %T", ErrNoSyscallConn, c.conn)
+}
+
+// SetReadBuffer sets the kernel receive buffer of the stream socket, as *net.TCPConn does,
+// it sizes the TCP socket as a whole rather than any per-datagram buffer.
+// It fails with ErrNoSocketBuffer when no conn beneath can be sized.
+func (c *UoTPacketConn) SetReadBuffer(bytes int) error {
+	if conn, ok := findUpstream[interface{ SetReadBuffer(int) error }](c.conn); ok {
+		return conn.SetReadBuffer(bytes)
+	}
+	return fmt.Errorf("%w: %T", ErrNoSocketBuffer, c.conn)
+}
+
+// SetWriteBuffer sets the kernel send buffer of the stream socket, see SetReadBuffer.
+func (c *UoTPacketConn) SetWriteBuffer(bytes int) error {
+	if conn, ok := findUpstream[interface{ SetWriteBuffer(int) error }](c.conn); ok {
+		return conn.SetWriteBuffer(bytes)
+	}
+	return fmt.Errorf("%w: %T", ErrNoSocketBuffer, c.conn)
+}
+
+// findUpstream returns the first conn implementing T, following Upstream() through wrapping conns.
+func findUpstream[T any](conn any) (T, bool) {
+	for conn != nil {
+		if found, ok := conn.(T); ok {
+			return found, true
+		}
+		wrapper, ok := conn.(interface{ Upstream() any })
+		if !ok {
+			break
+		}
+		conn = wrapper.Upstream()
+	}
+	var zero T
+	return zero, false
+}
+
 func (c *UoTPacketConn) SetDeadline(t time.Time) error {
-	return c.conn.SetDeadline(t)
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
 }
 
+// SetReadDeadline bounds ReadFrom like on any net.Conn. A deadline set before the read starts may
+// interrupt it in the middle of a frame without losing the framing: ReadFrom fails with the timeout,
+// a net.Error whose Timeout is true, and the next ReadFrom reads the interrupted frame whole.
 func (c *UoTPacketConn) SetReadDeadline(t time.Time) error {
-	return c.conn.SetReadDeadline(t)
+	return c.readDeadline.setUser(c.conn.SetReadDeadline, t)
 }
 
 func (c *UoTPacketConn) SetWriteDeadline(t time.Time) error {
-	return c.conn.SetWriteDeadline(t)
+	return c.writeDeadline.setUser(c.conn.SetWriteDeadline, t)
 }
 
-func readDatagramHeaderAndAddress(r io.Reader) (string, int, error) {
-	var header [4]byte
-	if _, err := io.ReadFull(r, header[:]); err != nil {
-		return "", 0, err
+// readDatagramHeaderAndAddress reads the frame header and address,
+// returning the decoded address, the payload length and the frame offset of the payload.
+func readDatagramHeaderAndAddress(r io.Reader, codec AddressCodec, maxPayload int) (string, int, int, error) {
+	addrLen, payloadLen, err := readFrameHeader(r)
+	if err != nil {
+		return "", 0, 0, err
 	}
-
-	addrLen := int(binary.BigEndian.Uint16(header[:2]))
-	payloadLen := int(binary.BigEndian.Uint16(header[2:]))
-	if addrLen <= 0 || addrLen > maxUoTPayload {
-		return "", 0, fmt.Errorf("invalid address length: %d", addrLen)
+	addr, offset, err := readFrameAddress(r, codec, maxPayload, uotHeaderLen, addrLen, payloadLen)
+	if err != nil {
+		return "", 0, 0, err
 	}
-	if payloadLen < 0 || payloadLen > maxUoTPayload {
-		return "", 0, fmt.Errorf("invalid payload length: %d", payloadLen)
+	return addr, payloadLen, offset, nil
+}
+
+// readFrameHeader reads the raw address and payload lengths of the next frame.
+func readFrameHeader(r io.Reader) (int, int, error) {
+	var header [uotHeaderLen]byte
+	return readFrameHeaderInto(r, &header)
+}
+
+// readFrameHeaderInto is readFrameHeader reading into header, which the caller may keep off the stack
+// since it escapes through io.Reader.
+func readFrameHeaderInto(r io.Reader, header *[uotHeaderLen]byte) (int, int, error) {
+	if n, err := io.ReadFull(r, header[:]); err != nil {
+		if n == 0 && errors.Is(err, io.EOF) {
+			return 0, 0, err
+		}
+		return 0, 0, newFrameError(FrameStageHeader, n, err)
 	}
+	return int(binary.BigEndian.Uint16(header[:2])), int(binary.BigEndian.Uint16(header[2:])), nil
+}
 
-	addrBuf := make([]byte, addrLen)
-	if _, err := io.ReadFull(r, addrBuf); err != nil {
+// readFrameAddress validates the header lengths of a datagram frame and decodes the address following
+// the headerLen bytes of header, returning the frame offset of the payload.
+func readFrameAddress(r io.Reader, codec AddressCodec, maxPayload, headerLen, addrLen, payloadLen int) (string, int, error) {
+	if err := validateFrameLengths(addrLen, minAddressLen(codec), payloadLen, maxPayload); err != nil {
 		return "", 0, err
 	}
 
-	addr, err := DecodeAddress(bytes.NewReader(addrBuf))
+	addrBuf := pool.Get(addrLen)
+	defer pool.Put(addrBuf)
+	if n, err := io.ReadFull(r, addrBuf); err != nil {
+		return "", 0, newFrameError(FrameStageAddress, headerLen+n, err)
+	}
+
+	addr, err := codec.DecodeAddress(addrBuf)
 	if err != nil {
-		return "", 0, fmt.Errorf("decode address: %w", err)
+		return "", 0, newFrameError(FrameStageAddress, headerLen+addressDecodeOffset(err), fmt.Errorf("%w: %w", errDecodeAddress, err))
+	}
+	return addr, headerLen + addrLen, nil
+}
+
+// validateFrameLengths checks the lengths of a datagram frame header, minAddrLen is the shortest
+// address the codec decodes. A zero address length marks a control frame and is never valid here,
+// while a zero payload length is an empty datagram. The lengths come from uint16 and can't be negative.
+func validateFrameLengths(addrLen, minAddrLen, payloadLen, maxPayload int) error {
+	if addrLen < minAddrLen || addrLen <= 0 || addrLen > maxUoTPayload {
+		return newFrameError(FrameStageHeader, 0, fmt.Errorf("%w: %d", ErrInvalidAddressLength, addrLen))
+	}
+	if payloadLen > maxPayload {
+		return newFrameError(FrameStageHeader, 2, fmt.Errorf("%w: %w: %d", ErrInvalidPayloadLength, ErrPayloadTooLarge, payloadLen))
+	}
+	return nil
+}
+
+func validatePayloadLimit(maxPayload int) error {
+	if maxPayload <= 0 || maxPayload > maxUoTPayload {
+		return fmt.Errorf("%w: %d", ErrInvalidPayloadLimit, maxPayload)
 	}
-	return addr, payloadLen, nil
+	return nil
 }
 
-func parseDatagramUDPAddr(addr string) (*net.UDPAddr, error) {
-	addrPort, err := netip.ParseAddrPort(addr)
+// readFramePayload fills payload from r, offset is the frame offset of the payload used for error reporting.
+func readFramePayload(r io.Reader, payload []byte, offset int) error {
+	if n, err := io.ReadFull(r, payload); err != nil {
+		return newFrameError(FrameStagePayload, offset+n, err)
+	}
+	return nil
+}
+
+// NamedAddr is a datagram address carrying a domain name, returned by ReadFrom as is instead of
+// being resolved, since with FakeIP or split tunneling the name is the meaningful part.
+type NamedAddr struct {
+	Host string
+	Port uint16
+}
+
+func (a *NamedAddr) Network() string {
+	return "udp"
+}
+
+func (a *NamedAddr) String() string {
+	return net.JoinHostPort(a.Host, strconv.Itoa(int(a.Port)))
+}
+
+// parseDatagramAddr returns a *net.UDPAddr for IP literals and a *NamedAddr for domain names.
+func parseDatagramAddr(addr string) (net.Addr, error) {
+	if addrPort, err := netip.ParseAddrPort(addr); err == nil {
+		return net.UDPAddrFromAddrPort(netip.AddrPortFrom(addrPort.Addr().Unmap(), addrPort.Port())), nil
+	}
+	host, portStr, err := net.SplitHostPort(addr)
 	if err != nil {
 		return nil, err
 	}
-	return net.UDPAddrFromAddrPort(netip.AddrPortFrom(addrPort.Addr().Unmap(), addrPort.Port())), nil
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", portStr)
+	}
+	if host == "" {
+		return nil, errors.New("empty host")
+	}
+	return &NamedAddr{Host: host, Port: uint16(port)}, nil
 }
 
 func discardBytes(r io.Reader, n int) error {
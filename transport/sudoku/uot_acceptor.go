@@ -0,0 +1,112 @@
+package sudoku
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+
+	"github.com/metacubex/mihomo/log"
+)
+
+// UoTAcceptor wraps a listener and bounds the number of live connections per remote IP.
+// Connections over the limit are closed right after being accepted.
+type UoTAcceptor struct {
+	net.Listener
+	maxPerIP atomic.Int64
+
+	mu     sync.Mutex
+	counts map[netip.Addr]int
+}
+
+func NewUoTAcceptor(l net.Listener) *UoTAcceptor {
+	return &UoTAcceptor{Listener: l, counts: make(map[netip.Addr]int)}
+}
+
+// SetMaxPerIP sets the allowed live connections per remote IP, 0 means unlimited.
+func (a *UoTAcceptor) SetMaxPerIP(n int) {
+	if n < 0 {
+		n = 0
+	}
+	a.maxPerIP.Store(int64(n))
+}
+
+// ActiveConns return the live connections accepted from ip
+func (a *UoTAcceptor) ActiveConns(ip netip.Addr) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.counts[ip.Unmap()]
+}
+
+// Accept waits for the next connection whose remote IP is under its limit.
+// The returned conn releases its slot when closed.
+func (a *UoTAcceptor) Accept() (net.Conn, error) {
+	for {
+		conn, err := a.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		ip, ok := remoteIP(conn.RemoteAddr())
+		if !ok {
+			// nothing to key the limit on, e.g. unix sockets
+			return conn, nil
+		}
+		if !a.acquire(ip) {
+			log.Debugln("[Sudoku][UoT] reject connection from %s: too many connections", ip)
+			_ = conn.Close()
+			continue
+		}
+		return &acceptedConn{Conn: conn, release: func() { a.release(ip) }}, nil
+	}
+}
+
+func (a *UoTAcceptor) acquire(ip netip.Addr) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if limit := a.maxPerIP.Load(); limit > 0 && int64(a.counts[ip]) >= limit {
+		return false
+	}
+	a.counts[ip]++
+	return true
+}
+
+func (a *UoTAcceptor) release(ip netip.Addr) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.counts[ip] <= 1 {
+		delete(a.counts, ip)
+		return
+	}
+	a.counts[ip]--
+}
+
+func remoteIP(addr net.Addr) (netip.Addr, bool) {
+	if addr == nil {
+		return netip.Addr{}, false
+	}
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		ip, ok := netip.AddrFromSlice(tcpAddr.IP)
+		return ip.Unmap(), ok
+	}
+	addrPort, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addrPort.Addr().Unmap(), true
+}
+
+type acceptedConn struct {
+	net.Conn
+	releaseOnce sync.Once
+	release     func()
+}
+
+func (c *acceptedConn) Close() error {
+	c.releaseOnce.Do(c.release)
+	return c.Conn.Close()
+}
+
+func (c *acceptedConn) Upstream() any {
+	return c.Conn
+}
@@ -0,0 +1,144 @@
+package sudoku
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/metacubex/mihomo/common/lru"
+)
+
+const (
+	defaultUoTAddrCacheSize = 256
+	defaultUoTAddrCacheTTL  = time.Minute
+)
+
+func newUoTAddrCache(size int, ttl time.Duration) *lru.LruCache[string, net.Addr] {
+	maxAge := int64(ttl / time.Second)
+	if maxAge < 1 {
+		maxAge = 1
+	}
+	return lru.New[string, net.Addr](
+		lru.WithSize[string, net.Addr](size),
+		lru.WithAge[string, net.Addr](maxAge),
+	)
+}
+
+// SetAddressCache bounds the cache of parsed source addresses used by ReadFrom to size entries
+// kept for ttl, rounded up to a second, so a handful of busy peers don't cost a parse and an
+// allocation per datagram. IP sources are kept apart, taking the same size without a TTL.
+// The returned addresses are shared and must not be modified.
+// A size of 0 or less disables the cache.
+func (c *UoTPacketConn) SetAddressCache(size int, ttl time.Duration) {
+	if size <= 0 {
+		c.addrCache.Store(nil)
+		c.addrCacheSize.Store(0)
+		return
+	}
+	c.addrCache.Store(newUoTAddrCache(size, ttl))
+	c.addrCacheSize.Store(int64(size))
+}
+
+// lookupDatagramAddr is parseDatagramAddr going through the address cache
+func (c *UoTPacketConn) lookupDatagramAddr(addr string) (net.Addr, error) {
+	cache := c.addrCache.Load()
+	if cache == nil {
+		return parseDatagramAddr(addr)
+	}
+	if cached, ok := cache.Get(addr); ok {
+		return cached, nil
+	}
+	parsed, err := parseDatagramAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	cache.Set(addr, parsed)
+	return parsed, nil
+}
+
+// uotIPAddrCache holds the *net.UDPAddr handed out for IP sources, so ReadFrom hands them over to the caller
+// without allocating. IP literals don't go stale, unlike names there is no TTL.
+// It is only used by the reading goroutine, holds up to the size set by SetAddressCache on its own,
+// and is emptied once full.
+type uotIPAddrCache struct {
+	addrs map[netip.AddrPort]*net.UDPAddr
+	// buf receives the encoded address, a stack array would escape through io.Reader
+	buf [maxIPAddressLen]byte
+}
+
+func (c *uotIPAddrCache) get(addrPort netip.AddrPort, size int) *net.UDPAddr {
+	if addr, ok := c.addrs[addrPort]; ok {
+		return addr
+	}
+	addr := net.UDPAddrFromAddrPort(addrPort)
+	if size <= 0 {
+		c.addrs = nil
+		return addr
+	}
+	if c.addrs == nil || len(c.addrs) >= size {
+		c.addrs = make(map[netip.AddrPort]*net.UDPAddr, size)
+	}
+	c.addrs[addrPort] = addr
+	return addr
+}
+
+// readShortFrameAddress is readFrameAddress for the default codec and addresses up to an IPv6 one, read
+// into a buffer of the conn. IP addresses are returned as a netip.AddrPort straight away, anything else
+// is decoded to a string for datagramSource.
+func (c *UoTPacketConn) readShortFrameAddress(r io.Reader, headerLen, addrLen, payloadLen int) (netip.AddrPort, string, int, error) {
+	if err := validateFrameLengths(addrLen, minSOCKSAddressLen, payloadLen, c.maxPayload); err != nil {
+		return netip.AddrPort{}, "", 0, err
+	}
+	addrBuf := c.ipAddrs.buf[:addrLen]
+	if n, err := io.ReadFull(r, addrBuf); err != nil {
+		return netip.AddrPort{}, "", 0, newFrameError(FrameStageAddress, headerLen+n, err)
+	}
+	offset := headerLen + addrLen
+
+	var ip netip.Addr
+	switch {
+	case addrBuf[0] == 0x01 && addrLen == 1+net.IPv4len+2:
+		ip = netip.AddrFrom4([4]byte(addrBuf[1:5]))
+	case addrBuf[0] == 0x04 && addrLen == maxIPAddressLen:
+		ip = netip.AddrFrom16([16]byte(addrBuf[1:17])).Unmap()
+	default:
+		addr, err := SOCKSAddressCodec{}.DecodeAddress(addrBuf)
+		if err != nil {
+			return netip.AddrPort{}, "", 0, newFrameError(FrameStageAddress, headerLen+addressDecodeOffset(err), fmt.Errorf("%w: %w", errDecodeAddress, err))
+		}
+		return netip.AddrPort{}, addr, offset, nil
+	}
+	port := uint16(addrBuf[addrLen-2])<<8 | uint16(addrBuf[addrLen-1])
+	return netip.AddrPortFrom(ip, port), "", offset, nil
+}
+
+// datagramSource returns the source of a datagram, given as addrPort when its address was decoded
+// to one already and as the string addr otherwise. ReadFrom wants it as a net.Addr, IP sources
+// coming from the IP cache. ReadFromAddrPort passes addrPortOnly to only get the netip.AddrPort
+// of IP sources, a name is still looked up and returned as from alone.
+func (c *UoTPacketConn) datagramSource(addrPort netip.AddrPort, addr string, addrPortOnly bool) (netip.AddrPort, net.Addr, error) {
+	if !addrPort.IsValid() && addrPortOnly {
+		if parsed, err := netip.ParseAddrPort(addr); err == nil {
+			addrPort = netip.AddrPortFrom(parsed.Addr().Unmap(), parsed.Port())
+		}
+	}
+	if addrPort.IsValid() {
+		if err := c.checkAddressType(addrPort, nil); err != nil {
+			return addrPort, nil, err
+		}
+		if addrPortOnly {
+			return addrPort, nil, nil
+		}
+		return addrPort, c.ipAddrs.get(addrPort, int(c.addrCacheSize.Load())), nil
+	}
+	from, err := c.lookupDatagramAddr(addr)
+	if err == nil {
+		err = c.checkAddressType(netip.AddrPort{}, from)
+	}
+	if err != nil {
+		return netip.AddrPort{}, nil, err
+	}
+	return netip.AddrPort{}, from, nil
+}
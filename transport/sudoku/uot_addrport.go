@@ -0,0 +1,68 @@
+package sudoku
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+)
+
+// WriteToAddrPort is WriteTo for an IP destination held as a netip.AddrPort. The default codec
+// encodes it straight into a buffer of the conn, without formatting or splitting a string nor
+// going through a *net.UDPAddr, so the address costs no allocation. An IPv4-mapped IPv6 address
+// is sent in the IPv4 form, as by WriteTo.
+func (c *UoTPacketConn) WriteToAddrPort(p []byte, addrPort netip.AddrPort) (int, error) {
+	if !addrPort.IsValid() {
+		return 0, errors.New("address is invalid")
+	}
+	if err := c.checkAddressType(addrPort, nil); err != nil {
+		return 0, err
+	}
+	if err := c.waitRateLimit(context.Background(), len(p)); err != nil {
+		return 0, err
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.writeClosed {
+		return 0, ErrWriteClosed
+	}
+	addrBuf, err := c.encodeAddrPortLocked(addrPort)
+	if err != nil {
+		return 0, err
+	}
+	wireLen, err := c.writeEncodedFrameLocked(c.writerLocked(), addrBuf, p)
+	if err != nil {
+		return 0, c.idleError(err)
+	}
+	c.countWrite(len(p), wireLen, c.frameSaved)
+	return len(p), nil
+}
+
+// encodeAddrPortLocked must be called with writeMu held, the default codec encodes into
+// addrPortBuf which stays valid until writeMu is released.
+func (c *UoTPacketConn) encodeAddrPortLocked(addrPort netip.AddrPort) ([]byte, error) {
+	if _, ok := c.codec.(SOCKSAddressCodec); ok {
+		return appendIPAddress(c.addrPortBuf[:0], addrPort.Addr(), addrPort.Port()), nil
+	}
+	addrBuf, err := c.codec.EncodeAddress(addrPort.String())
+	if err != nil {
+		return nil, fmt.Errorf("encode address: %w", err)
+	}
+	return addrBuf, nil
+}
+
+// ReadFromAddrPort is ReadFrom for peers sending from IP literals, returning the source as
+// a netip.AddrPort without building a net.Addr for it. A datagram from a domain name is still
+// read into p, and returned with the zero netip.AddrPort and an error wrapping ErrNamedSource
+// which carries the name, use ReadFrom where such sources are expected.
+func (c *UoTPacketConn) ReadFromAddrPort(p []byte) (int, netip.AddrPort, error) {
+	n, addrPort, from, err := c.readFrom(p, true)
+	if err != nil {
+		return n, addrPort, c.idleError(err)
+	}
+	c.touchIdle()
+	if !addrPort.IsValid() {
+		return n, addrPort, fmt.Errorf("%w: %s", ErrNamedSource, from)
+	}
+	return n, addrPort, nil
+}
@@ -0,0 +1,75 @@
+package sudoku
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+)
+
+// Bits of the address types denied by SetAllowedAddressTypes, none are by default
+const (
+	uotDenyIPv4 uint32 = 1 << iota
+	uotDenyIPv6
+	uotDenyDomain
+)
+
+// SetAllowedAddressTypes restricts the addresses the conn carries, such as refusing domains on
+// a server which only forwards pre-resolved IPs. ReadFrom discards datagrams from a denied type,
+// counted in DiscardedCount and failing once SetMaxConsecutiveDiscards is reached, and writes to
+// a denied type fail with ErrAddressTypeNotAllowed. IPv4-mapped IPv6 addresses count as IPv4,
+// being framed as such. All three types are allowed by default.
+func (c *UoTPacketConn) SetAllowedAddressTypes(ipv4, ipv6, domain bool) {
+	var denied uint32
+	if !ipv4 {
+		denied |= uotDenyIPv4
+	}
+	if !ipv6 {
+		denied |= uotDenyIPv6
+	}
+	if !domain {
+		denied |= uotDenyDomain
+	}
+	c.deniedAddrTypes.Store(denied)
+}
+
+// checkAddressType fails on an address of a type denied by SetAllowedAddressTypes,
+// given as addrPort when it is valid and as addr otherwise.
+func (c *UoTPacketConn) checkAddressType(addrPort netip.AddrPort, addr net.Addr) error {
+	denied := c.deniedAddrTypes.Load()
+	if denied == 0 {
+		return nil
+	}
+	var ip netip.Addr
+	switch {
+	case addrPort.IsValid():
+		ip = addrPort.Addr()
+	case addr == nil:
+	default:
+		switch addr := addr.(type) {
+		case *net.UDPAddr:
+			ip, _ = netip.AddrFromSlice(addr.IP)
+		case *NamedAddr:
+			ip, _ = netip.ParseAddr(addr.Host)
+		default:
+			if parsed, err := netip.ParseAddrPort(addr.String()); err == nil {
+				ip = parsed.Addr()
+			}
+		}
+	}
+
+	kind, name := uotDenyDomain, "domain"
+	if ip.IsValid() {
+		if ip.Unmap().Is4() {
+			kind, name = uotDenyIPv4, "IPv4"
+		} else {
+			kind, name = uotDenyIPv6, "IPv6"
+		}
+	}
+	if denied&kind == 0 {
+		return nil
+	}
+	if addrPort.IsValid() {
+		return fmt.Errorf("%w: %s %s", ErrAddressTypeNotAllowed, name, addrPort)
+	}
+	return fmt.Errorf("%w: %s %s", ErrAddressTypeNotAllowed, name, addr)
+}
@@ -0,0 +1,66 @@
+package sudoku
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net"
+)
+
+// An auth token is carried as its SHA-256 digest right after the preface, so the server always
+// reads a fixed number of bytes whatever the length of the configured token:
+//
+//	magic (1B) | version (1B) | sha256(token) (32B)
+//
+// A server expecting a token never answers a preface with a wrong one, it closes the conn instead.
+// Both sides must agree on whether a token is used, a peer without one sees garbled frames.
+const uotAuthDigestLen = sha256.Size
+
+// UoTHandshakeOptions configures the handshake of Client and NewUoTServerConn, the zero value is the plain handshake.
+type UoTHandshakeOptions struct {
+	// Versions are the versions offered by the client or accepted by the server,
+	// empty keeps the default of each side.
+	Versions []byte
+	// AuthToken is the shared secret checked by the server, empty disables the check.
+	AuthToken []byte
+	// Magic is the byte leading the preface, which both sides must agree on,
+	// 0 keeps UoTMagicByte. A server expecting another magic fails with ErrBadMagic.
+	Magic byte
+	// Wrapper, when set, wraps the conn before the preface is exchanged, so the preface
+	// and every frame pass through it. Both sides must use matching wrappers.
+	Wrapper StreamWrapper
+}
+
+func (o UoTHandshakeOptions) wrap(conn net.Conn) net.Conn {
+	if o.Wrapper == nil {
+		return conn
+	}
+	return o.Wrapper.Wrap(conn)
+}
+
+func (o UoTHandshakeOptions) magic() byte {
+	if o.Magic == 0 {
+		return UoTMagicByte
+	}
+	return o.Magic
+}
+
+func (o UoTHandshakeOptions) authDigest() []byte {
+	if len(o.AuthToken) == 0 {
+		return nil
+	}
+	digest := sha256.Sum256(o.AuthToken)
+	return digest[:]
+}
+
+func readAuthDigest(r io.Reader, expected []byte) error {
+	var digest [uotAuthDigestLen]byte
+	if _, err := io.ReadFull(r, digest[:]); err != nil {
+		return fmt.Errorf("%w: read token: %w", ErrAuthFailed, err)
+	}
+	if subtle.ConstantTimeCompare(digest[:], expected) != 1 {
+		return ErrAuthFailed
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package sudoku
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"github.com/metacubex/mihomo/common/pool"
+)
+
+// ReadBatch waits for a datagram, then fills the rest of msgs with the datagrams that came along
+// with it, without waiting for more: it reads the stream ahead and stops at the first frame not
+// fully buffered yet, which the next read picks up whole.
+// Each msgs[i] is resliced to the datagram length and addrs[i] receives its source address.
+// It returns the number of datagrams read, along with the error that prevented reading any more.
+func (c *UoTPacketConn) ReadBatch(msgs [][]byte, addrs []net.Addr) (int, error) {
+	if len(addrs) < len(msgs) {
+		return 0, errors.New("fewer addresses than messages")
+	}
+	c.replay.readAhead = true
+	defer func() {
+		c.replay.readAhead, c.replay.noBlock = false, false
+	}()
+	for i := range msgs {
+		n, addr, err := c.ReadFrom(msgs[i])
+		if err != nil {
+			if errors.Is(err, errWouldBlock) {
+				return i, nil
+			}
+			return i, err
+		}
+		msgs[i] = msgs[i][:n]
+		addrs[i] = addr
+		c.replay.noBlock = true
+	}
+	return len(msgs), nil
+}
+
+// WriteBatch frames payloads[i] to addrs[i] and flushes them with a single write to the conn.
+// A payload that can't be framed ends the batch, the ones before it are still sent.
+// It returns the number of datagrams fully written, along with the error that ended a partial batch.
+func (c *UoTPacketConn) WriteBatch(payloads [][]byte, addrs []net.Addr) (int, error) {
+	if len(addrs) < len(payloads) {
+		return 0, errors.New("fewer addresses than payloads")
+	}
+
+	if c.rateLimit.Load() != nil {
+		size := 0
+		for _, payload := range payloads {
+			size += len(payload)
+		}
+		if err := c.waitRateLimit(context.Background(), size); err != nil {
+			return 0, err
+		}
+	}
+
+	buf := pool.GetBuffer()
+	defer pool.PutBuffer(buf)
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.writeClosed {
+		return 0, ErrWriteClosed
+	}
+
+	frameEnds := make([]int, 0, len(payloads))
+	frameSaved := make([]int, 0, len(payloads))
+	var frameErr error
+	for i, payload := range payloads {
+		if addrs[i] == nil {
+			frameErr = errors.New("address is nil")
+			break
+		}
+		if _, err := c.writeFrameLocked(buf, addrs[i], payload); err != nil {
+			frameErr = err
+			break
+		}
+		frameEnds = append(frameEnds, buf.Len())
+		frameSaved = append(frameSaved, c.frameSaved)
+	}
+	if len(frameEnds) == 0 {
+		return 0, frameErr
+	}
+
+	written, err := c.writerLocked().Write(buf.Bytes())
+	err = c.idleError(err)
+	frameStart := 0
+	for i, frameEnd := range frameEnds {
+		if frameEnd > written {
+			return i, err
+		}
+		c.countWrite(len(payloads[i]), frameEnd-frameStart, frameSaved[i])
+		frameStart = frameEnd
+	}
+	if err != nil {
+		return len(frameEnds), err
+	}
+	return len(frameEnds), frameErr
+}
@@ -0,0 +1,46 @@
+package sudoku
+
+import (
+	"fmt"
+	"net"
+)
+
+// Client writes the version 1 preface on conn and returns it wrapped, ready for datagrams.
+// On error conn is left open, closing it is up to the caller.
+func Client(conn net.Conn) (*UoTPacketConn, error) {
+	return ClientWithOptions(conn, UoTHandshakeOptions{})
+}
+
+// ClientWithVersions is Client negotiating one of supported as NegotiateVersion does,
+// the returned conn frames at the agreed version.
+func ClientWithVersions(conn net.Conn, supported []byte) (*UoTPacketConn, error) {
+	return ClientWithOptions(conn, UoTHandshakeOptions{Versions: supported})
+}
+
+// ClientWithOptions is Client with the versions, auth token, magic and stream wrapper of options.
+// UoTVersion4 is refused before anything is written, as only UoTMux speaks it.
+func ClientWithOptions(conn net.Conn, options UoTHandshakeOptions) (*UoTPacketConn, error) {
+	supported := options.Versions
+	if len(supported) == 0 {
+		supported = []byte{uotVersion}
+	}
+	if err := checkPacketConnVersions(supported); err != nil {
+		return nil, err
+	}
+	conn = options.wrap(conn)
+	magic := options.magic()
+	version, err := negotiateVersion(conn, magic, supported, options.authDigest())
+	if err != nil {
+		return nil, err
+	}
+	c := newUoTPacketConnWithMagic(conn, magic, version)
+	c.handshake = options.handshakeInfo()
+	return c, nil
+}
+
+func checkPacketConnVersions(versions []byte) error {
+	if containsVersion(versions, UoTVersion4) {
+		return fmt.Errorf("%w: version %d needs a UoTMux", ErrUnsupportedVersion, UoTVersion4)
+	}
+	return nil
+}
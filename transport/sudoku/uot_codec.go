@@ -0,0 +1,62 @@
+package sudoku
+
+import (
+	"errors"
+	"fmt"
+)
+
+// AddressCodec converts between "host:port" strings and the address section of a UoT frame.
+//
+// The frame header carries the encoded address length, so DecodeAddress always receives
+// the complete address buffer of a single frame, which is reused afterwards and must not be retained.
+// Only the address encoding is pluggable, the surrounding framing stays the same for every codec.
+type AddressCodec interface {
+	EncodeAddress(addr string) ([]byte, error)
+	DecodeAddress(buf []byte) (string, error)
+}
+
+// SOCKSAddressCodec is the default AddressCodec, using the SOCKS5-style encoding of EncodeAddress/DecodeAddress.
+type SOCKSAddressCodec struct{}
+
+func (SOCKSAddressCodec) EncodeAddress(addr string) ([]byte, error) {
+	return EncodeAddress(addr)
+}
+
+// DecodeAddress decodes the address section of a frame, which must hold exactly one address:
+// bytes left over after it, as when the declared type doesn't match the section length,
+// are reported as ErrInvalidAddressLength instead of being ignored.
+func (SOCKSAddressCodec) DecodeAddress(buf []byte) (string, error) {
+	addr, consumed, err := DecodeAddress(buf)
+	if err != nil {
+		return "", &addressDecodeError{offset: consumed, err: err}
+	}
+	if consumed != len(buf) {
+		return "", &addressDecodeError{
+			offset: consumed,
+			err:    fmt.Errorf("%w: %d trailing bytes after %s", ErrInvalidAddressLength, len(buf)-consumed, addr),
+		}
+	}
+	return addr, nil
+}
+
+// addressDecodeError is a failure of SOCKSAddressCodec.DecodeAddress along with the offset
+// in the address section it failed at, so that a FrameError points at the faulty byte.
+type addressDecodeError struct {
+	offset int
+	err    error
+}
+
+func (e *addressDecodeError) Error() string { return e.err.Error() }
+func (e *addressDecodeError) Unwrap() error { return e.err }
+
+// addressDecodeOffset returns the offset in the address section where decoding failed with err,
+// 0 for the codecs that don't tell.
+func addressDecodeOffset(err error) int {
+	var decodeErr *addressDecodeError
+	if errors.As(err, &decodeErr) {
+		return decodeErr.offset
+	}
+	return 0
+}
+
+var defaultAddressCodec AddressCodec = SOCKSAddressCodec{}
@@ -0,0 +1,200 @@
+package sudoku
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/metacubex/mihomo/log"
+)
+
+// Control frames share the datagram framing but carry a zero address length,
+// the payload length then covers a body of one control type byte followed by its data:
+//
+//	addrLen=0 (2B) | bodyLen (2B) | type (1B) | data
+//
+// A control frame with an empty body is a heartbeat, four zero bytes on the wire,
+// and is dropped by the reader without surfacing anything. Control frames are never padded
+// or checksummed, whatever the datagram frame options are.
+// Unknown control types are skipped, so new ones can be added without breaking peers
+// that already understand control frames. Only UoTPacketConn reads control frames,
+// ReadDatagram treats them as malformed, so they must only be enabled when the peer reads
+// through UoTPacketConn as well.
+const (
+	// uotControlStats carries the sender's cumulative datagrams (8B) and payload bytes (8B) written.
+	uotControlStats byte = 0x01
+	// uotControlFin has no data, the sender won't write anything after it, see CloseWrite.
+	uotControlFin byte = 0x03
+
+	maxUoTControlBody = 256
+)
+
+type uotPeerCounters struct {
+	reports           atomic.Uint64
+	datagramsMismatch atomic.Int64
+	bytesMismatch     atomic.Int64
+}
+
+// UoTCounterDiscrepancy compares the peer's reported writes with what this side received.
+// Since a report is written after the datagrams it counts, a healthy session reports zero,
+// a growing value points to lost datagrams or a framing bug.
+type UoTCounterDiscrepancy struct {
+	// Reports is the number of peer reports received so far
+	Reports   uint64
+	Datagrams int64
+	Bytes     int64
+}
+
+// CounterDiscrepancy returns the result of the latest peer report, see EnableStatsExchange.
+func (c *UoTPacketConn) CounterDiscrepancy() UoTCounterDiscrepancy {
+	return UoTCounterDiscrepancy{
+		Reports:   c.peer.reports.Load(),
+		Datagrams: c.peer.datagramsMismatch.Load(),
+		Bytes:     c.peer.bytesMismatch.Load(),
+	}
+}
+
+// EnableStatsExchange sends this side's cumulative write counters to the peer every interval,
+// the peer compares them against its own view in CounterDiscrepancy.
+// It is opt-in because of the extra traffic, and the peer must read through UoTPacketConn.
+// The reporting goroutine stops on Close or on the first write error.
+func (c *UoTPacketConn) EnableStatsExchange(interval time.Duration) {
+	c.runPeriodically(interval, "stats exchange", c.writeStatsReport)
+}
+
+// EnableKeepalive writes a heartbeat frame whenever nothing was written for interval,
+// so NATs and firewalls don't drop an idle tunnel. The peer must read through UoTPacketConn.
+// The heartbeat goroutine stops on Close or on the first write error.
+func (c *UoTPacketConn) EnableKeepalive(interval time.Duration) {
+	var lastWritten uint64
+	c.runPeriodically(interval, "keepalive", func() error {
+		c.writeMu.Lock()
+		defer c.writeMu.Unlock()
+		if written := c.counters.wireBytesWritten.Load(); written != lastWritten {
+			lastWritten = written
+			return nil
+		}
+		if err := c.writeControlFrameLocked(nil); err != nil {
+			return err
+		}
+		lastWritten = c.counters.wireBytesWritten.Load()
+		return nil
+	})
+}
+
+func (c *UoTPacketConn) runPeriodically(interval time.Duration, name string, fn func() error) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.done:
+				return
+			case <-ticker.C:
+				if err := fn(); err != nil {
+					log.Debugln("[Sudoku][UoT] stop %s: %v", name, err)
+					return
+				}
+			}
+		}
+	}()
+}
+
+func (c *UoTPacketConn) writeStatsReport() error {
+	var body [17]byte
+	body[0] = uotControlStats
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	// counters are read under writeMu, so the report can't overtake a datagram it counts
+	binary.BigEndian.PutUint64(body[1:9], c.counters.datagramsWritten.Load())
+	binary.BigEndian.PutUint64(body[9:], c.counters.bytesWritten.Load())
+	return c.writeControlFrameLocked(body[:])
+}
+
+// CloseWrite tells the peer that no more datagrams follow by writing a FIN control frame,
+// after which the peer's ReadFrom reports ErrPeerClosed once it has read everything sent before.
+// Later writes, heartbeats and stats reports fail with ErrWriteClosed, reading keeps working.
+func (c *UoTPacketConn) CloseWrite() error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if err := c.writeControlFrameLocked([]byte{uotControlFin}); err != nil {
+		return err
+	}
+	c.writeClosed = true
+	return nil
+}
+
+// writeControlFrameLocked must be called with writeMu held
+func (c *UoTPacketConn) writeControlFrameLocked(body []byte) error {
+	if c.writeClosed {
+		return ErrWriteClosed
+	}
+	wireLen, err := writeControlFrame(c.writerLocked(), body)
+	if err != nil {
+		return err
+	}
+	c.counters.wireBytesWritten.Add(uint64(wireLen))
+	return nil
+}
+
+func writeControlFrame(w io.Writer, body []byte) (int, error) {
+	if len(body) > maxUoTControlBody {
+		return 0, fmt.Errorf("control frame too large: %d", len(body))
+	}
+	var header [uotHeaderLen]byte
+	binary.BigEndian.PutUint16(header[2:], uint16(len(body)))
+	if err := writeChunksOnce(w, header[:], body); err != nil {
+		return 0, err
+	}
+	return uotHeaderLen + len(body), nil
+}
+
+// readControlFrame consumes the body of a control frame whose header was already read,
+// and returns the datagram completed by a fragment, if any.
+func (c *UoTPacketConn) readControlFrame(bodyLen int) (*uotDatagram, error) {
+	c.counters.wireBytesRead.Add(uint64(uotHeaderLen + bodyLen))
+	if bodyLen == 0 {
+		return nil, nil
+	}
+
+	var controlType [1]byte
+	if err := readFramePayload(&c.replay, controlType[:], uotHeaderLen); err != nil {
+		return nil, err
+	}
+	dataLen := bodyLen - 1
+	switch {
+	case controlType[0] == uotControlFragment && c.version >= UoTVersion2:
+		return c.readFragment(dataLen)
+	case controlType[0] == uotControlFin:
+		if err := discardBytes(&c.replay, dataLen); err != nil {
+			return nil, newFrameError(FrameStagePayload, uotHeaderLen+1, err)
+		}
+		c.peerClosed.Store(true)
+		return nil, ErrPeerClosed
+	case controlType[0] == uotControlStats:
+		if dataLen < 16 || dataLen > maxUoTControlBody {
+			return nil, newFrameError(FrameStagePayload, uotHeaderLen, fmt.Errorf("invalid stats control frame: %d", bodyLen))
+		}
+		var buf [maxUoTControlBody]byte
+		data := buf[:dataLen]
+		if err := readFramePayload(&c.replay, data, uotHeaderLen+1); err != nil {
+			return nil, err
+		}
+		peerDatagrams := binary.BigEndian.Uint64(data[0:8])
+		peerBytes := binary.BigEndian.Uint64(data[8:16])
+		c.peer.datagramsMismatch.Store(int64(peerDatagrams - c.counters.framesReceived.Load()))
+		c.peer.bytesMismatch.Store(int64(peerBytes - c.counters.frameBytesReceived.Load()))
+		c.peer.reports.Add(1)
+	default:
+		if err := discardBytes(&c.replay, dataLen); err != nil {
+			return nil, newFrameError(FrameStagePayload, uotHeaderLen+1, err)
+		}
+	}
+	return nil, nil
+}
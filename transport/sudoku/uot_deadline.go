@@ -0,0 +1,175 @@
+package sudoku
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// aLongTimeAgo is a deadline in the past, used to interrupt a blocked operation
+var aLongTimeAgo = time.Unix(1, 0)
+
+// keepDeadline leaves the deadline of the stream alone, for operations that only wait on uotDeadline.wait
+func keepDeadline(time.Time) error { return nil }
+
+// uotDeadline merges the deadline set through SetReadDeadline/SetWriteDeadline with the one
+// of a context bound operation, so neither clobbers the other: the earlier one applies while
+// the operation runs, and the caller's deadline is restored once it returns.
+type uotDeadline struct {
+	mu     sync.Mutex
+	user   time.Time
+	ctx    time.Time
+	active bool
+	// cancel is the Done channel of the context of the running operation
+	cancel <-chan struct{}
+}
+
+func (d *uotDeadline) setUser(set func(time.Time) error, t time.Time) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.user = t
+	return d.applyLocked(set)
+}
+
+// userDeadline returns the deadline set through SetReadDeadline/SetWriteDeadline
+func (d *uotDeadline) userDeadline() time.Time {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.user
+}
+
+// wait returns the deadline applying to the running operation, and the channel closed once its
+// context is done, for the waits of the operation that the conn deadline can't interrupt
+func (d *uotDeadline) wait() (time.Time, <-chan struct{}) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.active {
+		return d.user, nil
+	}
+	return d.effectiveLocked(), d.cancel
+}
+
+// armed reports whether a deadline may interrupt the operation, set by the user or by a context
+func (d *uotDeadline) armed() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return !d.user.IsZero() || d.active
+}
+
+func (d *uotDeadline) begin(set func(time.Time) error, t time.Time, cancel <-chan struct{}) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.active, d.ctx, d.cancel = true, t, cancel
+	return d.applyLocked(set)
+}
+
+func (d *uotDeadline) interrupt(set func(time.Time) error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.active {
+		d.ctx = aLongTimeAgo
+		_ = d.applyLocked(set)
+	}
+}
+
+func (d *uotDeadline) end(set func(time.Time) error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.active, d.ctx, d.cancel = false, time.Time{}, nil
+	_ = d.applyLocked(set)
+}
+
+func (d *uotDeadline) applyLocked(set func(time.Time) error) error {
+	return set(d.effectiveLocked())
+}
+
+// effectiveLocked returns the earlier of the user deadline and the one of the running operation
+func (d *uotDeadline) effectiveLocked() time.Time {
+	effective := d.user
+	if d.active && !d.ctx.IsZero() && (effective.IsZero() || d.ctx.Before(effective)) {
+		effective = d.ctx
+	}
+	return effective
+}
+
+// run runs fn with the deadline derived from ctx applied through set,
+// and interrupts it by moving the deadline to the past once ctx is done.
+// An fn interrupted by ctx reports the context error instead of a timeout of the conn.
+func (d *uotDeadline) run(ctx context.Context, set func(time.Time) error, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	deadline, hasDeadline := ctx.Deadline()
+	if err := d.begin(set, deadline, ctx.Done()); err != nil {
+		return err
+	}
+	defer d.end(set)
+
+	if ctx.Done() == nil {
+		return fn()
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			d.interrupt(set)
+		case <-done:
+		}
+	}()
+	err := fn()
+	close(done)
+	<-stopped
+
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		// the conn deadline may fire slightly before the context timer does
+		if hasDeadline && !time.Now().Before(deadline) {
+			return context.DeadlineExceeded
+		}
+	}
+	return err
+}
+
+// ReadFromContext is ReadFrom bounded by ctx, returning ctx.Err() once ctx is done.
+// A deadline set through SetReadDeadline still applies if it is earlier, and is kept afterwards.
+// A frame interrupted by ctx is read whole by the next read, see SetReadDeadline.
+// Like ReadFrom, it must not run concurrently with another read.
+func (c *UoTPacketConn) ReadFromContext(ctx context.Context, p []byte) (int, net.Addr, error) {
+	var n int
+	var addr net.Addr
+	err := c.readDeadline.run(ctx, c.conn.SetReadDeadline, func() error {
+		var err error
+		n, addr, err = c.ReadFrom(p)
+		return err
+	})
+	return n, addr, err
+}
+
+// WriteToContext is WriteTo bounded by ctx, returning ctx.Err() once ctx is done.
+// A deadline set through SetWriteDeadline still applies if it is earlier, and is kept afterwards.
+// With a write queue, ctx only bounds the wait for room in the queue: the stream is shared with
+// the flusher writing the frames accepted before, which ctx must not interrupt.
+func (c *UoTPacketConn) WriteToContext(ctx context.Context, p []byte, addr net.Addr) (int, error) {
+	if err := c.waitRateLimit(ctx, len(p)); err != nil {
+		return 0, err
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	set := c.conn.SetWriteDeadline
+	if c.queue != nil {
+		set = keepDeadline
+	}
+	var n int
+	err := c.writeDeadline.run(ctx, set, func() error {
+		var err error
+		n, err = c.writeToLocked(p, addr)
+		return err
+	})
+	return n, err
+}
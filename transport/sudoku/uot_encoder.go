@@ -0,0 +1,78 @@
+package sudoku
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Encoder writes datagram frames to a stream like WriteDatagram, reusing one scratch buffer
+// for the header, address and payload of every frame, so a steady stream of frames writes
+// without allocating. It is meant for a single goroutine and does no locking.
+type Encoder struct {
+	w   io.Writer
+	buf []byte
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// WriteDatagram writes one frame of payload to addr with a single write to the stream.
+func (e *Encoder) WriteDatagram(addr string, payload []byte) error {
+	// room for the header, filled in once the length of the address is known
+	buf, err := appendAddress(append(e.buf[:0], 0, 0, 0, 0), addr)
+	if err != nil {
+		return fmt.Errorf("encode address: %w", err)
+	}
+	e.buf = buf
+	addrLen := len(buf) - uotHeaderLen
+	if err := validateFrameAddress(buf[uotHeaderLen:], maxUoTPayload, payload); err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint16(buf[:2], uint16(addrLen))
+	binary.BigEndian.PutUint16(buf[2:uotHeaderLen], uint16(len(payload)))
+	e.buf = append(buf, payload...)
+	_, err = e.w.Write(e.buf)
+	return err
+}
+
+// Decoder reads datagram frames from a stream like ReadDatagram, reusing its header and
+// frame buffers across frames. It is meant for a single goroutine and does no locking.
+type Decoder struct {
+	r      io.Reader
+	header [uotHeaderLen]byte
+	buf    []byte
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: r}
+}
+
+// ReadDatagram reads the next frame, errors are reported as by ReadDatagram.
+// The payload is only valid until the next call, copy it to keep it.
+func (d *Decoder) ReadDatagram() (string, []byte, error) {
+	addrLen, payloadLen, err := readFrameHeaderInto(d.r, &d.header)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := validateFrameLengths(addrLen, minSOCKSAddressLen, payloadLen, maxUoTPayload); err != nil {
+		return "", nil, err
+	}
+	if size := addrLen + payloadLen; cap(d.buf) < size {
+		d.buf = make([]byte, size)
+	}
+	frame := d.buf[:addrLen+payloadLen]
+	if n, err := io.ReadFull(d.r, frame[:addrLen]); err != nil {
+		return "", nil, newFrameError(FrameStageAddress, uotHeaderLen+n, err)
+	}
+	addr, err := defaultAddressCodec.DecodeAddress(frame[:addrLen])
+	if err != nil {
+		return "", nil, newFrameError(FrameStageAddress, uotHeaderLen+addressDecodeOffset(err), fmt.Errorf("%w: %w", errDecodeAddress, err))
+	}
+	payload := frame[addrLen:]
+	if err := readFramePayload(d.r, payload, uotHeaderLen+addrLen); err != nil {
+		return "", nil, err
+	}
+	return addr, payload, nil
+}
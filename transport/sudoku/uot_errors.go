@@ -0,0 +1,77 @@
+package sudoku
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Protocol violations are reported wrapping one of these, so errors.Is tells a malformed frame
+// or address apart from a failure of the underlying conn.
+var (
+	ErrBadMagic             = errors.New("bad uot magic")
+	ErrUnsupportedVersion   = errors.New("unsupported uot version")
+	ErrInvalidAddressLength = errors.New("invalid address length")
+	ErrInvalidPayloadLength = errors.New("invalid payload length")
+	ErrInvalidPayloadLimit  = errors.New("uot payload limit out of range")
+	ErrAddressTooLong       = errors.New("address too long")
+	ErrPayloadTooLarge      = errors.New("payload too large")
+	ErrUnknownAddressType   = errors.New("unknown address type")
+	ErrChecksumMismatch     = errors.New("uot frame checksum mismatch")
+	ErrNoSyscallConn        = errors.New("uot conn has no syscall.Conn beneath")
+	ErrNoSocketBuffer       = errors.New("uot conn has no socket buffer to size")
+	ErrTooManyDiscards      = errors.New("too many consecutive uot datagrams discarded")
+	ErrSessionExists        = errors.New("uot session already open")
+	ErrAuthFailed           = errors.New("uot auth token mismatch")
+	ErrWriteQueueFull       = errors.New("uot write queue full")
+	ErrEmptyStreamSecret    = errors.New("empty uot stream secret")
+	ErrRateExceeded         = errors.New("uot datagram rate exceeded")
+	// ErrTruncatedFrame is wrapped with io.ErrUnexpectedEOF by a FrameError when the stream ends
+	// in the middle of a frame, while an end at a frame boundary is a plain io.EOF
+	ErrTruncatedFrame = errors.New("uot frame truncated")
+	// ErrAddressTypeNotAllowed is returned for an address of a type denied by SetAllowedAddressTypes
+	ErrAddressTypeNotAllowed = errors.New("uot address type not allowed")
+
+	// ErrPeerClosed is returned by reads after the peer called CloseWrite, or closed its UoTMux session
+	ErrPeerClosed = errors.New("uot peer closed for writing")
+	// ErrWriteClosed is returned by writes after CloseWrite
+	ErrWriteClosed = errors.New("uot conn closed for writing")
+	// ErrNamedSource is returned by ReadFromAddrPort for a datagram from a domain name
+	ErrNamedSource = errors.New("uot datagram source is a domain name")
+
+	// errDecodeAddress and errUnknownFrameFlags tell garbage in a frame apart for SetResync
+	errDecodeAddress     = errors.New("decode address")
+	errUnknownFrameFlags = errors.New("unknown frame flags")
+)
+
+// Stages of a UoT frame reported by FrameError.
+const (
+	FrameStageHeader  = "header"
+	FrameStageAddress = "address"
+	FrameStagePayload = "payload"
+)
+
+// FrameError describes where decoding a UoT frame failed.
+// Offset counts bytes from the start of the frame, and errors.Is/As see through to Err.
+type FrameError struct {
+	Stage  string
+	Offset int
+	Err    error
+}
+
+func (e *FrameError) Error() string {
+	return fmt.Sprintf("uot frame %s at offset %d: %v", e.Stage, e.Offset, e.Err)
+}
+
+func (e *FrameError) Unwrap() error {
+	return e.Err
+}
+
+// newFrameError reports an end of the stream from io.ReadFull or io.CopyN as a truncated frame,
+// so a frame cut short never passes for a clean close with errors.Is(err, io.EOF).
+func newFrameError(stage string, offset int, err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = fmt.Errorf("%w: %w", ErrTruncatedFrame, io.ErrUnexpectedEOF)
+	}
+	return &FrameError{Stage: stage, Offset: offset, Err: err}
+}
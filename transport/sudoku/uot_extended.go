@@ -0,0 +1,248 @@
+package sudoku
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	mathRand "math/rand"
+	"sync/atomic"
+
+	"github.com/metacubex/mihomo/common/pool"
+
+	"github.com/klauspost/compress/s2"
+)
+
+// From UoTVersion3 on, datagram frames carry a flags byte after the header naming the optional
+// sections present in that frame:
+//
+//	addrLen (2B) | payloadLen (2B) | flags (1B) | addr | payload | [padLen (2B) | padding] | [crc32c (4B)]
+//
+// payloadLen only covers the payload, so options never count against the payload limit.
+// A compressed payload is an S2 block, and decompresses to at most the payload limit.
+// Every frame describes itself, a reader handles any combination regardless of its own settings.
+// Control frames keep the plain header.
+const (
+	// uotFlagPadded appends padLen random bytes after the payload
+	uotFlagPadded byte = 0x01
+	// uotFlagChecksum appends the CRC32 (Castagnoli) of every preceding byte of the frame
+	uotFlagChecksum byte = 0x02
+	// uotFlagCompressed marks a payload compressed as an S2 block
+	uotFlagCompressed byte = 0x04
+
+	uotKnownFlags = uotFlagPadded | uotFlagChecksum | uotFlagCompressed
+
+	maxUoTPadding = 4096
+)
+
+var uotCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+// uotPadding holds the padding bounds as min<<32 | max, 0 when disabled
+type uotPadding struct {
+	bounds atomic.Uint64
+}
+
+func (p *uotPadding) next() (int, bool) {
+	bounds := p.bounds.Load()
+	if bounds == 0 {
+		return 0, false
+	}
+	minLen, maxLen := int(bounds>>32), int(uint32(bounds))
+	if maxLen == minLen {
+		return minLen, true
+	}
+	return minLen + mathRand.Intn(maxLen-minLen+1), true
+}
+
+func (c *UoTPacketConn) extendedFraming() bool {
+	return c.version >= UoTVersion3
+}
+
+// SetPadding appends min to max random bytes to every datagram frame, chosen per frame,
+// so frame sizes don't mirror the datagram sizes. It requires a conn negotiated at UoTVersion3
+// or later, max must not exceed 4096 and SetPadding(0, 0) disables padding.
+func (c *UoTPacketConn) SetPadding(min, max int) error {
+	if !c.extendedFraming() {
+		return fmt.Errorf("%w: padding needs version %d, conn uses %d", ErrUnsupportedVersion, UoTVersion3, c.version)
+	}
+	if min < 0 || max < min || max > maxUoTPadding {
+		return fmt.Errorf("invalid padding range [%d, %d]", min, max)
+	}
+	if max == 0 {
+		c.padding.bounds.Store(0)
+		return nil
+	}
+	c.padding.bounds.Store(uint64(min)<<32 | uint64(max))
+	return nil
+}
+
+// SetChecksum appends a CRC32C to every datagram frame, which the peer verifies and reports
+// as ErrChecksumMismatch, catching corruption introduced between the TCP endpoints such as by
+// an obfuscation layer. It requires a conn negotiated at UoTVersion3 or later.
+func (c *UoTPacketConn) SetChecksum(enabled bool) error {
+	if !c.extendedFraming() {
+		return fmt.Errorf("%w: checksums need version %d, conn uses %d", ErrUnsupportedVersion, UoTVersion3, c.version)
+	}
+	c.checksum.Store(enabled)
+	return nil
+}
+
+// SetCompression compresses the payloads of at least minSize bytes with S2, falling back to
+// sending a payload as is when it doesn't shrink. The peer decompresses transparently.
+// It requires a conn negotiated at UoTVersion3 or later.
+func (c *UoTPacketConn) SetCompression(enabled bool, minSize int) error {
+	if !c.extendedFraming() {
+		return fmt.Errorf("%w: compression needs version %d, conn uses %d", ErrUnsupportedVersion, UoTVersion3, c.version)
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.compress, c.compressMin = enabled, minSize
+	return nil
+}
+
+// writeExtendedFrameLocked must be called with writeMu held, it writes a UoTVersion3 datagram frame.
+// addrBuf is the encoded address, already validated for payload.
+func (c *UoTPacketConn) writeExtendedFrameLocked(w io.Writer, addrBuf, payload []byte) (int, error) {
+	var header [uotHeaderLen + 1]byte
+	saved := 0
+	if c.compress && len(payload) > 0 && len(payload) >= c.compressMin {
+		buf := pool.Get(s2.MaxEncodedLen(len(payload)))
+		defer pool.Put(buf)
+		if encoded := s2.Encode(buf, payload); len(encoded) < len(payload) {
+			header[4] |= uotFlagCompressed
+			saved = len(payload) - len(encoded)
+			payload = encoded
+		}
+	}
+	binary.BigEndian.PutUint16(header[:2], uint16(len(addrBuf)))
+	binary.BigEndian.PutUint16(header[2:4], uint16(len(payload)))
+	chunks := [][]byte{header[:], addrBuf, payload}
+
+	if padLen, ok := c.padding.next(); ok {
+		header[4] |= uotFlagPadded
+		padding := pool.Get(2 + padLen)
+		defer pool.Put(padding)
+		binary.BigEndian.PutUint16(padding[:2], uint16(padLen))
+		_, _ = rand.Read(padding[2:])
+		chunks = append(chunks, padding)
+	}
+	var sum [4]byte
+	if c.checksum.Load() {
+		header[4] |= uotFlagChecksum
+		var crc uint32
+		for _, chunk := range chunks {
+			crc = crc32.Update(crc, uotCRCTable, chunk)
+		}
+		binary.BigEndian.PutUint32(sum[:], crc)
+		chunks = append(chunks, sum[:])
+	}
+
+	wireLen := 0
+	for _, chunk := range chunks {
+		wireLen += len(chunk)
+	}
+	if err := writeChunksOnce(w, chunks...); err != nil {
+		return 0, err
+	}
+	c.frameSaved = saved
+	return wireLen, nil
+}
+
+// uotFrameReader reads the rest of a datagram frame after its header,
+// hashing everything read while the frame carries a checksum.
+type uotFrameReader struct {
+	r     io.Reader
+	flags byte
+	crc   hash.Hash32
+}
+
+// newExtendedFrameReader reads the flags byte of a UoTVersion3 datagram frame.
+func (c *UoTPacketConn) newExtendedFrameReader(addrLen, payloadLen int) (uotFrameReader, error) {
+	var flags [1]byte
+	if _, err := io.ReadFull(&c.replay, flags[:]); err != nil {
+		return uotFrameReader{}, newFrameError(FrameStageHeader, uotHeaderLen, err)
+	}
+	if unknown := flags[0] &^ uotKnownFlags; unknown != 0 {
+		return uotFrameReader{}, newFrameError(FrameStageHeader, uotHeaderLen, fmt.Errorf("%w 0x%02x", errUnknownFrameFlags, unknown))
+	}
+
+	frame := uotFrameReader{r: &c.replay, flags: flags[0]}
+	if frame.flags&uotFlagChecksum != 0 {
+		var header [uotHeaderLen + 1]byte
+		binary.BigEndian.PutUint16(header[:2], uint16(addrLen))
+		binary.BigEndian.PutUint16(header[2:4], uint16(payloadLen))
+		header[4] = frame.flags
+		frame.crc = crc32.New(uotCRCTable)
+		_, _ = frame.crc.Write(header[:])
+		frame.r = io.TeeReader(&c.replay, frame.crc)
+	}
+	return frame, nil
+}
+
+// finishFrame consumes the optional sections after the payload and verifies the checksum,
+// offset is the frame offset right after the payload.
+func (c *UoTPacketConn) finishFrame(frame uotFrameReader, offset int) error {
+	if frame.flags&uotFlagPadded != 0 {
+		var padLen [2]byte
+		if n, err := io.ReadFull(frame.r, padLen[:]); err != nil {
+			return newFrameError(FrameStagePayload, offset+n, err)
+		}
+		n := int(binary.BigEndian.Uint16(padLen[:]))
+		if err := discardBytes(frame.r, n); err != nil {
+			return newFrameError(FrameStagePayload, offset+2, err)
+		}
+		c.counters.wireBytesRead.Add(uint64(2 + n))
+		offset += 2 + n
+	}
+	if frame.crc != nil {
+		var sum [4]byte
+		if n, err := io.ReadFull(&c.replay, sum[:]); err != nil {
+			return newFrameError(FrameStagePayload, offset+n, err)
+		}
+		c.counters.wireBytesRead.Add(4)
+		if got, want := frame.crc.Sum32(), binary.BigEndian.Uint32(sum[:]); got != want {
+			return newFrameError(FrameStagePayload, offset, fmt.Errorf("%w: got %08x, frame carries %08x", ErrChecksumMismatch, got, want))
+		}
+	}
+	return nil
+}
+
+// readCompressedPayload reads a compressed payload into a pooled buffer and returns it with its decompressed length.
+// It finishes the frame first, so that a corrupted payload fails its checksum before the S2 block is decoded.
+func (c *UoTPacketConn) readCompressedPayload(frame uotFrameReader, payloadLen, offset int) ([]byte, int, error) {
+	compressed := pool.Get(payloadLen)
+	err := readFramePayload(frame.r, compressed, offset)
+	if err == nil {
+		err = c.finishFrame(frame, offset+payloadLen)
+	}
+	if err != nil {
+		_ = pool.Put(compressed)
+		return nil, 0, err
+	}
+	decodedLen, err := s2.DecodedLen(compressed)
+	if err == nil && decodedLen > c.maxPayload {
+		err = fmt.Errorf("%w: decompresses to %d", ErrPayloadTooLarge, decodedLen)
+	}
+	if err != nil {
+		_ = pool.Put(compressed)
+		return nil, 0, newFrameError(FrameStagePayload, offset, err)
+	}
+	return compressed, decodedLen, nil
+}
+
+func decompressPayload(dst, compressed []byte, offset int) error {
+	if _, err := s2.Decode(dst, compressed); err != nil {
+		return newFrameError(FrameStagePayload, offset, fmt.Errorf("decompress: %w", err))
+	}
+	return nil
+}
+
+// discardFrameRest skips the payload and the optional sections of a frame that won't be delivered.
+func (c *UoTPacketConn) discardFrameRest(frame uotFrameReader, payloadLen, offset int) error {
+	if err := discardBytes(frame.r, payloadLen); err != nil {
+		return newFrameError(FrameStagePayload, offset, err)
+	}
+	return c.finishFrame(frame, offset+payloadLen)
+}
@@ -0,0 +1,67 @@
+package sudoku
+
+// UoTFeatures describes what a UoTPacketConn ended up using, for logs and for debugging the interop
+// of client and server builds. Version, Magic, Authenticated and Wrapped are settled by the handshake,
+// the options below them reflect the settings of this side at the time of the call: the receiving side
+// of each one needs nothing but the version, so the peer may well use another subset.
+type UoTFeatures struct {
+	// Version is the negotiated framing version
+	Version byte
+	// Magic leads the preface and the sync markers
+	Magic byte
+	// Authenticated is set when the handshake carried an auth token, see UoTHandshakeOptions.AuthToken
+	Authenticated bool
+	// Wrapped is set when the stream passes through a StreamWrapper
+	Wrapped bool
+	// ExtendedFraming is set from UoTVersion3 on, whose frames may be padded, checksummed or compressed
+	ExtendedFraming bool
+	// Reassembly is set from UoTVersion2 on, whose conns reassemble the fragments of the peer
+	Reassembly bool
+
+	// Padding is set by SetPadding, with its bounds in PaddingMin and PaddingMax
+	Padding    bool
+	PaddingMin int
+	PaddingMax int
+	// Checksum is set by SetChecksum
+	Checksum bool
+	// Compression is set by SetCompression, for payloads of at least CompressionMinSize bytes
+	Compression        bool
+	CompressionMinSize int
+	// Fragmentation is set by EnableFragmentation
+	Fragmentation bool
+	// Resync is set by SetResync
+	Resync bool
+}
+
+// uotHandshakeInfo is what the handshake of a conn used beyond its version and magic
+type uotHandshakeInfo struct {
+	authenticated bool
+	wrapped       bool
+}
+
+func (o UoTHandshakeOptions) handshakeInfo() uotHandshakeInfo {
+	return uotHandshakeInfo{authenticated: len(o.AuthToken) > 0, wrapped: o.Wrapper != nil}
+}
+
+// Features returns the negotiated version and the optional behaviors active on this conn
+func (c *UoTPacketConn) Features() UoTFeatures {
+	features := UoTFeatures{
+		Version:         c.version,
+		Magic:           c.magic,
+		Authenticated:   c.handshake.authenticated,
+		Wrapped:         c.handshake.wrapped,
+		ExtendedFraming: c.extendedFraming(),
+		Reassembly:      c.version >= UoTVersion2,
+		Checksum:        c.checksum.Load(),
+		Resync:          c.resync.Load(),
+	}
+	if bounds := c.padding.bounds.Load(); bounds != 0 {
+		features.Padding = true
+		features.PaddingMin, features.PaddingMax = int(bounds>>32), int(uint32(bounds))
+	}
+	c.writeMu.Lock()
+	features.Compression, features.CompressionMinSize = c.compress, c.compressMin
+	features.Fragmentation = c.fragmentWrites
+	c.writeMu.Unlock()
+	return features
+}
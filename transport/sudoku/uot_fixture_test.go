@@ -0,0 +1,78 @@
+package sudoku_test
+
+import (
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/metacubex/mihomo/transport/sudoku"
+	"github.com/metacubex/mihomo/transport/sudoku/uottest"
+)
+
+func TestDefaultAddressCodecFixtures(t *testing.T) {
+	uottest.AssertAddressRoundTrip(t, sudoku.SOCKSAddressCodec{})
+}
+
+func TestLossyConn(t *testing.T) {
+	run := func(config uottest.LossyConfig) ([]int, *uottest.LossyConn) {
+		clientConn, serverConn := net.Pipe()
+		defer serverConn.Close()
+		lossy := uottest.NewLossyConn(clientConn, config)
+		client := sudoku.NewUoTPacketConn(lossy)
+		server := sudoku.NewUoTPacketConn(serverConn)
+
+		dst := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 53}
+		go func() {
+			defer client.Close()
+			for i := 0; i < 200; i++ {
+				if _, err := client.WriteTo([]byte(strconv.Itoa(i)), dst); err != nil {
+					return
+				}
+			}
+		}()
+
+		var received []int
+		buf := make([]byte, 16)
+		for {
+			n, _, err := server.ReadFrom(buf)
+			if err != nil {
+				break
+			}
+			seq, err := strconv.Atoi(string(buf[:n]))
+			if err != nil {
+				t.Fatalf("garbled datagram %q", buf[:n])
+			}
+			received = append(received, seq)
+		}
+		return received, lossy
+	}
+
+	config := uottest.LossyConfig{Seed: 7, DropRate: 0.1, ReorderRate: 0.1}
+	received, lossy := run(config)
+	if lossy.Dropped() == 0 || lossy.Reordered() == 0 {
+		t.Fatalf("dropped %d, reordered %d", lossy.Dropped(), lossy.Reordered())
+	}
+	// a write held back at the end is lost with the conn
+	if lost := 200 - len(received); lost < lossy.Dropped() || lost > lossy.Dropped()+1 {
+		t.Fatalf("received %d of 200 with %d dropped", len(received), lossy.Dropped())
+	}
+	swapped := 0
+	for i := 1; i < len(received); i++ {
+		if received[i] < received[i-1] {
+			swapped++
+		}
+	}
+	if swapped == 0 || swapped > lossy.Reordered() {
+		t.Fatalf("%d datagrams out of order with %d reordered", swapped, lossy.Reordered())
+	}
+
+	again, _ := run(config)
+	if !reflect.DeepEqual(received, again) {
+		t.Fatal("same seed gave different outcomes")
+	}
+	if clean, _ := run(uottest.LossyConfig{}); len(clean) != 200 || !sort.IntsAreSorted(clean) {
+		t.Fatalf("zero config mangled the stream: %v", clean)
+	}
+}
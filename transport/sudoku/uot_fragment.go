@@ -0,0 +1,228 @@
+package sudoku
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/metacubex/mihomo/log"
+)
+
+// Datagrams larger than a single frame can carry are split into fragment control frames,
+// which are only understood from UoTVersion2 on:
+//
+//	type=0x02 (1B) | datagram id (4B) | index (2B) | count (2B) | addrLen (2B) | addr | chunk
+//
+// Every fragment carries the address, so fragments of a datagram may arrive in any order
+// and be interleaved with other frames. A version 1 peer skips them as an unknown control type.
+const (
+	uotControlFragment byte = 0x02
+
+	uotFragmentHeaderLen = 1 + 4 + 2 + 2 + 2
+
+	// maxUoTFragmentedPayload bounds a reassembled datagram
+	maxUoTFragmentedPayload = 1 << 20
+	// maxUoTPendingDatagrams bounds the datagrams being reassembled at once, the oldest one is dropped beyond it
+	maxUoTPendingDatagrams = 16
+
+	defaultUoTFragmentTimeout = 10 * time.Second
+)
+
+type uotDatagram struct {
+	addr    string
+	payload []byte
+}
+
+type uotPartialDatagram struct {
+	addr  string
+	count int
+	// chunks is keyed by fragment index and grows as fragments arrive, count comes off the wire
+	// and would let a single fragment reserve room for 65535 of them
+	chunks   map[int][]byte
+	received int
+	size     int
+	deadline time.Time
+}
+
+// fragmentChunkSize is how much of a datagram fits in one fragment next to an address of addrLen bytes
+func fragmentChunkSize(maxPayload, addrLen int) int {
+	chunkSize := maxUoTPayload - uotFragmentHeaderLen - addrLen
+	if maxPayload < chunkSize {
+		chunkSize = maxPayload
+	}
+	return chunkSize
+}
+
+// maxFragmentedDatagramSize is the largest datagram fragments next to an address of addrLen bytes carry,
+// bounded by the reassembly limit and by the 16-bit fragment count.
+func maxFragmentedDatagramSize(maxPayload, addrLen int) int {
+	size := fragmentChunkSize(maxPayload, addrLen) * 0xffff
+	if size > maxUoTFragmentedPayload {
+		size = maxUoTFragmentedPayload
+	}
+	return size
+}
+
+// uotReassembly is only used by the reading goroutine, except for timeout
+type uotReassembly struct {
+	timeout atomic.Int64
+	pending map[uint32]*uotPartialDatagram
+}
+
+// EnableFragmentation lets WriteTo split payloads above MaxPayload into fragments instead of failing,
+// it requires a conn negotiated at UoTVersion2 or later.
+// timeout bounds how long this side keeps the fragments of an incomplete datagram, 0 keeps the default.
+// Receiving fragments doesn't need this, a UoTVersion2 conn always reassembles them.
+func (c *UoTPacketConn) EnableFragmentation(timeout time.Duration) error {
+	if c.version < UoTVersion2 {
+		return fmt.Errorf("%w: fragmentation needs version %d, conn uses %d", ErrUnsupportedVersion, UoTVersion2, c.version)
+	}
+	c.writeMu.Lock()
+	c.fragmentWrites = true
+	c.writeMu.Unlock()
+	if timeout > 0 {
+		c.reassembly.timeout.Store(int64(timeout))
+	}
+	return nil
+}
+
+// writeFragmentsLocked must be called with writeMu held, it returns the size of all fragments on the wire.
+func (c *UoTPacketConn) writeFragmentsLocked(w io.Writer, addrBuf, payload []byte) (int, error) {
+	chunkSize := fragmentChunkSize(c.maxPayload, len(addrBuf))
+	if len(addrBuf) == 0 {
+		return 0, fmt.Errorf("%w: empty encoded address", ErrInvalidAddressLength)
+	} else if chunkSize <= 0 {
+		return 0, fmt.Errorf("%w: %d", ErrAddressTooLong, len(addrBuf))
+	}
+	if len(payload) > maxFragmentedDatagramSize(c.maxPayload, len(addrBuf)) {
+		return 0, fmt.Errorf("%w: %d", ErrPayloadTooLarge, len(payload))
+	}
+
+	count := (len(payload) + chunkSize - 1) / chunkSize
+	c.fragmentID++
+	var header [uotHeaderLen + uotFragmentHeaderLen]byte
+	fragmentHeader := header[uotHeaderLen:]
+	fragmentHeader[0] = uotControlFragment
+	binary.BigEndian.PutUint32(fragmentHeader[1:5], c.fragmentID)
+	binary.BigEndian.PutUint16(fragmentHeader[7:9], uint16(count))
+	binary.BigEndian.PutUint16(fragmentHeader[9:11], uint16(len(addrBuf)))
+
+	wireLen := 0
+	for index := 0; index < count; index++ {
+		chunk := payload[index*chunkSize:]
+		if len(chunk) > chunkSize {
+			chunk = chunk[:chunkSize]
+		}
+		bodyLen := uotFragmentHeaderLen + len(addrBuf) + len(chunk)
+		binary.BigEndian.PutUint16(header[2:4], uint16(bodyLen))
+		binary.BigEndian.PutUint16(fragmentHeader[5:7], uint16(index))
+		if err := writeChunksOnce(w, header[:], addrBuf, chunk); err != nil {
+			return wireLen, err
+		}
+		wireLen += uotHeaderLen + bodyLen
+	}
+	return wireLen, nil
+}
+
+// readFragment consumes a fragment control frame whose type byte was already read,
+// and returns the reassembled datagram once its last fragment arrived.
+func (c *UoTPacketConn) readFragment(dataLen int) (*uotDatagram, error) {
+	const offset = uotHeaderLen + 1
+	if dataLen < uotFragmentHeaderLen-1 {
+		return nil, newFrameError(FrameStagePayload, offset, fmt.Errorf("short fragment control frame: %d", dataLen))
+	}
+	data := make([]byte, dataLen)
+	if err := readFramePayload(&c.replay, data, offset); err != nil {
+		return nil, err
+	}
+
+	id := binary.BigEndian.Uint32(data[0:4])
+	index := int(binary.BigEndian.Uint16(data[4:6]))
+	count := int(binary.BigEndian.Uint16(data[6:8]))
+	addrLen := int(binary.BigEndian.Uint16(data[8:10]))
+	if addrLen == 0 || addrLen > len(data)-10 {
+		return nil, newFrameError(FrameStagePayload, offset+8, fmt.Errorf("%w: %d", ErrInvalidAddressLength, addrLen))
+	}
+	if count == 0 || index >= count {
+		return nil, newFrameError(FrameStagePayload, offset+4, fmt.Errorf("invalid fragment %d of %d", index, count))
+	}
+	addr, err := c.codec.DecodeAddress(data[10 : 10+addrLen])
+	if err != nil {
+		return nil, newFrameError(FrameStagePayload, offset+10+addressDecodeOffset(err), fmt.Errorf("decode address: %w", err))
+	}
+
+	return c.reassembly.add(id, index, count, addr, data[10+addrLen:]), nil
+}
+
+// add stores one fragment and returns the datagram it completes, if any.
+// Incomplete datagrams expire lazily whenever a new fragment arrives.
+func (r *uotReassembly) add(id uint32, index, count int, addr string, chunk []byte) *uotDatagram {
+	now := time.Now()
+	r.expire(now)
+	if r.pending == nil {
+		r.pending = make(map[uint32]*uotPartialDatagram)
+	}
+
+	partial := r.pending[id]
+	if partial != nil && (partial.count != count || partial.addr != addr) {
+		log.Debugln("[Sudoku][UoT] discard datagram %d with inconsistent fragments", id)
+		delete(r.pending, id)
+		partial = nil
+	}
+	if partial == nil {
+		if len(r.pending) >= maxUoTPendingDatagrams {
+			r.evictOldest()
+		}
+		timeout := time.Duration(r.timeout.Load())
+		if timeout <= 0 {
+			timeout = defaultUoTFragmentTimeout
+		}
+		partial = &uotPartialDatagram{addr: addr, count: count, chunks: make(map[int][]byte), deadline: now.Add(timeout)}
+		r.pending[id] = partial
+	}
+	if _, dup := partial.chunks[index]; dup {
+		return nil
+	}
+	if partial.size+len(chunk) > maxUoTFragmentedPayload {
+		log.Debugln("[Sudoku][UoT] discard datagram %d larger than %d bytes", id, maxUoTFragmentedPayload)
+		delete(r.pending, id)
+		return nil
+	}
+	partial.chunks[index] = chunk
+	partial.received++
+	partial.size += len(chunk)
+	if partial.received < count {
+		return nil
+	}
+
+	delete(r.pending, id)
+	payload := make([]byte, 0, partial.size)
+	for i := 0; i < count; i++ {
+		payload = append(payload, partial.chunks[i]...)
+	}
+	return &uotDatagram{addr: partial.addr, payload: payload}
+}
+
+func (r *uotReassembly) expire(now time.Time) {
+	for id, partial := range r.pending {
+		if now.After(partial.deadline) {
+			log.Debugln("[Sudoku][UoT] discard datagram %d after %d of %d fragments", id, partial.received, partial.count)
+			delete(r.pending, id)
+		}
+	}
+}
+
+func (r *uotReassembly) evictOldest() {
+	var oldestID uint32
+	var oldest *uotPartialDatagram
+	for id, partial := range r.pending {
+		if oldest == nil || partial.deadline.Before(oldest.deadline) {
+			oldestID, oldest = id, partial
+		}
+	}
+	if oldest != nil {
+		delete(r.pending, oldestID)
+	}
+}
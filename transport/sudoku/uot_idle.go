@@ -0,0 +1,81 @@
+package sudoku
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/metacubex/mihomo/log"
+)
+
+var ErrIdleTimeout = errors.New("uot conn closed after idle timeout")
+
+// uotIdle tracks datagram activity for SetIdleTimeout. Traffic only stores a timestamp,
+// the watcher goroutine rearms its timer from it, so no timer is touched per datagram.
+type uotIdle struct {
+	mu      sync.Mutex
+	stop    chan struct{}
+	timeout atomic.Int64
+	last    atomic.Int64
+	expired atomic.Bool
+}
+
+// SetIdleTimeout closes the conn once no datagram was read or written for d,
+// later operations then fail with ErrIdleTimeout. Control frames such as heartbeats
+// don't count as activity. A zero or negative d disables the timeout.
+func (c *UoTPacketConn) SetIdleTimeout(d time.Duration) {
+	idle := &c.idle
+	idle.mu.Lock()
+	defer idle.mu.Unlock()
+	if idle.stop != nil {
+		close(idle.stop)
+		idle.stop = nil
+	}
+	idle.timeout.Store(int64(d))
+	if d <= 0 {
+		return
+	}
+	idle.last.Store(time.Now().UnixNano())
+	stop := make(chan struct{})
+	idle.stop = stop
+	go c.watchIdle(d, stop)
+}
+
+func (c *UoTPacketConn) watchIdle(d time.Duration, stop chan struct{}) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-stop:
+			return
+		case <-timer.C:
+			idleFor := time.Since(time.Unix(0, c.idle.last.Load()))
+			if idleFor < d {
+				timer.Reset(d - idleFor)
+				continue
+			}
+			log.Debugln("[Sudoku][UoT] close conn idle for %v", idleFor)
+			c.idle.expired.Store(true)
+			_ = c.Close()
+			return
+		}
+	}
+}
+
+// touchIdle records datagram activity while an idle timeout is set
+func (c *UoTPacketConn) touchIdle() {
+	if c.idle.timeout.Load() > 0 {
+		c.idle.last.Store(time.Now().UnixNano())
+	}
+}
+
+// idleError reports ErrIdleTimeout for operations failing because the idle timeout closed the conn
+func (c *UoTPacketConn) idleError(err error) error {
+	if err != nil && c.idle.expired.Load() {
+		return ErrIdleTimeout
+	}
+	return err
+}
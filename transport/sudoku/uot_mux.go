@@ -0,0 +1,415 @@
+package sudoku
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/metacubex/mihomo/common/pool"
+	"github.com/metacubex/mihomo/log"
+)
+
+// UoTVersion4 prefixes every frame with a 4-byte session id, so several logical UDP sockets
+// share one stream:
+//
+//	session id (4B) | addrLen (2B) | payloadLen (2B) | addr | payload
+//
+// Behind the session id frames keep the version 1 layout, including control frames with a zero
+// address length. Only a UoTMux speaks it, a UoTPacketConn must not be negotiated at this version,
+// so both sides negotiate with []byte{UoTVersion4} before wrapping the conn in NewUoTMux.
+const (
+	// uotControlSessionClose has no data, the sender closed the session named by the frame
+	uotControlSessionClose byte = 0x04
+
+	uotMuxHeaderLen = 4 + uotHeaderLen
+
+	// uotMuxSessionQueue bounds the datagrams waiting to be read by a single session,
+	// datagrams beyond it are dropped so a slow session never stalls the shared read loop.
+	uotMuxSessionQueue = 64
+)
+
+// UoTMux demultiplexes the sessions of a stream negotiated at UoTVersion4.
+// A single goroutine reads the stream and routes datagrams to the session they name,
+// datagrams for sessions that aren't open on this side are dropped.
+type UoTMux struct {
+	conn    net.Conn
+	writeMu sync.Mutex
+
+	mu       sync.Mutex
+	sessions map[uint32]*uotMuxSession
+	closeErr error
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+type uotMuxDatagram struct {
+	addr    net.Addr
+	payload []byte
+}
+
+// NewUoTMux starts demultiplexing conn, which must already be negotiated at UoTVersion4.
+func NewUoTMux(conn net.Conn) *UoTMux {
+	m := &UoTMux{
+		conn:     conn,
+		sessions: make(map[uint32]*uotMuxSession),
+		done:     make(chan struct{}),
+	}
+	go m.readLoop()
+	return m
+}
+
+// OpenSession returns the packet conn of session id, both peers open the same ids to talk to each other.
+// Closing it sends a session close frame, after which the peer's session reads ErrPeerClosed.
+func (m *UoTMux) OpenSession(id uint32) (net.PacketConn, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.sessions == nil {
+		return nil, m.closeErr
+	}
+	if _, ok := m.sessions[id]; ok {
+		return nil, fmt.Errorf("%w: %d", ErrSessionExists, id)
+	}
+	s := &uotMuxSession{
+		mux:          m,
+		id:           id,
+		queue:        make(chan uotMuxDatagram, uotMuxSessionQueue),
+		closed:       make(chan struct{}),
+		remoteClosed: make(chan struct{}),
+	}
+	m.sessions[id] = s
+	return s, nil
+}
+
+// Done is closed once the stream failed or the mux was closed
+func (m *UoTMux) Done() <-chan struct{} {
+	return m.done
+}
+
+// Close closes the stream and every session on it
+func (m *UoTMux) Close() error {
+	m.closeWithError(net.ErrClosed)
+	return nil
+}
+
+func (m *UoTMux) closeWithError(err error) {
+	m.closeOnce.Do(func() {
+		m.mu.Lock()
+		m.closeErr = err
+		m.sessions = nil
+		m.mu.Unlock()
+		close(m.done)
+		_ = m.conn.Close()
+	})
+}
+
+func (m *UoTMux) err() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.closeErr
+}
+
+func (m *UoTMux) session(id uint32) *uotMuxSession {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.sessions[id]
+}
+
+func (m *UoTMux) removeSession(s *uotMuxSession) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.sessions[s.id] == s {
+		delete(m.sessions, s.id)
+	}
+}
+
+func (m *UoTMux) readLoop() {
+	for {
+		if err := m.readFrame(); err != nil {
+			m.closeWithError(err)
+			return
+		}
+	}
+}
+
+func (m *UoTMux) readFrame() error {
+	var id [4]byte
+	if _, err := io.ReadFull(m.conn, id[:]); err != nil {
+		return err
+	}
+	session := m.session(binary.BigEndian.Uint32(id[:]))
+	addrLen, payloadLen, err := readFrameHeader(m.conn)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			err = newFrameError(FrameStageHeader, 4, io.ErrUnexpectedEOF)
+		}
+		return err
+	}
+
+	if addrLen == 0 {
+		if payloadLen == 0 {
+			return nil
+		}
+		var controlType [1]byte
+		if err := readFramePayload(m.conn, controlType[:], uotMuxHeaderLen); err != nil {
+			return err
+		}
+		if err := discardBytes(m.conn, payloadLen-1); err != nil {
+			return newFrameError(FrameStagePayload, uotMuxHeaderLen+1, err)
+		}
+		if controlType[0] == uotControlSessionClose && session != nil {
+			session.closeRemote()
+		}
+		return nil
+	}
+
+	addr, offset, err := readFrameAddress(m.conn, defaultAddressCodec, maxUoTPayload, uotMuxHeaderLen, addrLen, payloadLen)
+	if err != nil {
+		return err
+	}
+	if session == nil {
+		if err := discardBytes(m.conn, payloadLen); err != nil {
+			return newFrameError(FrameStagePayload, offset, err)
+		}
+		return nil
+	}
+	payload := pool.Get(payloadLen)
+	if err := readFramePayload(m.conn, payload, offset); err != nil {
+		_ = pool.Put(payload)
+		return err
+	}
+	from, err := parseDatagramAddr(addr)
+	if err != nil {
+		log.Debugln("[Sudoku][UoT] discard session %d datagram with invalid address %s: %v", session.id, addr, err)
+		_ = pool.Put(payload)
+		return nil
+	}
+	session.enqueue(uotMuxDatagram{addr: from, payload: payload})
+	return nil
+}
+
+func (m *UoTMux) writeFrame(id uint32, addr net.Addr, payload []byte) error {
+	addrBuf, ok, err := appendNetAddr(make([]byte, 0, maxIPAddressLen), addr)
+	if !ok && err == nil {
+		addrBuf, err = EncodeAddress(addr.String())
+	}
+	if err != nil {
+		return fmt.Errorf("encode address: %w", err)
+	}
+	if err := validateFrameAddress(addrBuf, maxUoTPayload, payload); err != nil {
+		return err
+	}
+	var header [uotMuxHeaderLen]byte
+	binary.BigEndian.PutUint32(header[:4], id)
+	binary.BigEndian.PutUint16(header[4:6], uint16(len(addrBuf)))
+	binary.BigEndian.PutUint16(header[6:], uint16(len(payload)))
+	return m.write(header[:], addrBuf, payload)
+}
+
+func (m *UoTMux) writeSessionClose(id uint32) error {
+	var frame [uotMuxHeaderLen + 1]byte
+	binary.BigEndian.PutUint32(frame[:4], id)
+	binary.BigEndian.PutUint16(frame[6:8], 1)
+	frame[8] = uotControlSessionClose
+	return m.write(frame[:])
+}
+
+func (m *UoTMux) write(chunks ...[]byte) error {
+	m.writeMu.Lock()
+	defer m.writeMu.Unlock()
+	select {
+	case <-m.done:
+		return m.err()
+	default:
+	}
+	if err := writeChunksOnce(m.conn, chunks...); err != nil {
+		m.closeWithError(err)
+		return err
+	}
+	return nil
+}
+
+// uotMuxSession is the net.PacketConn of one session of a UoTMux.
+// Its write deadline is only checked before writing, a write in progress on the shared stream isn't interrupted.
+type uotMuxSession struct {
+	mux   *UoTMux
+	id    uint32
+	queue chan uotMuxDatagram
+
+	closeOnce    sync.Once
+	closed       chan struct{}
+	remoteOnce   sync.Once
+	remoteClosed chan struct{}
+
+	readDeadline  chanDeadline
+	writeDeadline chanDeadline
+}
+
+// enqueue is only called by the read loop, a full queue drops the datagram instead of blocking.
+func (s *uotMuxSession) enqueue(datagram uotMuxDatagram) {
+	select {
+	case s.queue <- datagram:
+	default:
+		log.Debugln("[Sudoku][UoT] discard session %d datagram from %s: read queue full", s.id, datagram.addr)
+		_ = pool.Put(datagram.payload)
+	}
+}
+
+func (s *uotMuxSession) closeRemote() {
+	s.remoteOnce.Do(func() {
+		close(s.remoteClosed)
+	})
+}
+
+func (s *uotMuxSession) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case datagram := <-s.queue:
+		return s.deliver(datagram, p)
+	default:
+	}
+
+	select {
+	case datagram := <-s.queue:
+		return s.deliver(datagram, p)
+	case <-s.closed:
+		return 0, nil, net.ErrClosed
+	case <-s.readDeadline.wait():
+		return 0, nil, os.ErrDeadlineExceeded
+	case <-s.remoteClosed:
+		return s.drain(p, ErrPeerClosed)
+	case <-s.mux.done:
+		return s.drain(p, s.mux.err())
+	}
+}
+
+// drain delivers what was queued before the session or the mux was closed, then reports err.
+func (s *uotMuxSession) drain(p []byte, err error) (int, net.Addr, error) {
+	select {
+	case datagram := <-s.queue:
+		return s.deliver(datagram, p)
+	default:
+		return 0, nil, err
+	}
+}
+
+func (s *uotMuxSession) deliver(datagram uotMuxDatagram, p []byte) (int, net.Addr, error) {
+	defer pool.Put(datagram.payload)
+	if len(datagram.payload) > len(p) {
+		return 0, nil, io.ErrShortBuffer
+	}
+	return copy(p, datagram.payload), datagram.addr, nil
+}
+
+func (s *uotMuxSession) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if addr == nil {
+		return 0, errors.New("address is nil")
+	}
+	select {
+	case <-s.closed:
+		return 0, net.ErrClosed
+	case <-s.writeDeadline.wait():
+		return 0, os.ErrDeadlineExceeded
+	default:
+	}
+	if err := s.mux.writeFrame(s.id, addr, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (s *uotMuxSession) Close() error {
+	err := net.ErrClosed
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		s.mux.removeSession(s)
+		err = s.mux.writeSessionClose(s.id)
+	})
+	return err
+}
+
+func (s *uotMuxSession) LocalAddr() net.Addr {
+	return s.mux.conn.LocalAddr()
+}
+
+func (s *uotMuxSession) SetDeadline(t time.Time) error {
+	s.readDeadline.set(t)
+	s.writeDeadline.set(t)
+	return nil
+}
+
+func (s *uotMuxSession) SetReadDeadline(t time.Time) error {
+	s.readDeadline.set(t)
+	return nil
+}
+
+func (s *uotMuxSession) SetWriteDeadline(t time.Time) error {
+	s.writeDeadline.set(t)
+	return nil
+}
+
+// chanDeadline is a deadline that can be waited on in a select, its channel is closed once it passes.
+// The zero value has no deadline set.
+type chanDeadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func (d *chanDeadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.cancel == nil {
+		d.cancel = make(chan struct{})
+	}
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel
+	}
+	d.timer = nil
+
+	closed := isClosedChan(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() {
+			close(cancel)
+		})
+		return
+	}
+
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+func (d *chanDeadline) wait() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.cancel == nil {
+		d.cancel = make(chan struct{})
+	}
+	return d.cancel
+}
+
+func isClosedChan(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
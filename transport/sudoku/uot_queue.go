@@ -0,0 +1,138 @@
+package sudoku
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/metacubex/mihomo/common/pool"
+)
+
+// defaultUoTQueueDrainTimeout bounds how long Close waits for queued frames to reach a slow peer
+const defaultUoTQueueDrainTimeout = 5 * time.Second
+
+// uotWriteQueue hands complete frames over to a flusher goroutine writing them to the stream,
+// so writers only hold writeMu for as long as it takes to encode a frame.
+type uotWriteQueue struct {
+	conn     *UoTPacketConn
+	frames   chan []byte
+	drained  chan struct{}
+	errMu    sync.Mutex
+	flushErr error
+}
+
+// SetWriteQueue makes writes enqueue their frames for a background flusher instead of writing
+// to the stream themselves, depth bounds the frames waiting. With the queue full a write fails
+// with ErrWriteQueueFull, or waits for room until the write deadline when one is set,
+// and for WriteToContext until its context is done.
+// Once the flusher failed to write, later writes report its error.
+// Close flushes what is queued before closing the stream, waiting up to 5 seconds for a slow peer.
+// depth <= 0 flushes and stops the queue, writing to the stream directly again.
+func (c *UoTPacketConn) SetWriteQueue(depth int) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.queue != nil {
+		c.queue.stop()
+		c.queue = nil
+	}
+	if depth <= 0 || isClosedChan(c.done) {
+		return
+	}
+	c.queue = &uotWriteQueue{
+		conn:    c,
+		frames:  make(chan []byte, depth),
+		drained: make(chan struct{}),
+	}
+	go c.queue.flush(c.conn)
+}
+
+// writerLocked returns where frames are written, it must be called with writeMu held
+func (c *UoTPacketConn) writerLocked() io.Writer {
+	if c.queue != nil {
+		return c.queue
+	}
+	return c.conn
+}
+
+// stopQueue flushes and stops the write queue, if any, before the stream is closed
+func (c *UoTPacketConn) stopQueue() {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.queue != nil {
+		c.queue.stop()
+		c.queue = nil
+	}
+}
+
+// Write enqueues a copy of one complete frame, it is called with writeMu held.
+func (q *uotWriteQueue) Write(p []byte) (int, error) {
+	if err := q.err(); err != nil {
+		return 0, err
+	}
+	frame := pool.Get(len(p))
+	copy(frame, p)
+	select {
+	case q.frames <- frame:
+		return len(p), nil
+	default:
+	}
+
+	// a WriteToContext done with its context reports ctx.Err() in place of the timeout
+	deadline, cancel := q.conn.writeDeadline.wait()
+	if deadline.IsZero() && cancel == nil {
+		_ = pool.Put(frame)
+		return 0, ErrWriteQueueFull
+	}
+	var expired <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case q.frames <- frame:
+		return len(p), nil
+	case <-expired:
+		_ = pool.Put(frame)
+		return 0, os.ErrDeadlineExceeded
+	case <-cancel:
+		_ = pool.Put(frame)
+		return 0, os.ErrDeadlineExceeded
+	case <-q.conn.done:
+		_ = pool.Put(frame)
+		return 0, net.ErrClosed
+	}
+}
+
+func (q *uotWriteQueue) flush(w io.Writer) {
+	defer close(q.drained)
+	for frame := range q.frames {
+		if q.err() == nil {
+			if _, err := w.Write(frame); err != nil {
+				q.errMu.Lock()
+				q.flushErr = err
+				q.errMu.Unlock()
+			}
+		}
+		_ = pool.Put(frame)
+	}
+}
+
+func (q *uotWriteQueue) err() error {
+	q.errMu.Lock()
+	defer q.errMu.Unlock()
+	return q.flushErr
+}
+
+// stop closes the queue once it is detached from writers, and waits for the flusher to drain it.
+func (q *uotWriteQueue) stop() {
+	close(q.frames)
+	timer := time.NewTimer(defaultUoTQueueDrainTimeout)
+	defer timer.Stop()
+	select {
+	case <-q.drained:
+	case <-timer.C:
+	}
+}
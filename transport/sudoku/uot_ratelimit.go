@@ -0,0 +1,183 @@
+package sudoku
+
+import (
+	"context"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// uotClock is the time source of the rate limiter, replaced by tests
+type uotClock interface {
+	Now() time.Time
+	// At fires once t is reached
+	At(t time.Time) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                  { return time.Now() }
+func (systemClock) At(t time.Time) <-chan time.Time { return time.After(time.Until(t)) }
+
+// uotRateLimiter is a token bucket of payload bytes. Writers reserve the tokens of their datagrams
+// up front, driving the bucket into debt when needed, and wait until the debt they added is paid off,
+// so concurrent writers queue up fairly and a datagram larger than the burst is delayed, never refused.
+type uotRateLimiter struct {
+	clock uotClock
+	rate  float64 // bytes per second
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newUoTRateLimiter(clock uotClock, bytesPerSec, burst int) *uotRateLimiter {
+	return &uotRateLimiter{
+		clock:  clock,
+		rate:   float64(bytesPerSec),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   clock.Now(),
+	}
+}
+
+// reserve takes n tokens and returns when they may be sent, now when there is no debt to wait out
+func (l *uotRateLimiter) reserve(n int) (ready time.Time, wait bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.clock.Now()
+	if elapsed := now.Sub(l.last); elapsed > 0 {
+		l.tokens += elapsed.Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+		l.last = now
+	}
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return now, false
+	}
+	return now.Add(time.Duration(-l.tokens / l.rate * float64(time.Second))), true
+}
+
+// cancel hands back the tokens of a reservation that won't be sent
+func (l *uotRateLimiter) cancel(n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.tokens += float64(n)
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+}
+
+// SetRateLimit caps the payload bytes sent by WriteTo, WriteToContext and WriteBatch at bytesPerSec,
+// allowing bursts of up to burst bytes, a burst below 1 allows one second worth of bytes.
+// A write waits until its datagrams fit in the budget, giving up with os.ErrDeadlineExceeded
+// right away when the write deadline would pass first, or with net.ErrClosed when the conn is closed.
+// WriteToContext gives up on ctx as well.
+// Datagrams larger than the burst are still sent, after the wait their size calls for.
+// bytesPerSec <= 0 disables the limit, which is the default.
+func (c *UoTPacketConn) SetRateLimit(bytesPerSec, burst int) {
+	if bytesPerSec <= 0 {
+		c.rateLimit.Store(nil)
+		return
+	}
+	if burst < 1 {
+		burst = bytesPerSec
+	}
+	c.rateLimit.Store(newUoTRateLimiter(systemClock{}, bytesPerSec, burst))
+}
+
+// waitRateLimit blocks until n payload bytes may be sent or ctx is done, it must be called without
+// writeMu held so that a waiting writer doesn't hold up the others past their own deadline.
+func (c *UoTPacketConn) waitRateLimit(ctx context.Context, n int) error {
+	limiter := c.rateLimit.Load()
+	if limiter == nil || n == 0 {
+		return nil
+	}
+	ready, wait := limiter.reserve(n)
+	if !wait {
+		return nil
+	}
+	if deadline := c.writeDeadline.userDeadline(); !deadline.IsZero() && deadline.Before(ready) {
+		limiter.cancel(n)
+		return os.ErrDeadlineExceeded
+	}
+	if deadline, ok := ctx.Deadline(); ok && deadline.Before(ready) {
+		limiter.cancel(n)
+		return context.DeadlineExceeded
+	}
+	select {
+	case <-limiter.clock.At(ready):
+		return nil
+	case <-ctx.Done():
+		limiter.cancel(n)
+		return ctx.Err()
+	case <-c.done:
+		return net.ErrClosed
+	}
+}
+
+// uotDatagramRate caps the datagrams read per second over a sliding window, estimated from
+// the counts of the current and previous second as Cloudflare does, so a datagram costs
+// a clock read and a few additions. It is only used by the reading goroutine.
+type uotDatagramRate struct {
+	clock  uotClock
+	perSec float64
+	// base carries the monotonic reading the seconds are counted from
+	base time.Time
+
+	second  int64
+	current float64
+	prev    float64
+}
+
+func newUoTDatagramRate(clock uotClock, perSec int) *uotDatagramRate {
+	return &uotDatagramRate{clock: clock, perSec: float64(perSec), base: clock.Now()}
+}
+
+// allow counts one more datagram, false when it would exceed the cap and is to be dropped.
+// Dropped datagrams aren't counted, so a flood is still let through at the capped rate.
+func (r *uotDatagramRate) allow() bool {
+	elapsed := r.clock.Now().Sub(r.base)
+	if second := int64(elapsed / time.Second); second != r.second {
+		if second == r.second+1 {
+			r.prev = r.current
+		} else {
+			r.prev = 0
+		}
+		r.current = 0
+		r.second = second
+	}
+	into := float64(elapsed%time.Second) / float64(time.Second)
+	if r.prev*(1-into)+r.current >= r.perSec {
+		return false
+	}
+	r.current++
+	return true
+}
+
+// SetMaxDatagramRate caps the datagrams ReadFrom accepts at perSec over a sliding second,
+// protecting a server from a peer flooding tiny datagrams. A datagram over the cap is read off
+// the stream and dropped, counted in UoTStats.RateDropped, and ReadFrom fails with ErrRateExceeded,
+// so the caller may close the conn or keep reading. perSec <= 0 removes the cap, which is the default.
+func (c *UoTPacketConn) SetMaxDatagramRate(perSec int) {
+	if perSec <= 0 {
+		c.datagramRate.Store(nil)
+		return
+	}
+	c.datagramRate.Store(newUoTDatagramRate(systemClock{}, perSec))
+}
+
+// overDatagramRate reports whether the datagram being read exceeds SetMaxDatagramRate, counting it
+// as dropped when it does.
+func (c *UoTPacketConn) overDatagramRate() bool {
+	rate := c.datagramRate.Load()
+	if rate == nil || rate.allow() {
+		return false
+	}
+	c.counters.rateDropped.Add(1)
+	return true
+}
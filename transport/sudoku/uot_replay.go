@@ -0,0 +1,181 @@
+package sudoku
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+)
+
+// uotReplayReader sits between ReadFrom and the stream so that a frame interrupted by a read deadline
+// isn't lost: while recording, the bytes of the frame being read are kept, and rewind hands them out
+// again so the next ReadFrom parses the frame from its start. It is only used by the reading goroutine.
+type uotReplayReader struct {
+	r   io.Reader
+	buf []byte
+	// pos is where the next Read continues in buf, the bytes after it are read ahead of the parser
+	pos    int
+	record bool
+	// readAhead makes reads from the stream fill buf as far as uotReadAheadSize rather than just p,
+	// noBlock fails reads past the end of buf with errWouldBlock, both are set by ReadBatch
+	readAhead bool
+	noBlock   bool
+}
+
+// uotReadAheadSize is how much ReadBatch reads from the stream at once, looking for more frames
+const uotReadAheadSize = 16 * 1024
+
+// errWouldBlock ends a read of ReadBatch at the end of the buffered bytes. It is a timeout,
+// so that readFrom rewinds an incomplete frame as it does for the read deadline.
+var errWouldBlock net.Error = wouldBlockError{}
+
+type wouldBlockError struct{}
+
+func (wouldBlockError) Error() string   { return "no buffered uot frame" }
+func (wouldBlockError) Timeout() bool   { return true }
+func (wouldBlockError) Temporary() bool { return true }
+
+func (r *uotReplayReader) Read(p []byte) (int, error) {
+	if r.pos == len(r.buf) {
+		if r.noBlock {
+			return 0, errWouldBlock
+		}
+		if r.readAhead {
+			if err := r.fill(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if r.pos < len(r.buf) {
+		n := copy(p, r.buf[r.pos:])
+		r.pos += n
+		if !r.record && r.pos == len(r.buf) {
+			r.buf, r.pos = r.buf[:0], 0
+		}
+		return n, nil
+	}
+	if !r.record {
+		return r.r.Read(p)
+	}
+	n, err := r.r.Read(p)
+	r.buf = append(r.buf, p[:n]...)
+	r.pos = len(r.buf)
+	return n, err
+}
+
+// fill reads from the stream into buf once, an error is only returned when nothing was read
+func (r *uotReplayReader) fill() error {
+	if !r.record && r.pos == len(r.buf) {
+		r.buf, r.pos = r.buf[:0], 0
+	}
+	if cap(r.buf)-len(r.buf) < uotReadAheadSize {
+		grown := make([]byte, len(r.buf), len(r.buf)+uotReadAheadSize)
+		copy(grown, r.buf)
+		r.buf = grown
+	}
+	n, err := r.r.Read(r.buf[len(r.buf):cap(r.buf)])
+	r.buf = r.buf[:len(r.buf)+n]
+	if n > 0 {
+		return nil
+	}
+	return err
+}
+
+// begin starts a new frame, forgetting the bytes consumed so far but not those read ahead,
+// record tells whether the bytes read from now on are kept for rewind. A non blocking read
+// always records, its frame may end past the buffered bytes.
+func (r *uotReplayReader) begin(record bool) {
+	record = record || r.noBlock
+	if r.pos > 0 {
+		r.buf = r.buf[:copy(r.buf, r.buf[r.pos:])]
+		r.pos = 0
+	}
+	if !record && len(r.buf) == 0 {
+		r.buf = nil
+	}
+	r.record = record
+}
+
+// prefetch reads ahead until n bytes past pos are buffered, it does nothing unless recording
+func (r *uotReplayReader) prefetch(n int) error {
+	if !r.record {
+		return nil
+	}
+	if need := r.pos + n; cap(r.buf) < need {
+		grown := make([]byte, len(r.buf), need)
+		copy(grown, r.buf)
+		r.buf = grown
+	}
+	for len(r.buf)-r.pos < n {
+		if r.noBlock {
+			return errWouldBlock
+		}
+		m, err := r.r.Read(r.buf[len(r.buf):cap(r.buf)])
+		r.buf = r.buf[:len(r.buf)+m]
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ahead returns the bytes read ahead of the parser
+func (r *uotReplayReader) ahead() []byte {
+	return r.buf[r.pos:]
+}
+
+// rewind makes the bytes recorded since begin readable again
+func (r *uotReplayReader) rewind() {
+	if r.record {
+		r.pos = 0
+	}
+}
+
+// prefetchFrame buffers the rest of the frame whose header was just read while a read deadline is set,
+// so that the deadline can only interrupt a frame before any of it is acted upon. A frame with invalid
+// lengths or flags isn't read ahead, the parser reports it as usual.
+func (c *UoTPacketConn) prefetchFrame(addrLen, payloadLen int) error {
+	if !c.replay.record {
+		return nil
+	}
+	if addrLen == 0 {
+		return c.replay.prefetch(payloadLen)
+	}
+	if validateFrameLengths(addrLen, minAddressLen(c.codec), payloadLen, c.maxPayload) != nil {
+		return nil
+	}
+	n := addrLen + payloadLen
+	if !c.extendedFraming() {
+		return c.replay.prefetch(n)
+	}
+	if err := c.replay.prefetch(1); err != nil {
+		return err
+	}
+	flags := c.replay.ahead()[0]
+	if flags&^uotKnownFlags != 0 {
+		return nil
+	}
+	n++
+	if flags&uotFlagPadded != 0 {
+		if err := c.replay.prefetch(n + 2); err != nil {
+			return err
+		}
+		n += 2 + int(binary.BigEndian.Uint16(c.replay.ahead()[n:]))
+	}
+	if flags&uotFlagChecksum != 0 {
+		n += 4
+	}
+	return c.replay.prefetch(n)
+}
+
+// timeoutError returns the timeout err was caused by, if any
+func timeoutError(err error) (net.Error, bool) {
+	if err == nil {
+		return nil, false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return netErr, true
+	}
+	return nil, false
+}
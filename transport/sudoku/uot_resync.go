@@ -0,0 +1,101 @@
+package sudoku
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/metacubex/mihomo/log"
+)
+
+// SetResync lets ReadFrom recover from a desynchronized stream instead of failing for good.
+// On a frame with absurd lengths, unknown flags or an undecodable address, the stream is scanned
+// byte by byte up to the next sync marker, the magic byte of the handshake followed by the version of the conn,
+// and framing resumes after it. The peer writes markers with WriteSyncMarker, and a conn with resync
+// enabled skips markers found where a frame starts. Skipped bytes are counted in UoTStats.ResyncDropped.
+//
+// The datagrams between the corrupt frame and the marker are lost. Checksum mismatches stay fatal,
+// as does everything on a conn without resync, since a peer that authenticates or checksums its
+// frames has no business sending garbage.
+func (c *UoTPacketConn) SetResync(v bool) {
+	c.resync.Store(v)
+}
+
+// WriteSyncMarker writes a marker the peer resynchronizes on, see SetResync.
+// The peer must have resync enabled, any other reader takes the marker for a corrupt frame.
+func (c *UoTPacketConn) WriteSyncMarker() error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.writeClosed {
+		return ErrWriteClosed
+	}
+	if err := writePreface(c.writerLocked(), c.magic, c.version, nil); err != nil {
+		return c.idleError(err)
+	}
+	c.counters.wireBytesWritten.Add(2)
+	return nil
+}
+
+// readFrameHeader reads the lengths of the next frame, skipping sync markers when resync is enabled.
+func (c *UoTPacketConn) readFrameHeader() (int, int, error) {
+	if !c.resync.Load() {
+		return readFrameHeaderInto(&c.replay, &c.readHeader)
+	}
+	header := &c.readHeader
+	if n, err := io.ReadFull(&c.replay, header[:]); err != nil {
+		if n == 0 && errors.Is(err, io.EOF) {
+			return 0, 0, err
+		}
+		return 0, 0, newFrameError(FrameStageHeader, n, err)
+	}
+	for header[0] == c.magic && header[1] == c.version {
+		copy(header[:2], header[2:])
+		if n, err := io.ReadFull(&c.replay, header[2:]); err != nil {
+			return 0, 0, newFrameError(FrameStageHeader, 2+n, err)
+		}
+	}
+	return int(binary.BigEndian.Uint16(header[:2])), int(binary.BigEndian.Uint16(header[2:])), nil
+}
+
+// resyncAfter returns nil when err was caused by garbage in the stream and the framing was recovered,
+// err when resync doesn't apply, or the failure of the scan, from where the next ReadFrom goes on.
+func (c *UoTPacketConn) resyncAfter(err error) error {
+	if !c.resync.Load() || !isDesyncError(err) {
+		return err
+	}
+	dropped, scanErr := c.scanSyncMarker()
+	c.counters.resyncDropped.Add(uint64(dropped))
+	if scanErr != nil {
+		return newFrameError(FrameStageHeader, 0, fmt.Errorf("resync after %w: %w", err, scanErr))
+	}
+	log.Debugln("[Sudoku][UoT] resynced after %v, dropped %d bytes", err, dropped)
+	return nil
+}
+
+// scanSyncMarker consumes the stream up to and including the next sync marker,
+// returning the number of bytes skipped before it. The skipped bytes aren't kept for rewind,
+// a scan interrupted by the read deadline is picked up by the next ReadFrom failing on the garbage left.
+func (c *UoTPacketConn) scanSyncMarker() (int, error) {
+	c.replay.begin(false)
+	var b [1]byte
+	var prev byte
+	scanned := 0
+	for {
+		if _, err := io.ReadFull(&c.replay, b[:]); err != nil {
+			return scanned, err
+		}
+		scanned++
+		if prev == c.magic && b[0] == c.version {
+			return scanned - 2, nil
+		}
+		prev = b[0]
+	}
+}
+
+func isDesyncError(err error) bool {
+	return errors.Is(err, ErrInvalidAddressLength) ||
+		errors.Is(err, ErrInvalidPayloadLength) ||
+		errors.Is(err, errDecodeAddress) ||
+		errors.Is(err, errUnknownFrameFlags)
+}
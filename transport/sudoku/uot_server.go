@@ -0,0 +1,160 @@
+package sudoku
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/metacubex/mihomo/log"
+)
+
+// defaultUoTHandshakeTimeout bounds how long UoTListener waits for the preface of an accepted conn
+const defaultUoTHandshakeTimeout = 10 * time.Second
+
+// NewUoTServerConn reads the preface of a client and returns conn wrapped at the agreed version.
+// A version 1 preface is read exactly like ReadPreface, a higher one is answered as by AcceptVersion.
+// On error conn is closed, a failed handshake leaves the stream in no state to be reused.
+func NewUoTServerConn(conn net.Conn) (*UoTPacketConn, error) {
+	return NewUoTServerConnWithOptions(conn, UoTHandshakeOptions{})
+}
+
+// NewUoTServerConnWithOptions is NewUoTServerConn accepting the versions and magic of options, over its stream wrapper,
+// and requiring its auth token when one is set. A client with a wrong or missing token
+// gets no answer and the error wraps ErrAuthFailed. On any error conn is closed.
+func NewUoTServerConnWithOptions(conn net.Conn, options UoTHandshakeOptions) (*UoTPacketConn, error) {
+	supported := options.Versions
+	if len(supported) == 0 {
+		supported = uotSupportedVersions
+	}
+	if err := checkPacketConnVersions(supported); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	conn = options.wrap(conn)
+	magic := options.magic()
+	version, err := acceptVersion(conn, conn, magic, supported, options.authDigest())
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	c := newUoTPacketConnWithMagic(conn, magic, version)
+	c.handshake = options.handshakeInfo()
+	return c, nil
+}
+
+// UoTListener accepts UoT streams from a listener, handing out ready packet conns.
+// Each stream runs its handshake in a goroutine of its own, so a client slow to send its preface
+// doesn't hold back the others.
+type UoTListener struct {
+	net.Listener
+	options   UoTHandshakeOptions
+	startOnce sync.Once
+	closeOnce sync.Once
+	conns     chan *UoTPacketConn
+	done      chan struct{}
+	// mu guards pending, the conns in their handshake, closed by Close
+	mu      sync.Mutex
+	pending map[net.Conn]struct{}
+	// acceptErr is the error that ended the accept loop, set before failed is closed
+	acceptErr error
+	failed    chan struct{}
+}
+
+func NewUoTListener(l net.Listener) *UoTListener {
+	return NewUoTListenerWithOptions(l, UoTHandshakeOptions{})
+}
+
+// NewUoTListenerWithOptions is NewUoTListener running the handshake with options, see NewUoTServerConnWithOptions.
+func NewUoTListenerWithOptions(l net.Listener, options UoTHandshakeOptions) *UoTListener {
+	return &UoTListener{
+		Listener: l,
+		options:  options,
+		conns:    make(chan *UoTPacketConn),
+		done:     make(chan struct{}),
+		pending:  make(map[net.Conn]struct{}),
+		failed:   make(chan struct{}),
+	}
+}
+
+// Accept waits for the next conn completing the UoT handshake.
+// Conns failing it, or not sending their preface in time, are closed and skipped.
+// Once the underlying listener failed to accept, Accept keeps returning its error.
+func (l *UoTListener) Accept() (net.PacketConn, error) {
+	l.startOnce.Do(func() {
+		go l.acceptLoop()
+	})
+	select {
+	case packetConn := <-l.conns:
+		return packetConn, nil
+	case <-l.failed:
+		return nil, l.acceptErr
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close closes the listener along with the conns still in their handshake.
+func (l *UoTListener) Close() error {
+	l.closeOnce.Do(func() {
+		l.mu.Lock()
+		close(l.done)
+		for conn := range l.pending {
+			_ = conn.Close()
+		}
+		l.mu.Unlock()
+	})
+	return l.Listener.Close()
+}
+
+func (l *UoTListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			l.acceptErr = err
+			close(l.failed)
+			return
+		}
+		go l.serve(conn)
+	}
+}
+
+// serve runs the handshake of conn and hands it to Accept
+func (l *UoTListener) serve(conn net.Conn) {
+	l.mu.Lock()
+	if isClosedChan(l.done) {
+		l.mu.Unlock()
+		_ = conn.Close()
+		return
+	}
+	l.pending[conn] = struct{}{}
+	l.mu.Unlock()
+
+	packetConn, err := l.handshake(conn)
+	l.mu.Lock()
+	delete(l.pending, conn)
+	l.mu.Unlock()
+	if err != nil {
+		log.Debugln("[Sudoku][UoT] handshake with %s failed: %v", conn.RemoteAddr(), err)
+		_ = conn.Close()
+		return
+	}
+	select {
+	case l.conns <- packetConn:
+	case <-l.done:
+		_ = packetConn.Close()
+	}
+}
+
+func (l *UoTListener) handshake(conn net.Conn) (*UoTPacketConn, error) {
+	if err := conn.SetDeadline(time.Now().Add(defaultUoTHandshakeTimeout)); err != nil {
+		return nil, err
+	}
+	packetConn, err := NewUoTServerConnWithOptions(conn, l.options)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+	return packetConn, nil
+}
@@ -0,0 +1,87 @@
+package sudoku
+
+import (
+	"sync/atomic"
+)
+
+// UoTStats is a snapshot of the traffic carried by a UoTPacketConn.
+// Bytes counters only count datagram payloads, WireBytes counters also include framing.
+type UoTStats struct {
+	DatagramsRead    uint64
+	DatagramsWritten uint64
+	BytesRead        uint64
+	BytesWritten     uint64
+	WireBytesRead    uint64
+	WireBytesWritten uint64
+	// Discarded counts the datagrams dropped for an invalid address, see DiscardedCount
+	Discarded uint64
+	// ResyncDropped counts the bytes skipped to recover the framing, see SetResync
+	ResyncDropped uint64
+	// RateDropped counts the datagrams dropped over the cap of SetMaxDatagramRate
+	RateDropped uint64
+	// CompressionSaved counts the payload bytes of both directions kept off the wire by SetCompression
+	CompressionSaved uint64
+	// Goodput is the payload bytes on the wire over wire bytes of both directions, see UoTPacketConn.Goodput
+	Goodput float64
+	// CompressionRatio is payload bytes over the bytes they took on the wire, 1 without compression
+	// and 0 before any traffic
+	CompressionRatio float64
+}
+
+type uotCounters struct {
+	datagramsRead    atomic.Uint64
+	datagramsWritten atomic.Uint64
+	bytesRead        atomic.Uint64
+	bytesWritten     atomic.Uint64
+	wireBytesRead    atomic.Uint64
+	wireBytesWritten atomic.Uint64
+	discarded        atomic.Uint64
+	resyncDropped    atomic.Uint64
+	rateDropped      atomic.Uint64
+	compressionSaved atomic.Uint64
+
+	// every datagram frame received, including the dropped ones, for reconciliation with the peer
+	framesReceived     atomic.Uint64
+	frameBytesReceived atomic.Uint64
+}
+
+// Stats returns a snapshot of the traffic counters, safe to call while traffic flows.
+func (c *UoTPacketConn) Stats() UoTStats {
+	// loaded first, as it is counted after the payload bytes it was saved on
+	saved := c.counters.compressionSaved.Load()
+	stats := UoTStats{
+		DatagramsRead:    c.counters.datagramsRead.Load(),
+		DatagramsWritten: c.counters.datagramsWritten.Load(),
+		BytesRead:        c.counters.bytesRead.Load(),
+		BytesWritten:     c.counters.bytesWritten.Load(),
+		WireBytesRead:    c.counters.wireBytesRead.Load(),
+		WireBytesWritten: c.counters.wireBytesWritten.Load(),
+		Discarded:        c.counters.discarded.Load(),
+		ResyncDropped:    c.counters.resyncDropped.Load(),
+		RateDropped:      c.counters.rateDropped.Load(),
+		CompressionSaved: saved,
+	}
+	payload := stats.BytesRead + stats.BytesWritten
+	var onWire uint64
+	if saved < payload {
+		onWire = payload - saved
+	}
+	stats.Goodput = goodput(onWire, stats.WireBytesRead+stats.WireBytesWritten)
+	stats.CompressionRatio = goodput(payload, onWire)
+	return stats
+}
+
+// Goodput returns the fraction of wire bytes that carried datagram payload, in [0, 1].
+// It is 0 before any traffic, small datagrams such as DNS queries have a low goodput
+// because every frame carries a header and an encoded address. A compressed payload counts
+// for its compressed size, the gain of compression is UoTStats.CompressionRatio.
+func (c *UoTPacketConn) Goodput() float64 {
+	return c.Stats().Goodput
+}
+
+func goodput(payload, wire uint64) float64 {
+	if wire == 0 {
+		return 0
+	}
+	return float64(payload) / float64(wire)
+}
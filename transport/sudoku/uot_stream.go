@@ -0,0 +1,130 @@
+package sudoku
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/metacubex/mihomo/common/pool"
+
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/hkdf"
+)
+
+// StreamWrapper layers obfuscation or encryption over the stream carrying UoT, Wrap is called once
+// per conn before the preface, so the preface and every frame pass through the returned conn.
+// Both sides must use matching wrappers.
+type StreamWrapper interface {
+	Wrap(conn net.Conn) net.Conn
+}
+
+// ChaCha20Wrapper XORs the stream with a ChaCha20 keystream keyed by a shared secret.
+// Each direction starts with a random nonce of its own, sent in clear ahead of
+// the first bytes written, so the keystreams of the two directions are independent.
+//
+// It hides the framing from passive observers but doesn't authenticate anything:
+// tampered bytes go unnoticed until they garble a frame, so use it for obfuscation,
+// not as a replacement for an AEAD. A failed or partial write leaves the stream unusable.
+type ChaCha20Wrapper struct {
+	key [chacha20.KeySize]byte
+}
+
+// NewChaCha20Wrapper derives the key of a ChaCha20Wrapper from secret, which must not be empty.
+func NewChaCha20Wrapper(secret []byte) (*ChaCha20Wrapper, error) {
+	if len(secret) == 0 {
+		return nil, ErrEmptyStreamSecret
+	}
+	sum := sha256.Sum256(secret)
+	w := &ChaCha20Wrapper{}
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, sum[:], []byte("sudoku-uot-chacha20")), w.key[:]); err != nil {
+		return nil, fmt.Errorf("derive stream key: %w", err)
+	}
+	return w, nil
+}
+
+func (w *ChaCha20Wrapper) Wrap(conn net.Conn) net.Conn {
+	return &chacha20Conn{Conn: conn, key: w.key}
+}
+
+// chacha20Conn sets up each direction on first use, the write side by sending a fresh nonce,
+// the read side once the nonce of the peer has arrived. A nonce read interrupted by a deadline
+// is resumed by the next Read.
+type chacha20Conn struct {
+	net.Conn
+	key [chacha20.KeySize]byte
+
+	writeMu sync.Mutex
+	writer  *chacha20.Cipher
+
+	readMu    sync.Mutex
+	reader    *chacha20.Cipher
+	nonce     [chacha20.NonceSizeX]byte
+	nonceRead int
+}
+
+func (c *chacha20Conn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	var prefix []byte
+	if c.writer == nil {
+		var nonce [chacha20.NonceSizeX]byte
+		if _, err := rand.Read(nonce[:]); err != nil {
+			return 0, fmt.Errorf("generate stream nonce: %w", err)
+		}
+		writer, err := chacha20.NewUnauthenticatedCipher(c.key[:], nonce[:])
+		if err != nil {
+			return 0, err
+		}
+		c.writer = writer
+		prefix = nonce[:]
+	}
+
+	buf := pool.Get(len(prefix) + len(p))
+	defer pool.Put(buf)
+	copy(buf, prefix)
+	c.writer.XORKeyStream(buf[len(prefix):], p)
+	n, err := c.Conn.Write(buf)
+	n -= len(prefix)
+	if n < 0 {
+		n = 0
+	}
+	return n, err
+}
+
+func (c *chacha20Conn) Read(p []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	for c.reader == nil {
+		n, err := c.Conn.Read(c.nonce[c.nonceRead:])
+		c.nonceRead += n
+		if c.nonceRead == len(c.nonce) {
+			reader, cipherErr := chacha20.NewUnauthenticatedCipher(c.key[:], c.nonce[:])
+			if cipherErr != nil {
+				return 0, cipherErr
+			}
+			c.reader = reader
+			break
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) && c.nonceRead > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+	}
+
+	n, err := c.Conn.Read(p)
+	c.reader.XORKeyStream(p[:n], p[:n])
+	return n, err
+}
+
+// Upstream lets SetReadBuffer/SetWriteBuffer reach the socket beneath
+func (c *chacha20Conn) Upstream() any {
+	return c.Conn
+}
@@ -0,0 +1,3631 @@
+package sudoku
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"golang.org/x/crypto/chacha20"
+)
+
+// testAddressCodecConformance checks the properties every AddressCodec must provide:
+// canonical round-trip of IP and domain addresses, rejection of malformed input,
+// and delivery through UoTPacketConn framing.
+func testAddressCodecConformance(t *testing.T, codec AddressCodec) {
+	t.Helper()
+
+	cases := []string{
+		"1.2.3.4:53",
+		"0.0.0.0:0",
+		"255.255.255.255:65535",
+		"[2001:db8::1]:443",
+		"[::]:1",
+		"example.com:8080",
+	}
+	for _, addr := range cases {
+		buf, err := codec.EncodeAddress(addr)
+		if err != nil {
+			t.Fatalf("encode %s: %v", addr, err)
+		}
+		if len(buf) == 0 {
+			t.Fatalf("encode %s: empty buffer", addr)
+		}
+		decoded, err := codec.DecodeAddress(buf)
+		if err != nil {
+			t.Fatalf("decode %s: %v", addr, err)
+		}
+		if decoded != addr {
+			t.Fatalf("round-trip %s: got %s", addr, decoded)
+		}
+	}
+
+	for _, addr := range []string{"", "1.2.3.4", "1.2.3.4:65536", "example.com:-1"} {
+		if _, err := codec.EncodeAddress(addr); err == nil {
+			t.Fatalf("expected encode %q to fail", addr)
+		}
+	}
+	if _, err := codec.DecodeAddress(nil); err == nil {
+		t.Fatalf("expected decode of empty buffer to fail")
+	}
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	client := NewUoTPacketConn(clientConn)
+	client.SetAddressCodec(codec)
+	server := NewUoTPacketConn(serverConn)
+	server.SetAddressCodec(codec)
+
+	target := &net.UDPAddr{IP: net.IPv4(8, 8, 8, 8), Port: 53}
+	payload := []byte("conformance")
+	writeErr := make(chan error, 1)
+	go func() {
+		_, err := client.WriteTo(payload, target)
+		writeErr <- err
+	}()
+
+	buf := make([]byte, 64)
+	n, addr, err := server.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("read from: %v", err)
+	}
+	if err := <-writeErr; err != nil {
+		t.Fatalf("write to: %v", err)
+	}
+	if !bytes.Equal(buf[:n], payload) {
+		t.Fatalf("payload mismatch: %q", buf[:n])
+	}
+	if addr.String() != target.String() {
+		t.Fatalf("addr mismatch: got %s want %s", addr, target)
+	}
+}
+
+func TestDefaultAddressCodecConformance(t *testing.T) {
+	testAddressCodecConformance(t, SOCKSAddressCodec{})
+}
+
+func TestDefaultAddressCodecWireFormat(t *testing.T) {
+	buf, err := SOCKSAddressCodec{}.EncodeAddress("1.2.3.4:53")
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	if want := []byte{0x01, 1, 2, 3, 4, 0x00, 0x35}; !bytes.Equal(buf, want) {
+		t.Fatalf("wire bytes = %x, want %x", buf, want)
+	}
+
+	var viaCodec, viaFree bytes.Buffer
+	if _, err := writeDatagram(&viaCodec, SOCKSAddressCodec{}, maxUoTPayload, "example.com:443", []byte{1, 2, 3}); err != nil {
+		t.Fatalf("write via codec: %v", err)
+	}
+	if err := WriteDatagram(&viaFree, "example.com:443", []byte{1, 2, 3}); err != nil {
+		t.Fatalf("write datagram: %v", err)
+	}
+	if !bytes.Equal(viaCodec.Bytes(), viaFree.Bytes()) {
+		t.Fatalf("default codec changed the wire format: %x vs %x", viaCodec.Bytes(), viaFree.Bytes())
+	}
+}
+
+// prefixedCodec is a toy codec that prefixes the default encoding with a marker byte.
+type prefixedCodec struct{}
+
+func (prefixedCodec) EncodeAddress(addr string) ([]byte, error) {
+	buf, err := EncodeAddress(addr)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{0x7f}, buf...), nil
+}
+
+func (prefixedCodec) DecodeAddress(buf []byte) (string, error) {
+	if len(buf) == 0 || buf[0] != 0x7f {
+		return "", errors.New("missing marker")
+	}
+	return SOCKSAddressCodec{}.DecodeAddress(buf[1:])
+}
+
+func TestCustomAddressCodecConformance(t *testing.T) {
+	testAddressCodecConformance(t, prefixedCodec{})
+
+	var buf bytes.Buffer
+	if _, err := writeDatagram(&buf, prefixedCodec{}, maxUoTPayload, "1.2.3.4:53", nil); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, _, err := ReadDatagram(&buf); err == nil {
+		t.Fatalf("expected default codec to reject custom encoding")
+	}
+}
+
+func TestWritePrefaceContext(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	read := make(chan []byte, 1)
+	go func() {
+		buf := make([]byte, 2)
+		_, _ = io.ReadFull(serverConn, buf)
+		read <- buf
+	}()
+
+	if err := WritePrefaceContext(context.Background(), clientConn); err != nil {
+		t.Fatalf("write preface: %v", err)
+	}
+	if got := <-read; !bytes.Equal(got, []byte{UoTMagicByte, uotVersion}) {
+		t.Fatalf("preface = %x", got)
+	}
+}
+
+func TestWritePrefaceContextStalledPeer(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := WritePrefaceContext(ctx, clientConn)
+	if !errors.Is(err, ErrPrefaceTimeout) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected preface timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("write preface took %v", elapsed)
+	}
+
+	canceled, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	if err := WritePrefaceContext(canceled, clientConn); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected canceled error, got %v", err)
+	}
+}
+
+func TestReadDatagramFrameErrors(t *testing.T) {
+	var frame bytes.Buffer
+	if err := WriteDatagram(&frame, "1.2.3.4:53", []byte("hello")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	raw := frame.Bytes()
+
+	cases := []struct {
+		name   string
+		data   []byte
+		stage  string
+		offset int
+		is     error
+	}{
+		{"truncated header", raw[:3], FrameStageHeader, 3, io.ErrUnexpectedEOF},
+		{"zero address length", []byte{0, 0, 0, 1}, FrameStageHeader, 0, ErrInvalidAddressLength},
+		{"truncated address", raw[:6], FrameStageAddress, 6, io.ErrUnexpectedEOF},
+		{"short address length", []byte{0, minSOCKSAddressLen - 1, 0, 0, 0x01, 0, 53}, FrameStageHeader, 0, ErrInvalidAddressLength},
+		{"bad address type", []byte{0, minSOCKSAddressLen, 0, 0, 0x09, 0, 0, 53}, FrameStageAddress, uotHeaderLen, ErrUnknownAddressType},
+		{"truncated domain", []byte{0, 5, 0, 0, 0x03, 9, 'a', 0, 53}, FrameStageAddress, uotHeaderLen + 5, io.ErrUnexpectedEOF},
+		{"trailing address bytes", []byte{0, 8, 0, 0, 0x01, 1, 2, 3, 4, 0, 53, 0xff}, FrameStageAddress, uotHeaderLen + 7, ErrInvalidAddressLength},
+		{"truncated payload", raw[:len(raw)-2], FrameStagePayload, len(raw) - 2, io.ErrUnexpectedEOF},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, _, err := ReadDatagram(bytes.NewReader(tc.data))
+			var frameErr *FrameError
+			if !errors.As(err, &frameErr) {
+				t.Fatalf("expected *FrameError, got %T: %v", err, err)
+			}
+			if frameErr.Stage != tc.stage || frameErr.Offset != tc.offset {
+				t.Fatalf("got stage=%s offset=%d, want stage=%s offset=%d", frameErr.Stage, frameErr.Offset, tc.stage, tc.offset)
+			}
+			if tc.is != nil && !errors.Is(err, tc.is) {
+				t.Fatalf("expected errors.Is(%v), got %v", tc.is, err)
+			}
+		})
+	}
+
+	if _, _, err := ReadDatagram(bytes.NewReader(nil)); err != io.EOF {
+		t.Fatalf("expected clean io.EOF, got %v", err)
+	}
+
+	// the conn reports the faulty byte of the address the same way
+	conn := NewUoTPacketConn(&readOnlyConn{Reader: bytes.NewReader([]byte{0, 8, 0, 0, 0x01, 1, 2, 3, 4, 0, 53, 0xff})})
+	_, _, err := conn.ReadFrom(make([]byte, 16))
+	var frameErr *FrameError
+	if !errors.As(err, &frameErr) || frameErr.Offset != uotHeaderLen+7 {
+		t.Fatalf("expected a FrameError at offset %d, got %v", uotHeaderLen+7, err)
+	}
+}
+
+func TestWriteDatagramFrom(t *testing.T) {
+	payload := bytes.Repeat([]byte("payload "), 1000)
+	var want, got bytes.Buffer
+	if err := WriteDatagram(&want, "example.com:443", payload); err != nil {
+		t.Fatal(err)
+	}
+	src := bytes.NewReader(append(append([]byte(nil), payload...), "trailing"...))
+	if err := WriteDatagramFrom(&got, "example.com:443", len(payload), src); err != nil {
+		t.Fatalf("write from reader: %v", err)
+	}
+	if !bytes.Equal(got.Bytes(), want.Bytes()) {
+		t.Fatalf("frame differs from WriteDatagram")
+	}
+	if rest, _ := io.ReadAll(src); string(rest) != "trailing" {
+		t.Fatalf("expected the bytes past the payload to be left unread, got %q", rest)
+	}
+	if addr, read, err := ReadDatagram(&got); err != nil || addr != "example.com:443" || !bytes.Equal(read, payload) {
+		t.Fatalf("read back: %q %d bytes, %v", addr, len(read), err)
+	}
+
+	got.Reset()
+	if err := WriteDatagramFrom(&got, "1.2.3.4:53", 0, strings.NewReader("")); err != nil {
+		t.Fatalf("write empty datagram: %v", err)
+	}
+	if addr, read, err := ReadDatagram(&got); err != nil || addr != "1.2.3.4:53" || len(read) != 0 {
+		t.Fatalf("read back empty datagram: %q %x, %v", addr, read, err)
+	}
+
+	var head bytes.Buffer
+	if err := WriteDatagram(&head, "1.2.3.4:53", make([]byte, 16)); err != nil {
+		t.Fatal(err)
+	}
+	headLen := head.Len() - 16
+	for _, short := range []string{"short", ""} {
+		got.Reset()
+		err := WriteDatagramFrom(&got, "1.2.3.4:53", 16, strings.NewReader(short))
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Fatalf("expected a short source to fail with io.ErrUnexpectedEOF, got %v", err)
+		}
+		if got.Len() != headLen+len(short) {
+			t.Fatalf("expected the header and the %d streamed bytes on the wire, got %d bytes", len(short), got.Len())
+		}
+		if _, _, err := ReadDatagram(&got); err == nil {
+			t.Fatalf("expected the truncated frame to fail to read")
+		}
+	}
+
+	got.Reset()
+	failure := errors.New("source failed")
+	if err := WriteDatagramFrom(&got, "1.2.3.4:53", 16, io.MultiReader(strings.NewReader("partial"), iotest.ErrReader(failure))); !errors.Is(err, failure) {
+		t.Fatalf("expected the source error, got %v", err)
+	}
+	got.Reset()
+	if err := WriteDatagramFrom(&got, "1.2.3.4:53", maxUoTPayload+1, src); !errors.Is(err, ErrPayloadTooLarge) {
+		t.Fatalf("expected ErrPayloadTooLarge, got %v", err)
+	}
+	if err := WriteDatagramFrom(&got, "1.2.3.4:53", -1, src); !errors.Is(err, ErrInvalidPayloadLength) {
+		t.Fatalf("expected ErrInvalidPayloadLength, got %v", err)
+	}
+	if err := WriteDatagramFrom(&got, "not an address", 0, src); err == nil || got.Len() != 0 {
+		t.Fatalf("expected an invalid address to fail without writing, got %v", err)
+	}
+}
+
+func TestUoTEmptyDatagram(t *testing.T) {
+	var stream bytes.Buffer
+	if err := WriteDatagram(&stream, "1.2.3.4:53", nil); err != nil {
+		t.Fatalf("write empty datagram: %v", err)
+	}
+	if addr, payload, err := ReadDatagram(bytes.NewReader(stream.Bytes())); err != nil || addr != "1.2.3.4:53" || len(payload) != 0 {
+		t.Fatalf("read empty datagram: %q %x, %v", addr, payload, err)
+	}
+	if addr, payload, err := NewDecoder(bytes.NewReader(stream.Bytes())).ReadDatagram(); err != nil || addr != "1.2.3.4:53" || len(payload) != 0 {
+		t.Fatalf("decode empty datagram: %q %x, %v", addr, payload, err)
+	}
+
+	addrPort := netip.MustParseAddrPort("1.2.3.4:53")
+	target := net.UDPAddrFromAddrPort(addrPort)
+	named := &NamedAddr{Host: "example.com", Port: 443}
+	for _, version := range []byte{UoTVersion1, UoTVersion3} {
+		stream.Reset()
+		writer := NewUoTPacketConnWithVersion(&captureConn{w: &stream}, version)
+		if version >= UoTVersion3 {
+			if err := writer.SetChecksum(true); err != nil {
+				t.Fatal(err)
+			}
+			if err := writer.SetPadding(1, 8); err != nil {
+				t.Fatal(err)
+			}
+			if err := writer.SetCompression(true, 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if n, err := writer.WriteTo(nil, target); err != nil || n != 0 {
+			t.Fatalf("v%d: write empty: %d, %v", version, n, err)
+		}
+		if n, err := writer.WriteToAddrPort([]byte{}, addrPort); err != nil || n != 0 {
+			t.Fatalf("v%d: write empty to an AddrPort: %d, %v", version, n, err)
+		}
+		if n, err := writer.WriteBatch([][]byte{nil, []byte("x"), nil}, []net.Addr{named, target, target}); err != nil || n != 3 {
+			t.Fatalf("v%d: write batch: %d, %v", version, n, err)
+		}
+
+		reader := NewUoTPacketConnWithVersion(&readOnlyConn{Reader: bytes.NewReader(stream.Bytes())}, version)
+		if n, from, err := reader.ReadFrom(nil); err != nil || n != 0 || from.String() != target.String() {
+			t.Fatalf("v%d: read empty into nil: %d from %v, %v", version, n, from, err)
+		}
+		buf := make([]byte, 8)
+		if n, from, err := reader.ReadFromAddrPort(buf); err != nil || n != 0 || from != addrPort {
+			t.Fatalf("v%d: read empty from an AddrPort: %d from %v, %v", version, n, from, err)
+		}
+		for _, want := range []struct {
+			payload string
+			from    net.Addr
+		}{{"", named}, {"x", target}, {"", target}} {
+			if n, from, err := reader.ReadFrom(buf); err != nil || string(buf[:n]) != want.payload || from.String() != want.from.String() {
+				t.Fatalf("v%d: read %q: %q from %v, %v", version, want.payload, buf[:n], from, err)
+			}
+		}
+		if _, _, err := reader.ReadFrom(buf); err != io.EOF {
+			t.Fatalf("v%d: expected io.EOF after the empty datagrams, got %v", version, err)
+		}
+		if stats := reader.Stats(); stats.DatagramsRead != 5 || stats.BytesRead != 1 {
+			t.Fatalf("v%d: unexpected read stats: %+v", version, stats)
+		}
+	}
+}
+
+func TestUoTPacketConnTruncatedFrame(t *testing.T) {
+	var frame bytes.Buffer
+	if err := WriteDatagram(&frame, "1.2.3.4:53", []byte("hello")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	raw := frame.Bytes()
+	payloadOffset := len(raw) - len("hello")
+
+	cases := []struct {
+		name  string
+		cut   int
+		stage string
+	}{
+		{"mid header", 2, FrameStageHeader},
+		{"mid address", uotHeaderLen + 3, FrameStageAddress},
+		{"before payload", payloadOffset, FrameStagePayload},
+		{"mid payload", len(raw) - 1, FrameStagePayload},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			peer, local := net.Pipe()
+			defer local.Close()
+			go func() {
+				_, _ = peer.Write(raw)
+				_, _ = peer.Write(raw[:tc.cut])
+				_ = peer.Close()
+			}()
+			conn := NewUoTPacketConn(local)
+			buf := make([]byte, 16)
+			if n, _, err := conn.ReadFrom(buf); err != nil || string(buf[:n]) != "hello" {
+				t.Fatalf("read the whole frame: %q, %v", buf[:n], err)
+			}
+			_, _, err := conn.ReadFrom(buf)
+			var frameErr *FrameError
+			if !errors.Is(err, ErrTruncatedFrame) || !errors.Is(err, io.ErrUnexpectedEOF) || !errors.As(err, &frameErr) {
+				t.Fatalf("expected a truncated frame, got %v", err)
+			}
+			if frameErr.Stage != tc.stage || frameErr.Offset != tc.cut {
+				t.Fatalf("got stage=%s offset=%d, want stage=%s offset=%d", frameErr.Stage, frameErr.Offset, tc.stage, tc.cut)
+			}
+			if errors.Is(err, io.EOF) {
+				t.Fatalf("truncation looks like a clean close: %v", err)
+			}
+		})
+	}
+
+	t.Run("frame boundary", func(t *testing.T) {
+		peer, local := net.Pipe()
+		defer local.Close()
+		go func() {
+			_, _ = peer.Write(raw)
+			_ = peer.Close()
+		}()
+		conn := NewUoTPacketConn(local)
+		buf := make([]byte, 16)
+		if _, _, err := conn.ReadFrom(buf); err != nil {
+			t.Fatalf("read the whole frame: %v", err)
+		}
+		if _, _, err := conn.ReadFrom(buf); err != io.EOF {
+			t.Fatalf("expected a clean io.EOF, got %v", err)
+		}
+	})
+}
+
+func TestUoTPacketConnDeadlineMidFrame(t *testing.T) {
+	named := &NamedAddr{Host: "example.com", Port: 443}
+	for _, version := range []byte{UoTVersion1, UoTVersion3} {
+		var stream bytes.Buffer
+		writer := NewUoTPacketConnWithVersion(&captureConn{w: &stream}, version)
+		if version >= UoTVersion3 {
+			if err := writer.SetChecksum(true); err != nil {
+				t.Fatal(err)
+			}
+			if err := writer.SetPadding(1, 8); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := writer.WriteTo([]byte("hello"), named); err != nil {
+			t.Fatal(err)
+		}
+		first := stream.Len()
+		if _, err := writer.WriteTo([]byte("world"), &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 53}); err != nil {
+			t.Fatal(err)
+		}
+		raw := stream.Bytes()
+
+		for _, cut := range []int{2, uotHeaderLen, uotHeaderLen + 3, first - 1, first + uotHeaderLen + 1} {
+			t.Run("v"+strconv.Itoa(int(version))+" cut "+strconv.Itoa(cut), func(t *testing.T) {
+				peer, local := net.Pipe()
+				defer local.Close()
+				resume := make(chan struct{})
+				go func() {
+					_, _ = peer.Write(raw[:cut])
+					<-resume
+					_, _ = peer.Write(raw[cut:])
+				}()
+				conn := NewUoTPacketConnWithVersion(local, version)
+				buf := make([]byte, 16)
+				if cut > first {
+					if n, _, err := conn.ReadFrom(buf); err != nil || string(buf[:n]) != "hello" {
+						t.Fatalf("read the first frame: %q, %v", buf[:n], err)
+					}
+				}
+
+				if err := conn.SetReadDeadline(time.Now().Add(20 * time.Millisecond)); err != nil {
+					t.Fatal(err)
+				}
+				_, _, err := conn.ReadFrom(buf)
+				var netErr net.Error
+				if !errors.As(err, &netErr) || !netErr.Timeout() {
+					t.Fatalf("expected a timeout, got %v", err)
+				}
+				if _, ok := err.(net.Error); !ok {
+					t.Fatalf("expected the timeout itself, got %T %v", err, err)
+				}
+				close(resume)
+				if err := conn.SetReadDeadline(time.Time{}); err != nil {
+					t.Fatal(err)
+				}
+
+				if cut < first {
+					n, addr, err := conn.ReadFrom(buf)
+					if err != nil || string(buf[:n]) != "hello" || addr.String() != named.String() {
+						t.Fatalf("read the interrupted frame: %q from %v, %v", buf[:n], addr, err)
+					}
+				}
+				n, addr, err := conn.ReadFrom(buf)
+				if err != nil || string(buf[:n]) != "world" || addr.String() != "1.2.3.4:53" {
+					t.Fatalf("read the next frame: %q from %v, %v", buf[:n], addr, err)
+				}
+				stats := conn.Stats()
+				if stats.DatagramsRead != 2 || stats.WireBytesRead != uint64(len(raw)) {
+					t.Fatalf("interrupted frame counted twice: %+v", stats)
+				}
+			})
+		}
+	}
+
+	t.Run("context", func(t *testing.T) {
+		var frame bytes.Buffer
+		if err := WriteDatagram(&frame, "1.2.3.4:53", []byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		raw := frame.Bytes()
+		peer, local := net.Pipe()
+		defer local.Close()
+		resume := make(chan struct{})
+		go func() {
+			_, _ = peer.Write(raw[:uotHeaderLen+2])
+			<-resume
+			_, _ = peer.Write(raw[uotHeaderLen+2:])
+		}()
+		conn := NewUoTPacketConn(local)
+		buf := make([]byte, 16)
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		if _, _, err := conn.ReadFromContext(ctx, buf); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected the context deadline, got %v", err)
+		}
+		close(resume)
+		if n, _, err := conn.ReadFrom(buf); err != nil || string(buf[:n]) != "hello" {
+			t.Fatalf("read the interrupted frame: %q, %v", buf[:n], err)
+		}
+	})
+}
+
+func TestUoTAcceptorMaxPerIP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	acceptor := NewUoTAcceptor(ln)
+	defer acceptor.Close()
+	acceptor.SetMaxPerIP(2)
+
+	accepted := make(chan net.Conn, 4)
+	go func() {
+		for {
+			conn, err := acceptor.Accept()
+			if err != nil {
+				close(accepted)
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		return conn
+	}
+
+	var serverConns []net.Conn
+	for i := 0; i < 2; i++ {
+		client := dial()
+		defer client.Close()
+		select {
+		case conn := <-accepted:
+			serverConns = append(serverConns, conn)
+		case <-time.After(time.Second):
+			t.Fatalf("connection %d not accepted", i)
+		}
+	}
+	loopback := netip.MustParseAddr("127.0.0.1")
+	if got := acceptor.ActiveConns(loopback); got != 2 {
+		t.Fatalf("active conns = %d, want 2", got)
+	}
+
+	rejected := dial()
+	defer rejected.Close()
+	_ = rejected.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := rejected.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("expected over-limit connection to be closed")
+	}
+	select {
+	case <-accepted:
+		t.Fatalf("over-limit connection was accepted")
+	default:
+	}
+
+	_ = serverConns[0].Close()
+	_ = serverConns[0].Close()
+	if got := acceptor.ActiveConns(loopback); got != 1 {
+		t.Fatalf("active conns after close = %d, want 1", got)
+	}
+	client := dial()
+	defer client.Close()
+	select {
+	case conn := <-accepted:
+		defer conn.Close()
+	case <-time.After(time.Second):
+		t.Fatalf("connection not accepted after a slot was released")
+	}
+	_ = serverConns[1].Close()
+}
+
+func TestUoTPacketConnGoodput(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	client := NewUoTPacketConn(clientConn)
+	server := NewUoTPacketConn(serverConn)
+
+	if got := client.Goodput(); got != 0 {
+		t.Fatalf("goodput before traffic = %v", got)
+	}
+
+	target := &net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 53}
+	payload := make([]byte, 21)
+	writeDone := make(chan struct{})
+	go func() {
+		defer close(writeDone)
+		for i := 0; i < 3; i++ {
+			_, _ = client.WriteTo(payload, target)
+		}
+	}()
+	buf := make([]byte, 64)
+	for i := 0; i < 3; i++ {
+		if _, _, err := server.ReadFrom(buf); err != nil {
+			t.Fatalf("read: %v", err)
+		}
+	}
+	<-writeDone
+
+	// each frame: 4 byte header + 7 byte ipv4 address + 21 byte payload
+	const wire = 4 + 7 + 21
+	want := UoTStats{DatagramsRead: 3, BytesRead: 3 * 21, WireBytesRead: 3 * wire, Goodput: 21.0 / wire, CompressionRatio: 1}
+	if got := server.Stats(); got != want {
+		t.Fatalf("server stats = %+v, want %+v", got, want)
+	}
+	if got := client.Stats(); got.BytesWritten != 3*21 || got.WireBytesWritten != 3*wire || got.Goodput != 21.0/wire {
+		t.Fatalf("client stats = %+v", got)
+	}
+}
+
+func TestUoTPacketConnStatsExchange(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	client := NewUoTPacketConn(clientConn)
+	server := NewUoTPacketConn(serverConn)
+	defer client.Close()
+
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			if _, _, err := server.ReadFrom(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	target := &net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 53}
+	for i := 0; i < 3; i++ {
+		if _, err := client.WriteTo([]byte("ping"), target); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	client.EnableStatsExchange(5 * time.Millisecond)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for server.CounterDiscrepancy().Reports == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("no stats report received")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := server.CounterDiscrepancy(); got.Datagrams != 0 || got.Bytes != 0 {
+		t.Fatalf("unexpected discrepancy on a healthy session: %+v", got)
+	}
+	if got := server.Stats().BytesRead; got != 12 {
+		t.Fatalf("control frames leaked into datagrams: bytes read = %d", got)
+	}
+}
+
+func TestUoTPacketConnStatsDiscrepancy(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	server := NewUoTPacketConn(serverConn)
+
+	go func() {
+		_ = WriteDatagram(clientConn, "1.1.1.1:53", []byte("ping"))
+		// claim three datagrams of four bytes while only one was sent
+		report := make([]byte, 17)
+		report[0] = uotControlStats
+		report[8] = 3
+		report[16] = 12
+		_, _ = writeControlFrame(clientConn, report)
+		_ = WriteDatagram(clientConn, "1.1.1.1:53", []byte("pong"))
+	}()
+
+	buf := make([]byte, 64)
+	for i := 0; i < 2; i++ {
+		if _, _, err := server.ReadFrom(buf); err != nil {
+			t.Fatalf("read: %v", err)
+		}
+	}
+	if got := server.CounterDiscrepancy(); got.Reports != 1 || got.Datagrams != 2 || got.Bytes != 8 {
+		t.Fatalf("unexpected discrepancy: %+v", got)
+	}
+}
+
+func TestUoTPacketConnMaxDatagramRate(t *testing.T) {
+	var stream bytes.Buffer
+	for i := 0; i < 60; i++ {
+		_ = WriteDatagram(&stream, "1.2.3.4:53", []byte(strconv.Itoa(i)))
+	}
+	pc := NewUoTPacketConn(&readOnlyConn{Reader: bytes.NewReader(stream.Bytes())})
+	pc.SetMaxDatagramRate(10)
+	if pc.datagramRate.Load() == nil {
+		t.Fatal("rate cap not set")
+	}
+	clock := &fakeUoTClock{now: time.Now()}
+	pc.datagramRate.Store(newUoTDatagramRate(clock, 10))
+
+	buf := make([]byte, 16)
+	next := 0
+	// read reports how many of n reads were let through, checking the stream stays in sync
+	read := func(n int) int {
+		t.Helper()
+		allowed := 0
+		for i := 0; i < n; i++ {
+			m, _, err := pc.ReadFrom(buf)
+			if want := strconv.Itoa(next); err == nil && string(buf[:m]) != want {
+				t.Fatalf("read %q, want %q", buf[:m], want)
+			}
+			next++
+			if errors.Is(err, ErrRateExceeded) {
+				continue
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			allowed++
+		}
+		return allowed
+	}
+
+	if allowed := read(25); allowed != 10 {
+		t.Fatalf("%d of a burst of 25 let through, want 10", allowed)
+	}
+	// half a second into the next one, half of the previous second still counts
+	clock.now = clock.now.Add(1500 * time.Millisecond)
+	if allowed := read(10); allowed != 5 {
+		t.Fatalf("%d let through after 1.5s, want 5", allowed)
+	}
+	clock.now = clock.now.Add(2 * time.Second)
+	if allowed := read(15); allowed != 10 {
+		t.Fatalf("%d let through after a quiet second, want 10", allowed)
+	}
+	if got := pc.Stats().RateDropped; got != 15+5+5 {
+		t.Fatalf("rate dropped = %d", got)
+	}
+
+	pc.SetMaxDatagramRate(0)
+	if allowed := read(10); allowed != 10 {
+		t.Fatalf("%d let through without a cap", allowed)
+	}
+}
+
+func TestUoTPacketConnMaxDatagramSize(t *testing.T) {
+	longDomain := &NamedAddr{Host: strings.Repeat("a", 255), Port: 53}
+	cases := []struct {
+		name    string
+		version byte
+		setup   func(c *UoTPacketConn) error
+		want    int
+	}{
+		{"default", UoTVersion1, func(c *UoTPacketConn) error { return nil }, maxUoTPayload},
+		{"limit", UoTVersion1, func(c *UoTPacketConn) error { c.maxPayload = 1200; return nil }, 1200},
+		{"padding and checksum", UoTVersion3, func(c *UoTPacketConn) error {
+			c.maxPayload = 1200
+			if err := c.SetPadding(100, maxUoTPadding); err != nil {
+				return err
+			}
+			return c.SetChecksum(true)
+		}, 1200},
+		{"compression", UoTVersion3, func(c *UoTPacketConn) error {
+			c.maxPayload = 1200
+			return c.SetCompression(true, 0)
+		}, 1200},
+		{"fragmentation", UoTVersion3, func(c *UoTPacketConn) error {
+			c.maxPayload = 1200
+			if err := c.SetChecksum(true); err != nil {
+				return err
+			}
+			return c.EnableFragmentation(0)
+		}, maxUoTFragmentedPayload},
+		{"fragmentation of a tiny limit", UoTVersion2, func(c *UoTPacketConn) error {
+			c.maxPayload = 8
+			return c.EnableFragmentation(0)
+		}, 8 * 0xffff},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := NewUoTPacketConnWithVersion(&captureConn{w: io.Discard}, tc.version)
+			if err := tc.setup(c); err != nil {
+				t.Fatal(err)
+			}
+			size := c.MaxDatagramSize()
+			if size != tc.want {
+				t.Fatalf("MaxDatagramSize = %d, want %d", size, tc.want)
+			}
+
+			payload := make([]byte, size+1)
+			_, _ = rand.Read(payload)
+			if _, err := c.WriteTo(payload[:size], longDomain); err != nil {
+				t.Fatalf("write of %d bytes: %v", size, err)
+			}
+			if _, err := c.WriteTo(payload, longDomain); !errors.Is(err, ErrPayloadTooLarge) {
+				t.Fatalf("write of %d bytes: expected ErrPayloadTooLarge, got %v", size+1, err)
+			}
+		})
+	}
+}
+
+func TestUoTPacketConnRemoteAddr(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := listener.Accept()
+		accepted <- conn
+	}()
+	clientConn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientConn.Close()
+	serverConn := <-accepted
+	if serverConn == nil {
+		t.Fatal("accept failed")
+	}
+	defer serverConn.Close()
+
+	client, server := NewUoTPacketConn(clientConn), NewUoTPacketConn(serverConn)
+	if got := client.RemoteAddr(); got.String() != listener.Addr().String() {
+		t.Fatalf("client remote = %v, want %v", got, listener.Addr())
+	}
+	if got := server.RemoteAddr(); got.String() != clientConn.LocalAddr().String() {
+		t.Fatalf("server remote = %v, want %v", got, clientConn.LocalAddr())
+	}
+
+	pipeA, pipeB := net.Pipe()
+	defer pipeA.Close()
+	defer pipeB.Close()
+	if got := NewUoTPacketConn(pipeA).RemoteAddr(); got == nil || got.Network() != "pipe" {
+		t.Fatalf("pipe remote = %v", got)
+	}
+	if got := NewUoTPacketConn(nil).RemoteAddr(); got != nil {
+		t.Fatalf("remote of a nil conn = %v", got)
+	}
+}
+
+func TestUoTPacketConnSetLocalAddr(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	client, server := NewUoTPacketConn(clientConn), NewUoTPacketConn(serverConn)
+	if got := server.LocalAddr(); got != serverConn.LocalAddr() {
+		t.Fatalf("default local = %v, want the stream's %v", got, serverConn.LocalAddr())
+	}
+
+	udp := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1080}
+	server.SetLocalAddr(udp)
+	if got := server.LocalAddr(); got != udp {
+		t.Fatalf("local = %v, want %v", got, udp)
+	}
+	if got := client.LocalAddr(); got != clientConn.LocalAddr() {
+		t.Fatalf("override leaked to the peer: %v", got)
+	}
+
+	target := &net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 53}
+	go func() { _, _ = client.WriteTo([]byte("ping"), target) }()
+	buf := make([]byte, 16)
+	if n, from, err := server.ReadFrom(buf); err != nil || string(buf[:n]) != "ping" || from.String() != target.String() {
+		t.Fatalf("read with an overridden local address: %q from %v, %v", buf[:n], from, err)
+	}
+
+	server.SetLocalAddr(nil)
+	if got := server.LocalAddr(); got != serverConn.LocalAddr() {
+		t.Fatalf("local after reset = %v, want the stream's %v", got, serverConn.LocalAddr())
+	}
+}
+
+func TestReadPreface(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WritePreface(&buf); err != nil {
+		t.Fatalf("write preface: %v", err)
+	}
+	version, err := ReadPreface(&buf)
+	if err != nil {
+		t.Fatalf("read preface: %v", err)
+	}
+	if version != uotVersion {
+		t.Fatalf("version = %d, want %d", version, uotVersion)
+	}
+
+	if _, err := ReadPreface(bytes.NewReader([]byte{0x01, uotVersion})); !errors.Is(err, ErrBadMagic) {
+		t.Fatalf("expected ErrBadMagic, got %v", err)
+	}
+	if _, err := ReadPreface(bytes.NewReader([]byte{UoTMagicByte, 0x7f})); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Fatalf("expected ErrUnsupportedVersion, got %v", err)
+	}
+	if _, err := ReadPreface(bytes.NewReader([]byte{UoTMagicByte})); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("expected io.ErrUnexpectedEOF, got %v", err)
+	}
+}
+
+func TestReadPrefaceWithMagic(t *testing.T) {
+	const magic byte = 0xA7
+	var buf bytes.Buffer
+	if err := WritePrefaceWithMagic(&buf, magic); err != nil {
+		t.Fatalf("write preface: %v", err)
+	}
+	if !bytes.Equal(buf.Bytes(), []byte{magic, uotVersion}) {
+		t.Fatalf("preface = %x", buf.Bytes())
+	}
+	if version, err := ReadPrefaceWithMagic(bytes.NewReader(buf.Bytes()), magic); err != nil || version != uotVersion {
+		t.Fatalf("read preface: %d, %v", version, err)
+	}
+
+	if _, err := ReadPreface(bytes.NewReader(buf.Bytes())); !errors.Is(err, ErrBadMagic) {
+		t.Fatalf("expected ErrBadMagic for the default magic, got %v", err)
+	}
+	if _, err := ReadPrefaceWithMagic(bytes.NewReader([]byte{UoTMagicByte, uotVersion}), magic); !errors.Is(err, ErrBadMagic) {
+		t.Fatalf("expected ErrBadMagic for a custom magic, got %v", err)
+	}
+	if _, err := ReadPrefaceWithMagic(bytes.NewReader([]byte{magic, 0x7f}), magic); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Fatalf("expected ErrUnsupportedVersion, got %v", err)
+	}
+}
+
+func TestNegotiateVersion(t *testing.T) {
+	cases := []struct {
+		name    string
+		client  []byte
+		server  []byte
+		want    byte
+		wantErr bool
+	}{
+		{"version 1 only", []byte{UoTVersion1}, []byte{UoTVersion1, 2}, UoTVersion1, false},
+		{"newer client falls back", []byte{UoTVersion1, 2, 3}, []byte{UoTVersion1, 2}, 2, false},
+		{"newer server", []byte{UoTVersion1, 2}, []byte{UoTVersion1, 2, 3}, 2, false},
+		{"no overlap", []byte{2}, []byte{3}, 0, true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			defer serverConn.Close()
+
+			type result struct {
+				version byte
+				err     error
+			}
+			serverResult := make(chan result, 1)
+			go func() {
+				v, err := AcceptVersion(serverConn, tc.server)
+				serverResult <- result{v, err}
+			}()
+
+			clientVersion, clientErr := NegotiateVersion(clientConn, tc.client)
+			server := <-serverResult
+			if tc.wantErr {
+				if clientErr == nil || server.err == nil {
+					t.Fatalf("expected both sides to fail, client=%v server=%v", clientErr, server.err)
+				}
+				if !errors.Is(clientErr, ErrUnsupportedVersion) || !errors.Is(server.err, ErrUnsupportedVersion) {
+					t.Fatalf("unexpected errors: client=%v server=%v", clientErr, server.err)
+				}
+				return
+			}
+			if clientErr != nil || server.err != nil {
+				t.Fatalf("negotiate: client=%v server=%v", clientErr, server.err)
+			}
+			if clientVersion != tc.want || server.version != tc.want {
+				t.Fatalf("agreed client=%d server=%d, want %d", clientVersion, server.version, tc.want)
+			}
+		})
+	}
+}
+
+func TestNegotiateVersionRejectsUnsupportedAnswer(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	go func() {
+		// the server assumes every version up to the offered one is spoken
+		_, _ = AcceptVersion(serverConn, []byte{UoTVersion1, 2})
+	}()
+	if _, err := NegotiateVersion(clientConn, []byte{3}); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Fatalf("expected client to reject version 2, got %v", err)
+	}
+}
+
+func TestNegotiateVersionCompatibleWithPreface(t *testing.T) {
+	var buf bytes.Buffer
+	if _, err := NegotiateVersion(&buf, []byte{UoTVersion1}); err != nil {
+		t.Fatalf("negotiate: %v", err)
+	}
+	if !bytes.Equal(buf.Bytes(), []byte{UoTMagicByte, uotVersion}) {
+		t.Fatalf("version 1 negotiation wrote %x", buf.Bytes())
+	}
+	if v, err := ReadPreface(&buf); err != nil || v != uotVersion {
+		t.Fatalf("read preface: %d %v", v, err)
+	}
+	if conn := NewUoTPacketConnWithVersion(nil, 2); conn.Version() != 2 {
+		t.Fatalf("version not threaded into the packet conn")
+	}
+}
+
+func TestReadDatagramInto(t *testing.T) {
+	var stream bytes.Buffer
+	_ = WriteDatagram(&stream, "1.2.3.4:53", bytes.Repeat([]byte{0xaa}, 32))
+	_ = WriteDatagram(&stream, "5.6.7.8:53", []byte("fits"))
+
+	addrBuf := make([]byte, 32)
+	payloadBuf := make([]byte, 16)
+	if _, _, err := ReadDatagramInto(&stream, addrBuf, payloadBuf); err != io.ErrShortBuffer {
+		t.Fatalf("expected io.ErrShortBuffer, got %v", err)
+	}
+	addrLen, payloadLen, err := ReadDatagramInto(&stream, addrBuf, payloadBuf)
+	if err != nil {
+		t.Fatalf("read into: %v", err)
+	}
+	addr, err := SOCKSAddressCodec{}.DecodeAddress(addrBuf[:addrLen])
+	if err != nil || addr != "5.6.7.8:53" {
+		t.Fatalf("decode address: %q %v", addr, err)
+	}
+	if string(payloadBuf[:payloadLen]) != "fits" {
+		t.Fatalf("payload = %q", payloadBuf[:payloadLen])
+	}
+}
+
+func benchmarkFrames(b *testing.B, payloadLen int) []byte {
+	var stream bytes.Buffer
+	payload := make([]byte, payloadLen)
+	for i := 0; i < b.N; i++ {
+		_ = WriteDatagram(&stream, "1.2.3.4:443", payload)
+	}
+	return stream.Bytes()
+}
+
+func BenchmarkReadDatagram(b *testing.B) {
+	r := bytes.NewReader(benchmarkFrames(b, 1200))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := ReadDatagram(r); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeAddress(b *testing.B) {
+	for _, addr := range []string{"1.2.3.4:443", "[2001:db8::1]:443", "example.com:443"} {
+		encoded, err := EncodeAddress(addr)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(addr, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := DecodeAddress(encoded); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkReadDatagramInto(b *testing.B) {
+	r := bytes.NewReader(benchmarkFrames(b, 1200))
+	addrBuf := make([]byte, 256)
+	payloadBuf := make([]byte, maxUoTPayload)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := ReadDatagramInto(r, addrBuf, payloadBuf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecoderReadDatagram(b *testing.B) {
+	d := NewDecoder(bytes.NewReader(benchmarkFrames(b, 1200)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := d.ReadDatagram(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkWriteDatagram(b *testing.B) {
+	payload := make([]byte, 1200)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := WriteDatagram(io.Discard, "1.2.3.4:443", payload); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEncoderWriteDatagram(b *testing.B) {
+	e := NewEncoder(io.Discard)
+	payload := make([]byte, 1200)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := e.WriteDatagram("1.2.3.4:443", payload); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestEncoderDecoder(t *testing.T) {
+	var stream bytes.Buffer
+	e := NewEncoder(&stream)
+	datagrams := []struct {
+		addr    string
+		payload []byte
+	}{
+		{"1.2.3.4:53", []byte("first")},
+		{"example.com:443", bytes.Repeat([]byte{0xaa}, 1500)},
+		{"[2001:db8::1]:53", []byte("after a larger one")},
+		{"5.6.7.8:53", nil},
+	}
+	for _, dg := range datagrams {
+		if err := e.WriteDatagram(dg.addr, dg.payload); err != nil {
+			t.Fatalf("write %s: %v", dg.addr, err)
+		}
+	}
+	if err := e.WriteDatagram("no port", nil); err == nil {
+		t.Fatal("expected an address without port to fail")
+	}
+	if err := e.WriteDatagram("1.2.3.4:53", make([]byte, maxUoTPayload+1)); !errors.Is(err, ErrPayloadTooLarge) {
+		t.Fatalf("expected ErrPayloadTooLarge, got %v", err)
+	}
+	wire := append([]byte(nil), stream.Bytes()...)
+
+	// the stateless functions read what the encoder wrote, and the other way round
+	for _, dg := range datagrams {
+		addr, payload, err := ReadDatagram(&stream)
+		if err != nil || addr != dg.addr || !bytes.Equal(payload, dg.payload) {
+			t.Fatalf("read %q %x, %v", addr, payload, err)
+		}
+	}
+	var freeWire bytes.Buffer
+	for _, dg := range datagrams {
+		_ = WriteDatagram(&freeWire, dg.addr, dg.payload)
+	}
+	if !bytes.Equal(wire, freeWire.Bytes()) {
+		t.Fatal("encoder and WriteDatagram disagree on the wire format")
+	}
+
+	d := NewDecoder(bytes.NewReader(wire))
+	for _, dg := range datagrams {
+		addr, payload, err := d.ReadDatagram()
+		if err != nil || addr != dg.addr || !bytes.Equal(payload, dg.payload) {
+			t.Fatalf("decode %q %x, %v", addr, payload, err)
+		}
+	}
+	if _, _, err := d.ReadDatagram(); err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+
+	truncated := NewDecoder(bytes.NewReader(wire[:14]))
+	var frameErr *FrameError
+	if _, _, err := truncated.ReadDatagram(); !errors.As(err, &frameErr) || frameErr.Stage != FrameStagePayload {
+		t.Fatalf("expected a payload FrameError, got %v", err)
+	}
+}
+
+func BenchmarkUoTPacketConnReadFrom(b *testing.B) {
+	conn := &readOnlyConn{Reader: bytes.NewReader(benchmarkFrames(b, 1200))}
+	pc := NewUoTPacketConn(conn)
+	buf := make([]byte, maxUoTPayload)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := pc.ReadFrom(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestUoTPacketConnReadFromIPAllocs(t *testing.T) {
+	var stream bytes.Buffer
+	for i := 0; i < 202; i++ {
+		addr := "1.2.3.4:53"
+		if i%2 == 1 {
+			addr = "[2001:db8::1]:53"
+		}
+		if err := WriteDatagram(&stream, addr, make([]byte, 100)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pc := NewUoTPacketConn(&readOnlyConn{Reader: bytes.NewReader(stream.Bytes())})
+	buf := make([]byte, maxUoTPayload)
+	allocs := testing.AllocsPerRun(100, func() {
+		if _, _, err := pc.ReadFrom(buf); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs != 0 {
+		t.Fatalf("expected ReadFrom of a known IP source not to allocate, got %v allocs", allocs)
+	}
+}
+
+func TestUoTPayloadLimit(t *testing.T) {
+	for _, limit := range []int{0, -1, maxUoTPayload + 1} {
+		if _, err := NewUoTPacketConnWithLimit(nil, limit); !errors.Is(err, ErrInvalidPayloadLimit) {
+			t.Fatalf("limit %d: expected ErrInvalidPayloadLimit, got %v", limit, err)
+		}
+	}
+
+	var stream bytes.Buffer
+	if err := WriteDatagramWithLimit(&stream, "1.2.3.4:53", make([]byte, 17), 16); err == nil {
+		t.Fatalf("expected oversized write to fail")
+	}
+	if stream.Len() != 0 {
+		t.Fatalf("rejected write left %d bytes", stream.Len())
+	}
+	_ = WriteDatagramWithLimit(&stream, "1.2.3.4:53", make([]byte, 16), 16)
+	_ = WriteDatagram(&stream, "1.2.3.4:53", make([]byte, 17))
+	if _, payload, err := ReadDatagramWithLimit(&stream, 16); err != nil || len(payload) != 16 {
+		t.Fatalf("read under limit: %d %v", len(payload), err)
+	}
+	if _, _, err := ReadDatagramWithLimit(&stream, 16); !errors.Is(err, ErrInvalidPayloadLength) {
+		t.Fatalf("expected ErrInvalidPayloadLength, got %v", err)
+	}
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	client, err := NewUoTPacketConnWithLimit(clientConn, 16)
+	if err != nil {
+		t.Fatalf("new conn: %v", err)
+	}
+	server, _ := NewUoTPacketConnWithLimit(serverConn, 16)
+	target := &net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 53}
+	if _, err := client.WriteTo(make([]byte, 17), target); err == nil {
+		t.Fatalf("expected oversized WriteTo to fail")
+	}
+	go func() { _, _ = client.WriteTo(make([]byte, 16), target) }()
+	buf := make([]byte, 64)
+	if n, _, err := server.ReadFrom(buf); err != nil || n != 16 {
+		t.Fatalf("read under limit: %d %v", n, err)
+	}
+}
+
+func TestUoTPacketConnFragmentation(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	client := NewUoTPacketConnWithVersion(clientConn, UoTVersion2)
+	server := NewUoTPacketConnWithVersion(serverConn, UoTVersion2)
+
+	if err := NewUoTPacketConn(clientConn).EnableFragmentation(0); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Fatalf("expected version 1 conn to refuse fragmentation, got %v", err)
+	}
+	target := &net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 53}
+	large := bytes.Repeat([]byte("0123456789"), 20000)
+	if _, err := client.WriteTo(large, target); err == nil {
+		t.Fatalf("expected oversized write to fail without fragmentation")
+	}
+	if err := client.EnableFragmentation(time.Second); err != nil {
+		t.Fatalf("enable fragmentation: %v", err)
+	}
+
+	go func() {
+		_, _ = client.WriteTo(large, target)
+		_, _ = client.WriteTo([]byte("small"), target)
+	}()
+	buf := make([]byte, len(large))
+	n, addr, err := server.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("read fragmented: %v", err)
+	}
+	if !bytes.Equal(buf[:n], large) || addr.String() != target.String() {
+		t.Fatalf("reassembled %d bytes from %v", n, addr)
+	}
+	if n, _, err := server.ReadFrom(buf); err != nil || string(buf[:n]) != "small" {
+		t.Fatalf("read after fragmented: %q %v", buf[:n], err)
+	}
+	if stats := server.Stats(); stats.BytesRead != uint64(len(large)+5) {
+		t.Fatalf("bytes read = %d", stats.BytesRead)
+	}
+}
+
+func TestUoTPacketConnFragmentTimeout(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	server := NewUoTPacketConnWithVersion(serverConn, UoTVersion2)
+	if err := server.EnableFragmentation(20 * time.Millisecond); err != nil {
+		t.Fatalf("enable fragmentation: %v", err)
+	}
+
+	var fragments bytes.Buffer
+	writer := NewUoTPacketConnWithVersion(&captureConn{w: &fragments}, UoTVersion2)
+	writer.maxPayload = 8
+	_ = writer.EnableFragmentation(0)
+	target := &net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 53}
+	if _, err := writer.WriteTo([]byte("0123456789"), target); err != nil {
+		t.Fatalf("write fragments: %v", err)
+	}
+	firstLen := uotHeaderLen + uotFragmentHeaderLen + 7 + 8
+
+	go func() {
+		// only the first of two fragments reaches the server before the timeout
+		_, _ = clientConn.Write(fragments.Bytes()[:firstLen])
+		time.Sleep(50 * time.Millisecond)
+		_ = WriteDatagram(clientConn, target.String(), []byte("after"))
+		_, _ = clientConn.Write(fragments.Bytes()[firstLen:])
+	}()
+
+	buf := make([]byte, 64)
+	if n, _, err := server.ReadFrom(buf); err != nil || string(buf[:n]) != "after" {
+		t.Fatalf("read: %q %v", buf[:n], err)
+	}
+	if pending := len(server.reassembly.pending); pending != 1 {
+		t.Fatalf("expected the late fragment to start a new datagram, %d pending", pending)
+	}
+	_ = clientConn.SetDeadline(time.Now().Add(100 * time.Millisecond))
+	_ = server.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, _, err := server.ReadFrom(buf); err == nil {
+		t.Fatalf("expected no datagram from an expired fragment set")
+	}
+}
+
+// captureConn records writes instead of sending them
+type captureConn struct {
+	net.Conn
+	w io.Writer
+}
+
+func (c *captureConn) Write(p []byte) (int, error) { return c.w.Write(p) }
+
+func TestUoTReassemblyFragmentCount(t *testing.T) {
+	var r uotReassembly
+	const addr = "1.1.1.1:53"
+
+	// a fragment claiming the largest count only costs what it carries
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	for id := uint32(0); id < maxUoTPendingDatagrams; id++ {
+		r.add(id, 0, 0xffff, addr, []byte("x"))
+	}
+	runtime.ReadMemStats(&after)
+	if grown := after.TotalAlloc - before.TotalAlloc; grown > 1<<20 {
+		t.Fatalf("%d pending fragments allocated %d bytes", maxUoTPendingDatagrams, grown)
+	}
+
+	// fragments arriving out of order still reassemble in order
+	var datagram *uotDatagram
+	for _, index := range []int{2, 0, 1} {
+		datagram = r.add(99, index, 3, addr, []byte{byte(index)})
+	}
+	if datagram == nil || !bytes.Equal(datagram.payload, []byte{0, 1, 2}) {
+		t.Fatalf("reassembled %+v", datagram)
+	}
+}
+
+func TestUoTVersion1SkipsFragments(t *testing.T) {
+	var stream bytes.Buffer
+	writer := NewUoTPacketConnWithVersion(&captureConn{w: &stream}, UoTVersion2)
+	writer.maxPayload = 4
+	_ = writer.EnableFragmentation(0)
+	target := &net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 53}
+	_, _ = writer.WriteTo([]byte("fragmented"), target)
+	_, _ = writer.WriteTo([]byte("ok"), target)
+
+	reader := NewUoTPacketConn(&readOnlyConn{Reader: bytes.NewReader(stream.Bytes())})
+	buf := make([]byte, 64)
+	if n, _, err := reader.ReadFrom(buf); err != nil || string(buf[:n]) != "ok" {
+		t.Fatalf("version 1 read: %q %v", buf[:n], err)
+	}
+}
+
+func TestUoTPacketConnBatch(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	client := NewUoTPacketConn(clientConn)
+	server := NewUoTPacketConn(serverConn)
+
+	payloads := [][]byte{[]byte("one"), []byte("two"), []byte("three")}
+	addrs := []net.Addr{
+		&net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 53},
+		&net.UDPAddr{IP: net.IPv4(8, 8, 8, 8), Port: 53},
+		&net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443},
+	}
+	writeResult := make(chan error, 1)
+	go func() {
+		n, err := client.WriteBatch(payloads, addrs)
+		if err == nil && n != len(payloads) {
+			err = io.ErrShortWrite
+		}
+		writeResult <- err
+	}()
+
+	msgs := make([][]byte, 2)
+	for i := range msgs {
+		msgs[i] = make([]byte, 64)
+	}
+	readAddrs := make([]net.Addr, 2)
+	if n, err := server.ReadBatch(msgs, readAddrs); err != nil || n != 2 {
+		t.Fatalf("read batch: %d %v", n, err)
+	}
+	for i := range msgs {
+		if string(msgs[i]) != string(payloads[i]) || readAddrs[i].String() != addrs[i].String() {
+			t.Fatalf("datagram %d: %q from %v", i, msgs[i], readAddrs[i])
+		}
+	}
+
+	// the third datagram is buffered, the next batch returns it without waiting for another
+	msgs = [][]byte{make([]byte, 64), make([]byte, 64)}
+	n, err := server.ReadBatch(msgs, readAddrs)
+	if n != 1 || err != nil || string(msgs[0]) != "three" {
+		t.Fatalf("partial read batch: %d %v %q", n, err, msgs[0])
+	}
+	if err := <-writeResult; err != nil {
+		t.Fatalf("write batch: %v", err)
+	}
+	if stats := client.Stats(); stats.BytesWritten != 11 {
+		t.Fatalf("bytes written = %d", stats.BytesWritten)
+	}
+}
+
+func TestUoTPacketConnReadBatchBuffered(t *testing.T) {
+	var stream bytes.Buffer
+	writer := NewUoTPacketConn(&captureConn{w: &stream})
+	target := &net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 53}
+	var secondEnd int
+	for i, payload := range []string{"one", "two", "three"} {
+		if _, err := writer.WriteTo([]byte(payload), target); err != nil {
+			t.Fatal(err)
+		}
+		if i == 1 {
+			secondEnd = stream.Len()
+		}
+	}
+	frames := stream.Bytes()
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	server := NewUoTPacketConn(serverConn)
+	written := make(chan struct{})
+	go func() {
+		// the third frame is cut in two, its end only comes after the batch returned
+		_, _ = clientConn.Write(frames[:secondEnd+3])
+		<-written
+		_, _ = clientConn.Write(frames[secondEnd+3:])
+	}()
+
+	msgs := make([][]byte, 4)
+	for i := range msgs {
+		msgs[i] = make([]byte, 64)
+	}
+	addrs := make([]net.Addr, len(msgs))
+	n, err := server.ReadBatch(msgs, addrs)
+	close(written)
+	if err != nil || n != 2 || string(msgs[0]) != "one" || string(msgs[1]) != "two" {
+		t.Fatalf("read batch: %d %v %q", n, err, msgs[:n])
+	}
+	buf := make([]byte, 64)
+	if n, addr, err := server.ReadFrom(buf); err != nil || string(buf[:n]) != "three" || addr.String() != target.String() {
+		t.Fatalf("read after batch: %q from %v: %v", buf[:n], addr, err)
+	}
+}
+
+func TestUoTPacketConnWriteBatchPartial(t *testing.T) {
+	var stream bytes.Buffer
+	conn := NewUoTPacketConn(&captureConn{w: &stream})
+	target := &net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 53}
+	payloads := [][]byte{[]byte("ok"), make([]byte, maxUoTPayload+1), []byte("never")}
+	n, err := conn.WriteBatch(payloads, []net.Addr{target, target, target})
+	if n != 1 || err == nil {
+		t.Fatalf("expected one datagram and an error, got %d %v", n, err)
+	}
+	if _, payload, err := ReadDatagram(&stream); err != nil || string(payload) != "ok" {
+		t.Fatalf("read flushed datagram: %q %v", payload, err)
+	}
+	if stream.Len() != 0 {
+		t.Fatalf("unexpected %d trailing bytes", stream.Len())
+	}
+}
+
+func TestUoTPacketConnStats(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	client := NewUoTPacketConn(clientConn)
+	server := NewUoTPacketConn(serverConn)
+
+	target := &net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 53}
+	writeDone := make(chan struct{})
+	go func() {
+		defer close(writeDone)
+		_, _ = client.WriteTo([]byte("hello"), target)
+		_, _ = client.WriteTo(nil, target)
+		_, _ = client.WriteTo([]byte("world!"), target)
+	}()
+	buf := make([]byte, 64)
+	for i := 0; i < 3; i++ {
+		if _, _, err := server.ReadFrom(buf); err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		// poll the counters the way a monitoring goroutine would
+		_ = client.Stats()
+	}
+	<-writeDone
+	replyDone := make(chan struct{})
+	go func() {
+		defer close(replyDone)
+		_, _ = server.WriteTo([]byte("reply"), target)
+	}()
+	if _, _, err := client.ReadFrom(buf); err != nil {
+		t.Fatalf("read reply: %v", err)
+	}
+	<-replyDone
+
+	got := server.Stats()
+	if got.DatagramsRead != 3 || got.BytesRead != 11 || got.DatagramsWritten != 1 || got.BytesWritten != 5 {
+		t.Fatalf("server stats = %+v", got)
+	}
+	if got := client.Stats(); got.DatagramsWritten != 3 || got.BytesWritten != 11 || got.DatagramsRead != 1 || got.BytesRead != 5 {
+		t.Fatalf("client stats = %+v", got)
+	}
+	if got.WireBytesRead <= got.BytesRead {
+		t.Fatalf("wire bytes don't include framing: %+v", got)
+	}
+}
+
+func TestUoTPacketConnKeepalive(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+	client := NewUoTPacketConn(clientConn)
+	client.EnableKeepalive(5 * time.Millisecond)
+
+	var heartbeat [uotHeaderLen]byte
+	_ = serverConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(serverConn, heartbeat[:]); err != nil {
+		t.Fatalf("read heartbeat: %v", err)
+	}
+	if heartbeat != [uotHeaderLen]byte{} {
+		t.Fatalf("heartbeat = %x", heartbeat)
+	}
+
+	server := NewUoTPacketConn(serverConn)
+	target := &net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 53}
+	writeDone := make(chan struct{})
+	go func() {
+		defer close(writeDone)
+		time.Sleep(20 * time.Millisecond)
+		_, _ = client.WriteTo([]byte("data"), target)
+	}()
+	buf := make([]byte, 64)
+	if n, addr, err := server.ReadFrom(buf); err != nil || string(buf[:n]) != "data" || addr.String() != target.String() {
+		t.Fatalf("read after heartbeats: %q %v %v", buf[:n], addr, err)
+	}
+	if stats := server.Stats(); stats.DatagramsRead != 1 || stats.WireBytesRead <= 4+7+4 {
+		t.Fatalf("heartbeats not dropped silently: %+v", stats)
+	}
+
+	<-writeDone
+
+	_ = client.Close()
+	written := client.Stats().WireBytesWritten
+	time.Sleep(20 * time.Millisecond)
+	if got := client.Stats().WireBytesWritten; got != written {
+		t.Fatalf("heartbeats continued after Close: %d -> %d", written, got)
+	}
+}
+
+func TestUoTPacketConnNamedAddr(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	client := NewUoTPacketConn(clientConn)
+	server := NewUoTPacketConn(serverConn)
+
+	go func() {
+		_, _ = client.WriteTo([]byte("fake"), &NamedAddr{Host: "unresolvable.invalid", Port: 53})
+		_, _ = client.WriteTo([]byte("ip"), &net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 53})
+	}()
+	buf := make([]byte, 64)
+	n, addr, err := server.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "fake" {
+		t.Fatalf("read domain datagram: %q %v", buf[:n], err)
+	}
+	named, ok := addr.(*NamedAddr)
+	if !ok || named.Host != "unresolvable.invalid" || named.Port != 53 {
+		t.Fatalf("addr = %#v", addr)
+	}
+	if addr.Network() != "udp" || addr.String() != "unresolvable.invalid:53" {
+		t.Fatalf("addr = %s/%s", addr.Network(), addr)
+	}
+	if _, addr, err := server.ReadFrom(buf); err != nil {
+		t.Fatalf("read ip datagram: %v", err)
+	} else if _, ok := addr.(*net.UDPAddr); !ok {
+		t.Fatalf("ip literal returned %T", addr)
+	}
+}
+
+func TestUoTSentinelErrors(t *testing.T) {
+	frame := func(addr, payload []byte) *bytes.Reader {
+		var buf bytes.Buffer
+		var header [uotHeaderLen]byte
+		binary.BigEndian.PutUint16(header[:2], uint16(len(addr)))
+		binary.BigEndian.PutUint16(header[2:], uint16(len(payload)))
+		buf.Write(header[:])
+		buf.Write(addr)
+		buf.Write(payload)
+		return bytes.NewReader(buf.Bytes())
+	}
+	_, encodeErr := EncodeAddress(strings.Repeat("a", 256) + ":53")
+	_, _, decodeErr := DecodeAddress([]byte{0x7f, 1, 2})
+	_, _, unknownTypeErr := ReadDatagram(frame([]byte{0x7f, 1, 2, 3}, nil))
+	_, _, emptyAddrErr := ReadDatagram(frame(nil, []byte{1}))
+	_, _, limitErr := ReadDatagramWithLimit(frame([]byte{0x01, 1, 1, 1, 1, 0, 53}, make([]byte, 9)), 8)
+	cases := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{"encode long domain", encodeErr, ErrAddressTooLong},
+		{"write long domain", WriteDatagram(io.Discard, strings.Repeat("a", 256)+":53", nil), ErrAddressTooLong},
+		{"write large payload", WriteDatagram(io.Discard, "1.1.1.1:53", make([]byte, maxUoTPayload+1)), ErrPayloadTooLarge},
+		{"decode unknown type", decodeErr, ErrUnknownAddressType},
+		{"read unknown type", unknownTypeErr, ErrUnknownAddressType},
+		{"read empty address", emptyAddrErr, ErrInvalidAddressLength},
+		{"read over limit", limitErr, ErrPayloadTooLarge},
+		{"read over limit length", limitErr, ErrInvalidPayloadLength},
+	}
+	for _, tc := range cases {
+		if !errors.Is(tc.err, tc.want) {
+			t.Fatalf("%s: %v is not %v", tc.name, tc.err, tc.want)
+		}
+		if errors.Is(tc.err, io.EOF) || errors.Is(tc.err, io.ErrUnexpectedEOF) {
+			t.Fatalf("%s: protocol violation looks like a conn failure: %v", tc.name, tc.err)
+		}
+	}
+}
+
+func TestUoTPacketConnContext(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	client := NewUoTPacketConn(clientConn)
+	server := NewUoTPacketConn(serverConn)
+	target := &net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 53}
+	buf := make([]byte, 64)
+
+	canceled, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	if _, _, err := server.ReadFromContext(canceled, buf); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	// the context deadline is cleared afterwards, a later read waits for data
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		_, _ = client.WriteTo([]byte("late"), target)
+	}()
+	if n, _, err := server.ReadFrom(buf); err != nil || string(buf[:n]) != "late" {
+		t.Fatalf("read after canceled read: %q %v", buf[:n], err)
+	}
+
+	// an earlier caller deadline wins over the context and survives the call
+	_ = server.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	ctx, cancelTimeout := context.WithTimeout(context.Background(), time.Second)
+	defer cancelTimeout()
+	if _, _, err := server.ReadFromContext(ctx, buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected the caller deadline to fire, got %v", err)
+	}
+	if _, _, err := server.ReadFrom(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("caller deadline was cleared: %v", err)
+	}
+	_ = server.SetReadDeadline(time.Time{})
+
+	timeout, cancelWrite := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancelWrite()
+	if _, err := client.WriteToContext(timeout, []byte("stalled"), target); err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+	go func() { _, _, _ = server.ReadFrom(buf) }()
+	if _, err := client.WriteToContext(context.Background(), []byte("ok"), target); err != nil {
+		t.Fatalf("write after timed out write: %v", err)
+	}
+}
+
+// countingWriter counts calls to Write
+type countingWriter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return w.Buffer.Write(p)
+}
+
+func TestWriteDatagramSingleWrite(t *testing.T) {
+	var w countingWriter
+	if err := WriteDatagram(&w, "1.2.3.4:53", []byte("hello")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if w.writes != 1 {
+		t.Fatalf("frame written with %d calls", w.writes)
+	}
+	if addr, payload, err := ReadDatagram(&w.Buffer); err != nil || addr != "1.2.3.4:53" || string(payload) != "hello" {
+		t.Fatalf("read: %s %q %v", addr, payload, err)
+	}
+}
+
+func benchmarkFrameWrite(b *testing.B, write func(io.Writer, ...[]byte) error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Skip(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.Copy(io.Discard, conn)
+	}()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+
+	header := make([]byte, uotHeaderLen)
+	addrBuf, _ := EncodeAddress("1.2.3.4:443")
+	payload := make([]byte, 1200)
+	b.SetBytes(int64(len(header) + len(addrBuf) + len(payload)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := write(conn, header, addrBuf, payload); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkFrameWriteThreeCalls(b *testing.B) {
+	benchmarkFrameWrite(b, writeAllChunks)
+}
+
+func BenchmarkFrameWriteVectored(b *testing.B) {
+	benchmarkFrameWrite(b, writeChunksOnce)
+}
+
+func TestUoTPacketConnAddressCache(t *testing.T) {
+	var stream bytes.Buffer
+	for _, addr := range []string{"a.example:53", "example.com:443", "a.example:53", "b.example:53", "a.example:53", "1.1.1.1:53", "1.1.1.1:53"} {
+		_ = WriteDatagram(&stream, addr, []byte("x"))
+	}
+	conn := NewUoTPacketConn(&readOnlyConn{Reader: bytes.NewReader(stream.Bytes())})
+	conn.SetAddressCache(2, time.Minute)
+
+	buf := make([]byte, 8)
+	var addrs []net.Addr
+	for i := 0; i < 7; i++ {
+		_, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("read %d: %v", i, err)
+		}
+		addrs = append(addrs, addr)
+	}
+	if addrs[0] != addrs[2] {
+		t.Fatalf("repeated source was parsed again")
+	}
+	// b.example and a.example remain, example.com was evicted
+	if addrs[4] != addrs[2] {
+		t.Fatalf("most recently used source was evicted")
+	}
+	if cache := conn.addrCache.Load(); cache.Exist("example.com:443") {
+		t.Fatalf("cache grew beyond its size")
+	}
+	// IP sources take the allocation free path, shared as well
+	if addrs[5] != addrs[6] || addrs[5].String() != "1.1.1.1:53" {
+		t.Fatalf("repeated IP source was parsed again")
+	}
+
+	conn.SetAddressCache(0, 0)
+	if conn.addrCache.Load() != nil {
+		t.Fatalf("cache not disabled")
+	}
+}
+
+func TestUoTPacketConnIdleTimeout(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	client := NewUoTPacketConn(clientConn)
+	server := NewUoTPacketConn(serverConn)
+	target := &net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 53}
+
+	server.SetIdleTimeout(60 * time.Millisecond)
+	buf := make([]byte, 64)
+	// steady traffic keeps the conn open past the timeout
+	go func() {
+		for i := 0; i < 4; i++ {
+			time.Sleep(30 * time.Millisecond)
+			_, _ = client.WriteTo([]byte("ping"), target)
+		}
+	}()
+	for i := 0; i < 4; i++ {
+		if _, _, err := server.ReadFrom(buf); err != nil {
+			t.Fatalf("read %d: %v", i, err)
+		}
+	}
+	if _, _, err := server.ReadFrom(buf); !errors.Is(err, ErrIdleTimeout) {
+		t.Fatalf("expected ErrIdleTimeout, got %v", err)
+	}
+	if _, err := server.WriteTo([]byte("late"), target); !errors.Is(err, ErrIdleTimeout) {
+		t.Fatalf("expected ErrIdleTimeout on write, got %v", err)
+	}
+}
+
+func TestUoTPacketConnIdleTimeoutNoLeak(t *testing.T) {
+	before := runtime.NumGoroutine()
+	for i := 0; i < 10; i++ {
+		clientConn, serverConn := net.Pipe()
+		conn := NewUoTPacketConn(serverConn)
+		conn.SetIdleTimeout(time.Hour)
+		conn.SetIdleTimeout(time.Hour)
+		_ = conn.Close()
+		_ = clientConn.Close()
+	}
+	disabled := NewUoTPacketConn(nil)
+	disabled.SetIdleTimeout(time.Hour)
+	disabled.SetIdleTimeout(0)
+
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("idle watchers leaked: %d goroutines, %d before", runtime.NumGoroutine(), before)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestEncodeAddressIPv4Mapped(t *testing.T) {
+	ipv4Wire := []byte{0x01, 192, 0, 2, 1, 0, 53}
+	cases := []struct {
+		addr    string
+		wire    []byte
+		decoded string
+	}{
+		{"192.0.2.1:53", ipv4Wire, "192.0.2.1:53"},
+		{"[::ffff:192.0.2.1]:53", ipv4Wire, "192.0.2.1:53"},
+		{"[::ffff:c000:201]:53", ipv4Wire, "192.0.2.1:53"},
+		{"[::ffff:192.0.2.1%eth0]:53", ipv4Wire, "192.0.2.1:53"},
+		{"[2001:db8::1]:53", append(append([]byte{0x04}, netip.MustParseAddr("2001:db8::1").AsSlice()...), 0, 53), "[2001:db8::1]:53"},
+	}
+	for _, tc := range cases {
+		wire, err := EncodeAddress(tc.addr)
+		if err != nil {
+			t.Fatalf("encode %s: %v", tc.addr, err)
+		}
+		if !bytes.Equal(wire, tc.wire) {
+			t.Fatalf("encode %s = %x, want %x", tc.addr, wire, tc.wire)
+		}
+		decoded, consumed, err := DecodeAddress(wire)
+		if err != nil || decoded != tc.decoded || consumed != len(wire) {
+			t.Fatalf("decode %s = %q %v, want %q", tc.addr, decoded, err, tc.decoded)
+		}
+	}
+}
+
+func TestUoTPacketConnPadding(t *testing.T) {
+	if err := NewUoTPacketConn(nil).SetPadding(1, 8); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Fatalf("expected version 1 conn to refuse padding, got %v", err)
+	}
+
+	var stream countingWriter
+	writer, err := NewUoTPacketConnWithLimit(&captureConn{w: &stream}, 16)
+	if err != nil {
+		t.Fatalf("new conn: %v", err)
+	}
+	writer.version = UoTVersion3
+	if err := writer.SetPadding(8, 4); err == nil {
+		t.Fatalf("expected inverted range to be rejected")
+	}
+	if err := writer.SetPadding(4, 32); err != nil {
+		t.Fatalf("set padding: %v", err)
+	}
+
+	target := &net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 53}
+	payloads := [][]byte{[]byte("sixteen bytes!!!"), []byte("a"), nil}
+	for _, payload := range payloads {
+		// a full sized payload stays within the limit, padding doesn't count against it
+		if _, err := writer.WriteTo(payload, target); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	_ = writer.SetPadding(0, 0)
+	_, _ = writer.WriteTo([]byte("plain"), target)
+
+	minWire := 3*(uotHeaderLen+1+7+2+4) + 17 + uotHeaderLen + 1 + 7 + 5
+	maxWire := 3*(uotHeaderLen+1+7+2+32) + 17 + uotHeaderLen + 1 + 7 + 5
+	if stream.Len() < minWire || stream.Len() > maxWire {
+		t.Fatalf("wire size %d outside [%d, %d]", stream.Len(), minWire, maxWire)
+	}
+
+	reader, _ := NewUoTPacketConnWithLimit(&readOnlyConn{Reader: bytes.NewReader(stream.Bytes())}, 16)
+	reader.version = UoTVersion3
+	buf := make([]byte, 64)
+	for _, want := range append(payloads, []byte("plain")) {
+		n, _, err := reader.ReadFrom(buf)
+		if err != nil || !bytes.Equal(buf[:n], want) {
+			t.Fatalf("read %q: %q %v", want, buf[:n], err)
+		}
+	}
+	if stats := reader.Stats(); stats.BytesRead != 22 || stats.WireBytesRead != uint64(stream.Len()) {
+		t.Fatalf("stats = %+v, wire %d", stats, stream.Len())
+	}
+}
+
+func TestUoTPacketConnChecksum(t *testing.T) {
+	if err := NewUoTPacketConn(nil).SetChecksum(true); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Fatalf("expected version 1 conn to refuse checksums, got %v", err)
+	}
+
+	var stream bytes.Buffer
+	writer := NewUoTPacketConnWithVersion(&captureConn{w: &stream}, UoTVersion3)
+	if err := writer.SetChecksum(true); err != nil {
+		t.Fatalf("set checksum: %v", err)
+	}
+	_ = writer.SetPadding(1, 8)
+	target := &net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 53}
+	if _, err := writer.WriteTo([]byte("checked"), target); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	frame := append([]byte(nil), stream.Bytes()...)
+
+	read := func(frame []byte) ([]byte, error) {
+		reader := NewUoTPacketConnWithVersion(&readOnlyConn{Reader: bytes.NewReader(frame)}, UoTVersion3)
+		buf := make([]byte, 64)
+		n, _, err := reader.ReadFrom(buf)
+		return buf[:n], err
+	}
+	if payload, err := read(frame); err != nil || string(payload) != "checked" {
+		t.Fatalf("read intact frame: %q %v", payload, err)
+	}
+	// flip a byte of the address, the payload and the padding
+	for _, offset := range []int{uotHeaderLen + 1 + 3, uotHeaderLen + 1 + 7 + 2, len(frame) - 5} {
+		corrupted := append([]byte(nil), frame...)
+		corrupted[offset] ^= 0x40
+		if _, err := read(corrupted); !errors.Is(err, ErrChecksumMismatch) {
+			t.Fatalf("offset %d: expected ErrChecksumMismatch, got %v", offset, err)
+		}
+	}
+
+	// a compressed payload is checked before it is decompressed, whichever of its bytes is flipped
+	stream.Reset()
+	if err := writer.SetCompression(true, 0); err != nil {
+		t.Fatalf("set compression: %v", err)
+	}
+	if _, err := writer.WriteTo(bytes.Repeat([]byte("checked "), 32), target); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	frame = append([]byte(nil), stream.Bytes()...)
+	if frame[uotHeaderLen]&uotFlagCompressed == 0 {
+		t.Fatal("expected a compressed frame")
+	}
+	payloadStart := uotHeaderLen + 1 + 7
+	payloadLen := int(binary.BigEndian.Uint16(frame[2:4]))
+	for offset := payloadStart; offset < payloadStart+payloadLen; offset++ {
+		for _, flip := range []byte{0x01, 0x40, 0xff} {
+			corrupted := append([]byte(nil), frame...)
+			corrupted[offset] ^= flip
+			if _, err := read(corrupted); !errors.Is(err, ErrChecksumMismatch) {
+				t.Fatalf("compressed offset %d flipped by %02x: expected ErrChecksumMismatch, got %v", offset, flip, err)
+			}
+		}
+	}
+}
+
+func TestUoTPacketConnCloseWrite(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	client := NewUoTPacketConnWithVersion(clientConn, UoTVersion3)
+	server := NewUoTPacketConnWithVersion(serverConn, UoTVersion3)
+	_ = client.SetPadding(1, 16)
+	client.EnableKeepalive(time.Millisecond)
+	target := &net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 53}
+
+	writeDone := make(chan error, 1)
+	go func() {
+		for _, payload := range []string{"first", "last"} {
+			if _, err := client.WriteTo([]byte(payload), target); err != nil {
+				writeDone <- err
+				return
+			}
+		}
+		writeDone <- client.CloseWrite()
+	}()
+
+	buf := make([]byte, 64)
+	for _, want := range []string{"first", "last"} {
+		if n, _, err := server.ReadFrom(buf); err != nil || string(buf[:n]) != want {
+			t.Fatalf("read %q: %q %v", want, buf[:n], err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if _, _, err := server.ReadFrom(buf); !errors.Is(err, ErrPeerClosed) {
+			t.Fatalf("expected ErrPeerClosed, got %v", err)
+		}
+	}
+	if err := <-writeDone; err != nil {
+		t.Fatalf("write side: %v", err)
+	}
+	if _, err := client.WriteTo([]byte("after"), target); !errors.Is(err, ErrWriteClosed) {
+		t.Fatalf("expected ErrWriteClosed, got %v", err)
+	}
+
+	// the other direction keeps working
+	go func() { _, _ = server.WriteTo([]byte("reply"), target) }()
+	if n, _, err := client.ReadFrom(buf); err != nil || string(buf[:n]) != "reply" {
+		t.Fatalf("read reply: %q %v", buf[:n], err)
+	}
+}
+
+func TestUoTPacketConnSyscallConn(t *testing.T) {
+	pipeConn, _ := net.Pipe()
+	defer pipeConn.Close()
+	if _, err := NewUoTPacketConn(pipeConn).SyscallConn(); !errors.Is(err, ErrNoSyscallConn) {
+		t.Fatalf("expected ErrNoSyscallConn, got %v", err)
+	}
+	if err := NewUoTPacketConn(pipeConn).SetReadBuffer(1 << 20); !errors.Is(err, ErrNoSocketBuffer) {
+		t.Fatalf("expected ErrNoSocketBuffer, got %v", err)
+	}
+	if err := NewUoTPacketConn(pipeConn).SetWriteBuffer(1 << 20); !errors.Is(err, ErrNoSocketBuffer) {
+		t.Fatalf("expected ErrNoSocketBuffer, got %v", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	acceptor := NewUoTAcceptor(listener)
+	defer acceptor.Close()
+	go func() {
+		if conn, err := net.Dial("tcp", listener.Addr().String()); err == nil {
+			defer conn.Close()
+			_, _ = io.Copy(io.Discard, conn)
+		}
+	}()
+	accepted, err := acceptor.Accept()
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	defer accepted.Close()
+
+	// the accepted conn wraps the *net.TCPConn and is unwrapped through Upstream
+	pc := NewUoTPacketConn(accepted)
+	if pc.NetConn() != accepted {
+		t.Fatalf("NetConn doesn't return the stream conn")
+	}
+	raw, err := pc.SyscallConn()
+	if err != nil {
+		t.Fatalf("syscall conn: %v", err)
+	}
+	called := false
+	if err := raw.Control(func(fd uintptr) { called = true }); err != nil || !called {
+		t.Fatalf("control: %v %v", called, err)
+	}
+	if err := pc.SetReadBuffer(1 << 20); err != nil {
+		t.Fatalf("set read buffer: %v", err)
+	}
+	if err := pc.SetWriteBuffer(1 << 20); err != nil {
+		t.Fatalf("set write buffer: %v", err)
+	}
+}
+
+func TestUoTPacketConnCompression(t *testing.T) {
+	if err := NewUoTPacketConn(nil).SetCompression(true, 0); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Fatalf("expected version 1 conn to refuse compression, got %v", err)
+	}
+
+	var stream bytes.Buffer
+	writer := NewUoTPacketConnWithVersion(&captureConn{w: &stream}, UoTVersion3)
+	if err := writer.SetCompression(true, 64); err != nil {
+		t.Fatalf("set compression: %v", err)
+	}
+	_ = writer.SetChecksum(true)
+	target := &net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 53}
+
+	random := make([]byte, 512)
+	_, _ = rand.Read(random)
+	cases := []struct {
+		name       string
+		payload    []byte
+		compressed bool
+	}{
+		{"compressible", bytes.Repeat([]byte("dns answer "), 100), true},
+		{"below threshold", bytes.Repeat([]byte("a"), 63), false},
+		{"incompressible", random, false},
+	}
+	var frames [][]byte
+	for _, tc := range cases {
+		before := stream.Len()
+		if _, err := writer.WriteTo(tc.payload, target); err != nil {
+			t.Fatalf("%s: write: %v", tc.name, err)
+		}
+		frame := stream.Bytes()[before:]
+		if compressed := frame[uotHeaderLen]&uotFlagCompressed != 0; compressed != tc.compressed {
+			t.Fatalf("%s: compressed = %v", tc.name, compressed)
+		}
+		if tc.compressed && len(frame) >= len(tc.payload) {
+			t.Fatalf("%s: frame of %d bytes didn't shrink", tc.name, len(frame))
+		}
+		frames = append(frames, frame)
+	}
+
+	reader := NewUoTPacketConnWithVersion(&readOnlyConn{Reader: bytes.NewReader(stream.Bytes())}, UoTVersion3)
+	buf := make([]byte, 2048)
+	for _, tc := range cases {
+		n, _, err := reader.ReadFrom(buf)
+		if err != nil || !bytes.Equal(buf[:n], tc.payload) {
+			t.Fatalf("%s: read %d bytes: %v", tc.name, n, err)
+		}
+	}
+	if got := reader.Stats().BytesRead; got != uint64(1100+63+512) {
+		t.Fatalf("bytes read = %d", got)
+	}
+
+	// a compressed payload counts for its size on the wire, the gain is reported apart
+	saved := uint64(1100 - binary.BigEndian.Uint16(frames[0][2:4]))
+	for name, stats := range map[string]UoTStats{"writer": writer.Stats(), "reader": reader.Stats()} {
+		if stats.CompressionSaved != saved {
+			t.Fatalf("%s: compression saved %d bytes, want %d", name, stats.CompressionSaved, saved)
+		}
+		if stats.Goodput <= 0 || stats.Goodput > 1 {
+			t.Fatalf("%s: goodput = %v", name, stats.Goodput)
+		}
+		if want := float64(1100+63+512) / float64(1100+63+512-saved); stats.CompressionRatio != want {
+			t.Fatalf("%s: compression ratio = %v, want %v", name, stats.CompressionRatio, want)
+		}
+	}
+
+	// a compressed frame failing its checksum saves nothing
+	corrupted := append([]byte(nil), frames[0]...)
+	corrupted[len(corrupted)-1] ^= 0xff
+	failed := NewUoTPacketConnWithVersion(&readOnlyConn{Reader: bytes.NewReader(corrupted)}, UoTVersion3)
+	if _, _, err := failed.ReadFrom(buf); err == nil {
+		t.Fatal("expected the corrupted frame to fail")
+	}
+	if stats := failed.Stats(); stats.CompressionSaved != 0 || stats.Goodput != 0 || stats.CompressionRatio != 0 {
+		t.Fatalf("failed frame counted: %+v", stats)
+	}
+
+	// the decompressed size is bounded by the payload limit of the reader
+	limited, _ := NewUoTPacketConnWithLimit(&readOnlyConn{Reader: bytes.NewReader(frames[0])}, 256)
+	limited.version = UoTVersion3
+	if _, _, err := limited.ReadFrom(buf); !errors.Is(err, ErrPayloadTooLarge) {
+		t.Fatalf("expected ErrPayloadTooLarge, got %v", err)
+	}
+}
+
+// rawCodec carries the address string verbatim, so a frame can name an address ReadFrom rejects
+type rawCodec struct{}
+
+func (rawCodec) EncodeAddress(addr string) ([]byte, error) { return []byte(addr), nil }
+
+func (rawCodec) DecodeAddress(buf []byte) (string, error) { return string(buf), nil }
+
+func TestUoTPacketConnDiscardedCount(t *testing.T) {
+	var stream bytes.Buffer
+	for _, addr := range []string{"no-port", "1.2.3.4:53", "host:badport", ":53", "no-port", "1.2.3.4:53"} {
+		if _, err := writeDatagram(&stream, rawCodec{}, maxUoTPayload, addr, []byte("payload")); err != nil {
+			t.Fatalf("write %s: %v", addr, err)
+		}
+	}
+
+	conn := NewUoTPacketConn(&readOnlyConn{Reader: bytes.NewReader(stream.Bytes())})
+	conn.SetAddressCodec(rawCodec{})
+	buf := make([]byte, 64)
+	for i := 0; i < 2; i++ {
+		if n, _, err := conn.ReadFrom(buf); err != nil || string(buf[:n]) != "payload" {
+			t.Fatalf("read %d: %q, %v", i, buf[:n], err)
+		}
+	}
+	if got := conn.DiscardedCount(); got != 4 {
+		t.Fatalf("discarded = %d", got)
+	}
+	if got := conn.Stats().Discarded; got != 4 {
+		t.Fatalf("stats discarded = %d", got)
+	}
+
+	// the limit counts consecutive discards only, a valid datagram resets it
+	conn = NewUoTPacketConn(&readOnlyConn{Reader: bytes.NewReader(stream.Bytes())})
+	conn.SetAddressCodec(rawCodec{})
+	conn.SetMaxConsecutiveDiscards(3)
+	if _, _, err := conn.ReadFrom(buf); err != nil {
+		t.Fatalf("read below the limit: %v", err)
+	}
+	if _, _, err := conn.ReadFrom(buf); !errors.Is(err, ErrTooManyDiscards) {
+		t.Fatalf("expected ErrTooManyDiscards, got %v", err)
+	}
+	if got := conn.DiscardedCount(); got != 4 {
+		t.Fatalf("discarded = %d", got)
+	}
+}
+
+func TestUoTPacketConnAllowedAddressTypes(t *testing.T) {
+	var stream bytes.Buffer
+	for _, addr := range []string{"example.com:53", "1.2.3.4:53", "[2001:db8::1]:53", "[::ffff:5.6.7.8]:53", "example.org:53"} {
+		if err := WriteDatagram(&stream, addr, []byte(addr)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	frames := stream.Bytes()
+
+	conn := NewUoTPacketConn(&readOnlyConn{Reader: bytes.NewReader(frames)})
+	conn.SetAllowedAddressTypes(true, true, false)
+	var discarded []error
+	conn.SetDiscardLogger(func(addr string, err error) { discarded = append(discarded, err) })
+	buf := make([]byte, 64)
+	for _, want := range []string{"1.2.3.4:53", "[2001:db8::1]:53", "[::ffff:5.6.7.8]:53"} {
+		if n, _, err := conn.ReadFrom(buf); err != nil || string(buf[:n]) != want {
+			t.Fatalf("read %s: %q, %v", want, buf[:n], err)
+		}
+	}
+	if _, _, err := conn.ReadFrom(buf); err != io.EOF {
+		t.Fatalf("expected the domain frames to be dropped, got %v", err)
+	}
+	if conn.DiscardedCount() != 2 || len(discarded) != 2 || !errors.Is(discarded[0], ErrAddressTypeNotAllowed) {
+		t.Fatalf("unexpected discards: %d %v", conn.DiscardedCount(), discarded)
+	}
+
+	// IPv6 denied, with the discards ending the read and ReadFromAddrPort checking as well
+	conn = NewUoTPacketConn(&readOnlyConn{Reader: bytes.NewReader(frames)})
+	conn.SetAllowedAddressTypes(true, false, true)
+	conn.SetMaxConsecutiveDiscards(1)
+	conn.SetDiscardLogger(func(string, error) {})
+	for _, want := range []string{"example.com:53", "1.2.3.4:53"} {
+		if n, _, err := conn.ReadFromAddrPort(buf); string(buf[:n]) != want || (err != nil) != (want == "example.com:53") {
+			t.Fatalf("read %s: %q, %v", want, buf[:n], err)
+		}
+	}
+	if _, _, err := conn.ReadFromAddrPort(buf); !errors.Is(err, ErrTooManyDiscards) || !errors.Is(err, ErrAddressTypeNotAllowed) || !strings.Contains(err.Error(), "2001:db8::1") {
+		t.Fatalf("expected the IPv6 frame to fail the read, got %v", err)
+	}
+
+	stream.Reset()
+	writer := NewUoTPacketConn(&captureConn{w: &stream})
+	writer.SetAllowedAddressTypes(true, false, false)
+	for _, addr := range []net.Addr{
+		&NamedAddr{Host: "example.com", Port: 53},
+		&net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 53},
+		stringAddr{&net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 53}},
+	} {
+		if _, err := writer.WriteTo([]byte("x"), addr); !errors.Is(err, ErrAddressTypeNotAllowed) {
+			t.Fatalf("write to %v: expected ErrAddressTypeNotAllowed, got %v", addr, err)
+		}
+	}
+	if _, err := writer.WriteToAddrPort([]byte("x"), netip.MustParseAddrPort("[2001:db8::1]:53")); !errors.Is(err, ErrAddressTypeNotAllowed) {
+		t.Fatalf("write to an IPv6 AddrPort: expected ErrAddressTypeNotAllowed, got %v", err)
+	}
+	if _, err := writer.WriteBatch([][]byte{[]byte("x")}, []net.Addr{&NamedAddr{Host: "example.com", Port: 53}}); !errors.Is(err, ErrAddressTypeNotAllowed) {
+		t.Fatalf("write batch to a domain: expected ErrAddressTypeNotAllowed, got %v", err)
+	}
+	if stream.Len() != 0 {
+		t.Fatalf("denied writes left %d bytes", stream.Len())
+	}
+	if _, err := writer.WriteTo([]byte("x"), &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 53}); err != nil {
+		t.Fatalf("write to IPv4: %v", err)
+	}
+	writer.SetAllowedAddressTypes(true, true, true)
+	if _, err := writer.WriteTo([]byte("x"), &NamedAddr{Host: "example.com", Port: 53}); err != nil {
+		t.Fatalf("write to a domain once allowed again: %v", err)
+	}
+}
+
+func TestUoTPacketConnDiscardLogger(t *testing.T) {
+	var stream bytes.Buffer
+	for _, addr := range []string{"no-port", "1.2.3.4:53", "host:badport", "1.2.3.4:53"} {
+		if _, err := writeDatagram(&stream, rawCodec{}, maxUoTPayload, addr, []byte("payload")); err != nil {
+			t.Fatalf("write %s: %v", addr, err)
+		}
+	}
+
+	conn := NewUoTPacketConn(&readOnlyConn{Reader: bytes.NewReader(stream.Bytes())})
+	conn.SetAddressCodec(rawCodec{})
+	var discarded []string
+	conn.SetDiscardLogger(func(addr string, err error) {
+		if err == nil {
+			t.Errorf("discard of %s reported without its error", addr)
+		}
+		// no lock of the conn is held, so the hook may use it
+		_ = conn.Stats()
+		discarded = append(discarded, addr)
+	})
+	buf := make([]byte, 64)
+	if _, _, err := conn.ReadFrom(buf); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDiscardLogger(nil)
+	if _, _, err := conn.ReadFrom(buf); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(discarded, []string{"no-port"}) {
+		t.Fatalf("discarded = %q", discarded)
+	}
+	if got := conn.DiscardedCount(); got != 2 {
+		t.Fatalf("discarded count = %d", got)
+	}
+}
+
+func TestUoTPacketConnResync(t *testing.T) {
+	var stream bytes.Buffer
+	writer := NewUoTPacketConn(&captureConn{w: &stream})
+	target := &net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 53}
+	_, _ = writer.WriteTo([]byte("one"), target)
+	oneLen := stream.Len()
+	// a frame with an unknown address type, followed by garbage up to the marker
+	stream.Write([]byte{0x00, 0x05, 0x00, 0x03, 0x09, 0x01, 0x02, 0x03, 0x04})
+	stream.WriteString("garbage")
+	_ = writer.WriteSyncMarker()
+	_, _ = writer.WriteTo([]byte("two"), target)
+	// markers where a frame starts are skipped, absurd lengths resync as well
+	_ = writer.WriteSyncMarker()
+	_, _ = writer.WriteTo([]byte("three"), target)
+	stream.Write([]byte{0x01, 0x00, 0xff, 0xff, 0xee})
+	_ = writer.WriteSyncMarker()
+	_, _ = writer.WriteTo([]byte("four"), target)
+	frames := stream.Bytes()
+
+	conn, _ := NewUoTPacketConnWithLimit(&readOnlyConn{Reader: bytes.NewReader(frames)}, 1024)
+	conn.SetResync(true)
+	buf := make([]byte, 64)
+	for _, want := range []string{"one", "two", "three", "four"} {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil || string(buf[:n]) != want || addr.String() != target.String() {
+			t.Fatalf("read %s: %q from %v, %v", want, buf[:n], addr, err)
+		}
+	}
+	if _, _, err := conn.ReadFrom(buf); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected EOF after the last frame, got %v", err)
+	}
+	// "garbage" and the 0xee before the last marker, the rest of the corrupt frames was read as such
+	if dropped := conn.Stats().ResyncDropped; dropped != uint64(len("garbage")+1) {
+		t.Fatalf("dropped %d bytes", dropped)
+	}
+
+	// without resync the corrupt frame is fatal
+	conn = NewUoTPacketConn(&readOnlyConn{Reader: bytes.NewReader(frames)})
+	if _, _, err := conn.ReadFrom(buf); err != nil {
+		t.Fatalf("read one: %v", err)
+	}
+	if _, _, err := conn.ReadFrom(buf); !errors.Is(err, ErrUnknownAddressType) {
+		t.Fatalf("expected the corrupt frame to fail, got %v", err)
+	}
+
+	// a stream ending before any marker reports the scan failure
+	conn = NewUoTPacketConn(&readOnlyConn{Reader: bytes.NewReader(frames[:oneLen+9+len("garbage")])})
+	conn.SetResync(true)
+	_, _, _ = conn.ReadFrom(buf)
+	var frameErr *FrameError
+	if _, _, err := conn.ReadFrom(buf); !errors.As(err, &frameErr) || !errors.Is(err, io.EOF) {
+		t.Fatalf("expected the failed resync to be reported, got %v", err)
+	}
+}
+
+// slowConn blocks every write until release is closed, then records it
+type slowConn struct {
+	readOnlyConn
+	release chan struct{}
+	mu      sync.Mutex
+	stream  bytes.Buffer
+	closed  bool
+}
+
+func (c *slowConn) Write(p []byte) (int, error) {
+	<-c.release
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	return c.stream.Write(p)
+}
+
+func (c *slowConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	return nil
+}
+
+func TestUoTPacketConnWriteQueue(t *testing.T) {
+	conn := &slowConn{readOnlyConn: readOnlyConn{Reader: bytes.NewReader(nil)}, release: make(chan struct{})}
+	c := NewUoTPacketConn(conn)
+	c.SetWriteQueue(2)
+	target := &net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 53}
+
+	// the flusher blocks on the first frame, two more fill the queue
+	for i := 0; i < 3; i++ {
+		if _, err := c.WriteTo([]byte{byte(i)}, target); err != nil {
+			t.Fatalf("write %d: %v", i, err)
+		}
+		for i == 0 && len(c.queue.frames) > 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	start := time.Now()
+	if _, err := c.WriteTo([]byte{3}, target); !errors.Is(err, ErrWriteQueueFull) {
+		t.Fatalf("expected ErrWriteQueueFull, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("full queue blocked the writer for %v", elapsed)
+	}
+	_ = c.SetWriteDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err := c.WriteTo([]byte{3}, target); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected the write to wait until its deadline, got %v", err)
+	}
+	_ = c.SetWriteDeadline(time.Time{})
+
+	// WriteToContext waits for room until its context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := c.WriteToContext(ctx, []byte{3}, target); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the write to wait until the context deadline, got %v", err)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	if _, err := c.WriteToContext(ctx, []byte{3}, target); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the write to wait until the context is cancelled, got %v", err)
+	}
+
+	// Close flushes what was queued before closing the stream
+	time.AfterFunc(20*time.Millisecond, func() { close(conn.release) })
+	if err := c.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	reader := NewUoTPacketConn(&readOnlyConn{Reader: bytes.NewReader(conn.stream.Bytes())})
+	buf := make([]byte, 8)
+	for i := 0; i < 3; i++ {
+		if n, _, err := reader.ReadFrom(buf); err != nil || n != 1 || buf[0] != byte(i) {
+			t.Fatalf("flushed frame %d: %v %v", i, buf[:n], err)
+		}
+	}
+	if _, _, err := reader.ReadFrom(buf); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected only the queued frames, got %v", err)
+	}
+	if !conn.closed {
+		t.Fatalf("expected the stream to be closed after the flush")
+	}
+}
+
+func TestUoTPacketConnWriteQueueContextKeepsFlusher(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	c := NewUoTPacketConn(clientConn)
+	c.SetWriteQueue(1)
+	target := &net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 53}
+
+	// the flusher blocks on the first frame until the peer reads, the second one fills the queue
+	for i := 0; i < 2; i++ {
+		if _, err := c.WriteTo([]byte{byte(i)}, target); err != nil {
+			t.Fatalf("write %d: %v", i, err)
+		}
+		for i == 0 && len(c.queue.frames) > 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	if _, err := c.WriteToContext(ctx, []byte{2}, target); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the context deadline, got %v", err)
+	}
+
+	// the deadline of ctx didn't reach the stream, the accepted frames still get through
+	server := NewUoTPacketConn(serverConn)
+	_ = server.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 8)
+	for i := 0; i < 2; i++ {
+		if n, _, err := server.ReadFrom(buf); err != nil || n != 1 || buf[0] != byte(i) {
+			t.Fatalf("frame %d: %v %v", i, buf[:n], err)
+		}
+	}
+	if _, err := c.WriteTo([]byte{3}, target); err != nil {
+		t.Fatalf("write after the context write: %v", err)
+	}
+	if n, _, err := server.ReadFrom(buf); err != nil || n != 1 || buf[0] != 3 {
+		t.Fatalf("frame after the context write: %v %v", buf[:n], err)
+	}
+}
+
+func TestUoTPacketConnWriteQueueError(t *testing.T) {
+	conn := &slowConn{readOnlyConn: readOnlyConn{Reader: bytes.NewReader(nil)}, release: make(chan struct{})}
+	close(conn.release)
+	_ = conn.Close()
+	c := NewUoTPacketConn(conn)
+	c.SetWriteQueue(4)
+	target := &net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 53}
+	if _, err := c.WriteTo([]byte("lost"), target); err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		_, err := c.WriteTo([]byte("next"), target)
+		if errors.Is(err, net.ErrClosed) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the flush error to surface, got %v", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// stopping the queue writes directly again
+	c.SetWriteQueue(0)
+	if _, err := c.WriteTo([]byte("direct"), target); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected the direct write to fail on the closed stream, got %v", err)
+	}
+	_ = c.Close()
+}
+
+// fakeUoTClock jumps straight to the times waited for
+type fakeUoTClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeUoTClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeUoTClock) At(t time.Time) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if t.After(c.now) {
+		c.now = t
+	}
+	fired := make(chan time.Time, 1)
+	fired <- c.now
+	return fired
+}
+
+func TestUoTPacketConnRateLimit(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	go func() { _, _ = io.Copy(io.Discard, serverConn) }()
+
+	start := time.Now()
+	clock := &fakeUoTClock{now: start}
+	pc := NewUoTPacketConn(clientConn)
+	pc.SetRateLimit(10000, 1000)
+	if pc.rateLimit.Load() == nil {
+		t.Fatal("rate limit not set")
+	}
+	pc.rateLimit.Store(newUoTRateLimiter(clock, 10000, 1000))
+
+	dst := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 53}
+	payload := make([]byte, 500)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 24; j++ {
+				if _, err := pc.WriteTo(payload, dst); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if _, err := pc.WriteBatch([][]byte{payload, payload, payload, payload}, []net.Addr{dst, dst, dst, dst}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 50000 bytes at 10000 B/s, the first 1000 of them taken from the burst
+	elapsed := clock.Now().Sub(start)
+	if want := 4900 * time.Millisecond; elapsed < want-want/100 || elapsed > want+want/100 {
+		t.Fatalf("sent 50000 bytes in %v, want %v", elapsed, want)
+	}
+	if got := pc.Stats().DatagramsWritten; got != 100 {
+		t.Fatalf("datagrams written = %d", got)
+	}
+
+	// a write that can't make its deadline fails right away and hands its tokens back
+	if err := pc.SetWriteDeadline(clock.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	before := clock.Now()
+	if _, err := pc.WriteTo(make([]byte, 20000), dst); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected os.ErrDeadlineExceeded, got %v", err)
+	}
+	if _, err := pc.WriteTo(payload, dst); err != nil {
+		t.Fatal(err)
+	}
+	if waited := clock.Now().Sub(before); waited != 50*time.Millisecond {
+		t.Fatalf("waited %v for 500 bytes", waited)
+	}
+	ctx, cancel := context.WithDeadline(context.Background(), clock.Now().Add(10*time.Millisecond))
+	defer cancel()
+	if _, err := pc.WriteToContext(ctx, payload, dst); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+	_ = pc.SetWriteDeadline(time.Time{})
+
+	pc.SetRateLimit(0, 0)
+	if pc.rateLimit.Load() != nil {
+		t.Fatal("rate limit not disabled")
+	}
+	before = clock.Now()
+	if _, err := pc.WriteTo(make([]byte, 20000), dst); err != nil {
+		t.Fatal(err)
+	}
+	if !clock.Now().Equal(before) {
+		t.Fatal("disabled rate limit still waited")
+	}
+}
+
+func TestUoTMux(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	accepted := make(chan error, 1)
+	go func() {
+		_, err := AcceptVersion(serverConn, []byte{UoTVersion4})
+		accepted <- err
+	}()
+	if v, err := NegotiateVersion(clientConn, []byte{UoTVersion4}); err != nil || v != UoTVersion4 {
+		t.Fatalf("negotiate: %d, %v", v, err)
+	}
+	if err := <-accepted; err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+
+	client, server := NewUoTMux(clientConn), NewUoTMux(serverConn)
+	defer client.Close()
+	defer server.Close()
+	open := func(m *UoTMux, id uint32) net.PacketConn {
+		t.Helper()
+		session, err := m.OpenSession(id)
+		if err != nil {
+			t.Fatalf("open session %d: %v", id, err)
+		}
+		return session
+	}
+	client1, client2 := open(client, 1), open(client, 2)
+	server1, server2 := open(server, 1), open(server, 2)
+	if _, err := client.OpenSession(1); !errors.Is(err, ErrSessionExists) {
+		t.Fatalf("expected ErrSessionExists, got %v", err)
+	}
+
+	target := &NamedAddr{Host: "example.com", Port: 443}
+	if _, err := client1.WriteTo([]byte("one"), target); err != nil {
+		t.Fatalf("write session 1: %v", err)
+	}
+	if _, err := client2.WriteTo([]byte("two"), &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 53}); err != nil {
+		t.Fatalf("write session 2: %v", err)
+	}
+	buf := make([]byte, 64)
+	n, addr, err := server2.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "two" || addr.String() != "1.2.3.4:53" {
+		t.Fatalf("session 2 read %q from %v: %v", buf[:n], addr, err)
+	}
+	n, addr, err = server1.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "one" || addr.String() != target.String() {
+		t.Fatalf("session 1 read %q from %v: %v", buf[:n], addr, err)
+	}
+	if _, err := server1.WriteTo([]byte("reply"), addr); err != nil {
+		t.Fatalf("write reply: %v", err)
+	}
+	if n, _, err := client1.ReadFrom(buf); err != nil || string(buf[:n]) != "reply" {
+		t.Fatalf("read reply %q: %v", buf[:n], err)
+	}
+
+	// a session nobody reads drops what exceeds its queue, without stalling the others
+	for i := 0; i < 2*uotMuxSessionQueue; i++ {
+		if _, err := client1.WriteTo([]byte{byte(i)}, target); err != nil {
+			t.Fatalf("flood %d: %v", i, err)
+		}
+	}
+	if _, err := client2.WriteTo([]byte("after"), target); err != nil {
+		t.Fatalf("write after flood: %v", err)
+	}
+	_ = server2.SetReadDeadline(time.Now().Add(time.Second))
+	if n, _, err := server2.ReadFrom(buf); err != nil || string(buf[:n]) != "after" {
+		t.Fatalf("read after flood %q: %v", buf[:n], err)
+	}
+	_ = server1.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	for i := 0; i < uotMuxSessionQueue; i++ {
+		if n, _, err := server1.ReadFrom(buf); err != nil || n != 1 || buf[0] != byte(i) {
+			t.Fatalf("queued datagram %d: %v, %v", i, buf[:n], err)
+		}
+	}
+	if _, _, err := server1.ReadFrom(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+
+	// closing a session reaches the peer after what was written before it
+	if _, err := client2.WriteTo([]byte("last"), target); err != nil {
+		t.Fatalf("write last: %v", err)
+	}
+	if err := client2.Close(); err != nil {
+		t.Fatalf("close session: %v", err)
+	}
+	if _, err := client2.WriteTo([]byte("late"), target); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected net.ErrClosed, got %v", err)
+	}
+	if n, _, err := server2.ReadFrom(buf); err != nil || string(buf[:n]) != "last" {
+		t.Fatalf("read last %q: %v", buf[:n], err)
+	}
+	if _, _, err := server2.ReadFrom(buf); !errors.Is(err, ErrPeerClosed) {
+		t.Fatalf("expected ErrPeerClosed, got %v", err)
+	}
+
+	client.Close()
+	_ = server1.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := server1.ReadFrom(buf); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected io.EOF after the mux closed, got %v", err)
+	}
+}
+
+func TestNewUoTServerConn(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	go func() {
+		client := NewUoTPacketConn(clientConn)
+		if err := WritePreface(clientConn); err != nil {
+			return
+		}
+		buf := make([]byte, 64)
+		for {
+			n, addr, err := client.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if _, err := client.WriteTo(append([]byte("echo "), buf[:n]...), addr); err != nil {
+				return
+			}
+		}
+	}()
+
+	server, err := NewUoTServerConn(serverConn)
+	if err != nil {
+		t.Fatalf("server handshake: %v", err)
+	}
+	if server.Version() != UoTVersion1 {
+		t.Fatalf("version = %d", server.Version())
+	}
+	target := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 53}
+	buf := make([]byte, 64)
+	for _, msg := range []string{"first", "second"} {
+		if _, err := server.WriteTo([]byte(msg), target); err != nil {
+			t.Fatalf("write %s: %v", msg, err)
+		}
+		n, addr, err := server.ReadFrom(buf)
+		if err != nil || string(buf[:n]) != "echo "+msg || addr.String() != target.String() {
+			t.Fatalf("read %q from %v: %v", buf[:n], addr, err)
+		}
+	}
+
+	// a higher preface is answered and framed at the agreed version
+	clientConn, serverConn = net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	negotiated := make(chan byte, 1)
+	go func() {
+		v, _ := NegotiateVersion(clientConn, []byte{UoTVersion1, UoTVersion2, UoTVersion3, UoTVersion4})
+		negotiated <- v
+	}()
+	if server, err = NewUoTServerConn(serverConn); err != nil || server.Version() != UoTVersion3 {
+		t.Fatalf("negotiated server: %v", err)
+	}
+	if v := <-negotiated; v != UoTVersion3 {
+		t.Fatalf("client negotiated %d", v)
+	}
+}
+
+func TestUoTListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	listener := NewUoTListener(ln)
+	defer listener.Close()
+
+	// a conn with a bad preface is closed without surfacing from Accept
+	bad, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer bad.Close()
+	if _, err := bad.Write([]byte{0x00, UoTVersion1}); err != nil {
+		t.Fatalf("write bad preface: %v", err)
+	}
+
+	good, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer good.Close()
+	if err := WritePreface(good); err != nil {
+		t.Fatalf("write preface: %v", err)
+	}
+	client := NewUoTPacketConn(good)
+	target := &net.UDPAddr{IP: net.IPv4(8, 8, 8, 8), Port: 53}
+	if _, err := client.WriteTo([]byte("query"), target); err != nil {
+		t.Fatalf("client write: %v", err)
+	}
+
+	server, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	defer server.Close()
+	buf := make([]byte, 64)
+	n, addr, err := server.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "query" || addr.String() != target.String() {
+		t.Fatalf("server read %q from %v: %v", buf[:n], addr, err)
+	}
+	if _, err := server.WriteTo([]byte("answer"), addr); err != nil {
+		t.Fatalf("server write: %v", err)
+	}
+	if n, _, err := client.ReadFrom(buf); err != nil || string(buf[:n]) != "answer" {
+		t.Fatalf("client read %q: %v", buf[:n], err)
+	}
+
+	_ = bad.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := bad.Read(buf); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected the bad conn to be closed, got %v", err)
+	}
+}
+
+func TestUoTListenerSlowHandshake(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	listener := NewUoTListener(ln)
+
+	// a client sending nothing doesn't hold back the ones behind it
+	silent, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer silent.Close()
+	good, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer good.Close()
+	if err := WritePreface(good); err != nil {
+		t.Fatalf("write preface: %v", err)
+	}
+
+	start := time.Now()
+	server, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	defer server.Close()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("accept waited %v behind a silent client", elapsed)
+	}
+
+	for {
+		listener.mu.Lock()
+		pending := len(listener.pending)
+		listener.mu.Unlock()
+		if pending == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := listener.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if _, err := listener.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected net.ErrClosed after Close, got %v", err)
+	}
+	_ = silent.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := silent.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected Close to close the conn in its handshake, got %v", err)
+	}
+}
+
+type failingWriter struct{ err error }
+
+func (w failingWriter) Write([]byte) (int, error) { return 0, w.err }
+
+func TestUoTClient(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	accepted := make(chan *UoTPacketConn, 1)
+	go func() {
+		server, _ := NewUoTServerConn(serverConn)
+		accepted <- server
+	}()
+	client, err := Client(clientConn)
+	if err != nil {
+		t.Fatalf("client handshake: %v", err)
+	}
+	server := <-accepted
+	if server == nil {
+		t.Fatal("server handshake failed")
+	}
+	target := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 53}
+	go func() {
+		_, _ = client.WriteTo([]byte("hello"), target)
+	}()
+	buf := make([]byte, 64)
+	if n, addr, err := server.ReadFrom(buf); err != nil || string(buf[:n]) != "hello" || addr.String() != target.String() {
+		t.Fatalf("server read %q from %v: %v", buf[:n], addr, err)
+	}
+
+	// a failed preface is reported without closing the conn
+	writeErr := errors.New("broken pipe")
+	conn := &closeTrackingConn{Conn: &captureConn{w: failingWriter{err: writeErr}}}
+	if _, err := Client(conn); !errors.Is(err, writeErr) {
+		t.Fatalf("expected the write error, got %v", err)
+	}
+	if conn.closed {
+		t.Fatal("conn closed on handshake failure")
+	}
+	if _, err := ClientWithVersions(conn, []byte{UoTVersion3, UoTVersion4}); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Fatalf("expected ErrUnsupportedVersion, got %v", err)
+	}
+}
+
+type closeTrackingConn struct {
+	net.Conn
+	closed bool
+}
+
+func (c *closeTrackingConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestUoTHandshakeAuthToken(t *testing.T) {
+	serverOptions := UoTHandshakeOptions{AuthToken: []byte("shared secret")}
+	cases := []struct {
+		name   string
+		client UoTHandshakeOptions
+		ok     bool
+	}{
+		{"correct token", UoTHandshakeOptions{AuthToken: []byte("shared secret")}, true},
+		{"correct token negotiated", UoTHandshakeOptions{Versions: []byte{UoTVersion1, UoTVersion3}, AuthToken: []byte("shared secret")}, true},
+		{"wrong token", UoTHandshakeOptions{Versions: []byte{UoTVersion3}, AuthToken: []byte("shared secreT")}, false},
+		{"missing token", UoTHandshakeOptions{}, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			server := &closeTrackingConn{Conn: serverConn}
+
+			accepted := make(chan error, 1)
+			go func() {
+				_, err := NewUoTServerConnWithOptions(server, serverOptions)
+				if server.closed {
+					// closeTrackingConn only records Close, the client waits for the pipe to close
+					_ = serverConn.Close()
+				}
+				accepted <- err
+			}()
+			client, clientErr := ClientWithOptions(clientConn, tc.client)
+			if clientErr == nil && !tc.ok {
+				// a version 1 client doesn't wait for an answer, its first datagram is taken for the token
+				_, clientErr = client.WriteTo(bytes.Repeat([]byte{1}, uotAuthDigestLen), &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 53})
+			}
+			serverErr := <-accepted
+
+			if tc.ok {
+				if clientErr != nil || serverErr != nil {
+					t.Fatalf("client: %v, server: %v", clientErr, serverErr)
+				}
+				if want := highestVersion(tc.client.Versions); want != 0 && client.Version() != want {
+					t.Fatalf("version = %d", client.Version())
+				}
+				return
+			}
+			if !errors.Is(serverErr, ErrAuthFailed) {
+				t.Fatalf("expected ErrAuthFailed, got %v", serverErr)
+			}
+			if !server.closed {
+				t.Fatal("server didn't close the conn")
+			}
+			if clientErr == nil {
+				t.Fatal("client kept going after the server closed the conn")
+			}
+		})
+	}
+}
+
+func TestUoTServerConnClosesOnError(t *testing.T) {
+	t.Run("bad preface", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
+		defer clientConn.Close()
+		server := &closeTrackingConn{Conn: serverConn}
+		go func() {
+			_, _ = clientConn.Write([]byte("not a preface"))
+		}()
+		if _, err := NewUoTServerConn(server); err == nil {
+			t.Fatal("expected the handshake to fail")
+		}
+		if !server.closed {
+			t.Fatal("server didn't close the conn")
+		}
+	})
+	t.Run("bad versions", func(t *testing.T) {
+		_, serverConn := net.Pipe()
+		server := &closeTrackingConn{Conn: serverConn}
+		if _, err := NewUoTServerConnWithOptions(server, UoTHandshakeOptions{Versions: []byte{UoTVersion4}}); err == nil {
+			t.Fatal("expected the versions to be rejected")
+		}
+		if !server.closed {
+			t.Fatal("server didn't close the conn")
+		}
+	})
+}
+
+func TestUoTPacketConnFeatures(t *testing.T) {
+	wrapper, err := NewChaCha20Wrapper([]byte("shared secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	accepted := make(chan *UoTPacketConn, 1)
+	go func() {
+		server, err := NewUoTServerConnWithOptions(serverConn, UoTHandshakeOptions{AuthToken: []byte("token"), Wrapper: wrapper})
+		if err != nil {
+			t.Errorf("accept: %v", err)
+		}
+		accepted <- server
+	}()
+	client, err := ClientWithOptions(clientConn, UoTHandshakeOptions{Versions: []byte{UoTVersion1, UoTVersion3}, AuthToken: []byte("token"), Wrapper: wrapper})
+	if err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	server := <-accepted
+	if server == nil {
+		t.FailNow()
+	}
+
+	if err := client.SetPadding(1, 8); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetChecksum(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.EnableFragmentation(0); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.SetCompression(true, 64); err != nil {
+		t.Fatal(err)
+	}
+	server.SetResync(true)
+
+	handshake := UoTFeatures{
+		Version:         UoTVersion3,
+		Magic:           UoTMagicByte,
+		Authenticated:   true,
+		Wrapped:         true,
+		ExtendedFraming: true,
+		Reassembly:      true,
+	}
+	want := handshake
+	want.Padding, want.PaddingMin, want.PaddingMax = true, 1, 8
+	want.Checksum = true
+	want.Fragmentation = true
+	if got := client.Features(); got != want {
+		t.Fatalf("client features = %+v, want %+v", got, want)
+	}
+	want = handshake
+	want.Compression, want.CompressionMinSize = true, 64
+	want.Resync = true
+	if got := server.Features(); got != want {
+		t.Fatalf("server features = %+v, want %+v", got, want)
+	}
+
+	if err := client.SetPadding(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := client.Features(); got.Padding || got.PaddingMin != 0 || got.PaddingMax != 0 {
+		t.Fatalf("padding still reported once disabled: %+v", got)
+	}
+	if got := NewUoTPacketConn(clientConn).Features(); got != (UoTFeatures{Version: UoTVersion1, Magic: UoTMagicByte}) {
+		t.Fatalf("plain conn features = %+v", got)
+	}
+}
+
+func TestUoTHandshakeMagic(t *testing.T) {
+	cases := []struct {
+		name           string
+		client, server UoTHandshakeOptions
+		ok             bool
+	}{
+		{"default", UoTHandshakeOptions{}, UoTHandshakeOptions{}, true},
+		{"explicit default", UoTHandshakeOptions{Magic: UoTMagicByte}, UoTHandshakeOptions{}, true},
+		{"custom", UoTHandshakeOptions{Magic: 0xA7}, UoTHandshakeOptions{Magic: 0xA7}, true},
+		{"custom negotiated", UoTHandshakeOptions{Versions: []byte{UoTVersion3}, Magic: 0xA7}, UoTHandshakeOptions{Magic: 0xA7}, true},
+		{"custom client", UoTHandshakeOptions{Magic: 0xA7}, UoTHandshakeOptions{}, false},
+		{"custom server", UoTHandshakeOptions{Versions: []byte{UoTVersion3}}, UoTHandshakeOptions{Magic: 0xA7}, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			defer serverConn.Close()
+
+			type result struct {
+				conn *UoTPacketConn
+				err  error
+			}
+			accepted := make(chan result, 1)
+			go func() {
+				conn, err := NewUoTServerConnWithOptions(serverConn, tc.server)
+				if err != nil {
+					_ = serverConn.Close()
+				}
+				accepted <- result{conn, err}
+			}()
+			client, clientErr := ClientWithOptions(clientConn, tc.client)
+			server := <-accepted
+
+			if !tc.ok {
+				if !errors.Is(server.err, ErrBadMagic) {
+					t.Fatalf("expected ErrBadMagic, got %v", server.err)
+				}
+				return
+			}
+			if clientErr != nil || server.err != nil {
+				t.Fatalf("client: %v, server: %v", clientErr, server.err)
+			}
+
+			// sync markers are led by the magic of the handshake
+			server.conn.SetResync(true)
+			dst := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 53}
+			go func() {
+				_ = client.WriteSyncMarker()
+				_, _ = client.WriteTo([]byte("ping"), dst)
+			}()
+			buf := make([]byte, 16)
+			n, _, err := server.conn.ReadFrom(buf)
+			if err != nil || string(buf[:n]) != "ping" {
+				t.Fatalf("read %q, %v", buf[:n], err)
+			}
+		})
+	}
+}
+
+func TestUoTChaCha20Wrapper(t *testing.T) {
+	wrapper, err := NewChaCha20Wrapper([]byte("shared secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := UoTHandshakeOptions{Versions: []byte{UoTVersion1, UoTVersion3}, Wrapper: wrapper}
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	var clientWire, serverWire bytes.Buffer
+	clientTap := &tapConn{Conn: clientConn, w: &clientWire}
+	serverTap := &tapConn{Conn: serverConn, w: &serverWire}
+
+	type result struct {
+		conn *UoTPacketConn
+		err  error
+	}
+	accepted := make(chan result, 1)
+	go func() {
+		conn, err := NewUoTServerConnWithOptions(serverTap, options)
+		accepted <- result{conn, err}
+	}()
+	client, err := ClientWithOptions(clientTap, options)
+	if err != nil {
+		t.Fatalf("client: %v", err)
+	}
+	server := <-accepted
+	if server.err != nil {
+		t.Fatalf("server: %v", server.err)
+	}
+	if client.Version() != UoTVersion3 || server.conn.Version() != UoTVersion3 {
+		t.Fatalf("versions = %d, %d", client.Version(), server.conn.Version())
+	}
+
+	dst := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 53}
+	payload := bytes.Repeat([]byte("same plaintext "), 8)
+	buf := make([]byte, 256)
+	echo := func(from, to *UoTPacketConn) {
+		t.Helper()
+		go func() { _, _ = from.WriteTo(payload, dst) }()
+		n, addr, err := to.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if !bytes.Equal(buf[:n], payload) || addr.String() != dst.String() {
+			t.Fatalf("read %q from %v", buf[:n], addr)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		echo(client, server.conn)
+		echo(server.conn, client)
+	}
+
+	clientBytes, serverBytes := clientWire.Bytes(), serverWire.Bytes()
+	if len(clientBytes) < chacha20.NonceSizeX+2 || clientBytes[chacha20.NonceSizeX] == UoTMagicByte {
+		t.Fatalf("preface sent in clear: %x", clientBytes)
+	}
+	if bytes.Contains(clientBytes, payload[:8]) || bytes.Contains(serverBytes, payload[:8]) {
+		t.Fatal("payload sent in clear")
+	}
+	if bytes.Equal(clientBytes[:chacha20.NonceSizeX], serverBytes[:chacha20.NonceSizeX]) {
+		t.Fatal("both directions use the same nonce")
+	}
+
+	if _, err := NewChaCha20Wrapper(nil); !errors.Is(err, ErrEmptyStreamSecret) {
+		t.Fatalf("expected ErrEmptyStreamSecret, got %v", err)
+	}
+}
+
+func TestUoTChaCha20WrapperMismatch(t *testing.T) {
+	clientWrapper, _ := NewChaCha20Wrapper([]byte("shared secret"))
+	serverWrapper, _ := NewChaCha20Wrapper([]byte("another secret"))
+
+	var stream bytes.Buffer
+	conn := clientWrapper.Wrap(&captureConn{w: &stream})
+	for i := 0; i < 64; i++ {
+		if err := WritePreface(conn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wrapped := serverWrapper.Wrap(&readOnlyConn{Reader: bytes.NewReader(stream.Bytes())})
+	// a wrong secret yields garbage, which the magic check catches almost always
+	mismatches := 0
+	for i := 0; i < 64; i++ {
+		if _, err := ReadPreface(wrapped); errors.Is(err, ErrBadMagic) || errors.Is(err, ErrUnsupportedVersion) {
+			mismatches++
+		}
+	}
+	if mismatches < 60 {
+		t.Fatalf("only %d of 64 prefaces rejected", mismatches)
+	}
+}
+
+// tapConn records the bytes written on the wire
+type tapConn struct {
+	net.Conn
+	w io.Writer
+}
+
+func (c *tapConn) Write(p []byte) (int, error) {
+	_, _ = c.w.Write(p)
+	return c.Conn.Write(p)
+}
+
+func FuzzDecodeAddress(f *testing.F) {
+	for _, seed := range [][]byte{
+		{0x01, 1, 2, 3, 4, 0x00, 0x35},
+		{0x04, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x01, 0x01, 0xbb},
+		append(append([]byte{0x03, 11}, "example.com"...), 0x1f, 0x90),
+		{0x03, 0xff, 'a', 'b'},               // domain length beyond the buffer
+		{0x01, 1, 2, 3, 4, 0x00, 0x35, 0xff}, // trailing byte
+		{0x04, 1, 2, 3, 4, 0x00, 0x35},       // IPv6 type with an IPv4 length
+		{0x03},
+		{0x7f},
+		{},
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		addr, consumed, err := DecodeAddress(b)
+		codecAddr, codecErr := SOCKSAddressCodec{}.DecodeAddress(b)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, ErrUnknownAddressType) {
+				t.Fatalf("untyped error for %x: %v", b, err)
+			}
+			if codecErr == nil {
+				t.Fatalf("codec decoded %x to %q", b, codecAddr)
+			}
+			return
+		}
+		if consumed < 1+1+2 || consumed > len(b) || consumed > maxDomainAddressLen {
+			t.Fatalf("decode %x consumed %d bytes", b, consumed)
+		}
+		if consumed == len(b) {
+			if codecErr != nil || codecAddr != addr {
+				t.Fatalf("codec decode %x = %q, %v, want %q", b, codecAddr, codecErr, addr)
+			}
+		} else if !errors.Is(codecErr, ErrInvalidAddressLength) {
+			t.Fatalf("codec accepted %d trailing bytes of %x: %v", len(b)-consumed, b, codecErr)
+		}
+
+		if b[0] == 0x03 {
+			return // arbitrary domain bytes don't survive host:port formatting
+		}
+		wire, err := EncodeAddress(addr)
+		if err != nil {
+			t.Fatalf("encode decoded %q: %v", addr, err)
+		}
+		if again, _, err := DecodeAddress(wire); err != nil || again != addr {
+			t.Fatalf("%q re-encoded to %x decodes to %q, %v", addr, wire, again, err)
+		}
+	})
+}
+
+func TestDecodeAddressRoundTrip(t *testing.T) {
+	random := make([]byte, 4096)
+	_, _ = rand.Read(random)
+	next := func(n int) []byte {
+		if len(random) < n {
+			random = make([]byte, 4096)
+			_, _ = rand.Read(random)
+		}
+		b := random[:n]
+		random = random[n:]
+		return b
+	}
+	const letters = "abcdefghijklmnopqrstuvwxyz0123456789-."
+
+	for i := 0; i < 1000; i++ {
+		var addr string
+		port := int(binary.BigEndian.Uint16(next(2)))
+		switch i % 3 {
+		case 0:
+			ip, _ := netip.AddrFromSlice(next(4))
+			addr = netip.AddrPortFrom(ip, uint16(port)).String()
+		case 1:
+			ip, _ := netip.AddrFromSlice(next(16))
+			addr = netip.AddrPortFrom(ip.Unmap(), uint16(port)).String()
+		default:
+			hostLen := 1 + int(next(1)[0])%255
+			host := make([]byte, hostLen)
+			for j, b := range next(hostLen) {
+				host[j] = letters[int(b)%len(letters)]
+			}
+			addr = net.JoinHostPort("h"+string(host[1:]), strconv.Itoa(port))
+		}
+
+		wire, err := EncodeAddress(addr)
+		if err != nil {
+			t.Fatalf("encode %s: %v", addr, err)
+		}
+		// trailing bytes are left alone and not counted as consumed
+		decoded, consumed, err := DecodeAddress(append(wire, 0xff))
+		if err != nil || decoded != addr || consumed != len(wire) {
+			t.Fatalf("decode %s = %q, %d, %v", addr, decoded, consumed, err)
+		}
+		if read, err := ReadAddress(bytes.NewReader(wire)); err != nil || read != addr {
+			t.Fatalf("read %s = %q, %v", addr, read, err)
+		}
+		cut := int(next(1)[0]) % len(wire)
+		if _, _, err := DecodeAddress(wire[:cut]); err == nil {
+			t.Fatalf("decode of %s cut at %d succeeded", addr, cut)
+		}
+		if _, err := ReadAddress(bytes.NewReader(wire[:cut])); err == nil {
+			t.Fatalf("read of %s cut at %d succeeded", addr, cut)
+		}
+	}
+
+	if _, _, err := DecodeAddress(nil); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+	if _, _, err := DecodeAddress([]byte{0x01, 1, 2}); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("expected io.ErrUnexpectedEOF, got %v", err)
+	}
+	if _, _, err := DecodeAddress([]byte{0x02, 1, 2}); !errors.Is(err, ErrUnknownAddressType) {
+		t.Fatalf("expected ErrUnknownAddressType, got %v", err)
+	}
+}
+
+// stringAddr hides the structured address types, forcing the String round-trip of WriteTo
+type stringAddr struct{ net.Addr }
+
+func TestUoTWriteToStructuredAddr(t *testing.T) {
+	addrs := []net.Addr{
+		&net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 53},
+		&net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443, Zone: "eth0"},
+		&net.UDPAddr{IP: net.ParseIP("::ffff:10.0.0.1"), Port: 0},
+		&net.UDPAddr{Port: 53},
+		&NamedAddr{Host: "example.com", Port: 8080},
+		&NamedAddr{Host: "192.168.1.1", Port: 53},
+		&NamedAddr{Host: "fe80::1%eth0", Port: 53},
+	}
+	for _, addr := range addrs {
+		var fast, slow bytes.Buffer
+		_, fastErr := NewUoTPacketConn(&captureConn{w: &fast}).WriteTo([]byte("x"), addr)
+		_, slowErr := NewUoTPacketConn(&captureConn{w: &slow}).WriteTo([]byte("x"), stringAddr{addr})
+		if (fastErr == nil) != (slowErr == nil) || !bytes.Equal(fast.Bytes(), slow.Bytes()) {
+			t.Fatalf("%s: fast path %x (%v), string path %x (%v)", addr, fast.Bytes(), fastErr, slow.Bytes(), slowErr)
+		}
+	}
+
+	long := &NamedAddr{Host: strings.Repeat("a", 256), Port: 53}
+	if _, err := NewUoTPacketConn(&captureConn{w: io.Discard}).WriteTo(nil, long); !errors.Is(err, ErrAddressTooLong) {
+		t.Fatalf("expected ErrAddressTooLong, got %v", err)
+	}
+}
+
+func benchmarkUoTWriteTo(b *testing.B, addr net.Addr) {
+	conn := NewUoTPacketConn(&captureConn{w: io.Discard})
+	payload := make([]byte, 1200)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := conn.WriteTo(payload, addr); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkUoTWriteToUDPAddr(b *testing.B) {
+	benchmarkUoTWriteTo(b, &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 53})
+}
+
+func BenchmarkUoTWriteToUDPAddrString(b *testing.B) {
+	benchmarkUoTWriteTo(b, stringAddr{&net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 53}})
+}
+
+func TestUoTPacketConnAddrPort(t *testing.T) {
+	var stream, want bytes.Buffer
+	pc := NewUoTPacketConn(&captureConn{w: &stream})
+	ref := NewUoTPacketConn(&captureConn{w: &want})
+	sources := []netip.AddrPort{
+		netip.MustParseAddrPort("1.2.3.4:53"),
+		netip.MustParseAddrPort("[2001:db8::1]:443"),
+		netip.MustParseAddrPort("[::ffff:5.6.7.8]:80"),
+	}
+	for i, addrPort := range sources {
+		payload := []byte{byte(i)}
+		if n, err := pc.WriteToAddrPort(payload, addrPort); err != nil || n != 1 {
+			t.Fatalf("write to %s: %d, %v", addrPort, n, err)
+		}
+		_, _ = ref.WriteTo(payload, net.UDPAddrFromAddrPort(addrPort))
+	}
+	if !bytes.Equal(stream.Bytes(), want.Bytes()) {
+		t.Fatalf("WriteToAddrPort wrote %x, WriteTo %x", stream.Bytes(), want.Bytes())
+	}
+	if _, err := pc.WriteToAddrPort(nil, netip.AddrPort{}); err == nil {
+		t.Fatalf("expected the zero AddrPort to be refused")
+	}
+	if stats := pc.Stats(); stats.DatagramsWritten != 3 {
+		t.Fatalf("unexpected datagrams written: %d", stats.DatagramsWritten)
+	}
+	_ = WriteDatagram(&stream, "example.com:53", []byte("named"))
+
+	rc := NewUoTPacketConn(&readOnlyConn{Reader: bytes.NewReader(stream.Bytes())})
+	buf := make([]byte, 16)
+	for i, addrPort := range sources {
+		n, from, err := rc.ReadFromAddrPort(buf)
+		if want := netip.AddrPortFrom(addrPort.Addr().Unmap(), addrPort.Port()); err != nil || n != 1 || buf[0] != byte(i) || from != want {
+			t.Fatalf("read %d: %d from %s, %v, want from %s", i, n, from, err, want)
+		}
+	}
+	n, from, err := rc.ReadFromAddrPort(buf)
+	if !errors.Is(err, ErrNamedSource) || !strings.Contains(err.Error(), "example.com:53") || from.IsValid() || string(buf[:n]) != "named" {
+		t.Fatalf("read from a name: %q from %s, %v", buf[:n], from, err)
+	}
+	if _, _, err := rc.ReadFromAddrPort(buf); err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+
+	// with the address cache off, ReadFrom allocates each source and ReadFromAddrPort doesn't
+	rc = NewUoTPacketConn(&readOnlyConn{Reader: bytes.NewReader(bytes.Repeat(want.Bytes(), 50))})
+	rc.SetAddressCache(0, 0)
+	allocs := testing.AllocsPerRun(100, func() {
+		if _, _, err := rc.ReadFromAddrPort(buf); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs != 0 {
+		t.Fatalf("expected ReadFromAddrPort not to allocate, got %v allocs", allocs)
+	}
+}
+
+func BenchmarkUoTWriteToAddrPort(b *testing.B) {
+	conn := NewUoTPacketConn(&captureConn{w: io.Discard})
+	payload := make([]byte, 1200)
+	addrPort := netip.MustParseAddrPort("1.2.3.4:53")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := conn.WriteToAddrPort(payload, addrPort); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkUoTWriteToUDPAddrFromAddrPort is the net.Addr path for a caller holding a netip.AddrPort
+func BenchmarkUoTWriteToUDPAddrFromAddrPort(b *testing.B) {
+	conn := NewUoTPacketConn(&captureConn{w: io.Discard})
+	payload := make([]byte, 1200)
+	addrPort := netip.MustParseAddrPort("1.2.3.4:53")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := conn.WriteTo(payload, net.UDPAddrFromAddrPort(addrPort)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkUoTReadFromUncached(b *testing.B, read func(pc *UoTPacketConn, buf []byte) error) {
+	pc := NewUoTPacketConn(&readOnlyConn{Reader: bytes.NewReader(benchmarkFrames(b, 1200))})
+	pc.SetAddressCache(0, 0)
+	buf := make([]byte, maxUoTPayload)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := read(pc, buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkUoTReadFromUncached(b *testing.B) {
+	benchmarkUoTReadFromUncached(b, func(pc *UoTPacketConn, buf []byte) error {
+		_, _, err := pc.ReadFrom(buf)
+		return err
+	})
+}
+
+func BenchmarkUoTReadFromAddrPort(b *testing.B) {
+	benchmarkUoTReadFromUncached(b, func(pc *UoTPacketConn, buf []byte) error {
+		_, _, err := pc.ReadFromAddrPort(buf)
+		return err
+	})
+}
+
+func TestEncodeAddressPort(t *testing.T) {
+	cases := []struct {
+		addr string
+		port uint16
+		ok   bool
+	}{
+		{"1.2.3.4:53", 53, true},
+		{"1.2.3.4:0", 0, true},
+		{"1.2.3.4:65535", 65535, true},
+		{"1.2.3.4:0053", 53, true},
+		{"1.2.3.4:65536", 0, false},
+		{"1.2.3.4:-1", 0, false},
+		{"1.2.3.4:+53", 0, false},
+		{"1.2.3.4:", 0, false},
+		{"1.2.3.4:no-such-service", 0, false},
+	}
+	for _, tc := range cases {
+		buf, err := EncodeAddress(tc.addr)
+		if (err == nil) != tc.ok {
+			t.Fatalf("encode %s: %v", tc.addr, err)
+		}
+		if tc.ok && binary.BigEndian.Uint16(buf[len(buf)-2:]) != tc.port {
+			t.Fatalf("encode %s: port %x", tc.addr, buf[len(buf)-2:])
+		}
+	}
+
+	// named services resolve, through the services database or its builtin fallback
+	if port, err := net.LookupPort("udp", "domain"); err == nil {
+		buf, err := EncodeAddress("1.2.3.4:domain")
+		if err != nil || binary.BigEndian.Uint16(buf[len(buf)-2:]) != uint16(port) {
+			t.Fatalf("encode named port: %x, %v", buf, err)
+		}
+	}
+}
+
+func BenchmarkEncodeAddressNumericPort(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := EncodeAddress("1.2.3.4:53"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEncodeAddressNamedPort(b *testing.B) {
+	if _, err := net.LookupPort("udp", "domain"); err != nil {
+		b.Skip(err)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := EncodeAddress("1.2.3.4:domain"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package sudoku
+
+import (
+	"fmt"
+	"io"
+)
+
+// Version negotiation extends the preface without breaking version 1 peers:
+//
+//   - the client writes the preface carrying the highest version it supports
+//   - a preface of version 1 is never answered, so old clients keep working
+//   - for any higher version the server answers with one byte, the highest version
+//     it supports that is not above the offered one, or 0 when there is none
+//
+// A version 1 server rejects a higher preface, a client that has to talk to one
+// must offer version 1 only.
+
+// uotSupportedVersions lists the versions this build speaks
+var uotSupportedVersions = []byte{UoTVersion1, UoTVersion2, UoTVersion3}
+
+// NegotiateVersion runs the client side of the preface and returns the agreed version.
+// The highest of supported is offered, so listing only UoTVersion1 writes a plain version 1 preface.
+func NegotiateVersion(rw io.ReadWriter, supported []byte) (byte, error) {
+	return negotiateVersion(rw, UoTMagicByte, supported, nil)
+}
+
+// negotiateVersion writes the preface led by magic, and the auth digest, if any, together with it.
+func negotiateVersion(rw io.ReadWriter, magic byte, supported []byte, auth []byte) (byte, error) {
+	offered := highestVersion(supported)
+	if offered == 0 {
+		return 0, fmt.Errorf("%w: no version to offer", ErrUnsupportedVersion)
+	}
+	if err := writePreface(rw, magic, offered, auth); err != nil {
+		return 0, err
+	}
+	if offered == UoTVersion1 {
+		return UoTVersion1, nil
+	}
+
+	var answer [1]byte
+	if _, err := io.ReadFull(rw, answer[:]); err != nil {
+		return 0, fmt.Errorf("read uot version answer: %w", err)
+	}
+	if answer[0] == 0 {
+		return 0, fmt.Errorf("%w: peer shares none of %v", ErrUnsupportedVersion, supported)
+	}
+	if !containsVersion(supported, answer[0]) {
+		return 0, fmt.Errorf("%w: peer chose %d", ErrUnsupportedVersion, answer[0])
+	}
+	return answer[0], nil
+}
+
+// AcceptVersion runs the server side of the preface and returns the agreed version.
+func AcceptVersion(rw io.ReadWriter, supported []byte) (byte, error) {
+	return acceptVersion(rw, rw, UoTMagicByte, supported, nil)
+}
+
+// acceptVersion reads the preface from r and answers on w when the offered version requires it,
+// a nil w only accepts version 1 style prefaces that need no answer.
+// A preface not led by magic reports ErrBadMagic before anything else is read.
+// A non-nil auth is the digest expected right after the preface, a mismatch is never answered.
+func acceptVersion(r io.Reader, w io.Writer, magic byte, supported []byte, auth []byte) (byte, error) {
+	var preface [2]byte
+	if _, err := io.ReadFull(r, preface[:]); err != nil {
+		return 0, err
+	}
+	if preface[0] != magic {
+		return 0, fmt.Errorf("%w: 0x%02x", ErrBadMagic, preface[0])
+	}
+	if auth != nil {
+		if err := readAuthDigest(r, auth); err != nil {
+			return 0, err
+		}
+	}
+
+	offered := preface[1]
+	if offered == UoTVersion1 || w == nil {
+		if !containsVersion(supported, offered) {
+			return 0, fmt.Errorf("%w: %d", ErrUnsupportedVersion, offered)
+		}
+		return offered, nil
+	}
+
+	var chosen byte
+	for _, v := range supported {
+		if v <= offered && v > chosen {
+			chosen = v
+		}
+	}
+	if _, err := w.Write([]byte{chosen}); err != nil {
+		return 0, fmt.Errorf("write uot version answer: %w", err)
+	}
+	if chosen == 0 {
+		return 0, fmt.Errorf("%w: %d", ErrUnsupportedVersion, offered)
+	}
+	return chosen, nil
+}
+
+func writePreface(w io.Writer, magic, version byte, auth []byte) error {
+	if len(auth) > 0 {
+		return writeChunksOnce(w, []byte{magic, version}, auth)
+	}
+	_, err := w.Write([]byte{magic, version})
+	return err
+}
+
+func highestVersion(versions []byte) byte {
+	var highest byte
+	for _, v := range versions {
+		if v > highest {
+			highest = v
+		}
+	}
+	return highest
+}
+
+func containsVersion(versions []byte, version byte) bool {
+	for _, v := range versions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,93 @@
+// Package uottest provides shared fixtures for testing Sudoku UoT implementations.
+package uottest
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/metacubex/mihomo/transport/sudoku"
+)
+
+// AddressFixture locks one address to its wire encoding.
+type AddressFixture struct {
+	Name string
+	// Addr is the "host:port" passed to EncodeAddress
+	Addr string
+	// Wire is the exact encoded address section
+	Wire []byte
+	// Decoded is what decoding Wire must return
+	Decoded string
+}
+
+var longDomain = strings.Repeat("a", 255)
+
+// AddressFixtures is the reference table of the SOCKS-style UoT address encoding.
+var AddressFixtures = []AddressFixture{
+	{
+		Name:    "ipv4",
+		Addr:    "1.2.3.4:53",
+		Wire:    []byte{0x01, 1, 2, 3, 4, 0x00, 0x35},
+		Decoded: "1.2.3.4:53",
+	},
+	{
+		Name:    "ipv6",
+		Addr:    "[2001:db8::1]:443",
+		Wire:    []byte{0x04, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x01, 0x01, 0xbb},
+		Decoded: "[2001:db8::1]:443",
+	},
+	{
+		Name:    "ipv4-mapped ipv6",
+		Addr:    "[::ffff:192.0.2.1]:80",
+		Wire:    []byte{0x01, 192, 0, 2, 1, 0x00, 0x50},
+		Decoded: "192.0.2.1:80",
+	},
+	{
+		Name:    "domain",
+		Addr:    "example.com:8080",
+		Wire:    append(append([]byte{0x03, 11}, "example.com"...), 0x1f, 0x90),
+		Decoded: "example.com:8080",
+	},
+	{
+		Name:    "min port",
+		Addr:    "10.0.0.1:0",
+		Wire:    []byte{0x01, 10, 0, 0, 1, 0x00, 0x00},
+		Decoded: "10.0.0.1:0",
+	},
+	{
+		Name:    "max port",
+		Addr:    "[::1]:65535",
+		Wire:    []byte{0x04, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0xff, 0xff},
+		Decoded: "[::1]:65535",
+	},
+	{
+		Name:    "255-byte domain",
+		Addr:    longDomain + ":1",
+		Wire:    append(append([]byte{0x03, 255}, longDomain...), 0x00, 0x01),
+		Decoded: longDomain + ":1",
+	},
+}
+
+// AssertAddressRoundTrip checks that codec reproduces AddressFixtures byte for byte,
+// and that every encoding decodes back to its canonical address.
+func AssertAddressRoundTrip(t testing.TB, codec sudoku.AddressCodec) {
+	t.Helper()
+	for _, fixture := range AddressFixtures {
+		wire, err := codec.EncodeAddress(fixture.Addr)
+		if err != nil {
+			t.Errorf("%s: encode %q: %v", fixture.Name, fixture.Addr, err)
+			continue
+		}
+		if !bytes.Equal(wire, fixture.Wire) {
+			t.Errorf("%s: encode %q = %x, want %x", fixture.Name, fixture.Addr, wire, fixture.Wire)
+		}
+		decoded, err := codec.DecodeAddress(fixture.Wire)
+		if err != nil {
+			t.Errorf("%s: decode %x: %v", fixture.Name, fixture.Wire, err)
+			continue
+		}
+		if decoded != fixture.Decoded {
+			t.Errorf("%s: decode %x = %q, want %q", fixture.Name, fixture.Wire, decoded, fixture.Decoded)
+		}
+	}
+}
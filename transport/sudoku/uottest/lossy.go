@@ -0,0 +1,91 @@
+package uottest
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// LossyConfig tells LossyConn how to mistreat writes, the zero value passes them through untouched.
+type LossyConfig struct {
+	// Seed drives every random choice, the same seed and writes give the same outcome
+	Seed int64
+	// DropRate is the fraction of writes silently discarded
+	DropRate float64
+	// ReorderRate is the fraction of writes held back and sent right after the next one
+	ReorderRate float64
+	// MaxDelay holds each write for a random duration up to it before it goes out,
+	// blocking the writer like a slow link
+	MaxDelay time.Duration
+}
+
+// LossyConn is a testing-only net.Conn turning a reliable stream into an unreliable one:
+// it drops, delays and reorders whole writes, so the layers above see frames lost or swapped
+// the way a UoT peer treats them as datagrams. Reads and everything else go straight to the
+// wrapped conn. Dropped and held writes still report success, a write held back when the conn
+// is closed is lost.
+//
+// It is meant for exercising fragmentation, resync and keepalive, never use it in production.
+type LossyConn struct {
+	net.Conn
+	config LossyConfig
+
+	mu        sync.Mutex
+	rand      *rand.Rand
+	held      []byte
+	dropped   int
+	reordered int
+}
+
+func NewLossyConn(conn net.Conn, config LossyConfig) *LossyConn {
+	return &LossyConn{
+		Conn:   conn,
+		config: config,
+		rand:   rand.New(rand.NewSource(config.Seed)),
+	}
+}
+
+func (c *LossyConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.config.DropRate > 0 && c.rand.Float64() < c.config.DropRate {
+		c.dropped++
+		return len(p), nil
+	}
+	if c.held == nil && c.config.ReorderRate > 0 && c.rand.Float64() < c.config.ReorderRate {
+		c.held = append([]byte(nil), p...)
+		c.reordered++
+		return len(p), nil
+	}
+	if c.config.MaxDelay > 0 {
+		time.Sleep(time.Duration(c.rand.Int63n(int64(c.config.MaxDelay) + 1)))
+	}
+
+	n, err := c.Conn.Write(p)
+	if err != nil {
+		return n, err
+	}
+	if held := c.held; held != nil {
+		c.held = nil
+		if _, err := c.Conn.Write(held); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Dropped returns the number of writes discarded so far
+func (c *LossyConn) Dropped() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.dropped
+}
+
+// Reordered returns the number of writes held back behind the next one so far
+func (c *LossyConn) Reordered() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.reordered
+}
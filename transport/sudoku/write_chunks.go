@@ -1,6 +1,11 @@
 package sudoku
 
-import "io"
+import (
+	"io"
+	"net"
+
+	"github.com/metacubex/mihomo/common/pool"
+)
 
 func writeAllChunks(w io.Writer, chunks ...[]byte) error {
 	for _, chunk := range chunks {
@@ -10,3 +15,28 @@ func writeAllChunks(w io.Writer, chunks ...[]byte) error {
 	}
 	return nil
 }
+
+// writeChunksOnce writes chunks with a single call to w, so a frame costs one syscall and
+// can't be interleaved with other writes: vectored for conns supporting writev, and
+// coalesced into one pooled buffer for any other writer.
+func writeChunksOnce(w io.Writer, chunks ...[]byte) error {
+	switch w.(type) {
+	case *net.TCPConn, *net.UnixConn:
+		bufs := net.Buffers(chunks)
+		_, err := bufs.WriteTo(w)
+		return err
+	}
+
+	size := 0
+	for _, chunk := range chunks {
+		size += len(chunk)
+	}
+	buf := pool.Get(size)
+	defer pool.Put(buf)
+	n := 0
+	for _, chunk := range chunks {
+		n += copy(buf[n:], chunk)
+	}
+	_, err := w.Write(buf)
+	return err
+}